@@ -0,0 +1,295 @@
+// Package admin 本机的管理接口, 运行时查看插件和修改配置
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"goreplay/config"
+	"goreplay/logger"
+	"goreplay/plugins"
+)
+
+// Modifier 可以在运行时替换 http 改写规则, 即 emitter
+type Modifier interface {
+	SetModifierConfig(conf config.HTTPModifierConfig)
+}
+
+// sampler 可以修改 logreplay 录制采样率的插件, 即 input-raw
+type sampler interface {
+	SampleRate() (int, bool)
+	SetSampleRate(rate int) error
+}
+
+// PluginInfo 插件的信息
+type PluginInfo struct {
+	Index      int    `json:"index"`
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Input      bool   `json:"input"`
+	Output     bool   `json:"output"`
+	Limit      string `json:"limit,omitempty"`
+	SampleRate *int   `json:"sample_rate,omitempty"`
+}
+
+// LimitRequest 修改限流, Plugin 为 /plugins 返回的 index
+type LimitRequest struct {
+	Plugin int    `json:"plugin"`
+	Limit  string `json:"limit"`
+}
+
+// SampleRateRequest 修改采样率, Plugin 为空时修改所有 logreplay 录制的 input-raw
+type SampleRateRequest struct {
+	Plugin *int `json:"plugin"`
+	Rate   int  `json:"rate"`
+}
+
+// Server 管理接口, 修改串行执行, 每项修改都整体替换, 不会中断流量
+type Server struct {
+	sync.Mutex
+	plugins  *plugins.InOutPlugins
+	modifier Modifier
+	token    string
+	rules    map[string][]string // 正在使用的 http 改写规则, 开始时为命令行设置的规则
+}
+
+// New 新建 Server
+func New(conf config.AdminConfig, inOutPlugins *plugins.InOutPlugins, modifier Modifier) *Server {
+	rules := config.Settings.ModifierRules
+	if rules == nil {
+		rules = make(map[string][]string)
+	}
+
+	return &Server{plugins: inOutPlugins, modifier: modifier, token: conf.Token, rules: rules}
+}
+
+// Start 在本机地址上监听管理接口
+func Start(conf config.AdminConfig, inOutPlugins *plugins.InOutPlugins, modifier Modifier) error {
+	addr, err := localAddress(conf.Address)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s := New(conf, inOutPlugins, modifier)
+	go func() {
+		if err := http.Serve(ln, s.Handler()); err != nil {
+			logger.Error("[ADMIN] serve error: ", err)
+		}
+	}()
+
+	logger.Info("[ADMIN] serving admin api on ", ln.Addr().String())
+
+	return nil
+}
+
+// localAddress 只允许监听本机地址, 没有指定 host 时监听 127.0.0.1
+func localAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	switch host {
+	case "":
+		host = "127.0.0.1"
+	case "localhost":
+	default:
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return "", fmt.Errorf("admin api can only listen on a local address, got %q", addr)
+		}
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// Handler 管理接口的路由
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plugins", s.method(http.MethodGet, s.listPlugins))
+	mux.HandleFunc("/modifier", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			s.setModifier(w, r)
+			return
+		}
+		s.method(http.MethodGet, s.getModifier)(w, r)
+	})
+	mux.HandleFunc("/limit", s.method(http.MethodPut, s.setLimit))
+	mux.HandleFunc("/sample-rate", s.method(http.MethodPut, s.setSampleRate))
+
+	return s.auth(mux)
+}
+
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			want := []byte("Bearer " + s.token)
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// listPlugins 列出 InOutPlugins.All 中的插件
+func (s *Server) listPlugins(w http.ResponseWriter, _ *http.Request) {
+	infos := []PluginInfo{}
+	for i, p := range s.plugins.All {
+		plugin := unwrap(p)
+		_, input := p.(plugins.PluginReader)
+		_, output := p.(plugins.PluginWriter)
+		info := PluginInfo{Index: i, Type: fmt.Sprintf("%T", plugin), Name: fmt.Sprint(plugin),
+			Input: input, Output: output}
+
+		if l, ok := p.(*plugins.Limiter); ok {
+			info.Limit = l.Limit()
+		}
+		if sp, ok := plugin.(sampler); ok {
+			if rate, ok := sp.SampleRate(); ok {
+				info.SampleRate = &rate
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	writeJSON(w, infos)
+}
+
+func (s *Server) getModifier(w http.ResponseWriter, _ *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	writeJSON(w, s.rules)
+}
+
+// setModifier 整体替换 http 改写规则, 包括命令行设置的规则
+func (s *Server) setModifier(w http.ResponseWriter, r *http.Request) {
+	var rules map[string][]string
+	if !readJSON(w, r, &rules) {
+		return
+	}
+
+	conf, err := config.ParseHTTPModifierRules(rules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.modifier.SetModifierConfig(conf)
+	s.rules = rules
+	logger.Info(fmt.Sprintf("[ADMIN] http modifier rules: %v", rules))
+
+	writeJSON(w, rules)
+}
+
+func (s *Server) setLimit(w http.ResponseWriter, r *http.Request) {
+	var req LimitRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Plugin < 0 || req.Plugin >= len(s.plugins.All) {
+		http.Error(w, fmt.Sprintf("plugin %d not found", req.Plugin), http.StatusNotFound)
+		return
+	}
+
+	l, ok := s.plugins.All[req.Plugin].(*plugins.Limiter)
+	if !ok {
+		http.Error(w, fmt.Sprintf("plugin %d has no limit, add one with the \"|\" option", req.Plugin),
+			http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := l.SetLimit(req.Limit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Info(fmt.Sprintf("[ADMIN] limit %s", l))
+
+	writeJSON(w, req)
+}
+
+func (s *Server) setSampleRate(w http.ResponseWriter, r *http.Request) {
+	var req SampleRateRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	var samplers []sampler
+	for i, p := range s.plugins.All {
+		if req.Plugin != nil && *req.Plugin != i {
+			continue
+		}
+		if sp, ok := unwrap(p).(sampler); ok {
+			if _, ok = sp.SampleRate(); ok {
+				samplers = append(samplers, sp)
+			}
+		}
+	}
+	if len(samplers) == 0 {
+		http.Error(w, "no input-raw recording for logreplay", http.StatusNotFound)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, sp := range samplers {
+		if err := sp.SetSampleRate(req.Rate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJSON(w, req)
+}
+
+func unwrap(p interface{}) interface{} {
+	if l, ok := p.(*plugins.Limiter); ok {
+		return l.Plugin()
+	}
+	return p
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debug("[ADMIN] write response error: ", err)
+	}
+}
@@ -0,0 +1,249 @@
+package admin
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+	"goreplay/plugins"
+)
+
+// TestUnitAdmin admin test execute
+func TestUnitAdmin(t *testing.T) {
+	suite.Run(t, new(adminSuite))
+}
+
+type adminSuite struct {
+	suite.Suite
+	server   *httptest.Server
+	modifier *fakeModifier
+	input    *fakeInput
+	limiter  *plugins.Limiter
+}
+
+type fakeModifier struct {
+	conf *config.HTTPModifierConfig
+}
+
+func (f *fakeModifier) SetModifierConfig(conf config.HTTPModifierConfig) {
+	f.conf = &conf
+}
+
+// fakeInput logreplay 录制的 input-raw
+type fakeInput struct {
+	rate int
+}
+
+func (f *fakeInput) PluginRead() (*plugins.Message, error) {
+	return nil, nil
+}
+
+func (f *fakeInput) SampleRate() (int, bool) {
+	return f.rate, true
+}
+
+func (f *fakeInput) SetSampleRate(rate int) error {
+	if rate < 0 || rate > 16 {
+		return fmt.Errorf("sample rate %d out of range", rate)
+	}
+	f.rate = rate
+	return nil
+}
+
+func (f *fakeInput) String() string {
+	return "fake input"
+}
+
+type fakeOutput struct{}
+
+func (fakeOutput) PluginWrite(msg *plugins.Message) (int, error) {
+	return len(msg.Data), nil
+}
+
+func (fakeOutput) String() string {
+	return "fake output"
+}
+
+func (s *adminSuite) SetupTest() {
+	s.modifier = &fakeModifier{}
+	s.input = &fakeInput{rate: 16}
+	s.limiter = plugins.NewLimiter(fakeOutput{}, "10").(*plugins.Limiter)
+
+	inOutPlugins := &plugins.InOutPlugins{All: []interface{}{s.input, s.limiter}}
+	s.server = httptest.NewServer(New(config.AdminConfig{Token: "secret"}, inOutPlugins, s.modifier).Handler())
+}
+
+func (s *adminSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *adminSuite) do(method, path, body, token string) (int, string) {
+	req, err := http.NewRequest(method, s.server.URL+path, strings.NewReader(body))
+	s.Require().NoError(err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	s.Require().NoError(err)
+
+	return resp.StatusCode, string(data)
+}
+
+func (s *adminSuite) TestAuth() {
+	for _, token := range []string{"", "wrong"} {
+		code, _ := s.do(http.MethodGet, "/plugins", "", token)
+		s.Equal(http.StatusUnauthorized, code, token)
+	}
+
+	code, _ := s.do(http.MethodPost, "/plugins", "", "secret")
+	s.Equal(http.StatusMethodNotAllowed, code)
+}
+
+func (s *adminSuite) TestListPlugins() {
+	code, body := s.do(http.MethodGet, "/plugins", "", "secret")
+	s.Require().Equal(http.StatusOK, code)
+
+	var infos []PluginInfo
+	s.Require().NoError(json.Unmarshal([]byte(body), &infos))
+	rate := 16
+	s.Equal([]PluginInfo{
+		{Index: 0, Type: "*admin.fakeInput", Name: "fake input", Input: true, SampleRate: &rate},
+		{Index: 1, Type: "admin.fakeOutput", Name: "fake output", Input: true, Output: true, Limit: "10"},
+	}, infos)
+}
+
+func (s *adminSuite) TestModifier() {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{name: "invalid json", body: `{"http-allow-url":`, wantCode: http.StatusBadRequest},
+		{name: "unknown rule", body: `{"http-allow-body":["a"]}`, wantCode: http.StatusBadRequest},
+		{name: "invalid regexp", body: `{"http-allow-url":["("]}`, wantCode: http.StatusBadRequest},
+		{name: "rules", body: `{"http-allow-url":["^/api"],"http-set-header":["User-Agent: Gor"]}`,
+			wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			code, _ := s.do(http.MethodPut, "/modifier", tt.body, "secret")
+			s.Equal(tt.wantCode, code)
+		})
+	}
+
+	s.Require().NotNil(s.modifier.conf)
+	s.Len(s.modifier.conf.URLRegexp, 1)
+	s.Len(s.modifier.conf.Headers, 1)
+
+	code, body := s.do(http.MethodGet, "/modifier", "", "secret")
+	s.Equal(http.StatusOK, code)
+	s.JSONEq(`{"http-allow-url":["^/api"],"http-set-header":["User-Agent: Gor"]}`, body)
+}
+
+func (s *adminSuite) TestModifierFlags() {
+	// 命令行设置的规则
+	s.Require().NoError(flag.Set("http-allow-method", "GET"))
+	defer func() {
+		config.Settings.ModifierRules, config.Settings.ModifierConfig.Methods = nil, nil
+	}()
+	s.Equal(map[string][]string{"http-allow-method": {"GET"}}, config.Settings.ModifierRules)
+
+	s.server.Close()
+	s.server = httptest.NewServer(New(config.AdminConfig{Token: "secret"}, &plugins.InOutPlugins{}, s.modifier).Handler())
+
+	_, body := s.do(http.MethodGet, "/modifier", "", "secret")
+	s.JSONEq(`{"http-allow-method":["GET"]}`, body)
+
+	// PUT 整体替换, 包括命令行的规则
+	code, _ := s.do(http.MethodPut, "/modifier", `{"http-allow-url":["^/api"]}`, "secret")
+	s.Equal(http.StatusOK, code)
+	_, body = s.do(http.MethodGet, "/modifier", "", "secret")
+	s.JSONEq(`{"http-allow-url":["^/api"]}`, body)
+	s.Empty(s.modifier.conf.Methods)
+}
+
+func (s *adminSuite) TestLimit() {
+	tests := []struct {
+		name      string
+		body      string
+		wantCode  int
+		wantLimit string
+	}{
+		{name: "not found", body: `{"plugin":5,"limit":"10%"}`, wantCode: http.StatusNotFound, wantLimit: "10"},
+		{name: "no limiter", body: `{"plugin":0,"limit":"10%"}`, wantCode: http.StatusBadRequest, wantLimit: "10"},
+		{name: "invalid", body: `{"plugin":1,"limit":"200%"}`, wantCode: http.StatusBadRequest, wantLimit: "10"},
+		{name: "percent", body: `{"plugin":1,"limit":"50%"}`, wantCode: http.StatusOK, wantLimit: "50%"},
+		{name: "absolute", body: `{"plugin":1,"limit":"100"}`, wantCode: http.StatusOK, wantLimit: "100"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			code, _ := s.do(http.MethodPut, "/limit", tt.body, "secret")
+			s.Equal(tt.wantCode, code)
+			s.Equal(tt.wantLimit, s.limiter.Limit())
+		})
+	}
+}
+
+func (s *adminSuite) TestSampleRate() {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantRate int
+	}{
+		{name: "out of range", body: `{"rate":17}`, wantCode: http.StatusBadRequest, wantRate: 16},
+		{name: "not a sampler", body: `{"plugin":1,"rate":8}`, wantCode: http.StatusNotFound, wantRate: 16},
+		{name: "all", body: `{"rate":8}`, wantCode: http.StatusOK, wantRate: 8},
+		{name: "plugin", body: `{"plugin":0,"rate":4}`, wantCode: http.StatusOK, wantRate: 4},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			code, _ := s.do(http.MethodPut, "/sample-rate", tt.body, "secret")
+			s.Equal(tt.wantCode, code)
+			s.Equal(tt.wantRate, s.input.rate)
+		})
+	}
+}
+
+func (s *adminSuite) TestLocalAddress() {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: ":9091", want: "127.0.0.1:9091"},
+		{addr: "localhost:9091", want: "localhost:9091"},
+		{addr: "[::1]:9091", want: "[::1]:9091"},
+		{addr: "0.0.0.0:9091", wantErr: true},
+		{addr: "10.0.0.1:9091", wantErr: true},
+		{addr: "9091", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.addr, func() {
+			got, err := localAddress(tt.addr)
+			if tt.wantErr {
+				s.Error(err)
+				return
+			}
+			s.NoError(err)
+			s.Equal(tt.want, got)
+		})
+	}
+}
@@ -9,8 +9,6 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/afpacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"golang.org/x/net/bpf"
 
 	_ "github.com/google/gopacket/layers"
 )
@@ -55,20 +53,10 @@ func (h *afpacketHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo,
 
 // SetBPFFilter translates a BPF filter string into BPF RawInstruction and applies them.
 func (h *afpacketHandle) SetBPFFilter(filter string, snaplen int) (err error) {
-	pcapBPF, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, filter)
+	bpfIns, err := compileBPF(layers.LinkTypeEthernet, snaplen, filter)
 	if err != nil {
 		return err
 	}
-	bpfIns := []bpf.RawInstruction{}
-	for _, ins := range pcapBPF {
-		bpfIns2 := bpf.RawInstruction{
-			Op: ins.Code,
-			Jt: ins.Jt,
-			Jf: ins.Jf,
-			K:  ins.K,
-		}
-		bpfIns = append(bpfIns, bpfIns2)
-	}
 	if h.TPacket.SetBPF(bpfIns); err != nil {
 		return err
 	}
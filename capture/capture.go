@@ -12,7 +12,6 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 
 	"goreplay/config"
 	"goreplay/logger"
@@ -23,6 +22,9 @@ const (
 	tcp = "tcp"
 )
 
+// errNoLibpcap 使用 -tags nopcap 编译时, 需要 libpcap 的功能返回这个错误
+var errNoLibpcap = errors.New("goreplay is built without libpcap")
+
 // Handler is a function that is used to handle packets
 type Handler func(gopacket.Packet)
 
@@ -157,109 +159,47 @@ func (l *Listener) Filter(ifi NetInterface) (filter string) {
 	return
 }
 
-// PcapDumpHandler returns a handler to write packet data in PCAP
-// format, See http://wiki.wireshark.org/Development/LibpcapFileFormathandler.
-// if link layer is invalid Ethernet is assumed
-func PcapDumpHandler(file *os.File, link layers.LinkType) (handler func(packet gopacket.Packet), err error) {
-	w := NewWriterNanos(file)
-	err = w.WriteFileHeader(64<<10, link)
-	if err != nil {
-		return nil, err
+// SetBPFFilter replaces the BPF filter of all the opened handles, packets keep being
+// captured while the filter is swapped
+func (l *Listener) SetBPFFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty BPF filter")
 	}
-	return func(packet gopacket.Packet) {
-		err = w.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
-		if err != nil {
-			go logger.Warn(err)
-		}
-	}, nil
-}
-
-func (l *Listener) checkBeforePcapHandle(inactive *pcap.InactiveHandle, ifi NetInterface) error {
-	if l.TimestampType != "" {
-		var ts pcap.TimestampSource
-		ts, err := pcap.TimestampSourceFromString(l.TimestampType)
-		if err != nil {
-			return fmt.Errorf("%q: supported timestampSourceFromString: %q, interface: %q", err,
-				inactive.SupportedTimestamps(), ifi.Name)
-		}
-
-		err = inactive.SetTimestampSource(ts)
-		if err != nil {
-			return fmt.Errorf("%q: supported timestamps: %q, interface: %q", err, inactive.SupportedTimestamps(), ifi.Name)
-		}
+	if filter[0] != '(' || filter[len(filter)-1] != ')' {
+		filter = "(" + filter + ")"
 	}
 
-	if l.Promiscuous {
-		if err := inactive.SetPromisc(l.Promiscuous); err != nil {
-			return fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name)
+	l.Lock()
+	defer l.Unlock()
+	for key, handle := range l.Handles {
+		h, ok := handle.(interface{ SetBPFFilter(string) error })
+		if !ok {
+			continue
 		}
-	}
-
-	if l.Monitor {
-		if err := inactive.SetRFMon(l.Monitor); err != nil && !errors.Is(err, pcap.CannotSetRFMon) {
-			return fmt.Errorf("monitor mode error: %q, interface: %q", err, ifi.Name)
+		if err := h.SetBPFFilter(filter); err != nil {
+			return fmt.Errorf("BPF filter error: %q%s, handle: %q", err, filter, key)
 		}
 	}
+	l.BPFFilter = filter
 
 	return nil
 }
 
-// PcapHandle returns new pcap Handle from dev on success.
-// this function should be called after setting all necessary options for this listener
-func (l *Listener) PcapHandle(ifi NetInterface) (handle *pcap.Handle, err error) {
-	var inactive *pcap.InactiveHandle
-	inactive, err = pcap.NewInactiveHandle(ifi.Name)
-	if inactive != nil && err != nil {
-		defer inactive.CleanUp()
-	}
+// PcapDumpHandler returns a handler to write packet data in PCAP
+// format, See http://wiki.wireshark.org/Development/LibpcapFileFormathandler.
+// if link layer is invalid Ethernet is assumed
+func PcapDumpHandler(file *os.File, link layers.LinkType) (handler func(packet gopacket.Packet), err error) {
+	w := NewWriterNanos(file)
+	err = w.WriteFileHeader(64<<10, link)
 	if err != nil {
-		return nil, fmt.Errorf("inactive handle error: %q, interface: %q", err, ifi.Name)
-	}
-
-	if err = l.checkBeforePcapHandle(inactive, ifi); err != nil {
 		return nil, err
 	}
-
-	var snap int
-	if l.Snaplen {
-		snap = 64<<10 + 200
-	} else if ifi.MTU > 0 {
-		snap = ifi.MTU + 200
-	}
-	err = inactive.SetSnapLen(snap)
-	if err != nil {
-		return nil, fmt.Errorf("snapshot length error: %q, interface: %q", err, ifi.Name)
-	}
-	if l.BufferSize > 0 {
-		err = inactive.SetBufferSize(int(l.BufferSize))
+	return func(packet gopacket.Packet) {
+		err = w.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
 		if err != nil {
-			return nil, fmt.Errorf("handle buffer size error: %q, interface: %q", err, ifi.Name)
-		}
-	}
-	if l.BufferTimeout == 0 {
-		l.BufferTimeout = pcap.BlockForever
-	}
-	err = inactive.SetTimeout(l.BufferTimeout)
-	if err != nil {
-		return nil, fmt.Errorf("handle buffer timeout error: %q, interface: %q", err, ifi.Name)
-	}
-	handle, err = inactive.Activate()
-	if err != nil {
-		return nil, fmt.Errorf("PCAP Activate device error: %q, interface: %q", err, ifi.Name)
-	}
-	if l.BPFFilter != "" {
-		if l.BPFFilter[0] != '(' || l.BPFFilter[len(l.BPFFilter)-1] != ')' {
-			l.BPFFilter = "(" + l.BPFFilter + ")"
+			go logger.Warn(err)
 		}
-	} else {
-		l.BPFFilter = l.Filter(ifi)
-	}
-	err = handle.SetBPFFilter(l.BPFFilter)
-	if err != nil {
-		handle.Close()
-		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, l.BPFFilter, ifi.Name)
-	}
-	return
+	}, nil
 }
 
 // SocketHandle returns new unix ethernet handle associated with this listener settings
@@ -290,15 +230,19 @@ func (l *Listener) read() {
 	l.Lock()
 	defer l.Unlock()
 	for key, handle := range l.Handles {
-		var source *gopacket.PacketSource
-		linkType := layers.LinkTypeEthernet
-		if _, ok := handle.(*pcap.Handle); ok {
-			linkType = handle.(*pcap.Handle).LinkType()
+		var ch chan gopacket.Packet
+		if h, ok := handle.(*fileHandle); ok {
+			ch = h.Packets()
+		} else {
+			linkType := layers.LinkTypeEthernet
+			if h, ok := handle.(interface{ LinkType() layers.LinkType }); ok {
+				linkType = h.LinkType()
+			}
+			source := gopacket.NewPacketSource(handle, linkType)
+			source.Lazy = true
+			source.NoCopy = true
+			ch = source.Packets()
 		}
-		source = gopacket.NewPacketSource(handle, linkType)
-		source.Lazy = true
-		source.NoCopy = true
-		ch := source.Packets()
 		go func(key string) {
 			defer l.closeHandles(key)
 			for {
@@ -322,10 +266,13 @@ func (l *Listener) closeHandles(key string) {
 	l.Lock()
 	defer l.Unlock()
 	if handle, ok := l.Handles[key]; ok {
-		if _, ok = handle.(Socket); ok {
-			_ = handle.(Socket).Close()
-		} else {
-			handle.(*pcap.Handle).Close()
+		switch h := handle.(type) {
+		case Socket:
+			_ = h.Close()
+		case *fileHandle:
+			h.Close()
+		case interface{ Close() }:
+			h.Close()
 		}
 		delete(l.Handles, key)
 		if len(l.Handles) == 0 {
@@ -334,24 +281,6 @@ func (l *Listener) closeHandles(key string) {
 	}
 }
 
-func (l *Listener) activatePcap() error {
-	var e error
-	var msg string
-	for _, ifi := range l.Interfaces {
-		var handle *pcap.Handle
-		handle, e = l.PcapHandle(ifi)
-		if e != nil {
-			msg += "\n" + e.Error()
-			continue
-		}
-		l.Handles[ifi.Name] = handle
-	}
-	if len(l.Handles) == 0 {
-		return fmt.Errorf("pcap handles error:%s", msg)
-	}
-	return nil
-}
-
 func (l *Listener) activateRawSocket() error {
 	if runtime.GOOS != "linux" {
 		return fmt.Errorf("sock_raw is not stabilized on OS other than linux")
@@ -370,10 +299,15 @@ func (l *Listener) activateRawSocket() error {
 	return e
 }
 
+// activatePcapFile 使用纯 Go 的 fileHandle 读取文件, 目录或 glob 匹配的文件
 func (l *Listener) activatePcapFile() (err error) {
-	var handle *pcap.Handle
-	var e error
-	if handle, e = pcap.OpenOffline(l.host); e != nil {
+	var files []string
+	if files, err = PcapFiles(l.host); err != nil {
+		return fmt.Errorf("open pcap file error: %q", err)
+	}
+
+	handle, e := newFileHandle(files)
+	if e != nil {
 		return fmt.Errorf("open pcap file error: %q", e)
 	}
 	if l.BPFFilter != "" {
@@ -381,6 +315,7 @@ func (l *Listener) activatePcapFile() (err error) {
 			l.BPFFilter = "(" + l.BPFFilter + ")"
 		}
 	} else {
+		// host 是文件名, 自动 filter 不限制地址
 		addr := l.host
 		l.host = ""
 		l.BPFFilter = l.Filter(NetInterface{})
@@ -1,3 +1,6 @@
+//go:build !nopcap
+// +build !nopcap
+
 package capture
 
 import (
@@ -23,16 +26,6 @@ import (
 	"goreplay/config"
 )
 
-var ifts, _ = net.Interfaces()
-var loopBack = func() net.Interface {
-	for _, v := range ifts {
-		if v.Flags&net.FlagLoopback != 0 {
-			return v
-		}
-	}
-	return ifts[0]
-}()
-
 const (
 	testPort = 18899
 	pbfFiler = "dst port 18899 and host 127.0.0.1"
@@ -0,0 +1,654 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetFilter 纯 Go 实现的 pcap-filter 表达式, pcap_file 引擎和没有 libpcap 时的 raw_socket 引擎使用.
+// 支持 pcap-filter(7) 的子集: and, or, not 和括号; ip, ip6, tcp, udp; [src|dst] host, net, port, portrange;
+// 以及 tcp[0:2] & 0x0f < 5 这样的取值和算术比较
+type packetFilter struct {
+	expr  string
+	match filterFunc
+}
+
+// filterFunc 判断一个包是否满足表达式的一部分
+type filterFunc func(p *filterPacket) bool
+
+// arithFunc 算术表达式的值, 取值越界或者包中没有对应的协议时返回 false
+type arithFunc func(p *filterPacket) (uint32, bool)
+
+// filterPacket 包中 filter 用到的层
+type filterPacket struct {
+	length int
+	ip4    *layers.IPv4
+	ip6    *layers.IPv6
+	tcp    *layers.TCP
+	udp    *layers.UDP
+}
+
+// tcp[tcpflags] 中可以使用的常量
+var filterConsts = map[string]uint32{
+	"tcpflags": 13,
+	"tcp-fin":  0x01,
+	"tcp-syn":  0x02,
+	"tcp-rst":  0x04,
+	"tcp-push": 0x08,
+	"tcp-ack":  0x10,
+	"tcp-urg":  0x20,
+}
+
+// compileFilter 解析表达式, 不支持的语法返回错误
+func compileFilter(expr string) (*packetFilter, error) {
+	toks, err := filterTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return &packetFilter{expr: expr, match: func(*filterPacket) bool { return true }}, nil
+	}
+
+	p := &filterParser{toks: toks}
+	match, err := p.or()
+	if err == nil && p.pos < len(p.toks) {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &packetFilter{expr: expr, match: match}, nil
+}
+
+// Matches 包是否满足表达式
+func (f *packetFilter) Matches(packet gopacket.Packet) bool {
+	p := &filterPacket{length: packet.Metadata().Length}
+	if p.length == 0 {
+		p.length = len(packet.Data())
+	}
+	switch l := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		p.ip4 = l
+	case *layers.IPv6:
+		p.ip6 = l
+	}
+	switch l := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		p.tcp = l
+	case *layers.UDP:
+		p.udp = l
+	}
+
+	return f.match(p)
+}
+
+// addrs 源地址和目的地址
+func (p *filterPacket) addrs() (src, dst net.IP, ok bool) {
+	switch {
+	case p.ip4 != nil:
+		return p.ip4.SrcIP, p.ip4.DstIP, true
+	case p.ip6 != nil:
+		return p.ip6.SrcIP, p.ip6.DstIP, true
+	}
+
+	return nil, nil, false
+}
+
+// ports 源端口和目的端口
+func (p *filterPacket) ports() (src, dst uint16, ok bool) {
+	switch {
+	case p.tcp != nil:
+		return uint16(p.tcp.SrcPort), uint16(p.tcp.DstPort), true
+	case p.udp != nil:
+		return uint16(p.udp.SrcPort), uint16(p.udp.DstPort), true
+	}
+
+	return 0, 0, false
+}
+
+// layer proto[...] 取值的协议层, 包中没有时返回 nil
+func (p *filterPacket) layer(proto string) gopacket.Layer {
+	switch {
+	case proto == "ip" && p.ip4 != nil:
+		return p.ip4
+	case proto == "ip6" && p.ip6 != nil:
+		return p.ip6
+	case proto == tcp && p.tcp != nil:
+		return p.tcp
+	case proto == "udp" && p.udp != nil:
+		return p.udp
+	}
+
+	return nil
+}
+
+// load 从协议头开始的偏移读取 size 字节的大端整数
+func (p *filterPacket) load(proto string, off uint32, size int) (uint32, bool) {
+	l := p.layer(proto)
+	if l == nil {
+		return 0, false
+	}
+
+	head, body := l.LayerContents(), l.LayerPayload()
+	var v uint32
+	for i := uint32(0); i < uint32(size); i++ {
+		j := off + i
+		switch {
+		case j < uint32(len(head)):
+			v = v<<8 | uint32(head[j])
+		case j-uint32(len(head)) < uint32(len(body)):
+			v = v<<8 | uint32(body[j-uint32(len(head))])
+		default:
+			return 0, false
+		}
+	}
+
+	return v, true
+}
+
+// filterTokens 拆分表达式. 方括号中的 ':' 是分隔符, 其他地方是 IPv6 地址的一部分
+func filterTokens(expr string) ([]string, error) {
+	var toks []string
+	depth := 0
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isFilterWordByte(c, depth):
+			j := filterWordEnd(expr, i, depth)
+			toks = append(toks, expr[i:j])
+			i = j
+			continue
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+
+		op := filterOperator(expr[i:])
+		if op == "" {
+			return nil, fmt.Errorf("unexpected %q in filter", c)
+		}
+		toks = append(toks, op)
+		i += len(op)
+	}
+
+	return toks, nil
+}
+
+// filterWordEnd 从 i 开始的单词的结尾. 字母开头的单词可以包含 '-', 如 tcp-syn
+func filterWordEnd(expr string, i, depth int) int {
+	j := i + 1
+	for ; j < len(expr); j++ {
+		dash := expr[j] == '-' && j+1 < len(expr) && isLetter(expr[j+1]) && isLetter(expr[i])
+		if !dash && !isFilterWordByte(expr[j], depth) {
+			break
+		}
+	}
+
+	return j
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isFilterWordByte(c byte, depth int) bool {
+	return isLetter(c) || c >= '0' && c <= '9' || c == '_' || c == '.' || c == ':' && depth == 0
+}
+
+// filterOperator s 开头的运算符或者括号
+func filterOperator(s string) string {
+	for _, op := range []string{"&&", "||", "<<", ">>", "<=", ">=", "==", "!="} {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	if strings.IndexByte("()[]:!=<>&|+-*/", s[0]) >= 0 {
+		return s[:1]
+	}
+
+	return ""
+}
+
+// filterParser 递归下降的解析器. 与 pcap 相同, 省略了限定词的值沿用上一个, 如 tcp port 80 or 81
+type filterParser struct {
+	toks []string
+	pos  int
+	last qualifiers
+}
+
+// qualifiers 原语的限定词, 如 tcp dst port
+type qualifiers struct {
+	proto, dir, typ string
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+
+	return ""
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *filterParser) unexpected() error {
+	if p.pos >= len(p.toks) {
+		return fmt.Errorf("unexpected end of filter")
+	}
+
+	return fmt.Errorf("syntax error in filter at %q", p.toks[p.pos])
+}
+
+func (p *filterParser) expect(tok string) error {
+	if p.peek() != tok {
+		return p.unexpected()
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) or() (filterFunc, error) {
+	left, err := p.and()
+	for err == nil && (p.peek() == "or" || p.peek() == "||") {
+		p.pos++
+		var right filterFunc
+		if right, err = p.and(); err == nil {
+			l := left
+			left = func(pkt *filterPacket) bool { return l(pkt) || right(pkt) }
+		}
+	}
+
+	return left, err
+}
+
+func (p *filterParser) and() (filterFunc, error) {
+	left, err := p.not()
+	for err == nil && (p.peek() == "and" || p.peek() == "&&") {
+		p.pos++
+		var right filterFunc
+		if right, err = p.not(); err == nil {
+			l := left
+			left = func(pkt *filterPacket) bool { return l(pkt) && right(pkt) }
+		}
+	}
+
+	return left, err
+}
+
+func (p *filterParser) not() (filterFunc, error) {
+	if p.peek() != "not" && p.peek() != "!" {
+		return p.primary()
+	}
+
+	p.pos++
+	f, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(pkt *filterPacket) bool { return !f(pkt) }, nil
+}
+
+// primary 先按比较解析, 失败时再按括号或者原语解析, 因为两者都可以用括号开头
+func (p *filterParser) primary() (filterFunc, error) {
+	start := p.pos
+	if f, err := p.relation(); err == nil {
+		return f, nil
+	}
+	p.pos = start
+
+	if p.peek() == "(" {
+		p.pos++
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+
+	return p.primitive()
+}
+
+// primitive 如 tcp, dst host 10.0.0.1, tcp port 80, portrange 0-65535
+func (p *filterParser) primitive() (filterFunc, error) {
+	var q qualifiers
+	found := false
+	for {
+		switch tok := p.peek(); tok {
+		case "ip", "ip6", tcp, "udp":
+			q.proto = tok
+		case "src", "dst":
+			q.dir = tok
+		case "host", "net", "port", "portrange":
+			q.typ = tok
+		default:
+			return p.value(q, found)
+		}
+		found = true
+		p.pos++
+	}
+}
+
+// value 原语中限定词之后的值
+func (p *filterParser) value(q qualifiers, found bool) (filterFunc, error) {
+	switch tok := p.peek(); {
+	case found && q.dir == "" && q.typ == "" && !isFilterValue(tok):
+		return protoFilter(q.proto), nil
+	case !isFilterValue(tok):
+		return nil, p.unexpected()
+	case !found:
+		if q = p.last; q == (qualifiers{}) {
+			return nil, p.unexpected()
+		}
+	}
+	p.last = q
+
+	var f filterFunc
+	var err error
+	switch q.typ {
+	case "port", "portrange":
+		f, err = p.port(q)
+	case "net":
+		f, err = p.network(q)
+	default:
+		f, err = p.host(q)
+	}
+	if err != nil || q.proto == "" {
+		return f, err
+	}
+
+	proto := protoFilter(q.proto)
+	return func(pkt *filterPacket) bool { return proto(pkt) && f(pkt) }, nil
+}
+
+func isFilterValue(tok string) bool {
+	switch tok {
+	case "", "and", "or", "not", "(", ")", "&&", "||", "!":
+		return false
+	}
+
+	return true
+}
+
+func protoFilter(proto string) filterFunc {
+	return func(pkt *filterPacket) bool {
+		switch proto {
+		case "ip":
+			return pkt.ip4 != nil
+		case "ip6":
+			return pkt.ip6 != nil
+		case tcp:
+			return pkt.tcp != nil
+		}
+		return pkt.udp != nil
+	}
+}
+
+// dirMatch 按 src, dst 或者两者之一比较
+func dirMatch(dir string, src, dst bool) bool {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+
+	return src || dst
+}
+
+func (p *filterParser) port(q qualifiers) (filterFunc, error) {
+	lo, err := p.portNumber(q.proto)
+	if err != nil {
+		return nil, err
+	}
+	hi := lo
+	if q.typ == "portrange" {
+		if err = p.expect("-"); err != nil {
+			return nil, err
+		}
+		if hi, err = p.portNumber(q.proto); err != nil {
+			return nil, err
+		}
+	}
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	return func(pkt *filterPacket) bool {
+		src, dst, ok := pkt.ports()
+		return ok && dirMatch(q.dir, lo <= src && src <= hi, lo <= dst && dst <= hi)
+	}, nil
+}
+
+// portNumber 端口号或者服务名
+func (p *filterParser) portNumber(proto string) (uint16, error) {
+	tok := p.next()
+	if n, err := strconv.ParseUint(tok, 0, 16); err == nil {
+		return uint16(n), nil
+	}
+	if proto != "udp" {
+		proto = tcp
+	}
+	n, err := net.LookupPort(proto, tok)
+	if err != nil {
+		return 0, fmt.Errorf("unknown port %q in filter", tok)
+	}
+
+	return uint16(n), nil
+}
+
+// host IP 地址或者主机名, 主机名与 libpcap 相同在编译时解析
+func (p *filterParser) host(q qualifiers) (filterFunc, error) {
+	tok := p.next()
+	ips := []net.IP{net.ParseIP(tok)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(tok); err != nil {
+			return nil, fmt.Errorf("unknown host %q in filter", tok)
+		}
+	}
+
+	return func(pkt *filterPacket) bool {
+		src, dst, ok := pkt.addrs()
+		if !ok {
+			return false
+		}
+		for _, ip := range ips {
+			if dirMatch(q.dir, ip.Equal(src), ip.Equal(dst)) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// network 网段, 如 net 10.0.0.0/8
+func (p *filterParser) network(q qualifiers) (filterFunc, error) {
+	tok := p.next()
+	if p.peek() == "/" {
+		p.pos++
+		tok += "/" + p.next()
+	} else if ip := net.ParseIP(tok); ip != nil && ip.To4() != nil {
+		tok += "/32"
+	} else {
+		tok += "/128"
+	}
+	_, ipnet, err := net.ParseCIDR(tok)
+	if err != nil {
+		return nil, fmt.Errorf("invalid net %q in filter", tok)
+	}
+
+	return func(pkt *filterPacket) bool {
+		src, dst, ok := pkt.addrs()
+		return ok && dirMatch(q.dir, ipnet.Contains(src), ipnet.Contains(dst))
+	}, nil
+}
+
+// relation 算术表达式的比较, 如 tcp[0:2] & 0x0f < 5
+func (p *filterParser) relation() (filterFunc, error) {
+	left, err := p.arith(0)
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	right, err := p.arith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	cmp, ok := map[string]func(a, b uint32) bool{
+		"=":  func(a, b uint32) bool { return a == b },
+		"==": func(a, b uint32) bool { return a == b },
+		"!=": func(a, b uint32) bool { return a != b },
+		"<":  func(a, b uint32) bool { return a < b },
+		"<=": func(a, b uint32) bool { return a <= b },
+		">":  func(a, b uint32) bool { return a > b },
+		">=": func(a, b uint32) bool { return a >= b },
+	}[op]
+	if !ok {
+		return nil, fmt.Errorf("unknown relation %q in filter", op)
+	}
+
+	return func(pkt *filterPacket) bool {
+		a, ok := left(pkt)
+		if !ok {
+			return false
+		}
+		b, ok := right(pkt)
+		return ok && cmp(a, b)
+	}, nil
+}
+
+// arithLevels 算术运算符按优先级从低到高, 与 pcap 相同
+var arithLevels = [][]string{{"|"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/"}}
+
+func (p *filterParser) arith(level int) (arithFunc, error) {
+	if level == len(arithLevels) {
+		return p.operand()
+	}
+
+	left, err := p.arith(level + 1)
+	for err == nil {
+		op := p.peek()
+		if !containsString(arithLevels[level], op) {
+			break
+		}
+		p.pos++
+		var right arithFunc
+		if right, err = p.arith(level + 1); err == nil {
+			left = arithOp(op, left, right)
+		}
+	}
+
+	return left, err
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func arithOp(op string, left, right arithFunc) arithFunc {
+	return func(pkt *filterPacket) (uint32, bool) {
+		a, ok := left(pkt)
+		if !ok {
+			return 0, false
+		}
+		b, ok := right(pkt)
+		if !ok {
+			return 0, false
+		}
+		switch op {
+		case "|":
+			return a | b, true
+		case "&":
+			return a & b, true
+		case "<<":
+			return a << b, true
+		case ">>":
+			return a >> b, true
+		case "+":
+			return a + b, true
+		case "-":
+			return a - b, true
+		case "*":
+			return a * b, true
+		}
+		return a / b, b != 0
+	}
+}
+
+// operand 数字, 常量, len, 括号, 或者 proto[off:size] 取值
+func (p *filterParser) operand() (arithFunc, error) {
+	tok := p.next()
+	if n, err := strconv.ParseUint(tok, 0, 32); err == nil {
+		return func(*filterPacket) (uint32, bool) { return uint32(n), true }, nil
+	}
+	if n, ok := filterConsts[tok]; ok {
+		return func(*filterPacket) (uint32, bool) { return n, true }, nil
+	}
+
+	switch tok {
+	case "len":
+		return func(pkt *filterPacket) (uint32, bool) { return uint32(pkt.length), true }, nil
+	case "(":
+		f, err := p.arith(0)
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	case "ip", "ip6", tcp, "udp":
+		return p.load(tok)
+	}
+	p.pos--
+
+	return nil, p.unexpected()
+}
+
+// load proto[off] 或者 proto[off:size], size 为 1, 2 或 4
+func (p *filterParser) load(proto string) (arithFunc, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	off, err := p.arith(0)
+	if err != nil {
+		return nil, err
+	}
+	size := 1
+	if p.peek() == ":" {
+		p.pos++
+		if size, err = strconv.Atoi(p.next()); err != nil || size != 1 && size != 2 && size != 4 {
+			return nil, fmt.Errorf("data size must be 1, 2 or 4 in filter")
+		}
+	}
+	if err = p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	return func(pkt *filterPacket) (uint32, bool) {
+		o, ok := off(pkt)
+		if !ok {
+			return 0, false
+		}
+		return pkt.load(proto, o, size)
+	}, nil
+}
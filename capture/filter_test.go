@@ -0,0 +1,104 @@
+package capture
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/suite"
+)
+
+type filterSuite struct {
+	suite.Suite
+}
+
+func TestUnitFilter(t *testing.T) {
+	suite.Run(t, new(filterSuite))
+}
+
+// filterPacketData 10.0.0.1:45678 -> 10.0.0.2:80 的 tcp 包, syn 时不带 ack
+func filterPacketData(syn bool, udp bool, v6 bool) gopacket.Packet {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4}
+	var ip gopacket.NetworkLayer = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	if v6 {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+			SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("fe80::2")}
+	}
+
+	var transport gopacket.SerializableLayer = &layers.TCP{SrcPort: 45678, DstPort: 80, SYN: syn, ACK: !syn}
+	if udp {
+		transport = &layers.UDP{SrcPort: 45678, DstPort: 80}
+		if ip4, ok := ip.(*layers.IPv4); ok {
+			ip4.Protocol = layers.IPProtocolUDP
+		} else {
+			ip.(*layers.IPv6).NextHeader = layers.IPProtocolUDP
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	_ = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		eth, ip.(gopacket.SerializableLayer), transport, gopacket.Payload("GET / HTTP/1.1\r\n\r\n"))
+
+	return gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.DecodeOptions{Lazy: true})
+}
+
+func (s *filterSuite) TestMatches() {
+	request := filterPacketData(false, false, false)
+	syn := filterPacketData(true, false, false)
+	udp := filterPacketData(false, true, false)
+	v6 := filterPacketData(false, false, true)
+
+	for _, tt := range []struct {
+		expr   string
+		packet gopacket.Packet
+		want   bool
+	}{
+		{expr: "", packet: request, want: true},
+		{expr: "(tcp dst port 80)", packet: request, want: true},
+		{expr: "(tcp dst port 80)", packet: udp, want: false},
+		{expr: "(tcp src port 80)", packet: request, want: false},
+		{expr: "(tcp port 80 and host 10.0.0.2)", packet: request, want: true},
+		{expr: "(tcp dst portrange 0-65535)", packet: v6, want: true},
+		{expr: "tcp port 81 or 80", packet: request, want: true},
+		{expr: "udp and not port 81", packet: udp, want: true},
+		{expr: "ip6 and src host fe80::1", packet: v6, want: true},
+		{expr: "ip and dst net 10.0.0.0/24", packet: request, want: true},
+		{expr: "src net 10.0.1.0/24", packet: request, want: false},
+		{expr: "tcp[tcpflags] & tcp-syn != 0", packet: syn, want: true},
+		{expr: "tcp[tcpflags] & tcp-syn != 0", packet: request, want: false},
+		{expr: "tcp[20:4] = 0x47455420", packet: request, want: true},
+		{expr: "tcp[1000] = 0", packet: request, want: false},
+		{expr: "len > 60 && ip[9] == 6", packet: request, want: true},
+		// logreplay 录制的采样 filter, 45678 & 0x0f 为 14
+		{expr: "(tcp dst port 80 and dst host 10.0.0.2  and (( tcp[0:2] & 0x0f) < 15)) or " +
+			"(tcp src port 80 and src host 10.0.0.2  and (( tcp[2:2] & 0x0f) < 15))", packet: request, want: true},
+		{expr: "(tcp dst port 80 and dst host 10.0.0.2  and (( tcp[0:2] & 0x0f) < 14)) or " +
+			"(tcp src port 80 and src host 10.0.0.2  and (( tcp[2:2] & 0x0f) < 14))", packet: request, want: false},
+	} {
+		s.Run(tt.expr, func() {
+			f, err := compileFilter(tt.expr)
+			s.Require().NoError(err)
+			s.Equal(tt.want, f.Matches(tt.packet))
+		})
+	}
+}
+
+func (s *filterSuite) TestCompileError() {
+	for _, expr := range []string{
+		"tcp dst port",
+		"(tcp port 80",
+		"tcp[0:3] = 1",
+		"80",
+		"ether host 00:01:02:03:04:05",
+		"tcp port 80 $",
+	} {
+		s.Run(expr, func() {
+			_, err := compileFilter(expr)
+			s.Error(err)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+//go:build !nopcap
+// +build !nopcap
+
+package capture
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// compileBPF 用 libpcap 把表达式编译成内核使用的 BPF 指令
+func compileBPF(linkType layers.LinkType, snaplen int, expr string) ([]bpf.RawInstruction, error) {
+	ins, err := pcap.CompileBPFFilter(linkType, snaplen, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]bpf.RawInstruction, len(ins))
+	for i, in := range ins {
+		raw[i] = bpf.RawInstruction{Op: in.Code, Jt: in.Jt, Jf: in.Jf, K: in.K}
+	}
+
+	return raw, nil
+}
+
+func (l *Listener) checkBeforePcapHandle(inactive *pcap.InactiveHandle, ifi NetInterface) error {
+	if l.TimestampType != "" {
+		var ts pcap.TimestampSource
+		ts, err := pcap.TimestampSourceFromString(l.TimestampType)
+		if err != nil {
+			return fmt.Errorf("%q: supported timestampSourceFromString: %q, interface: %q", err,
+				inactive.SupportedTimestamps(), ifi.Name)
+		}
+
+		err = inactive.SetTimestampSource(ts)
+		if err != nil {
+			return fmt.Errorf("%q: supported timestamps: %q, interface: %q", err, inactive.SupportedTimestamps(), ifi.Name)
+		}
+	}
+
+	if l.Promiscuous {
+		if err := inactive.SetPromisc(l.Promiscuous); err != nil {
+			return fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name)
+		}
+	}
+
+	if l.Monitor {
+		if err := inactive.SetRFMon(l.Monitor); err != nil && !errors.Is(err, pcap.CannotSetRFMon) {
+			return fmt.Errorf("monitor mode error: %q, interface: %q", err, ifi.Name)
+		}
+	}
+
+	return nil
+}
+
+// PcapHandle returns new pcap Handle from dev on success.
+// this function should be called after setting all necessary options for this listener
+func (l *Listener) PcapHandle(ifi NetInterface) (handle *pcap.Handle, err error) {
+	var inactive *pcap.InactiveHandle
+	inactive, err = pcap.NewInactiveHandle(ifi.Name)
+	if inactive != nil && err != nil {
+		defer inactive.CleanUp()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inactive handle error: %q, interface: %q", err, ifi.Name)
+	}
+
+	if err = l.checkBeforePcapHandle(inactive, ifi); err != nil {
+		return nil, err
+	}
+
+	var snap int
+	if l.Snaplen {
+		snap = 64<<10 + 200
+	} else if ifi.MTU > 0 {
+		snap = ifi.MTU + 200
+	}
+	err = inactive.SetSnapLen(snap)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot length error: %q, interface: %q", err, ifi.Name)
+	}
+	if l.BufferSize > 0 {
+		err = inactive.SetBufferSize(int(l.BufferSize))
+		if err != nil {
+			return nil, fmt.Errorf("handle buffer size error: %q, interface: %q", err, ifi.Name)
+		}
+	}
+	if l.BufferTimeout == 0 {
+		l.BufferTimeout = pcap.BlockForever
+	}
+	err = inactive.SetTimeout(l.BufferTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("handle buffer timeout error: %q, interface: %q", err, ifi.Name)
+	}
+	handle, err = inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("PCAP Activate device error: %q, interface: %q", err, ifi.Name)
+	}
+	if l.BPFFilter != "" {
+		if l.BPFFilter[0] != '(' || l.BPFFilter[len(l.BPFFilter)-1] != ')' {
+			l.BPFFilter = "(" + l.BPFFilter + ")"
+		}
+	} else {
+		l.BPFFilter = l.Filter(ifi)
+	}
+	err = handle.SetBPFFilter(l.BPFFilter)
+	if err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, l.BPFFilter, ifi.Name)
+	}
+	return
+}
+
+func (l *Listener) activatePcap() error {
+	var e error
+	var msg string
+	for _, ifi := range l.Interfaces {
+		var handle *pcap.Handle
+		handle, e = l.PcapHandle(ifi)
+		if e != nil {
+			msg += "\n" + e.Error()
+			continue
+		}
+		l.Handles[ifi.Name] = handle
+	}
+	if len(l.Handles) == 0 {
+		return fmt.Errorf("pcap handles error:%s", msg)
+	}
+	return nil
+}
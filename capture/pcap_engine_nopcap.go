@@ -0,0 +1,20 @@
+//go:build nopcap
+// +build nopcap
+
+package capture
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// compileBPF 没有 libpcap 时不能编译内核使用的 BPF 指令, raw_socket 引擎改为用 Go 过滤
+func compileBPF(_ layers.LinkType, _ int, _ string) ([]bpf.RawInstruction, error) {
+	return nil, errNoLibpcap
+}
+
+func (l *Listener) activatePcap() error {
+	return fmt.Errorf("%v, use --input-raw-engine raw_socket or pcap_file", errNoLibpcap)
+}
@@ -0,0 +1,304 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"goreplay/capture/zstd"
+	"goreplay/logger"
+)
+
+// 文件开头的魔数, 用来识别格式和压缩方式
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+)
+
+// PcapFiles 展开 pcap_file 引擎的输入: 文件, 目录下的所有文件, 或者 glob
+func PcapFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err == nil && !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	switch {
+	case err == nil:
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	case strings.ContainsAny(path, "*?["):
+		if files, err = filepath.Glob(path); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no capture files in %q", path)
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// packetReader 一个 pcap 或 pcapng 文件
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// captureFile 打开的文件和下一个数据包
+type captureFile struct {
+	name     string
+	reader   packetReader
+	linkType layers.LinkType // linkType pcap 文件的链路类型, pcapng 每个包自带
+	closers  []io.Closer
+
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+// openCaptureFile 按魔数识别 gzip, zstd 压缩和 pcap, pcapng 格式
+func openCaptureFile(name string) (*captureFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &captureFile{name: name, closers: []io.Closer{f}}
+
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		c.closers = append(c.closers, gz)
+		r = bufio.NewReader(gz)
+	case bytes.HasPrefix(magic, zstdMagic):
+		r = bufio.NewReader(zstd.NewReader(r))
+	}
+
+	if magic, _ = r.Peek(4); bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		c.reader = ng
+	} else {
+		p, err := pcapgo.NewReader(r)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		c.reader, c.linkType = p, p.LinkType()
+	}
+
+	return c, nil
+}
+
+// next 读取下一个包, 返回 false 表示文件读完
+func (c *captureFile) next() (bool, error) {
+	data, ci, err := c.reader.ReadPacketData()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", c.name, err)
+	}
+
+	c.data, c.ci = data, ci
+	return true, nil
+}
+
+// LinkType 当前包的链路类型
+func (c *captureFile) LinkType() layers.LinkType {
+	if len(c.ci.AncillaryData) > 0 {
+		if linkType, ok := c.ci.AncillaryData[0].(layers.LinkType); ok {
+			return linkType
+		}
+	}
+
+	return c.linkType
+}
+
+// Close 关闭解压和文件
+func (c *captureFile) Close() {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		_ = c.closers[i].Close()
+	}
+}
+
+// fileHeap 按下一个包的时间戳排序的文件
+type fileHeap []*captureFile
+
+func (h fileHeap) Len() int { return len(h) }
+func (h fileHeap) Less(i, j int) bool {
+	return h[i].ci.Timestamp.Before(h[j].ci.Timestamp)
+}
+func (h fileHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fileHeap) Push(x interface{}) { *h = append(*h, x.(*captureFile)) }
+func (h *fileHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// fileHandle 纯 Go 读取离线抓包文件, 不需要 libpcap. 多个文件按时间戳合并,
+// 每个包按自己的链路类型解码, 再用 Go 实现的 filter 过滤
+type fileHandle struct {
+	mu     sync.Mutex
+	files  fileHeap
+	filter *packetFilter
+	closed bool
+}
+
+// newFileHandle 打开全部文件, 读取每个文件的第一个包
+func newFileHandle(names []string) (*fileHandle, error) {
+	h := new(fileHandle)
+	for _, name := range names {
+		c, err := openCaptureFile(name)
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+
+		ok, err := c.next()
+		if err != nil {
+			logger.Warn(fmt.Sprintf("[CAPTURE] %v", err))
+		}
+		if !ok {
+			c.Close()
+			continue
+		}
+		h.files = append(h.files, c)
+	}
+	heap.Init(&h.files)
+
+	return h, nil
+}
+
+// SetBPFFilter 替换 filter, 表达式由 compileFilter 解析
+func (h *fileHandle) SetBPFFilter(expr string) error {
+	filter, err := compileFilter(expr)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.filter = filter
+	h.mu.Unlock()
+
+	return nil
+}
+
+// ReadPacketData 返回下一个满足 filter 的包
+func (h *fileHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	packet, err := h.nextPacket()
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+
+	return packet.Data(), packet.Metadata().CaptureInfo, nil
+}
+
+// Packets 与 gopacket.PacketSource 相同, 但是每个包使用所在接口的链路类型解码
+func (h *fileHandle) Packets() chan gopacket.Packet {
+	ch := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(ch)
+		for {
+			packet, err := h.nextPacket()
+			if err != nil {
+				if err != io.EOF {
+					logger.Error(fmt.Sprintf("[CAPTURE] %v", err))
+				}
+				return
+			}
+			ch <- packet
+		}
+	}()
+
+	return ch
+}
+
+// nextPacket 时间戳最早的包, 所有文件读完时返回 io.EOF
+func (h *fileHandle) nextPacket() (gopacket.Packet, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for {
+		if h.closed || len(h.files) == 0 {
+			return nil, io.EOF
+		}
+
+		c := h.files[0]
+		data, ci, linkType := c.data, c.ci, c.LinkType()
+		ok, err := c.next()
+		if err != nil {
+			// 损坏或者截断的文件, 跳过剩下的部分
+			logger.Warn(fmt.Sprintf("[CAPTURE] %v", err))
+		}
+		if ok {
+			heap.Fix(&h.files, 0)
+		} else {
+			heap.Pop(&h.files)
+			c.Close()
+		}
+
+		if packet := h.match(data, ci, linkType); packet != nil {
+			return packet, nil
+		}
+	}
+}
+
+// match 不满足 filter 时返回 nil
+func (h *fileHandle) match(data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType) gopacket.Packet {
+	packet := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	m := packet.Metadata()
+	m.CaptureInfo = ci
+	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+
+	if h.filter != nil && !h.filter.Matches(packet) {
+		return nil
+	}
+
+	return packet
+}
+
+// Close 关闭所有文件
+func (h *fileHandle) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, c := range h.files {
+		c.Close()
+	}
+	h.files = nil
+	h.closed = true
+}
@@ -0,0 +1,273 @@
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+)
+
+type pcapFileSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestUnitPcapFile(t *testing.T) {
+	suite.Run(t, new(pcapFileSuite))
+}
+
+// SetupTest init before test run
+func (s *pcapFileSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+}
+
+// testPacket 一个包, seq 作为 payload, 用来检查读出的顺序
+type testPacket struct {
+	linkType layers.LinkType
+	dstPort  uint16
+	seq      byte
+	ts       int64 // 秒
+}
+
+func (p testPacket) data() []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 45678, DstPort: layers.TCPPort(p.dstPort), PSH: true, ACK: true}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+
+	var link gopacket.SerializableLayer = &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}, EthernetType: layers.EthernetTypeIPv4}
+	if p.linkType == layers.LinkTypeLoop {
+		link = &layers.Loopback{Family: layers.ProtocolFamilyIPv4}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	_ = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		link, ip, tcp, gopacket.Payload{p.seq})
+
+	return buf.Bytes()
+}
+
+func (p testPacket) ci() gopacket.CaptureInfo {
+	n := len(p.data())
+	return gopacket.CaptureInfo{Timestamp: time.Unix(p.ts, 0), CaptureLength: n, Length: n}
+}
+
+// writePcap 写 pcap 文件, 链路类型使用第一个包的
+func (s *pcapFileSuite) writePcap(packets ...testPacket) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriterNanos(&buf)
+	s.Require().NoError(w.WriteFileHeader(64<<10, packets[0].linkType))
+	for _, p := range packets {
+		s.Require().NoError(w.WritePacket(p.ci(), p.data()))
+	}
+
+	return buf.Bytes()
+}
+
+// writePcapng 写 pcapng 文件, 每种链路类型一个接口
+func (s *pcapFileSuite) writePcapng(packets ...testPacket) []byte {
+	var buf bytes.Buffer
+	w, err := pcapgo.NewNgWriter(&buf, layers.LinkTypeEthernet)
+	s.Require().NoError(err)
+	intf := pcapgo.DefaultNgInterface
+	intf.LinkType = layers.LinkTypeLoop
+	loop, err := w.AddInterface(intf)
+	s.Require().NoError(err)
+
+	for _, p := range packets {
+		ci := p.ci()
+		if p.linkType == layers.LinkTypeLoop {
+			ci.InterfaceIndex = loop
+		}
+		s.Require().NoError(w.WritePacket(ci, p.data()))
+	}
+	s.Require().NoError(w.Flush())
+
+	return buf.Bytes()
+}
+
+func (s *pcapFileSuite) gzip(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(data)
+	s.Require().NoError(w.Close())
+
+	return buf.Bytes()
+}
+
+// zstd 只用 raw block 组成 zstd 帧, 测试不依赖压缩库
+func (s *pcapFileSuite) zstd(data []byte) []byte {
+	buf := append([]byte{}, zstdMagic...)
+	buf = append(buf, 0, 0x38) // 无 checksum, window 128K
+	for {
+		n := len(data)
+		if n > 1<<17 {
+			n = 1 << 17
+		}
+		h := uint32(n) << 3
+		if n == len(data) {
+			h |= 1 // last block
+		}
+		buf = append(buf, byte(h), byte(h>>8), byte(h>>16))
+		buf = append(buf, data[:n]...)
+		if data = data[n:]; h&1 == 1 {
+			return buf
+		}
+	}
+}
+
+func (s *pcapFileSuite) file(name string, data []byte) string {
+	path := filepath.Join(s.dir, name)
+	s.Require().NoError(ioutil.WriteFile(path, data, 0644))
+
+	return path
+}
+
+// read 通过 pcap_file 引擎读取 80 端口的请求, 返回每个包的 payload
+func (s *pcapFileSuite) read(path string) []byte {
+	return s.readFilter(path, "")
+}
+
+// readFilter 与 read 相同, filter 不为空时代替自动 filter
+func (s *pcapFileSuite) readFilter(path, filter string) []byte {
+	l, err := NewListener(path, 80, "", config.EnginePcapFile, false)
+	s.Require().NoError(err)
+	l.BPFFilter = filter
+	s.Require().NoError(l.Activate())
+
+	var got []byte
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Require().NoError(l.Listen(ctx, func(packet gopacket.Packet) {
+		if app := packet.ApplicationLayer(); app != nil {
+			got = append(got, app.Payload()...)
+		}
+	}))
+
+	return got
+}
+
+func (s *pcapFileSuite) TestPcapFiles() {
+	a := s.file("a.pcap", nil)
+	b := s.file("b.pcap", nil)
+	s.file(".hidden", nil)
+	s.Require().NoError(os.Mkdir(filepath.Join(s.dir, "sub"), 0755))
+
+	for _, tt := range []struct {
+		name    string
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "file", path: b, want: []string{b}},
+		{name: "dir", path: s.dir, want: []string{a, b}},
+		{name: "glob", path: filepath.Join(s.dir, "*.pcap"), want: []string{a, b}},
+		{name: "glob no match", path: filepath.Join(s.dir, "*.gz"), wantErr: true},
+		{name: "missing", path: filepath.Join(s.dir, "c.pcap"), wantErr: true},
+	} {
+		s.Run(tt.name, func() {
+			files, err := PcapFiles(tt.path)
+			if tt.wantErr {
+				s.Error(err)
+				return
+			}
+			s.NoError(err)
+			s.Equal(tt.want, files)
+		})
+	}
+}
+
+func (s *pcapFileSuite) TestRead() {
+	eth, loop := layers.LinkTypeEthernet, layers.LinkTypeLoop
+
+	for _, tt := range []struct {
+		name  string
+		files map[string][]byte
+		path  string
+		want  []byte
+	}{
+		{
+			name:  "pcap",
+			files: map[string][]byte{"a.pcap": s.writePcap(testPacket{eth, 80, 1, 1}, testPacket{eth, 81, 2, 2})},
+			path:  "a.pcap",
+			want:  []byte{1},
+		},
+		{
+			name: "pcapng mixed link types",
+			files: map[string][]byte{"a.pcapng": s.writePcapng(testPacket{eth, 80, 1, 1},
+				testPacket{loop, 80, 2, 2}, testPacket{eth, 80, 3, 3})},
+			path: "a.pcapng",
+			want: []byte{1, 2, 3},
+		},
+		{
+			name: "merge in timestamp order",
+			files: map[string][]byte{
+				"a.pcap.gz": s.gzip(s.writePcap(testPacket{eth, 80, 1, 1}, testPacket{eth, 80, 4, 4})),
+				"b.pcapng":  s.writePcapng(testPacket{loop, 80, 2, 2}, testPacket{eth, 80, 3, 3}),
+			},
+			path: "*",
+			want: []byte{1, 2, 3, 4},
+		},
+		{
+			name: "zstd",
+			files: map[string][]byte{
+				"a.pcapng.zst": s.zstd(s.writePcapng(testPacket{eth, 80, 1, 1}, testPacket{loop, 80, 3, 3})),
+				"b.pcap.zst":   s.zstd(s.writePcap(testPacket{eth, 80, 2, 2})),
+			},
+			path: "*.zst",
+			want: []byte{1, 2, 3},
+		},
+		{
+			name: "truncated file",
+			files: map[string][]byte{
+				"a.pcap": s.writePcap(testPacket{eth, 80, 1, 1}, testPacket{eth, 80, 3, 3})[:100],
+				"b.pcap": s.writePcap(testPacket{eth, 80, 2, 2}),
+			},
+			path: "*.pcap",
+			want: []byte{1, 2},
+		},
+	} {
+		s.Run(tt.name, func() {
+			s.SetupTest()
+			for name, data := range tt.files {
+				s.file(name, data)
+			}
+			s.Equal(tt.want, s.read(filepath.Join(s.dir, tt.path)))
+		})
+	}
+}
+
+func (s *pcapFileSuite) TestBPFFilter() {
+	eth, loop := layers.LinkTypeEthernet, layers.LinkTypeLoop
+	path := s.file("a.pcapng", s.writePcapng(testPacket{eth, 80, 1, 1}, testPacket{loop, 81, 2, 2},
+		testPacket{eth, 82, 3, 3}))
+
+	s.Equal([]byte{2, 3}, s.readFilter(path, "tcp dst portrange 81-82 and dst host 10.0.0.2"))
+	s.Equal([]byte{1, 3}, s.readFilter(path, "not (tcp[2:2] & 0x0f) = 1"))
+
+	l, err := NewListener(path, 80, "", config.EnginePcapFile, false)
+	s.Require().NoError(err)
+	l.BPFFilter = "tcp dst port"
+	s.Error(l.Activate())
+}
+
+func (s *pcapFileSuite) TestNotCapture() {
+	path := s.file("a.txt", []byte("not a capture file"))
+
+	l, err := NewListener(path, 80, "", config.EnginePcapFile, false)
+	s.Require().NoError(err)
+	s.Error(l.Activate())
+}
@@ -9,7 +9,6 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"golang.org/x/sys/unix"
 )
 
@@ -37,9 +36,10 @@ type SockRaw struct {
 	ifindex     int
 	snaplen     int
 	pollTimeout uintptr
-	frame       uint32 // current frame
-	buf         []byte // points to the memory space of the ring buffer shared with the kernel.
-	loopIndex   int32  // this field must filled to avoid reading packet twice on a loopback device
+	frame       uint32        // current frame
+	buf         []byte        // points to the memory space of the ring buffer shared with the kernel.
+	loopIndex   int32         // this field must filled to avoid reading packet twice on a loopback device
+	filter      *packetFilter // 没有 libpcap 时在用户态过滤, 为 nil 时由内核过滤
 }
 
 // NewSocket returns new M'maped sock_raw on packet version 2.
@@ -144,6 +144,12 @@ read:
 	ci.InterfaceIndex = int(sockAddr.Ifindex)
 	buf = make([]byte, tpHdr.Snaplen)
 	ci.CaptureLength = copy(buf, sock.buf[i+int(tpHdr.Mac):])
+	if sock.filter != nil {
+		packet := gopacket.NewPacket(buf, layers.LinkTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		if !sock.filter.Matches(packet) {
+			goto read
+		}
+	}
 
 	return
 }
@@ -196,10 +202,15 @@ func (sock *SockRaw) GetSnapLen() int {
 func (sock *SockRaw) SetBPFFilter(expr string) error {
 	sock.mu.Lock()
 	defer sock.mu.Unlock()
+	sock.filter = nil
 	if len(expr) == 0 {
 		return unix.SetsockoptInt(sock.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
 	}
-	filter, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, sock.snaplen, expr)
+	filter, err := compileBPF(layers.LinkTypeEthernet, sock.snaplen, expr)
+	if err == errNoLibpcap {
+		sock.filter, err = compileFilter(expr)
+		return err
+	}
 	if err != nil {
 		return err
 	}
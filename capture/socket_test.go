@@ -0,0 +1,16 @@
+package capture
+
+import (
+	"net"
+)
+
+// loopBack pcap 和 raw_socket 的测试都在回环网卡上抓包
+var ifts, _ = net.Interfaces()
+var loopBack = func() net.Interface {
+	for _, v := range ifts {
+		if v.Flags&net.FlagLoopback != 0 {
+			return v
+		}
+	}
+	return ifts[0]
+}()
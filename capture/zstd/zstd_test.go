@@ -0,0 +1,65 @@
+package zstd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type zstdSuite struct {
+	suite.Suite
+}
+
+func TestUnitZstd(t *testing.T) {
+	suite.Run(t, new(zstdSuite))
+}
+
+func (s *zstdSuite) TestSamples() {
+	for _, tt := range []struct {
+		name       string
+		compressed string
+		want       string
+	}{
+		{name: "raw block", compressed: "\x28\xb5\x2f\xfd\x00\x00\x15\x00\x00\x00\x00", want: ""},
+		{name: "hello", compressed: "\x28\xb5\x2f\xfd\x24\x0d\x69\x00\x00\x68\x65\x6c\x6c\x6f\x2c" +
+			"\x20\x77\x6f\x72\x6c\x64\x0a\x4c\x1f\xf9\xf1", want: "hello, world\n"},
+		{name: "skippable frame", compressed: "\x50\x2a\x4d\x18\x00\x00\x00\x00", want: ""},
+	} {
+		s.Run(tt.name, func() {
+			got, err := ioutil.ReadAll(NewReader(strings.NewReader(tt.compressed)))
+			s.Require().NoError(err)
+			s.Equal(tt.want, string(got))
+		})
+	}
+}
+
+// TestFiles testdata 文件名前 8 位为解压结果 sha256 的前缀
+func (s *zstdSuite) TestFiles() {
+	names, err := filepath.Glob("testdata/*.zst")
+	s.Require().NoError(err)
+	s.Require().NotEmpty(names)
+
+	for _, name := range names {
+		s.Run(name, func() {
+			data, err := ioutil.ReadFile(name)
+			s.Require().NoError(err)
+
+			h := sha256.New()
+			_, err = io.Copy(h, NewReader(bytes.NewReader(data)))
+			s.Require().NoError(err)
+			s.Equal(filepath.Base(name)[:8], hex.EncodeToString(h.Sum(nil))[:8])
+		})
+	}
+}
+
+func (s *zstdSuite) TestCorrupt() {
+	_, err := ioutil.ReadAll(NewReader(strings.NewReader("\x28\xb5\x2f\xfd\xff")))
+	s.Error(err)
+}
@@ -0,0 +1,704 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"goreplay/framer"
+	"goreplay/logger"
+)
+
+const (
+	http2DefaultWindow    = 65535
+	http2DefaultFrameSize = 16384
+	http2TableSize        = 4096
+	http2MaxStreamID      = 1<<31 - 1
+)
+
+var (
+	errNoHeaders  = errors.New("no http2 headers frame in the request")
+	errConnClosed = errors.New("http2 connection closed")
+	errTimeout    = errors.New("i/o timeout")
+	// errRefused 服务端没有处理的 stream, 比如还没有收到 SETTINGS_MAX_CONCURRENT_STREAMS, 可以重试
+	errRefused = errors.New("stream refused by server")
+)
+
+// GRPCClientConfig grpc client configuration
+type GRPCClientConfig struct {
+	Timeout    time.Duration
+	Secure     bool // Secure h2 over tls, 否则 h2c
+	SkipVerify bool
+}
+
+// GRPCClient replays the frames of recorded http2 streams on one h2c or h2 connection, requests
+// share the connection concurrently. Headers are re-encoded by the hpack encoder of the connection
+// and stream ids are allocated by the connection, the recorded ones would collide
+type GRPCClient struct {
+	addr   string
+	config *GRPCClientConfig
+
+	mu   sync.Mutex
+	conn *h2Conn
+}
+
+// NewGRPCClient returns new GRPCClient
+func NewGRPCClient(addr string, config *GRPCClientConfig) *GRPCClient {
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	return &GRPCClient{addr: addr, config: config}
+}
+
+// RoundTrip sends the frames of one recorded stream and returns the frames of the response, on
+// the recorded stream id. Response headers are encoded by a fresh hpack encoder, like the recorded
+// ones, so that the response decodes on its own
+func (c *GRPCClient) RoundTrip(data []byte) ([]byte, error) {
+	parts, err := requestParts(data)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(c.config.Timeout)
+	for {
+		conn, err := c.connection()
+		if err != nil {
+			return nil, &OpError{Op: OpDial, Err: err}
+		}
+
+		stream, err := conn.send(parts, deadline)
+		if err != nil {
+			return nil, &OpError{Op: OpWrite, Err: err}
+		}
+
+		resp, err := conn.wait(stream, deadline)
+		if !errors.Is(err, errRefused) || time.Now().After(deadline) {
+			return resp, err
+		}
+	}
+}
+
+// connection 当前的连接, 断开或者不能再开新的 stream 时重新连接
+func (c *GRPCClient) connection() (*h2Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil && c.conn.usable() {
+		return c.conn, nil
+	}
+
+	conn, err := dialH2(c.addr, c.config)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	return conn, nil
+}
+
+// Disconnect closes the client connection
+func (c *GRPCClient) Disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		c.conn.close(errConnClosed)
+		c.conn = nil
+		logger.Debug("[GRPCClient] Disconnected: ", c.addr)
+	}
+}
+
+// requestPart 请求的一个 headers 或 data frame
+type requestPart struct {
+	streamID  uint32 // streamID 录制时的 stream id
+	fields    []hpack.HeaderField
+	data      []byte
+	isData    bool
+	endStream bool
+}
+
+// requestParts 解码录制的 frames, 每个 headers frame 都是独立编码的
+func requestParts(data []byte) ([]requestPart, error) {
+	var parts []requestPart
+	fr := framer.NewHTTP2Framer(data, "", true)
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			break
+		}
+
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			parts = append(parts, requestPart{streamID: f.StreamID, fields: f.Fields, endStream: f.StreamEnded()})
+		case *http2.DataFrame:
+			if len(parts) == 0 {
+				return nil, errNoHeaders
+			}
+			parts = append(parts, requestPart{data: append([]byte(nil), f.Data()...), isData: true,
+				endStream: f.StreamEnded()})
+		}
+
+		if len(parts) > 0 && parts[len(parts)-1].endStream {
+			break
+		}
+	}
+
+	if len(parts) == 0 || parts[0].isData {
+		return nil, errNoHeaders
+	}
+	// 没有录到结束的请求也要结束, 否则服务端一直等待
+	parts[len(parts)-1].endStream = true
+
+	return parts, nil
+}
+
+// h2Stream 连接上的一个请求, 响应按录制的 stream id 重新编码到 resp
+type h2Stream struct {
+	id     uint32
+	origID uint32
+	window int32 // window 发送窗口
+
+	resp *bytes.Buffer
+	fw   *http2.Framer
+	enc  *hpack.Encoder
+	hbuf bytes.Buffer
+
+	err  error
+	done chan struct{}
+}
+
+func (s *h2Stream) finish(err error) {
+	select {
+	case <-s.done:
+	default:
+		s.err = err
+		close(s.done)
+	}
+}
+
+// h2Conn 一个 http2 连接. wmu 保证 frame 和 hpack 编码的顺序, mu 保护连接和 stream 的状态
+type h2Conn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	fw   *http2.Framer
+	enc  *hpack.Encoder
+	hbuf bytes.Buffer
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	streams      map[uint32]*h2Stream
+	reserved     int // reserved 等待发送 headers 和进行中的 stream
+	nextID       uint32
+	window       int32 // window 连接的发送窗口
+	initWindow   int32
+	maxFrameSize uint32
+	maxStreams   uint32
+	goAway       bool
+	err          error
+}
+
+// dialH2 连接并发送 preface 和 SETTINGS, tls 连接需要协商出 h2
+func dialH2(addr string, config *GRPCClientConfig) (*h2Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Secure {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: config.SkipVerify,
+			NextProtos: []string{http2.NextProtoTLS}})
+		_ = tlsConn.SetDeadline(time.Now().Add(config.Timeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+			conn.Close()
+			return nil, fmt.Errorf("%s does not speak h2 over tls, negotiated %q", addr, p)
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	c := &h2Conn{
+		conn:         conn,
+		streams:      make(map[uint32]*h2Stream),
+		nextID:       1,
+		window:       http2DefaultWindow,
+		initWindow:   http2DefaultWindow,
+		maxFrameSize: http2DefaultFrameSize,
+		maxStreams:   http2MaxStreamID,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.fw = http2.NewFramer(conn, nil)
+	c.enc = hpack.NewEncoder(&c.hbuf)
+
+	_ = conn.SetWriteDeadline(time.Now().Add(config.Timeout))
+	if _, err = io.WriteString(conn, http2.ClientPreface); err == nil {
+		err = c.fw.WriteSettings(http2.Setting{ID: http2.SettingEnablePush})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	fr := http2.NewFramer(nil, bufio.NewReader(conn))
+	fr.ReadMetaHeaders = hpack.NewDecoder(http2TableSize, nil)
+	go c.readLoop(fr)
+
+	return c, nil
+}
+
+// usable 可以开新的 stream
+func (c *h2Conn) usable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err == nil && !c.goAway
+}
+
+// send 分配 stream id, 用连接的 encoder 编码 headers 后按流控发送 data
+func (c *h2Conn) send(parts []requestPart, deadline time.Time) (*h2Stream, error) {
+	timer := time.AfterFunc(time.Until(deadline), c.cond.Broadcast)
+	defer timer.Stop()
+
+	if err := c.reserve(deadline); err != nil {
+		return nil, err
+	}
+
+	stream, err := c.open(parts[0], deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range parts[1:] {
+		if part.isData {
+			err = c.writeData(stream, part, deadline)
+		} else {
+			err = c.writeHeaders(stream.id, part, deadline)
+		}
+		if err != nil {
+			c.reset(stream, err)
+			return nil, err
+		}
+	}
+
+	return stream, nil
+}
+
+// reserve 等待 SETTINGS_MAX_CONCURRENT_STREAMS 允许新的 stream
+func (c *h2Conn) reserve(deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.err == nil && !c.goAway && uint32(c.reserved) >= c.maxStreams {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("wait for a stream: %v", errTimeout)
+		}
+		c.cond.Wait()
+	}
+	switch {
+	case c.err != nil:
+		return c.err
+	case c.goAway:
+		return errConnClosed
+	}
+	c.reserved++
+
+	return nil
+}
+
+// open 写第一个 headers frame. 新 stream 的 id 必须递增, 所以分配 id 和写 headers 都在 wmu 中
+func (c *h2Conn) open(part requestPart, deadline time.Time) (*h2Stream, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.reserved--
+		c.mu.Unlock()
+		c.cond.Broadcast()
+		return nil, c.err
+	}
+	stream := &h2Stream{id: c.nextID, origID: part.streamID, window: c.initWindow,
+		resp: new(bytes.Buffer), done: make(chan struct{})}
+	stream.fw = http2.NewFramer(stream.resp, nil)
+	stream.enc = hpack.NewEncoder(&stream.hbuf)
+	c.streams[stream.id] = stream
+	c.nextID += 2
+	if c.nextID > http2MaxStreamID {
+		c.goAway = true
+	}
+	c.mu.Unlock()
+
+	// 失败时连接已经关闭, stream 随之结束
+	if err := c.writeHeadersLocked(stream.id, part, deadline); err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (c *h2Conn) writeHeaders(id uint32, part requestPart, deadline time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.writeHeadersLocked(id, part, deadline)
+}
+
+// writeHeadersLocked 编码 headers, 超过 frame 大小时拆成 CONTINUATION
+func (c *h2Conn) writeHeadersLocked(id uint32, part requestPart, deadline time.Time) error {
+	c.hbuf.Reset()
+	for _, hf := range part.fields {
+		if hf.Name == framer.LogReplayTraceID {
+			continue
+		}
+		if err := c.enc.WriteField(hf); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	maxFrameSize := int(c.maxFrameSize)
+	c.mu.Unlock()
+
+	_ = c.conn.SetWriteDeadline(deadline)
+	block := c.hbuf.Bytes()
+	first := true
+	for first || len(block) > 0 {
+		chunk := block
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		block = block[len(chunk):]
+
+		var err error
+		if first {
+			err = c.fw.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: chunk,
+				EndStream: part.endStream, EndHeaders: len(block) == 0})
+		} else {
+			err = c.fw.WriteContinuation(id, len(block) == 0, chunk)
+		}
+		if err != nil {
+			c.close(err)
+			return err
+		}
+		first = false
+	}
+
+	return nil
+}
+
+// writeData 按连接和 stream 的发送窗口分段发送
+func (c *h2Conn) writeData(stream *h2Stream, part requestPart, deadline time.Time) error {
+	data := part.data
+	for first := true; first || len(data) > 0; first = false {
+		n, err := c.takeWindow(stream, len(data), deadline)
+		if err != nil {
+			return err
+		}
+
+		c.wmu.Lock()
+		_ = c.conn.SetWriteDeadline(deadline)
+		err = c.fw.WriteData(stream.id, part.endStream && n == len(data), data[:n])
+		c.wmu.Unlock()
+		if err != nil {
+			c.close(err)
+			return err
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// takeWindow 等待发送窗口, 返回这次可以发送的字节数
+func (c *h2Conn) takeWindow(stream *h2Stream, want int, deadline time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if want == 0 {
+		return 0, c.err
+	}
+
+	for c.err == nil && (c.window <= 0 || stream.window <= 0) {
+		select {
+		case <-stream.done:
+			return 0, stream.err
+		default:
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("wait for flow control window: %v", errTimeout)
+		}
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n := want
+	for _, limit := range []int{int(c.window), int(stream.window), int(c.maxFrameSize)} {
+		if n > limit {
+			n = limit
+		}
+	}
+	c.window -= int32(n)
+	stream.window -= int32(n)
+
+	return n, nil
+}
+
+// wait 等待响应结束, 超时的 stream 被取消
+func (c *h2Conn) wait(stream *h2Stream, deadline time.Time) ([]byte, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-stream.done:
+	case <-timer.C:
+		c.reset(stream, errTimeout)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stream.err != nil {
+		return stream.resp.Bytes(), &OpError{Op: OpRead, Err: stream.err}
+	}
+
+	return stream.resp.Bytes(), nil
+}
+
+// reset 取消 stream
+func (c *h2Conn) reset(stream *h2Stream, err error) {
+	c.mu.Lock()
+	_, open := c.streams[stream.id]
+	c.mu.Unlock()
+
+	if open {
+		c.wmu.Lock()
+		_ = c.fw.WriteRSTStream(stream.id, http2.ErrCodeCancel)
+		c.wmu.Unlock()
+	}
+
+	c.mu.Lock()
+	c.finish(stream, err)
+	c.mu.Unlock()
+}
+
+// finish 结束 stream, 在 mu 中调用. 不能再开 stream 的连接在最后一个 stream 结束后关闭
+func (c *h2Conn) finish(stream *h2Stream, err error) {
+	if _, ok := c.streams[stream.id]; !ok {
+		return
+	}
+	delete(c.streams, stream.id)
+	c.reserved--
+	stream.finish(err)
+	c.cond.Broadcast()
+
+	if c.goAway && len(c.streams) == 0 && c.err == nil {
+		c.err = errConnClosed
+		c.conn.Close()
+	}
+}
+
+// close 关闭连接, 进行中的 stream 都失败
+func (c *h2Conn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+		c.conn.Close()
+	}
+	for _, stream := range c.streams {
+		c.finish(stream, err)
+	}
+	c.cond.Broadcast()
+}
+
+// readLoop 读取响应, 回应 SETTINGS 和 PING, 归还流控窗口
+func (c *h2Conn) readLoop(fr *http2.Framer) {
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				err = errConnClosed
+			}
+			c.close(err)
+			return
+		}
+
+		if err = c.handle(frame); err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+func (c *h2Conn) handle(frame http2.Frame) error {
+	switch f := frame.(type) {
+	case *http2.SettingsFrame:
+		return c.handleSettings(f)
+	case *http2.PingFrame:
+		if !f.IsAck() {
+			return c.write(func() error { return c.fw.WritePing(true, f.Data) })
+		}
+	case *http2.GoAwayFrame:
+		c.handleGoAway(f)
+	case *http2.WindowUpdateFrame:
+		c.handleWindowUpdate(f)
+	case *http2.MetaHeadersFrame:
+		c.deliver(f.StreamID, f.StreamEnded(), func(s *h2Stream) error {
+			return writeResponseHeaders(s, f.Fields, f.StreamEnded())
+		})
+	case *http2.DataFrame:
+		return c.handleData(f)
+	case *http2.RSTStreamFrame:
+		c.deliver(f.StreamID, true, func(s *h2Stream) error {
+			if f.ErrCode == http2.ErrCodeRefusedStream {
+				return errRefused
+			}
+			if err := s.fw.WriteRSTStream(s.origID, f.ErrCode); err != nil {
+				return err
+			}
+			return fmt.Errorf("stream reset by server: %v", f.ErrCode)
+		})
+	}
+
+	return nil
+}
+
+func (c *h2Conn) write(fn func() error) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	return fn()
+}
+
+func (c *h2Conn) handleSettings(f *http2.SettingsFrame) error {
+	if f.IsAck() {
+		return nil
+	}
+
+	c.mu.Lock()
+	err := f.ForeachSetting(func(s http2.Setting) error {
+		switch s.ID {
+		case http2.SettingMaxFrameSize:
+			c.maxFrameSize = s.Val
+		case http2.SettingMaxConcurrentStreams:
+			c.maxStreams = s.Val
+		case http2.SettingInitialWindowSize:
+			// 已经打开的 stream 的窗口一起调整
+			delta := int32(s.Val) - c.initWindow
+			for _, stream := range c.streams {
+				stream.window += delta
+			}
+			c.initWindow = int32(s.Val)
+		}
+		return nil
+	})
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return c.write(func() error {
+		if v, ok := f.Value(http2.SettingHeaderTableSize); ok {
+			c.enc.SetMaxDynamicTableSizeLimit(v)
+		}
+		return c.fw.WriteSettingsAck()
+	})
+}
+
+// handleGoAway 服务端没有处理的 stream 在新连接上重试, 其他的继续等待响应
+func (c *h2Conn) handleGoAway(f *http2.GoAwayFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.goAway = true
+	for id, stream := range c.streams {
+		if id > f.LastStreamID {
+			c.finish(stream, fmt.Errorf("http2 goaway %v: %w", f.ErrCode, errRefused))
+		}
+	}
+	if len(c.streams) == 0 && c.err == nil {
+		c.err = errConnClosed
+		c.conn.Close()
+	}
+}
+
+func (c *h2Conn) handleWindowUpdate(f *http2.WindowUpdateFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f.StreamID == 0 {
+		c.window += int32(f.Increment)
+	} else if stream, ok := c.streams[f.StreamID]; ok {
+		stream.window += int32(f.Increment)
+	}
+	c.cond.Broadcast()
+}
+
+// handleData 保存响应数据, 马上归还窗口
+func (c *h2Conn) handleData(f *http2.DataFrame) error {
+	data := f.Data()
+	c.deliver(f.StreamID, f.StreamEnded(), func(s *h2Stream) error {
+		return s.fw.WriteData(s.origID, f.StreamEnded(), data)
+	})
+
+	if f.Length == 0 {
+		return nil
+	}
+
+	return c.write(func() error {
+		if err := c.fw.WriteWindowUpdate(0, f.Length); err != nil {
+			return err
+		}
+		if f.StreamEnded() {
+			return nil
+		}
+		return c.fw.WriteWindowUpdate(f.StreamID, f.Length)
+	})
+}
+
+// deliver 把 frame 写入 stream 的响应, end 时结束 stream. 已经取消的 stream 的 frame 被丢弃
+func (c *h2Conn) deliver(id uint32, end bool, write func(s *h2Stream) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stream, ok := c.streams[id]
+	if !ok {
+		return
+	}
+
+	if err := write(stream); err != nil || end {
+		c.finish(stream, err)
+	}
+}
+
+// writeResponseHeaders 用 stream 自己的 encoder 编码响应的 headers
+func writeResponseHeaders(s *h2Stream, fields []hpack.HeaderField, endStream bool) error {
+	s.hbuf.Reset()
+	for _, hf := range fields {
+		if err := s.enc.WriteField(hf); err != nil {
+			return err
+		}
+	}
+
+	return s.fw.WriteHeaders(http2.HeadersFrameParam{StreamID: s.origID, BlockFragment: s.hbuf.Bytes(),
+		EndStream: endStream, EndHeaders: true})
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"goreplay/framer"
+)
+
+// TestUnitGRPCClient grpc client unit test execute
+func TestUnitGRPCClient(t *testing.T) {
+	suite.Run(t, new(grpcClientSuite))
+}
+
+type grpcClientSuite struct {
+	suite.Suite
+}
+
+// echoHandler 返回请求的 body, 用 trailer 返回 grpc-status
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get(framer.LogReplayTraceID) != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("content-type", "application/grpc")
+	w.Header().Set("Trailer", "grpc-status")
+	_, _ = w.Write(body)
+	w.Header().Set("grpc-status", "0")
+}
+
+// serveH2C h2c 服务端
+func (s *grpcClientSuite) serveH2C(server *http2.Server, handler http.Handler) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	s.T().Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// grpcRequest 录制的请求: 独立编码的 headers, 带 logreplay 加上的 trace id, 和一个 data frame
+func grpcRequest(streamID uint32, body []byte) []byte {
+	var hbuf, buf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	for _, hf := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/helloworld.Greeter/SayHello"},
+		{Name: ":authority", Value: "localhost"},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: framer.LogReplayTraceID, Value: "1"},
+	} {
+		_ = enc.WriteField(hf)
+	}
+
+	fw := http2.NewFramer(&buf, nil)
+	_ = fw.WriteHeaders(http2.HeadersFrameParam{StreamID: streamID, BlockFragment: hbuf.Bytes(), EndHeaders: true})
+	_ = fw.WriteData(streamID, true, body)
+
+	return buf.Bytes()
+}
+
+// grpcResponse 解码响应, 返回 headers, body 和所有 frame 的 stream id
+func grpcResponse(data []byte) (map[string]string, []byte, map[uint32]bool) {
+	headers := make(map[string]string)
+	var body []byte
+	ids := make(map[uint32]bool)
+
+	fr := framer.NewHTTP2Framer(data, "", true)
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			break
+		}
+		ids[frame.Header().StreamID] = true
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			for _, hf := range f.Fields {
+				headers[hf.Name] = hf.Value
+			}
+		case *http2.DataFrame:
+			body = append(body, f.Data()...)
+		}
+	}
+
+	return headers, body, ids
+}
+
+func (s *grpcClientSuite) TestRoundTrip() {
+	h2c := s.serveH2C(&http2.Server{MaxConcurrentStreams: 2}, http.HandlerFunc(echoHandler))
+
+	tls := httptest.NewUnstartedServer(http.HandlerFunc(echoHandler))
+	tls.EnableHTTP2 = true
+	tls.StartTLS()
+	defer tls.Close()
+
+	for _, tt := range []struct {
+		name   string
+		addr   string
+		config GRPCClientConfig
+	}{
+		{name: "h2c", addr: h2c},
+		{name: "h2", addr: tls.Listener.Addr().String(), config: GRPCClientConfig{Secure: true, SkipVerify: true}},
+	} {
+		s.Run(tt.name, func() {
+			c := NewGRPCClient(tt.addr, &tt.config)
+			defer c.Disconnect()
+
+			// 录制的 stream id 都是 1, 并发数超过服务端的 MaxConcurrentStreams, 最后一个超过流控窗口
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				body := []byte(fmt.Sprintf("request %d", i))
+				if i == 7 {
+					body = bytes.Repeat(body, 20000)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := c.RoundTrip(grpcRequest(1, body))
+					s.NoError(err)
+
+					headers, got, ids := grpcResponse(resp)
+					s.Equal("200", headers[":status"])
+					s.Equal("0", headers["grpc-status"])
+					s.Equal(body, got)
+					s.Equal(map[uint32]bool{1: true}, ids)
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func (s *grpcClientSuite) TestRoundTripError() {
+	slow := s.serveH2C(&http2.Server{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "hi" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		_, _ = w.Write(body)
+	}))
+
+	for _, tt := range []struct {
+		name   string
+		addr   string
+		data   []byte
+		wantOp string
+	}{
+		{name: "no headers", addr: slow, data: []byte("PING")},
+		{name: "timeout", addr: slow, data: grpcRequest(3, nil), wantOp: OpRead},
+		{name: "dial", addr: "127.0.0.1:1", data: grpcRequest(3, nil), wantOp: OpDial},
+	} {
+		s.Run(tt.name, func() {
+			c := NewGRPCClient(tt.addr, &GRPCClientConfig{Timeout: 100 * time.Millisecond})
+			defer c.Disconnect()
+
+			_, err := c.RoundTrip(tt.data)
+			s.Error(err)
+			var opErr *OpError
+			if tt.wantOp == "" {
+				s.False(errors.As(err, &opErr))
+				return
+			}
+			s.Require().True(errors.As(err, &opErr))
+			s.Equal(tt.wantOp, opErr.Op)
+		})
+	}
+
+	// 超时取消的 stream 不影响连接上之后的请求
+	c := NewGRPCClient(slow, &GRPCClientConfig{Timeout: 100 * time.Millisecond})
+	defer c.Disconnect()
+	_, err := c.RoundTrip(grpcRequest(1, nil))
+	s.Error(err)
+	resp, err := c.RoundTrip(grpcRequest(1, []byte("hi")))
+	s.NoError(err)
+	_, body, _ := grpcResponse(resp)
+	s.Equal([]byte("hi"), body)
+}
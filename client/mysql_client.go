@@ -0,0 +1,484 @@
+package client
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"goreplay/framer"
+	"goreplay/logger"
+)
+
+// mysql auth plugins and their messages
+const (
+	mysqlNativePassword      = "mysql_native_password"
+	mysqlCachingSHA2Password = "caching_sha2_password"
+	mysqlAuthMoreData        = 0x01
+	mysqlRequestPublicKey    = 0x02
+	mysqlFastAuthSuccess     = 0x03
+	mysqlPerformFullAuth     = 0x04
+	mysqlScrambleLen         = 20
+	mysqlCharsetUTF8MB4      = 45
+	mysqlHandshakeFillerLen  = 23
+)
+
+// mysqlClientCapabilities capabilities asked for, DEPRECATE_EOF is left out so that result sets
+// always end the same way
+const mysqlClientCapabilities = framer.MySQLClientLongPassword | framer.MySQLClientLongFlag |
+	framer.MySQLClientProtocol41 | framer.MySQLClientTransactions | framer.MySQLClientSecureConnection |
+	framer.MySQLClientMultiResults | framer.MySQLClientPSMultiResults | framer.MySQLClientPluginAuth
+
+// MySQLClientConfig mysql client configuration
+type MySQLClientConfig struct {
+	User     string
+	Password string
+	Database string
+	Timeout  time.Duration
+}
+
+// MySQLClient replays mysql commands on a connection logged in with its own account, the auth
+// data of captured connections only answers the challenge of the recorded server
+type MySQLClient struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    byte
+	stmts  map[string]uint32 // statement id of the sql prepared on the connection
+	config *MySQLClientConfig
+}
+
+// NewMySQLClient returns new MySQLClient
+func NewMySQLClient(addr string, config *MySQLClientConfig) *MySQLClient {
+	if config.Timeout.Nanoseconds() == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	return &MySQLClient{addr: addr, config: config}
+}
+
+// Connect creates a mysql connection of the client and logs in
+func (c *MySQLClient) Connect() error {
+	c.Disconnect()
+
+	conn, err := net.DialTimeout("tcp", c.addr, c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.stmts = make(map[string]uint32)
+
+	_ = c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	if err = c.handshake(); err != nil {
+		c.Disconnect()
+		return err
+	}
+
+	return nil
+}
+
+// Disconnect closes the client connection
+func (c *MySQLClient) Disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+		logger.Debug("[MySQLClient] Disconnected: ", c.addr)
+	}
+}
+
+// Command sends a command payload, the command byte followed by its arguments, and reads its
+// response back. Errors are returned as *OpError.
+func (c *MySQLClient) Command(payload []byte) ([]byte, error) {
+	if err := c.doConnect(); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.command(payload)
+	if err != nil {
+		c.Disconnect()
+		return nil, err
+	}
+
+	if payload[0] == framer.MySQLComStmtPrepare {
+		c.prepared(string(payload[1:]), resp)
+	}
+
+	return resp, nil
+}
+
+// Execute replays the COM_STMT_EXECUTE payload of a statement whose sql is known. The
+// statement is prepared on the connection first if needed, its id replaces the captured one.
+func (c *MySQLClient) Execute(sql string, payload []byte) ([]byte, error) {
+	if err := c.doConnect(); err != nil {
+		return nil, err
+	}
+
+	id, ok := c.stmts[sql]
+	if !ok {
+		resp, err := c.command(append([]byte{framer.MySQLComStmtPrepare}, sql...))
+		if err != nil {
+			c.Disconnect()
+			return nil, err
+		}
+
+		// the error of the prepare is what the execute gets
+		if id, ok = c.prepared(sql, resp); !ok {
+			return resp, nil
+		}
+	}
+
+	cmd := append([]byte{}, payload...)
+	binary.LittleEndian.PutUint32(cmd[1:], id)
+
+	resp, err := c.command(cmd)
+	if err != nil {
+		c.Disconnect()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (c *MySQLClient) doConnect() error {
+	if c.conn == nil {
+		if err := c.Connect(); err != nil {
+			logger.Debug("[MySQLClient] Connection error:", err)
+			return &OpError{Op: OpDial, Err: err}
+		}
+	}
+
+	// the whole round trip has to finish within timeout
+	_ = c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+
+	return nil
+}
+
+// prepared remembers the statement id of a successful COM_STMT_PREPARE response
+func (c *MySQLClient) prepared(sql string, resp []byte) (uint32, bool) {
+	p, err := framer.ReadMySQLPacket(resp)
+	if err != nil || len(p.Payload) < 5 || p.Payload[0] != framer.MySQLOK {
+		return 0, false
+	}
+
+	id := binary.LittleEndian.Uint32(p.Payload[1:])
+	c.stmts[sql] = id
+
+	return id, true
+}
+
+func (c *MySQLClient) command(payload []byte) ([]byte, error) {
+	c.seq = 0
+	if err := c.writePacket(payload); err != nil {
+		return nil, &OpError{Op: OpWrite, Err: err}
+	}
+
+	if !framer.MySQLHasResponse(payload[0]) {
+		return nil, nil
+	}
+
+	resp, err := c.readResponse(payload[0])
+	if err != nil {
+		return nil, &OpError{Op: OpRead, Err: err}
+	}
+
+	return resp, nil
+}
+
+func (c *MySQLClient) readResponse(cmd byte) ([]byte, error) {
+	r := framer.NewMySQLResponse(cmd, false)
+
+	var resp []byte
+	for {
+		payload, raw, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		first := len(resp) == 0
+		resp = append(resp, raw...)
+
+		done, err := r.Next(payload)
+		if err != nil {
+			return nil, err
+		}
+		if !done {
+			continue
+		}
+
+		if !first || payload[0] != framer.MySQLLocalInfile {
+			return resp, nil
+		}
+
+		// LOCAL INFILE request, there is no file to send, an empty packet says so
+		if err = c.writePacket(nil); err != nil {
+			return nil, err
+		}
+		if _, raw, err = c.readPacket(); err != nil {
+			return nil, err
+		}
+
+		return append(resp, raw...), nil
+	}
+}
+
+// readPacket reads a logical packet, returning its payload and its bytes on the wire
+func (c *MySQLClient) readPacket() (payload, raw []byte, err error) {
+	header := make([]byte, framer.MySQLHeaderLen)
+	for {
+		if _, err = io.ReadFull(c.reader, header); err != nil {
+			return nil, nil, err
+		}
+
+		n := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+		buf := make([]byte, n)
+		if _, err = io.ReadFull(c.reader, buf); err != nil {
+			return nil, nil, err
+		}
+
+		c.seq = header[3] + 1
+		payload = append(payload, buf...)
+		raw = append(append(raw, header...), buf...)
+
+		if n < framer.MySQLMaxPacketLen {
+			return payload, raw, nil
+		}
+	}
+}
+
+// writePacket writes payload, split into packets of MySQLMaxPacketLen bytes at most
+func (c *MySQLClient) writePacket(payload []byte) error {
+	var buf []byte
+	for {
+		n := len(payload)
+		if n > framer.MySQLMaxPacketLen {
+			n = framer.MySQLMaxPacketLen
+		}
+
+		buf = append(buf, byte(n), byte(n>>8), byte(n>>16), c.seq)
+		buf = append(buf, payload[:n]...)
+		c.seq++
+		payload = payload[n:]
+
+		if n < framer.MySQLMaxPacketLen {
+			break
+		}
+	}
+
+	_, err := c.conn.Write(buf)
+
+	return err
+}
+
+func (c *MySQLClient) handshake() error {
+	payload, _, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > 0 && payload[0] == framer.MySQLErr {
+		return mysqlError(payload)
+	}
+
+	greeting, err := framer.ParseMySQLGreeting(payload)
+	if err != nil {
+		return err
+	}
+
+	plugin := greeting.AuthPlugin
+	if plugin == "" {
+		plugin = mysqlNativePassword
+	}
+
+	auth, err := mysqlAuth(plugin, c.config.Password, greeting.AuthData)
+	if err != nil {
+		return err
+	}
+
+	if err = c.writePacket(c.handshakeResponse(greeting.Capabilities, plugin, auth)); err != nil {
+		return err
+	}
+
+	return c.authResult(plugin, greeting.AuthData)
+}
+
+// handshakeResponse the HandshakeResponse41 payload
+func (c *MySQLClient) handshakeResponse(serverCaps uint32, plugin string, auth []byte) []byte {
+	caps := mysqlClientCapabilities
+	if c.config.Database != "" {
+		caps |= framer.MySQLClientConnectWithDB
+	}
+	caps &= serverCaps | framer.MySQLClientProtocol41
+
+	buf := make([]byte, 9+mysqlHandshakeFillerLen)
+	binary.LittleEndian.PutUint32(buf, caps)
+	binary.LittleEndian.PutUint32(buf[4:], framer.MySQLMaxPacketLen)
+	buf[8] = mysqlCharsetUTF8MB4
+
+	buf = append(append(buf, c.config.User...), 0)
+	// auth data is shorter than 251 bytes, its length reads the same length encoded or not
+	buf = append(append(buf, byte(len(auth))), auth...)
+	if caps&framer.MySQLClientConnectWithDB != 0 {
+		buf = append(append(buf, c.config.Database...), 0)
+	}
+	if caps&framer.MySQLClientPluginAuth != 0 {
+		buf = append(append(buf, plugin...), 0)
+	}
+
+	return buf
+}
+
+// authResult follows the server until it accepts or refuses the login
+func (c *MySQLClient) authResult(plugin string, scramble []byte) error {
+	for {
+		payload, _, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+
+		if len(payload) == 0 {
+			return framer.ErrMySQLInvalid
+		}
+
+		switch payload[0] {
+		case framer.MySQLOK:
+			return nil
+		case framer.MySQLErr:
+			return mysqlError(payload)
+		case framer.MySQLEOF:
+			// auth switch request: plugin name, then its auth data
+			plugin, scramble = mysqlAuthSwitch(payload[1:])
+			auth, err := mysqlAuth(plugin, c.config.Password, scramble)
+			if err != nil {
+				return err
+			}
+			if err = c.writePacket(auth); err != nil {
+				return err
+			}
+		case mysqlAuthMoreData:
+			if err = c.authMoreData(plugin, scramble, payload[1:]); err != nil {
+				return err
+			}
+		default:
+			return framer.ErrMySQLInvalid
+		}
+	}
+}
+
+// authMoreData caching_sha2_password asks for the full auth when the password isn't cached,
+// without TLS the password is sent encrypted with the public key of the server
+func (c *MySQLClient) authMoreData(plugin string, scramble, data []byte) error {
+	if plugin != mysqlCachingSHA2Password || len(data) == 0 {
+		return framer.ErrMySQLInvalid
+	}
+
+	switch data[0] {
+	case mysqlFastAuthSuccess:
+		// OK follows
+		return nil
+	case mysqlPerformFullAuth:
+		return c.writePacket([]byte{mysqlRequestPublicKey})
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return framer.ErrMySQLInvalid
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return framer.ErrMySQLInvalid
+	}
+
+	password := append([]byte(c.config.Password), 0)
+	for i := range password {
+		password[i] ^= scramble[i%len(scramble)]
+	}
+
+	enc, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, password, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.writePacket(enc)
+}
+
+// mysqlAuthSwitch plugin and auth data of an auth switch request
+func mysqlAuthSwitch(data []byte) (string, []byte) {
+	for i, b := range data {
+		if b == 0 {
+			return string(data[:i]), mysqlTrimScramble(data[i+1:])
+		}
+	}
+
+	return string(data), nil
+}
+
+// mysqlTrimScramble the scramble is sent NUL terminated
+func mysqlTrimScramble(scramble []byte) []byte {
+	if len(scramble) > mysqlScrambleLen {
+		return scramble[:mysqlScrambleLen]
+	}
+
+	return scramble
+}
+
+// mysqlAuth auth data answering the scramble of the server
+func mysqlAuth(plugin, password string, scramble []byte) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+
+	scramble = mysqlTrimScramble(scramble)
+	switch plugin {
+	case mysqlNativePassword:
+		// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		h1 := sha1.Sum([]byte(password))
+		h2 := sha1.Sum(h1[:])
+		h3 := sha1.Sum(append(append([]byte{}, scramble...), h2[:]...))
+		for i := range h1 {
+			h1[i] ^= h3[i]
+		}
+		return h1[:], nil
+	case mysqlCachingSHA2Password:
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		h1 := sha256.Sum256([]byte(password))
+		h2 := sha256.Sum256(h1[:])
+		h3 := sha256.Sum256(append(h2[:], scramble...))
+		for i := range h1 {
+			h1[i] ^= h3[i]
+		}
+		return h1[:], nil
+	}
+
+	return nil, fmt.Errorf("mysql: unsupported auth plugin %s", plugin)
+}
+
+// mysqlError error of an ERR packet: code, sql state marker and state, message
+func mysqlError(payload []byte) error {
+	if len(payload) < 3 {
+		return framer.ErrMySQLInvalid
+	}
+
+	code := binary.LittleEndian.Uint16(payload[1:])
+	msg := payload[3:]
+	if len(msg) > 6 && msg[0] == '#' {
+		msg = msg[6:]
+	}
+
+	return fmt.Errorf("mysql: error %d: %s", code, msg)
+}
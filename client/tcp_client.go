@@ -1,7 +1,9 @@
 package client
 
 import (
+	"bufio"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
 	"syscall"
@@ -15,6 +17,33 @@ const (
 	maxResponseSize = 1073741824
 )
 
+// operations a TCPClient round trip can fail at, see OpError
+const (
+	OpDial  = "dial"
+	OpWrite = "write"
+	OpRead  = "read"
+)
+
+// OpError records which step of a TCPClient round trip failed
+type OpError struct {
+	Op  string
+	Err error
+}
+
+// Error implements error
+func (e *OpError) Error() string {
+	return fmt.Sprintf("tcp client %s: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// ResponseReader reads exactly one response from r, w can be used to answer
+// protocol control messages (e.g. http2 SETTINGS) while waiting for it
+type ResponseReader func(r *bufio.Reader, w io.Writer) ([]byte, error)
+
 // TCPClientConfig client configuration
 type TCPClientConfig struct {
 	Debug              bool
@@ -29,6 +58,7 @@ type TCPClient struct {
 	baseURL string
 	addr    string
 	conn    net.Conn
+	reader  *bufio.Reader
 	respBuf []byte
 	config  *TCPClientConfig
 }
@@ -75,6 +105,7 @@ func (c *TCPClient) Disconnect() {
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
+		c.reader = nil
 		logger.Debug("[TCPClient] Disconnected: ", c.baseURL)
 	}
 }
@@ -199,3 +230,32 @@ func (c *TCPClient) Send(data []byte) (response []byte, err error) {
 
 	return payload, err
 }
+
+// RoundTrip sends data and reads one response back using read. Unlike Send it
+// doesn't half-close the connection, so it can be kept alive for the next call.
+// Errors are returned as *OpError.
+func (c *TCPClient) RoundTrip(data []byte, read ResponseReader) ([]byte, error) {
+	if err := c.doConnect(); err != nil {
+		return nil, &OpError{Op: OpDial, Err: err}
+	}
+
+	// the whole round trip has to finish within timeout
+	_ = c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+
+	if _, err := c.conn.Write(data); err != nil {
+		c.Disconnect()
+		return nil, &OpError{Op: OpWrite, Err: err}
+	}
+
+	if c.reader == nil {
+		c.reader = bufio.NewReaderSize(c.conn, c.config.ResponseBufferSize)
+	}
+
+	response, err := read(c.reader, c.conn)
+	if err != nil {
+		c.Disconnect()
+		return nil, &OpError{Op: OpRead, Err: err}
+	}
+
+	return response, nil
+}
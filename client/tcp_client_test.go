@@ -1,6 +1,7 @@
 package client
 
 import (
+	"bufio"
 	"errors"
 	"io"
 	"net"
@@ -261,3 +262,75 @@ func (s *clientSuite) TestSend() {
 		})
 	}
 }
+
+func (s *clientSuite) TestRoundTrip() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer ln.Close()
+
+	// echo every line back, keeping the connection open
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+
+	readLine := func(r *bufio.Reader, _ io.Writer) ([]byte, error) {
+		return r.ReadBytes('\n')
+	}
+
+	tests := []struct {
+		name    string
+		addr    string
+		data    string
+		wantOp  string
+		wantRsp string
+	}{
+		{
+			name:    "success",
+			addr:    ln.Addr().String(),
+			data:    "ping\n",
+			wantRsp: "ping\n",
+		},
+		{
+			name:   "read timeout",
+			addr:   ln.Addr().String(),
+			data:   "no line end",
+			wantOp: OpRead,
+		},
+		{
+			name:   "dial error",
+			addr:   "127.0.0.1:1",
+			data:   "ping\n",
+			wantOp: OpDial,
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			client := NewTCPClient(tt.addr, &TCPClientConfig{Timeout: 200 * time.Millisecond})
+			defer client.Disconnect()
+
+			// second call checks that the connection is reused
+			for i := 0; i < 2; i++ {
+				rsp, err := client.RoundTrip([]byte(tt.data), readLine)
+				if tt.wantOp != "" {
+					opErr := &OpError{}
+					s.True(errors.As(err, &opErr))
+					s.Equal(tt.wantOp, opErr.Op)
+					return
+				}
+
+				s.NoError(err)
+				s.Equal(tt.wantRsp, string(rsp))
+			}
+		})
+	}
+}
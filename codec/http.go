@@ -8,8 +8,11 @@ import (
 	"strings"
 )
 
+// HTTPName "http"常量，暴露出去供其他包使用
+const HTTPName = "http"
+
 func init() {
-	RegisterHeaderCodec("http", &httpHeaderCodecBuilder{})
+	RegisterHeaderCodec(HTTPName, &httpHeaderCodecBuilder{})
 }
 
 type httpHeaderCodecBuilder struct {
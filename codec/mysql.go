@@ -0,0 +1,64 @@
+package codec
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"goreplay/framer"
+)
+
+// MySQLName "mysql"常量，暴露出去供其他包使用
+const MySQLName = "mysql"
+
+func init() {
+	RegisterHeaderCodec(MySQLName, &mysqlHeaderCodecBuilder{})
+}
+
+type mysqlHeaderCodecBuilder struct {
+}
+
+// New 实例化解码器
+func (builder *mysqlHeaderCodecBuilder) New() HeaderCodec {
+	return &mysqlHeaderCodec{}
+}
+
+// mysqlHeaderCodec mysql请求头解析, 语句类型和表名作为接口名, 非语句命令取命令名
+type mysqlHeaderCodec struct {
+}
+
+// Decode 请求解码
+func (m *mysqlHeaderCodec) Decode(payload []byte, connectionID string) (ProtocolHeader, error) {
+	cmd, args, err := framer.MySQLCommand(payload)
+	if err != nil {
+		return ProtocolHeader{}, fmt.Errorf("mysqlHeaderCodec err: %v %s", err, hex.EncodeToString(payload))
+	}
+
+	sql, ok := framer.MySQLCommandSQL(cmd, args, connectionID)
+	if !ok {
+		name := framer.MySQLCommandName(cmd)
+		return ProtocolHeader{
+			ServiceName:   unknown,
+			APIName:       name,
+			MethodName:    name,
+			InterfaceName: unknown,
+		}, nil
+	}
+
+	st := framer.ParseSQL(sql)
+	if st.Type == "" {
+		st.Type = framer.MySQLCommandName(cmd)
+	}
+
+	header := ProtocolHeader{
+		ServiceName:   unknown,
+		APIName:       st.Type,
+		MethodName:    st.Type,
+		InterfaceName: unknown,
+	}
+	if st.Table != "" {
+		header.APIName = st.Type + " " + st.Table
+		header.InterfaceName = st.Table
+	}
+
+	return header, nil
+}
@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/framer"
+)
+
+// TestUnitMySQLCodec MySQLCodec test execute
+func TestUnitMySQLCodec(t *testing.T) {
+	suite.Run(t, new(TestUnitMySQLCodecSuite))
+}
+
+// TestUnitMySQLCodecSuite MySQLCodec test suite
+type TestUnitMySQLCodecSuite struct {
+	suite.Suite
+
+	codec HeaderCodec
+}
+
+// SetupTest which will run before each test in the suite.
+func (t *TestUnitMySQLCodecSuite) SetupTest() {
+	t.codec = GetHeaderCodec(MySQLName)
+}
+
+func mysqlCommand(payload string) []byte {
+	n := len(payload)
+	return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), 0}, payload...)
+}
+
+// TestMySQLHeaderCodecDecode test mysqlHeaderCodec Decode Method
+func (t *TestUnitMySQLCodecSuite) TestMySQLHeaderCodecDecode() {
+	framer.PutMySQLStatement("conn", 1, "UPDATE users SET name = ? WHERE id = ?")
+
+	tests := []struct {
+		name          string
+		reqBuf        []byte
+		wantAPI       string
+		wantMethod    string
+		wantInterface string
+		wantErr       bool
+	}{
+		{name: "query", reqBuf: mysqlCommand("\x03SELECT * FROM users WHERE id = 1"),
+			wantAPI: "SELECT users", wantMethod: "SELECT", wantInterface: "users"},
+		{name: "query without table", reqBuf: mysqlCommand("\x03SELECT 1"),
+			wantAPI: "SELECT", wantMethod: "SELECT", wantInterface: unknown},
+		{name: "prepare", reqBuf: mysqlCommand("\x16INSERT INTO orders VALUES (?)"),
+			wantAPI: "INSERT orders", wantMethod: "INSERT", wantInterface: "orders"},
+		{name: "execute", reqBuf: mysqlCommand("\x17\x01\x00\x00\x00\x00\x01\x00\x00\x00"),
+			wantAPI: "UPDATE users", wantMethod: "UPDATE", wantInterface: "users"},
+		{name: "execute of an unknown statement", reqBuf: mysqlCommand("\x17\x02\x00\x00\x00\x00\x01\x00\x00\x00"),
+			wantAPI: "COM_STMT_EXECUTE", wantMethod: "COM_STMT_EXECUTE", wantInterface: unknown},
+		{name: "ping", reqBuf: mysqlCommand("\x0e"),
+			wantAPI: "COM_PING", wantMethod: "COM_PING", wantInterface: unknown},
+		{name: "not a command", reqBuf: []byte("\x07\x00\x00\x02\x00\x00\x00\x02\x00\x00\x00"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			got, err := t.codec.Decode(tt.reqBuf, "conn")
+			if tt.wantErr {
+				t.Error(err)
+				return
+			}
+
+			t.NoError(err)
+			t.Equal(ProtocolHeader{
+				ServiceName:   unknown,
+				APIName:       tt.wantAPI,
+				MethodName:    tt.wantMethod,
+				InterfaceName: tt.wantInterface,
+			}, got)
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package codec
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"goreplay/framer"
+)
+
+// RedisName "redis"常量，暴露出去供其他包使用
+const RedisName = "redis"
+
+func init() {
+	RegisterHeaderCodec(RedisName, &redisHeaderCodecBuilder{})
+}
+
+type redisHeaderCodecBuilder struct {
+}
+
+// New 实例化解码器
+func (builder *redisHeaderCodecBuilder) New() HeaderCodec {
+	return &redisHeaderCodec{}
+}
+
+// redisHeaderCodec redis请求头解析, 命令名作为接口名
+type redisHeaderCodec struct {
+}
+
+// Decode 请求解码
+func (r *redisHeaderCodec) Decode(payload []byte, _ string) (ProtocolHeader, error) {
+	cmd, err := framer.RESPCommand(payload)
+	if err != nil {
+		return ProtocolHeader{}, fmt.Errorf("redisHeaderCodec err: %v %s", err, hex.EncodeToString(payload))
+	}
+
+	return ProtocolHeader{
+		ServiceName:   unknown,
+		APIName:       cmd,
+		MethodName:    cmd,
+		InterfaceName: unknown,
+	}, nil
+}
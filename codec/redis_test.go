@@ -0,0 +1,56 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitRedisCodec RedisCodec test execute
+func TestUnitRedisCodec(t *testing.T) {
+	suite.Run(t, new(TestUnitRedisCodecSuite))
+}
+
+// TestUnitRedisCodecSuite RedisCodec test suite
+type TestUnitRedisCodecSuite struct {
+	suite.Suite
+
+	codec HeaderCodec
+}
+
+// SetupTest which will run before each test in the suite.
+func (t *TestUnitRedisCodecSuite) SetupTest() {
+	t.codec = GetHeaderCodec(RedisName)
+}
+
+// TestRedisHeaderCodecDecode test redisHeaderCodec Decode Method
+func (t *TestUnitRedisCodecSuite) TestRedisHeaderCodecDecode() {
+	tests := []struct {
+		name    string
+		reqBuf  string
+		want    string
+		wantErr bool
+	}{
+		{name: "command", reqBuf: "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n", want: "SET"},
+		{name: "inline command", reqBuf: "PING\r\n", want: "PING"},
+		{name: "invalid redis buff", reqBuf: "+OK\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			got, err := t.codec.Decode([]byte(tt.reqBuf), "")
+			if tt.wantErr {
+				t.Error(err)
+				return
+			}
+
+			t.NoError(err)
+			t.Equal(ProtocolHeader{
+				ServiceName:   unknown,
+				APIName:       tt.want,
+				MethodName:    tt.want,
+				InterfaceName: unknown,
+			}, got)
+		})
+	}
+}
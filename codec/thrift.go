@@ -0,0 +1,58 @@
+package codec
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"goreplay/framer"
+)
+
+// ThriftName "thrift"常量，暴露出去供其他包使用
+const ThriftName = "thrift"
+
+// thriftMultiplexedSeparator TMultiplexedProtocol 用来拼接服务名与方法名的分隔符
+const thriftMultiplexedSeparator = ":"
+
+func init() {
+	RegisterHeaderCodec(ThriftName, &thriftHeaderCodecBuilder{})
+}
+
+type thriftHeaderCodecBuilder struct {
+}
+
+// New 实例化解码器
+func (builder *thriftHeaderCodecBuilder) New() HeaderCodec {
+	return &thriftHeaderCodec{}
+}
+
+// thriftHeaderCodec thrift请求头解析
+type thriftHeaderCodec struct {
+}
+
+// Decode 请求解码
+func (t *thriftHeaderCodec) Decode(payload []byte, _ string) (ProtocolHeader, error) {
+	h, err := framer.ParseThriftHeader(payload)
+	if err != nil {
+		return ProtocolHeader{}, fmt.Errorf("thriftHeaderCodec err: %v %s", err, hex.EncodeToString(payload))
+	}
+
+	service, method := parseThriftName(h.Name)
+
+	return ProtocolHeader{
+		ServiceName:   service,
+		APIName:       method,
+		MethodName:    method,
+		InterfaceName: service,
+	}, nil
+}
+
+// parseThriftName 非 multiplexed 的调用里没有服务名
+func parseThriftName(name string) (service, method string) {
+	pos := strings.Index(name, thriftMultiplexedSeparator)
+	if pos == -1 {
+		return unknown, name
+	}
+
+	return name[:pos], name[pos+1:]
+}
@@ -0,0 +1,76 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitThriftCodec ThriftCodec test execute
+func TestUnitThriftCodec(t *testing.T) {
+	suite.Run(t, new(TestUnitThriftCodecSuite))
+}
+
+// TestUnitThriftCodecSuite ThriftCodec test suite
+type TestUnitThriftCodecSuite struct {
+	suite.Suite
+
+	codec HeaderCodec
+}
+
+// SetupTest which will run before each test in the suite.
+func (t *TestUnitThriftCodecSuite) SetupTest() {
+	t.codec = GetHeaderCodec(ThriftName)
+}
+
+// TestThriftHeaderCodecDecode test thriftHeaderCodec Decode Method
+func (t *TestUnitThriftCodecSuite) TestThriftHeaderCodecDecode() {
+	tests := []struct {
+		name    string
+		reqBuf  []byte
+		want    ProtocolHeader
+		wantErr bool
+	}{
+		{
+			name: "binary multiplexed",
+			// framed, strict binary, call "Calculator:add" seqid 1
+			reqBuf: []byte{0, 0, 0, 27, 0x80, 0x01, 0, 0x01, 0, 0, 0, 14,
+				'C', 'a', 'l', 'c', 'u', 'l', 'a', 't', 'o', 'r', ':', 'a', 'd', 'd', 0, 0, 0, 1, 0},
+			want: ProtocolHeader{
+				ServiceName:   "Calculator",
+				APIName:       "add",
+				MethodName:    "add",
+				InterfaceName: "Calculator",
+			},
+		},
+		{
+			name: "compact",
+			// buffered, compact, call "ping" seqid 5
+			reqBuf: []byte{0x82, 0x21, 0x05, 0x04, 'p', 'i', 'n', 'g', 0},
+			want: ProtocolHeader{
+				ServiceName:   unknown,
+				APIName:       "ping",
+				MethodName:    "ping",
+				InterfaceName: unknown,
+			},
+		},
+		{
+			name:    "invalid thrift buff",
+			reqBuf:  []byte("GET / HTTP/1.1\r\n\r\n"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			got, err := t.codec.Decode(tt.reqBuf, "")
+			if tt.wantErr {
+				t.Error(err)
+				return
+			}
+
+			t.NoError(err)
+			t.Equal(tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LoadFile 从 yaml 或 json 文件读取配置到 Settings, 命令行中设置的 flag 优先.
+// key 为 flag 名, 或者 AppSettings 字段的 json tag 或字段名, 嵌套的配置写成对象, 多个取值写成数组
+func LoadFile(path string) error {
+	return loadFile(flag.CommandLine, &Settings, path)
+}
+
+// fileLoader 通过 flag 设置字段, 与命令行使用同样的解析
+type fileLoader struct {
+	fs      *flag.FlagSet
+	flags   map[uintptr][]string // 字段地址 -> 绑定的 flag
+	visited map[string]bool      // 命令行中设置过的 flag
+}
+
+func loadFile(fs *flag.FlagSet, settings interface{}, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values, err := decodeFile(path, data)
+	if err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+
+	l := &fileLoader{fs: fs, flags: make(map[uintptr][]string), visited: make(map[string]bool)}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v := reflect.ValueOf(f.Value); v.Kind() == reflect.Ptr {
+			l.flags[v.Pointer()] = append(l.flags[v.Pointer()], f.Name)
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		l.visited[f.Name] = true
+	})
+
+	if err = l.apply(reflect.ValueOf(settings).Elem(), values, "", true); err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// decodeFile .json 按 json 解析, 其他按 yaml 解析
+func decodeFile(path string, data []byte) (map[string]interface{}, error) {
+	var values map[string]interface{}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&values); err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+
+	var raw interface{}
+	if err := yaml.UnmarshalStrict(data, &raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return values, nil
+	}
+
+	m, ok := stringKeys(raw).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("want a mapping at the top level")
+	}
+
+	return m, nil
+}
+
+// stringKeys yaml 的 map key 转为 string
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = stringKeys(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stringKeys(item)
+		}
+	}
+
+	return v
+}
+
+// apply 按 key 的顺序设置, 保证出错信息稳定; 只有最外层可以直接使用 flag 名
+func (l *fileLoader) apply(v reflect.Value, values map[string]interface{}, prefix string, top bool) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := prefix + key
+		value := values[key]
+
+		if field, ok := fieldByKey(v, key); ok {
+			if err := l.applyField(field, value, path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if f := l.fs.Lookup(key); top && f != nil {
+			if err := l.set([]string{f.Name}, value, path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		return fmt.Errorf("unknown key %q", path)
+	}
+
+	return nil
+}
+
+func (l *fileLoader) applyField(field reflect.Value, value interface{}, path string) error {
+	// 结构体是一组配置, 比如 OutputLogReplayConfig, 它与第一个字段的地址相同, 不能按地址查找 flag
+	if _, isValue := field.Addr().Interface().(flag.Value); field.Kind() == reflect.Struct && !isValue {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want a mapping", path)
+		}
+		return l.apply(field, m, path+".", false)
+	}
+
+	names := l.flags[field.Addr().Pointer()]
+	if len(names) == 0 {
+		return fmt.Errorf("%s can't be set in the config file", path)
+	}
+
+	return l.set(names, value, path)
+}
+
+// set 命令行中已经设置的 flag 不覆盖, 数组的每个取值调用一次 Set
+func (l *fileLoader) set(names []string, value interface{}, path string) error {
+	for _, name := range names {
+		if l.visited[name] {
+			return nil
+		}
+	}
+
+	items, isList := value.([]interface{})
+	if !isList {
+		items = []interface{}{value}
+	} else if reflect.Indirect(reflect.ValueOf(l.fs.Lookup(names[0]).Value)).Kind() != reflect.Slice {
+		return fmt.Errorf("%s takes a single value", path)
+	}
+
+	for _, item := range items {
+		s, err := scalar(item)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err = l.fs.Set(names[0], s); err != nil {
+			return fmt.Errorf("%s %q: %v", path, s, err)
+		}
+	}
+
+	return nil
+}
+
+// fieldByKey 按 json tag 或字段名查找, 包括匿名嵌入的字段
+func fieldByKey(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if tag == key || sf.Name == key {
+			return v.Field(i), true
+		}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		if sf := t.Field(i); sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			if field, ok := fieldByKey(v.Field(i), key); ok {
+				return field, true
+			}
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+func scalar(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+
+	return "", fmt.Errorf("want a string, number or bool, got %T", v)
+}
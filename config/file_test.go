@@ -0,0 +1,128 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitConfigFile config file test execute
+func TestUnitConfigFile(t *testing.T) {
+	suite.Run(t, new(configFileSuite))
+}
+
+type configFileSuite struct {
+	suite.Suite
+}
+
+type fileTestEmbedded struct {
+	Expire time.Duration `json:"input-raw-expire"`
+}
+
+type fileTestSettings struct {
+	Verbose  int         `json:"verbose"`
+	InputRAW MultiOption `json:"input_raw"`
+	fileTestEmbedded
+	OutputLogReplayConfig LogReplayOutputConfig
+	ModifierConfig        HTTPModifierConfig
+	NoFlag                string `json:"no-flag"`
+}
+
+func (s *configFileSuite) load(name, content string, args ...string) (*fileTestSettings, error) {
+	settings := &fileTestSettings{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.IntVar(&settings.Verbose, "verbose", 0, "")
+	fs.Var(&settings.InputRAW, "input-raw", "")
+	fs.DurationVar(&settings.Expire, "input-raw-expire", 2*time.Second, "")
+	fs.StringVar(&settings.OutputLogReplayConfig.ModuleID, "output-logreplay-moduleid", "", "")
+	fs.IntVar(&settings.OutputLogReplayConfig.Workers, "output-logreplay-workers", 1, "")
+	// 第一个字段与 ModifierConfig 地址相同
+	fs.Var(&settings.ModifierConfig.URLNegativeRegexp, "http-disallow-url", "")
+	fs.Var(&settings.ModifierConfig.URLRegexp, "http-allow-url", "")
+	fs.Var(&settings.ModifierConfig.Headers, "http-set-header", "")
+	s.Require().NoError(fs.Parse(args))
+
+	path := filepath.Join(s.T().TempDir(), name)
+	s.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+
+	return settings, loadFile(fs, settings, path)
+}
+
+func (s *configFileSuite) TestLoad() {
+	yamlConfig := `
+verbose: 2
+input_raw: [":80", ":8080"]
+input-raw-expire: 5s
+OutputLogReplayConfig:
+  output-logreplay-moduleid: module
+  output-logreplay-workers: 4
+ModifierConfig:
+  http-allow-url: ["^/api"]
+  http-set-header:
+    - "User-Agent: Gor"
+`
+	jsonConfig := `{"verbose": 2, "input-raw": [":80", ":8080"], "input-raw-expire": "5s",
+		"OutputLogReplayConfig": {"output-logreplay-moduleid": "module", "output-logreplay-workers": 4},
+		"ModifierConfig": {"http-allow-url": ["^/api"], "http-set-header": ["User-Agent: Gor"]}}`
+
+	for _, tt := range []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "yaml", file: "gor.yaml", content: yamlConfig},
+		{name: "json", file: "gor.json", content: jsonConfig},
+	} {
+		s.Run(tt.name, func() {
+			settings, err := s.load(tt.file, tt.content)
+			s.Require().NoError(err)
+			s.Equal(2, settings.Verbose)
+			s.Equal(MultiOption{":80", ":8080"}, settings.InputRAW)
+			s.Equal(5*time.Second, settings.Expire)
+			s.Equal("module", settings.OutputLogReplayConfig.ModuleID)
+			s.Equal(4, settings.OutputLogReplayConfig.Workers)
+			s.Len(settings.ModifierConfig.URLRegexp, 1)
+			s.Len(settings.ModifierConfig.Headers, 1)
+		})
+	}
+}
+
+func (s *configFileSuite) TestFlagsTakePrecedence() {
+	settings, err := s.load("gor.yaml", "verbose: 2\ninput_raw: [':80']\noutput-logreplay-workers: 4\n",
+		"-verbose", "3", "-input-raw", ":9090")
+	s.Require().NoError(err)
+	s.Equal(3, settings.Verbose)
+	s.Equal(MultiOption{":9090"}, settings.InputRAW)
+	s.Equal(4, settings.OutputLogReplayConfig.Workers)
+}
+
+func (s *configFileSuite) TestErrors() {
+	for _, tt := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "unknown key", content: "input-row: [':80']", want: `unknown key "input-row"`},
+		{name: "unknown nested key", content: "OutputLogReplayConfig:\n  moduleid: a",
+			want: `unknown key "OutputLogReplayConfig.moduleid"`},
+		{name: "flag name in section", content: "ModifierConfig:\n  verbose: 1",
+			want: `unknown key "ModifierConfig.verbose"`},
+		{name: "no flag", content: "no-flag: a", want: "no-flag can't be set"},
+		{name: "not a mapping", content: "OutputLogReplayConfig: a", want: "want a mapping"},
+		{name: "single value", content: "verbose: [1, 2]", want: "verbose takes a single value"},
+		{name: "invalid value", content: "input-raw-expire: soon", want: `input-raw-expire "soon"`},
+		{name: "invalid rule", content: "ModifierConfig:\n  http-set-header: [a]", want: "http-set-header"},
+		{name: "duplicate key", content: "verbose: 1\nverbose: 2", want: "already set"},
+		{name: "top level list", content: "- a", want: "want a mapping at the top level"},
+	} {
+		s.Run(tt.name, func() {
+			_, err := s.load("gor.yml", tt.content)
+			s.Require().Error(err)
+			s.Contains(err.Error(), tt.want)
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ParseHTTPModifierRules 由 flag 名和取值新建 HTTPModifierConfig, 取值的格式与命令行相同, 比如
+// {"http-allow-url": ["^/api"], "http-set-header": ["User-Agent: Gor"]}
+func ParseHTTPModifierRules(rules map[string][]string) (HTTPModifierConfig, error) {
+	var conf HTTPModifierConfig
+
+	fields := make(map[string]flag.Value)
+	v := reflect.ValueOf(&conf).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if value, ok := v.Field(i).Addr().Interface().(flag.Value); ok {
+			fields[name] = value
+		}
+	}
+
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok {
+			return HTTPModifierConfig{}, fmt.Errorf("unknown http modifier rule %q", name)
+		}
+
+		for _, value := range rules[name] {
+			if err := field.Set(value); err != nil {
+				return HTTPModifierConfig{}, fmt.Errorf("%s %q: %v", name, value, err)
+			}
+		}
+	}
+
+	return conf, nil
+}
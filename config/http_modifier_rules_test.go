@@ -0,0 +1,34 @@
+package config
+
+func (s *httpModifierSettingsSuite) TestParseHTTPModifierRules() {
+	for _, tt := range []struct {
+		name    string
+		rules   map[string][]string
+		wantErr bool
+	}{
+		{name: "empty"},
+		{
+			name: "rules",
+			rules: map[string][]string{
+				"http-allow-url":      {"^/api", "^/v2"},
+				"http-set-header":     {"User-Agent: Gor"},
+				"http-header-limiter": {"user_id: 50%"},
+			},
+		},
+		{name: "unknown", rules: map[string][]string{"http-allow-body": {"a"}}, wantErr: true},
+		{name: "invalid", rules: map[string][]string{"http-set-header": {"User-Agent"}}, wantErr: true},
+	} {
+		s.Run(tt.name, func() {
+			conf, err := ParseHTTPModifierRules(tt.rules)
+			if tt.wantErr {
+				s.Error(err)
+				return
+			}
+
+			s.NoError(err)
+			s.Len(conf.URLRegexp, len(tt.rules["http-allow-url"]))
+			s.Len(conf.Headers, len(tt.rules["http-set-header"]))
+			s.Len(conf.HeaderHashFilters, len(tt.rules["http-header-limiter"]))
+		})
+	}
+}
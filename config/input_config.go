@@ -33,7 +33,9 @@ type RAWInputConfig struct {
 	LogreplaySampleRate int           `json:"input-raw-logreplay-sample-rate"`
 	AutoSelectIP        bool          `json:"input-raw-auto-select-ip"` // 自动选择Ip
 	SelectHost          string        `json:"input-raw-select-host"`    // 录制指定host的流量, 如果指定多个host来源。使用 "," 进行分割
+	TLSKeylog           string        `json:"input-raw-tls-keylog"`     // NSS key log 文件, 用来解密 TLS 流量
 	Quit                chan bool     // Channel used only to indicate goroutine should shutdown
+	KeepPackets         bool          // KeepPackets 消息带上原始数据包, 有 --output-pcap 时打开
 	Host                string
 	Port                uint16
 }
@@ -95,3 +97,39 @@ func (eng *EngineType) String() (e string) {
 	}
 	return e
 }
+
+// --middleware 的通信协议
+const (
+	MiddlewareHex    = "hex"    // MiddlewareHex 每行一个 hex 编码的消息, 没有应答
+	MiddlewareBinary = "binary" // MiddlewareBinary 长度前缀的二进制帧
+	MiddlewareJSON   = "json"   // MiddlewareJSON 每行一个 JSON 帧
+)
+
+// MiddlewareProtocol --middleware-protocol
+type MiddlewareProtocol string
+
+// String MiddlewareProtocol to string method
+func (p *MiddlewareProtocol) String() string {
+	return string(*p)
+}
+
+// Set 只接受 hex, binary 和 json
+func (p *MiddlewareProtocol) Set(value string) error {
+	switch value {
+	case MiddlewareHex, MiddlewareBinary, MiddlewareJSON:
+		*p = MiddlewareProtocol(value)
+		return nil
+	}
+
+	return fmt.Errorf("unknown middleware protocol %q, want %s, %s or %s",
+		value, MiddlewareHex, MiddlewareBinary, MiddlewareJSON)
+}
+
+// MiddlewareConfig --middleware 进程的配置. Window, Timeout 和 Heartbeat 只用于 binary 和 json 协议, 它们的每个消息都有应答
+type MiddlewareConfig struct {
+	Protocol   MiddlewareProtocol `json:"middleware-protocol"`
+	Window     int                `json:"middleware-window"`      // Window 发给 middleware 还没有应答的最大消息数
+	Heartbeat  time.Duration      `json:"middleware-heartbeat"`   // Heartbeat 心跳间隔, 一个间隔内没有应答时重启进程
+	MaxBackoff time.Duration      `json:"middleware-max-backoff"` // MaxBackoff 进程退出后重启的最长等待
+	Timeout    time.Duration      `json:"middleware-timeout"`     // Timeout 消息等待应答的最长时间, 超时的消息计为丢弃
+}
@@ -1,8 +1,30 @@
 package config
 
+import "time"
+
 // 定义 CPU 和内存的默认阈值，超过该阈值就会发送退出命令
 const (
 	CPUThreshold   = 85.0 // CPU 的默认阈值
 	MemThreshold   = 85.0 // 内存的默认阈值
 	TimeOfDuration = 10   // 持续时间为10s
 )
+
+// MonitorConfig 资源监控配置, 阈值为 0 时不检查
+type MonitorConfig struct {
+	CPUThreshold float64       `json:"monitor-cpu-threshold"` // CPUThreshold 占全部核的百分比
+	MemThreshold float64       `json:"monitor-mem-threshold"` // MemThreshold RSS 占物理内存的百分比
+	Duration     time.Duration `json:"monitor-duration"`      // Duration 持续超过阈值多久后处理
+}
+
+// AdminConfig 管理接口配置
+type AdminConfig struct {
+	Address string `json:"http-admin"`       // Address 只能监听本机地址
+	Token   string `json:"http-admin-token"` // Token 不为空时请求需要带上 Authorization: Bearer <token>
+}
+
+// NotifyConfig 通知配置
+type NotifyConfig struct {
+	Targets MultiOption   `json:"notify"`         // Targets type:target, type 为 webhook, wecom, slack 或 file
+	Timeout time.Duration `json:"notify-timeout"` // Timeout 每次发送的超时时间
+	Retries int           `json:"notify-retries"` // Retries 失败后的重试次数
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
 	"goreplay/size"
@@ -15,7 +18,30 @@ type FileOutputConfig struct {
 	QueueLimit        int           `json:"output-file-queue-limit"`    // QueueLimit file write queue len limit
 	Append            bool          `json:"output-file-append"`         //
 	BufferPath        string        `json:"output-file-buffer"`
+	DecodeProtobuf    bool          `json:"output-file-decode-pb"` // DecodeProtobuf 把 grpc 消息解码为 JSON 写入
 	OnClose           func(string)
+	Protobuf          *ProtobufConfig
+}
+
+// StdoutOutputConfig stdout output configuration
+type StdoutOutputConfig struct {
+	DecodeProtobuf bool `json:"output-stdout-decode-pb"` // DecodeProtobuf 把 grpc 消息解码为 JSON 输出
+	Protobuf       *ProtobufConfig
+}
+
+// ProtobufConfig protobuf 描述的来源, 用于把 grpc 消息解码为 JSON
+type ProtobufConfig struct {
+	DescriptorSets MultiOption   `json:"proto-descriptor-set"` // DescriptorSets protoc --descriptor_set_out 生成的文件
+	Files          MultiOption   `json:"proto-file"`           // Files .proto 文件
+	ImportPaths    MultiOption   `json:"proto-import-path"`    // ImportPaths 查找 import 的目录
+	Reflection     string        `json:"proto-reflection"`     // Reflection 通过 server reflection 获取描述的服务地址
+	Timeout        time.Duration `json:"proto-reflection-timeout"`
+}
+
+// PcapOutputConfig pcap output configuration
+type PcapOutputConfig struct {
+	SizeLimit      size.Size     `json:"output-pcap-size-limit"`      // SizeLimit 单个文件的大小上限, 超过后写新文件
+	RotateInterval time.Duration `json:"output-pcap-rotate-interval"` // RotateInterval 每个文件写入的时长
 }
 
 // TCPOutputConfig tcp output configuration
@@ -41,6 +67,10 @@ type HTTPOutputConfig struct {
 	WorkerTimeout  time.Duration `json:"output-http-worker-timeout"`
 	BufferSize     size.Size     `json:"output-http-response-buffer"`
 	SkipVerify     bool          `json:"output-http-skip-verify"`
+	Session        bool          `json:"output-http-session"`         // 同一个录制连接的请求按顺序在单独的连接上回放
+	SessionTimeout time.Duration `json:"output-http-session-timeout"` // 空闲的会话关闭, 默认 1m
+	RewriteCookies bool          `json:"output-http-rewrite-cookies"` // 请求的 cookie 换成回放服务 Set-Cookie 的值
+	RewriteTokens  HTTPTokens    `json:"output-http-rewrite-token"`   // 请求中换成回放服务返回的值的 token
 	RawURL         string
 	URL            *url.URL
 }
@@ -71,6 +101,11 @@ type LogReplayOutputConfig struct {
 	// GrpcReplayMethodName Grpc 协议边录制边回放指定的方法名称，开启边录制边回放（指定 target，并且是 grpc 协议）才会生效，（可多个值输入，英文逗号分割）
 	GrpcReplayMethodName string `json:"output-logreplay-grpc-method-name"`
 	GatewayAddr          string `json:"output-logreplay-gateway"` // goreplay 服务器端地址
+	// SpoolDir 上报失败和退出时没有上报的记录保存在这个目录, 之后重试
+	SpoolDir  string    `json:"output-logreplay-spool"`
+	SpoolSize size.Size `json:"output-logreplay-spool-size"` // SpoolSize 磁盘队列的大小上限
+	// Protobuf SerializeType 为 pb 时解码 grpc 消息的描述
+	Protobuf *ProtobufConfig
 }
 
 // BinaryOutputConfig struct for holding binary output configuration
@@ -80,9 +115,131 @@ type BinaryOutputConfig struct {
 	BufferSize     size.Size     `json:"output-tcp-response-buffer"`
 	Debug          bool          `json:"output-binary-debug"`
 	TrackResponses bool          `json:"output-binary-track-response"`
+	Protocol       string        `json:"output-binary-protocol"` // 回放协议, 为空时取 input-raw-protocol
+}
+
+// MySQLOutputConfig struct for holding mysql output configuration
+type MySQLOutputConfig struct {
+	User           string        `json:"output-mysql-user"`
+	Password       string        `json:"output-mysql-password"`
+	Database       string        `json:"output-mysql-database"`
+	ReadOnly       bool          `json:"output-mysql-read-only"` // 只回放只读语句, 默认开启
+	Workers        int           `json:"output-mysql-workers"`
+	Timeout        time.Duration `json:"output-mysql-timeout"`
+	TrackResponses bool          `json:"output-mysql-track-response"`
+}
+
+// GRPCOutputConfig struct for holding grpc output configuration
+type GRPCOutputConfig struct {
+	Workers        int           `json:"output-grpc-workers"`     // Workers 同时回放的请求数
+	Connections    int           `json:"output-grpc-connections"` // Connections 复用的 http2 连接数
+	Timeout        time.Duration `json:"output-grpc-timeout"`
+	TrackResponses bool          `json:"output-grpc-track-response"`
+	SkipVerify     bool          `json:"output-grpc-skip-verify"` // SkipVerify h2 over tls 时不校验证书
+}
+
+// ComparatorOutputConfig struct for holding comparator output configuration
+type ComparatorOutputConfig struct {
+	Headers       MultiOption   `json:"output-comparator-header"`         // Headers 比较的响应头
+	IgnoreFields  MultiOption   `json:"output-comparator-ignore"`         // IgnoreFields 比较 json body 时忽略的字段
+	CacheSize     int           `json:"output-comparator-cache-size"`     // CacheSize 等待配对的最大数量
+	StatsInterval time.Duration `json:"output-comparator-stats-interval"` // StatsInterval 输出统计的间隔
+	Protocol      string        // 取 input-raw-protocol, 用于非 http 协议的接口名
+}
+
+// Enabled 配置了 protobuf 描述的来源
+func (conf *ProtobufConfig) Enabled() bool {
+	return len(conf.DescriptorSets) > 0 || len(conf.Files) > 0 || conf.Reflection != ""
 }
 
 // GatewayHost logreplay open api gateway host
 func (conf *LogReplayOutputConfig) GatewayHost() string {
 	return conf.GatewayAddr
 }
+
+// 输出队列满时的处理
+const (
+	QueueBlock      = "block"       // QueueBlock 等待队列有空位
+	QueueDropNewest = "drop-newest" // QueueDropNewest 丢弃新的消息
+	QueueDropOldest = "drop-oldest" // QueueDropOldest 丢弃最早的消息
+)
+
+// QueuePolicy 输出队列满时的处理, 对应 --output-queue-policy
+type QueuePolicy string
+
+// String QueuePolicy to string method
+func (p *QueuePolicy) String() string {
+	return string(*p)
+}
+
+// Set 只接受 block, drop-newest 和 drop-oldest
+func (p *QueuePolicy) Set(value string) error {
+	switch value {
+	case QueueBlock, QueueDropNewest, QueueDropOldest:
+		*p = QueuePolicy(value)
+		return nil
+	}
+
+	return fmt.Errorf("unknown policy %q, want %s, %s or %s", value, QueueBlock, QueueDropNewest, QueueDropOldest)
+}
+
+// ReplayTimingConfig 按录制的连接写出消息, 保持请求之间的间隔
+type ReplayTimingConfig struct {
+	Enabled bool          `json:"replay-timing"`
+	MaxGap  time.Duration `json:"replay-timing-max-gap"` // MaxGap 更长的间隔缩短到 MaxGap
+}
+
+// OutputQueueConfig 每个输出单独的队列, Size 为 0 时直接写入输出
+type OutputQueueConfig struct {
+	Size   int         `json:"output-queue-size"`   // Size 每个输出的队列长度
+	Policy QueuePolicy `json:"output-queue-policy"` // Policy 队列满时的处理
+}
+
+// 从响应中取 token 的位置
+const (
+	TokenJSON   = "json"   // TokenJSON json body 的字段, 比如 data.csrf_token
+	TokenHeader = "header" // TokenHeader 响应头
+	TokenBody   = "body"   // TokenBody body 匹配的正则, 有分组时取第一个分组
+)
+
+// HTTPToken 回放时跟踪的一个 token, 格式为 json:<path>, header:<name> 或 body:<regexp>
+type HTTPToken struct {
+	Kind   string
+	Name   string // json 的路径或者 header 名
+	Regexp *regexp.Regexp
+}
+
+// HTTPTokens holds list of --output-http-rewrite-token options
+type HTTPTokens []HTTPToken
+
+// String HTTPTokens to string method
+func (t *HTTPTokens) String() string {
+	return fmt.Sprint(*t)
+}
+
+// Set method to implement flags.Value
+func (t *HTTPTokens) Set(value string) error {
+	kind, name := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		kind, name = value[:i], value[i+1:]
+	}
+	if name == "" {
+		return fmt.Errorf("need a token like json:data.csrf_token, header:X-CSRF-Token or body:<regexp>, got %q", value)
+	}
+
+	token := HTTPToken{Kind: kind, Name: name}
+	switch kind {
+	case TokenJSON, TokenHeader:
+	case TokenBody:
+		r, err := regexp.Compile(name)
+		if err != nil {
+			return err
+		}
+		token.Regexp = r
+	default:
+		return fmt.Errorf("unknown token kind %q, want %s, %s or %s", kind, TokenJSON, TokenHeader, TokenBody)
+	}
+	*t = append(*t, token)
+
+	return nil
+}
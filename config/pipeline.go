@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 管道匹配条件的类型
+const (
+	MatchPath    = "path"    // http path 前缀
+	MatchService = "service" // 协议头中的服务名
+	MatchAPI     = "api"     // 协议头中的接口名
+	MatchIP      = "ip"      // 来源 IP 或网段
+)
+
+// Pipeline 命名管道, 输入中满足全部匹配条件的请求只发往管道的输出
+type Pipeline struct {
+	Name    string
+	Inputs  []string // Inputs 输入的地址, 为空时使用所有输入
+	Outputs []string // Outputs 输出的地址
+	Matches []PipelineMatch
+}
+
+// PipelineMatch 管道的匹配条件
+type PipelineMatch struct {
+	Kind  string
+	Value string
+	IPNet *net.IPNet // IPNet Kind 为 ip 时的网段
+}
+
+// Pipelines 多个命名管道, 对应 --pipeline
+type Pipelines []Pipeline
+
+// String Pipelines to string method
+func (p *Pipelines) String() string {
+	names := make([]string, 0, len(*p))
+	for _, pipeline := range *p {
+		names = append(names, pipeline.Name)
+	}
+
+	return fmt.Sprint(names)
+}
+
+// Set 解析 "name in=:80 out=http://staging.com,http://dev.com match=path:/api match=ip:10.0.0.0/8"
+func (p *Pipelines) Set(value string) error {
+	pipeline, err := ParsePipeline(value)
+	if err != nil {
+		return err
+	}
+
+	for _, exist := range *p {
+		if exist.Name == pipeline.Name {
+			return fmt.Errorf("pipeline %q already exists", pipeline.Name)
+		}
+	}
+	*p = append(*p, pipeline)
+
+	return nil
+}
+
+// ParsePipeline 解析一个管道, 第一项为名字, 其余为 in=, out= 和 match=, 地址中的限速选项会被忽略
+func ParsePipeline(value string) (Pipeline, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || strings.Contains(fields[0], "=") {
+		return Pipeline{}, fmt.Errorf("pipeline %q: need a name first", value)
+	}
+
+	pipeline := Pipeline{Name: fields[0]}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) < 2 || kv[1] == "" {
+			return Pipeline{}, fmt.Errorf("pipeline %s: %q is not key=value", pipeline.Name, field)
+		}
+
+		switch kv[0] {
+		case "in":
+			pipeline.Inputs = append(pipeline.Inputs, splitAddresses(kv[1])...)
+		case "out":
+			pipeline.Outputs = append(pipeline.Outputs, splitAddresses(kv[1])...)
+		case "match":
+			match, err := parsePipelineMatch(kv[1])
+			if err != nil {
+				return Pipeline{}, fmt.Errorf("pipeline %s: %v", pipeline.Name, err)
+			}
+			pipeline.Matches = append(pipeline.Matches, match)
+		default:
+			return Pipeline{}, fmt.Errorf("pipeline %s: unknown key %q, want in, out or match", pipeline.Name, kv[0])
+		}
+	}
+
+	if len(pipeline.Outputs) == 0 {
+		return Pipeline{}, fmt.Errorf("pipeline %s: need at least 1 output", pipeline.Name)
+	}
+
+	return pipeline, nil
+}
+
+func splitAddresses(value string) []string {
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		// 与 --output-http "staging.com|10%" 一样去掉限速选项
+		if address = strings.Split(address, "|")[0]; address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+func parsePipelineMatch(value string) (PipelineMatch, error) {
+	kv := strings.SplitN(value, ":", 2)
+	if len(kv) < 2 || kv[1] == "" {
+		return PipelineMatch{}, fmt.Errorf("match %q: need kind:value (ex. path:/api)", value)
+	}
+
+	match := PipelineMatch{Kind: kv[0], Value: kv[1]}
+	switch match.Kind {
+	case MatchPath, MatchService, MatchAPI:
+	case MatchIP:
+		if !strings.Contains(match.Value, "/") {
+			ip := net.ParseIP(match.Value)
+			if ip == nil {
+				return PipelineMatch{}, fmt.Errorf("match %q: invalid ip", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			match.IPNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			break
+		}
+
+		_, ipNet, err := net.ParseCIDR(match.Value)
+		if err != nil {
+			return PipelineMatch{}, fmt.Errorf("match %q: %v", value, err)
+		}
+		match.IPNet = ipNet
+	default:
+		return PipelineMatch{}, fmt.Errorf("match %q: unknown kind, want path, service, api or ip", value)
+	}
+
+	return match, nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitPipeline pipeline test execute
+func TestUnitPipeline(t *testing.T) {
+	suite.Run(t, new(pipelineSuite))
+}
+
+type pipelineSuite struct {
+	suite.Suite
+}
+
+func (s *pipelineSuite) TestParsePipeline() {
+	pipeline, err := ParsePipeline("api in=:80,:8080 out=staging.com|10%,dev.com match=path:/api match=ip:10.0.0.1")
+	s.Require().NoError(err)
+	s.Equal("api", pipeline.Name)
+	s.Equal([]string{":80", ":8080"}, pipeline.Inputs)
+	s.Equal([]string{"staging.com", "dev.com"}, pipeline.Outputs)
+	s.Require().Len(pipeline.Matches, 2)
+	s.Equal(PipelineMatch{Kind: MatchPath, Value: "/api"}, pipeline.Matches[0])
+	s.Equal("10.0.0.1/32", pipeline.Matches[1].IPNet.String())
+
+	for _, tt := range []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "no name", value: "out=a", wantErr: "need a name first"},
+		{name: "empty", value: " ", wantErr: "need a name first"},
+		{name: "no output", value: "api in=:80", wantErr: "need at least 1 output"},
+		{name: "not key value", value: "api out", wantErr: "is not key=value"},
+		{name: "unknown key", value: "api to=a", wantErr: `unknown key "to"`},
+		{name: "no match kind", value: "api out=a match=/api", wantErr: "need kind:value"},
+		{name: "unknown match kind", value: "api out=a match=host:a.com", wantErr: "unknown kind"},
+		{name: "invalid ip", value: "api out=a match=ip:10.0.0", wantErr: "invalid ip"},
+		{name: "invalid cidr", value: "api out=a match=ip:10.0.0.0/40", wantErr: "invalid CIDR"},
+	} {
+		s.Run(tt.name, func() {
+			_, err := ParsePipeline(tt.value)
+			s.Require().Error(err)
+			s.Contains(err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func (s *pipelineSuite) TestSet() {
+	var pipelines Pipelines
+	s.NoError(pipelines.Set("api out=a"))
+	s.NoError(pipelines.Set("web out=b match=ip:::1"))
+	s.Equal("::1/128", pipelines[1].Matches[0].IPNet.String())
+	s.Contains(pipelines.Set("api out=c").Error(), "already exists")
+	s.Equal("[api web]", pipelines.String())
+}
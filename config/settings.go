@@ -21,10 +21,13 @@ const (
 	EnvFormal = "formal"
 	// FluxSwitchDefault flux switch default is close
 	FluxSwitchDefault = "0"
+	// SerializeTypePB output logreplay decodes grpc messages with protobuf descriptors
+	SerializeTypePB = "pb"
 
 	sizeLimit      = 33554432
 	fileMaxSize    = 1099511627776
 	copyBufferSize = 5242880
+	spoolSize      = 1073741824
 )
 
 // MultiOption allows to specify multiple flags with same name and collects all values into array
@@ -43,18 +46,24 @@ func (h *MultiOption) Set(value string) error {
 
 // AppSettings is the struct of main configuration
 type AppSettings struct {
+	ConfigFile     string        `json:"config"`
 	Verbose        int           `json:"verbose"`
 	LogPath        string        `json:"log-path"`
 	Stats          bool          `json:"stats"`
+	HTTPMetrics    string        `json:"http-metrics"`
 	OnlyOneProcess bool          `json:"only-one-process"`
 	ExitAfter      time.Duration `json:"exit-after"`
 
-	SplitOutput bool `json:"split-output"`
+	SplitOutput       bool      `json:"split-output"`
+	Pipelines         Pipelines `json:"pipeline"`
+	OutputQueueConfig OutputQueueConfig
+	ReplayTiming      ReplayTimingConfig
 
-	InputDummy   MultiOption `json:"input-dummy"`
-	OutputDummy  MultiOption
-	OutputStdout bool `json:"output-stdout"`
-	OutputNull   bool `json:"output-null"`
+	InputDummy         MultiOption `json:"input-dummy"`
+	OutputDummy        MultiOption
+	OutputStdout       bool `json:"output-stdout"`
+	OutputStdoutConfig StdoutOutputConfig
+	OutputNull         bool `json:"output-null"`
 
 	InputTCP        MultiOption `json:"input-tcp"`
 	InputTCPConfig  TCPInputConfig
@@ -67,10 +76,16 @@ type AppSettings struct {
 	OutputFile       MultiOption `json:"output-file"`
 	OutputFileConfig FileOutputConfig
 
+	OutputPcap       MultiOption `json:"output-pcap"`
+	OutputPcapConfig PcapOutputConfig
+
 	InputRAW MultiOption `json:"input_raw"`
 	RAWInputConfig
 
-	Middleware string `json:"middleware"`
+	Middleware         string      `json:"middleware"`
+	Transformers       MultiOption `json:"transformer"`        // Transformers 进程内修改消息, 按顺序调用
+	TransformerPlugins MultiOption `json:"transformer-plugin"` // TransformerPlugins 注册 transformer 的 go 插件
+	MiddlewareConfig   MiddlewareConfig
 
 	InputHTTP       MultiOption
 	OutputHTTP      MultiOption `json:"output-http"`
@@ -83,10 +98,26 @@ type AppSettings struct {
 	OutputBinary       MultiOption `json:"output-binary"`
 	OutputBinaryConfig BinaryOutputConfig
 
+	OutputMySQL       MultiOption `json:"output-mysql"`
+	OutputMySQLConfig MySQLOutputConfig
+
+	OutputGRPC       MultiOption `json:"output-grpc"`
+	OutputGRPCConfig GRPCOutputConfig
+
+	OutputComparator       MultiOption `json:"output-comparator"`
+	OutputComparatorConfig ComparatorOutputConfig
+
+	MonitorConfig MonitorConfig
+	NotifyConfig  NotifyConfig
+	AdminConfig   AdminConfig
+
 	ModifierConfig HTTPModifierConfig
+	ModifierRules  map[string][]string // ModifierRules 命令行设置的 ModifierConfig, 格式同 ParseHTTPModifierRules 的参数
 
 	InputUDP       MultiOption `json:"input-udp"`
 	InputUDPConfig UDPInputConfig
+
+	ProtobufConfig ProtobufConfig
 }
 
 // Settings holds Gor configuration
@@ -105,10 +136,14 @@ Current Version: v%s\n`, VERSION)
 
 func init() {
 	flag.Usage = usage
+	flag.StringVar(&Settings.ConfigFile, "config", "",
+		"Read settings from a yaml or json (.json) file, flags given on the command line take precedence")
 	flag.IntVar(&Settings.Verbose, "verbose", 0,
 		"set the level of verbosity, if greater than zero then it will turn on debug output")
 	flag.StringVar(&Settings.LogPath, "log-path", "", "path of log")
 	flag.BoolVar(&Settings.Stats, "stats", false, "Turn on queue stats output")
+	flag.StringVar(&Settings.HTTPMetrics, "http-metrics", "",
+		"Serve prometheus metrics of inputs and outputs on this address, at /metrics: --http-metrics :9090")
 	flag.BoolVar(&Settings.OnlyOneProcess, "only-one-process", false,
 		"only one goreplay process can run in thin machine")
 
@@ -122,8 +157,30 @@ func init() {
 	setOutputLogReplayConfig()
 	// setOutputBinaryConfig
 	setOutputBinaryConfig()
+	// setOutputMySQLConfig
+	setOutputMySQLConfig()
+	// setOutputGRPCConfig
+	setOutputGRPCConfig()
+	// setOutputComparatorConfig
+	setOutputComparatorConfig()
+	// setOutputPcapConfig
+	setOutputPcapConfig()
+	// setOutputQueueConfig
+	setOutputQueueConfig()
+	// setReplayTimingConfig
+	setReplayTimingConfig()
+	// setMonitorConfig
+	setMonitorConfig()
+	// setNotifyConfig
+	setNotifyConfig()
+	// setAdminConfig
+	setAdminConfig()
 	// setModifierConfig
 	setModifierConfig()
+	// setProtobufConfig
+	setProtobufConfig()
+	// setMiddlewareConfig
+	setMiddlewareConfig()
 	// default values, using for tests
 	Settings.OutputFileConfig.SizeLimit = sizeLimit
 	Settings.OutputFileConfig.OutputFileMaxSize = fileMaxSize
@@ -168,11 +225,19 @@ func setExitAfter() {
 	flag.BoolVar(&Settings.SplitOutput, "split-output", false,
 		"By default each output gets same traffic. "+
 			"If set to `true` it splits traffic equally among all outputs.")
+	flag.Var(&Settings.Pipelines, "pipeline", "Named pipeline sending matched requests of some inputs "+
+		"only to some outputs, responses follow their request. Can be repeated. Example: \n\t"+
+		"gor --input-raw :80 --output-http staging.com --output-file api.gor "+
+		"--pipeline 'api in=:80 out=staging.com,api.gor match=path:/api match=ip:10.0.0.0/8'\n\t"+
+		"Match kinds: path (http path prefix), service and api (from the protocol header), ip (source ip or cidr)")
 
 	flag.Var(&Settings.InputDummy, "input-dummy", "Used for testing outputs. "+
 		"Emits 'Get /' request every 1s")
 	flag.BoolVar(&Settings.OutputStdout, "output-stdout", false,
 		"Used for testing inputs. Just prints to console data coming from inputs.")
+	flag.BoolVar(&Settings.OutputStdoutConfig.DecodeProtobuf, "output-stdout-decode-pb", false,
+		"Print grpc messages decoded to JSON with the descriptors of --proto-descriptor-set, "+
+			"--proto-file or --proto-reflection")
 	flag.BoolVar(&Settings.OutputNull, "output-null", false,
 		"Used for testing inputs. Drops all requests.")
 
@@ -221,6 +286,9 @@ func setExitAfter() {
 	flag.Var(&Settings.OutputFileConfig.OutputFileMaxSize, "output-file-max-size-limit",
 		"Max size of output file, Default: 1TB")
 
+	flag.BoolVar(&Settings.OutputFileConfig.DecodeProtobuf, "output-file-decode-pb", false,
+		"Write grpc messages decoded to JSON, like --output-stdout-decode-pb. The file can't be replayed.")
+
 	flag.StringVar(&Settings.OutputFileConfig.BufferPath, "output-file-buffer", "/tmp",
 		"The path for temporary storing current buffer: \n\t"+
 			"gor --input-raw :80 "+
@@ -242,7 +310,7 @@ func setRawInputFlags() {
 	flag.Var(&Settings.Engine, "input-raw-engine",
 		"Intercept traffic using `libpcap` (default), `raw_socket` or `pcap_file`")
 	flag.StringVar(&Settings.Protocol, "input-raw-protocol", "",
-		"Specify application protocol of intercepted traffic. ")
+		"Specify application protocol of intercepted traffic: http, grpc, thrift, redis or mysql. ")
 	flag.StringVar(&Settings.RealIPHeader, "input-raw-realip-header", "",
 		"If not blank, injects header with given name and real IP value to the request payload. "+
 			"Usually this header should be named: X-Real-IP")
@@ -278,11 +346,20 @@ func setRawInputFlags() {
 		"auto select first ip if multiple exists")
 	flag.StringVar(&Settings.Middleware, "middleware", "",
 		"Used for modifying traffic using external command")
+	flag.Var(&Settings.Transformers, "transformer",
+		"Modify traffic in process with a registered Go transformer, as name or name:options. "+
+			"Can be repeated, transformers are called in order.")
+	flag.Var(&Settings.TransformerPlugins, "transformer-plugin",
+		"Load a Go plugin, built with -buildmode=plugin, which registers transformers. Can be repeated:\n\t"+
+			"gor --input-raw :80 --transformer-plugin ./auth.so --transformer auth:secret --output-http staging.com")
 
 	flag.Var(&Settings.OutputHTTP, "output-http", "Forwards incoming requests to given http address.\n\t"+
 		"# Redirect all incoming requests to staging.com address \n\t"+
 		"gor --input-raw :80 --output-http http://staging.com")
 	flag.StringVar(&Settings.SelectHost, "input-raw-select-host", "", "select the traffic of the specified host.\n\t")
+	flag.StringVar(&Settings.TLSKeylog, "input-raw-tls-keylog", "",
+		"Decrypt TLS 1.2 and 1.3 traffic with the secrets of a NSS key log file, as written to SSLKEYLOGFILE:\n\t"+
+			"gor --input-raw :443 --input-raw-protocol http --input-raw-tls-keylog /tmp/keys.log --output-stdout")
 }
 
 func setOutputHTTPConfig() {
@@ -299,6 +376,19 @@ func setOutputHTTPConfig() {
 		"Don't verify hostname on TLS secure connection.")
 	flag.DurationVar(&Settings.OutputHTTPConfig.WorkerTimeout, "output-http-worker-timeout", 2*time.Second,
 		"Duration to rollback idle workers.")
+	flag.BoolVar(&Settings.OutputHTTPConfig.Session, "output-http-session", false,
+		"Replay the requests of each recorded connection in order, over a connection of their own "+
+			"which is closed when the recorded connection sees FIN or RST.")
+	flag.DurationVar(&Settings.OutputHTTPConfig.SessionTimeout, "output-http-session-timeout", time.Minute,
+		"Close the connection of --output-http-session after being idle for this duration.")
+	flag.BoolVar(&Settings.OutputHTTPConfig.RewriteCookies, "output-http-rewrite-cookies", false,
+		"Replace the recorded cookies of requests with the ones the replayed server set instead. "+
+			"Needs --input-raw-track-response.")
+	flag.Var(&Settings.OutputHTTPConfig.RewriteTokens, "output-http-rewrite-token",
+		"Replace a token of the recorded responses in later requests with the one the replayed server returned "+
+			"instead, found by json path, response header or body regexp. Needs --input-raw-track-response:\n\t"+
+			"gor --input-raw :80 --input-raw-track-response --output-http staging.com "+
+			"--output-http-rewrite-token json:data.csrf_token --output-http-rewrite-token header:X-CSRF-Token")
 
 	flag.IntVar(&Settings.OutputHTTPConfig.RedirectLimit, "output-http-redirects", 0,
 		"Enable how often redirects should be followed.")
@@ -364,6 +454,15 @@ func setOutputLogReplayConfig() {
 		"output-logreplay-grpc-method-name", "", "grpc 边录制边回放指定的回放的方法名称，为空则不做拦截")
 	flag.StringVar(&Settings.OutputLogReplayConfig.GatewayAddr, "output-logreplay-gateway", "",
 		"gateway host for goreplay, mandatory")
+	flag.StringVar(&Settings.OutputLogReplayConfig.SpoolDir, "output-logreplay-spool", "",
+		"Directory where records are kept until logreplay accepts them, so that they survive\n\t"+
+			"gateway outages and restarts. By default records failing to report are lost.")
+	flag.StringVar(&Settings.OutputLogReplayConfig.SerializeType, "output-logreplay-serialize-type", "",
+		"Serialization of the grpc messages: pb decodes them to the request and response of the records,\n\t"+
+			"with the descriptors of --proto-descriptor-set, --proto-file or --proto-reflection")
+	Settings.OutputLogReplayConfig.SpoolSize = spoolSize
+	flag.Var(&Settings.OutputLogReplayConfig.SpoolSize, "output-logreplay-spool-size",
+		"Maximum size of --output-logreplay-spool, new records are dropped when it is full. By default 1gb.")
 }
 
 func setOutputBinaryConfig() {
@@ -379,62 +478,236 @@ func setOutputBinaryConfig() {
 		"Specify HTTP request/response timeout. By default 5s. Example: --output-binary-timeout 30s")
 	flag.BoolVar(&Settings.OutputBinaryConfig.TrackResponses, "output-binary-track-response", false,
 		"If turned on, Binary output responses will be set to all outputs like stdout, file and etc.")
+	flag.StringVar(&Settings.OutputBinaryConfig.Protocol, "output-binary-protocol", "",
+		"Application protocol of replayed payloads, one response is read per request for http, thrift and redis.\n\t"+
+			"Connections are kept open between requests. By default the input-raw-protocol.")
 
 	flag.BoolVar(&Settings.OutputBinaryConfig.Debug, "output-binary-debug", false,
 		"Enables binary debug output.")
 }
 
+func setOutputMySQLConfig() {
+	flag.Var(&Settings.OutputMySQL, "output-mysql",
+		"Replays recorded mysql commands against the given address, logged in with its own account.\n\t"+
+			"# Replay the read-only statements recorded on :3306 to a staging database\n\t"+
+			"gor --input-raw :3306 --input-raw-protocol mysql --output-mysql staging.com:3306 --output-mysql-user gor")
+	flag.StringVar(&Settings.OutputMySQLConfig.User, "output-mysql-user", "",
+		"User the mysql output logs in as.")
+	flag.StringVar(&Settings.OutputMySQLConfig.Password, "output-mysql-password", "",
+		"Password of the mysql output user.")
+	flag.StringVar(&Settings.OutputMySQLConfig.Database, "output-mysql-database", "",
+		"Default database of the mysql output connections.")
+	flag.BoolVar(&Settings.OutputMySQLConfig.ReadOnly, "output-mysql-read-only", true,
+		"Replay only statements which can't change data: SELECT, SHOW, DESCRIBE and EXPLAIN.\n\t"+
+			"Turn it off only against a database you can throw away.")
+	flag.IntVar(&Settings.OutputMySQLConfig.Workers, "output-mysql-workers", 10,
+		"Number of mysql connections. Commands of a recorded connection are replayed in order on one of them.")
+	flag.DurationVar(&Settings.OutputMySQLConfig.Timeout, "output-mysql-timeout", 0,
+		"Specify mysql request/response timeout. By default 5s. Example: --output-mysql-timeout 30s")
+	flag.BoolVar(&Settings.OutputMySQLConfig.TrackResponses, "output-mysql-track-response", false,
+		"If turned on, MySQL output responses will be set to all outputs like stdout, file and etc.")
+}
+
+func setOutputGRPCConfig() {
+	flag.Var(&Settings.OutputGRPC, "output-grpc",
+		"Replays recorded grpc calls over h2c, or h2 over tls for https:// addresses, on pooled connections.\n\t"+
+			"# Replay the grpc calls recorded on :50051 to staging\n\t"+
+			"gor --input-raw :50051 --input-raw-protocol grpc --output-grpc staging.com:50051")
+	flag.IntVar(&Settings.OutputGRPCConfig.Workers, "output-grpc-workers", 10,
+		"Number of grpc calls replayed at the same time.")
+	flag.IntVar(&Settings.OutputGRPCConfig.Connections, "output-grpc-connections", 1,
+		"Number of http2 connections the calls are spread over.")
+	flag.DurationVar(&Settings.OutputGRPCConfig.Timeout, "output-grpc-timeout", 0,
+		"Specify grpc request/response timeout. By default 5s. Example: --output-grpc-timeout 30s")
+	flag.BoolVar(&Settings.OutputGRPCConfig.TrackResponses, "output-grpc-track-response", false,
+		"If turned on, gRPC output responses will be set to all outputs like stdout, file and etc.")
+	flag.BoolVar(&Settings.OutputGRPCConfig.SkipVerify, "output-grpc-skip-verify", false,
+		"Don't verify the certificate of https:// grpc outputs.")
+}
+
+func setOutputComparatorConfig() {
+	flag.Var(&Settings.OutputComparator, "output-comparator",
+		"Compares original responses with replayed ones and writes the differences to the given JSONL file.\n\t"+
+			"Needs --input-raw-track-response and a replaying output with --output-*-track-response.\n\t"+
+			"gor --input-raw :80 --input-raw-track-response --output-http staging.com "+
+			"--output-http-track-response --output-comparator diffs.jsonl")
+	flag.Var(&Settings.OutputComparatorConfig.Headers, "output-comparator-header",
+		"Response header to compare, the status and the body are always compared:\n\t"+
+			"--output-comparator-header Content-Type --output-comparator-header Location")
+	flag.Var(&Settings.OutputComparatorConfig.IgnoreFields, "output-comparator-ignore",
+		"JSON body field to ignore, either a name at any depth or a dotted path where * matches any key or index:\n\t"+
+			"--output-comparator-ignore timestamp --output-comparator-ignore data.items.*.trace_id")
+	flag.IntVar(&Settings.OutputComparatorConfig.CacheSize, "output-comparator-cache-size", 10000,
+		"Maximum number of responses waiting for their pair.")
+	flag.DurationVar(&Settings.OutputComparatorConfig.StatsInterval, "output-comparator-stats-interval", time.Minute,
+		"Interval of logging the match and mismatch stats of each endpoint.")
+}
+
+func setOutputPcapConfig() {
+	flag.Var(&Settings.OutputPcap, "output-pcap",
+		"Write the original packets of the recorded input-raw messages to pcap files,\n\t"+
+			"only messages that passed the http filters are written: \n\t"+
+			"gor --input-raw :80 --http-allow-url /api --output-pcap ./api.pcap")
+	flag.Var(&Settings.OutputPcapConfig.SizeLimit, "output-pcap-size-limit",
+		"Start a new pcap file when the current one reaches this size, 0 means no limit. Example: 256mb")
+	flag.DurationVar(&Settings.OutputPcapConfig.RotateInterval, "output-pcap-rotate-interval", 0,
+		"Start a new pcap file after this duration, 0 means no limit. Example: 1h")
+}
+
+func setReplayTimingConfig() {
+	flag.BoolVar(&Settings.ReplayTiming.Enabled, "replay-timing", false,
+		"Write the messages of each captured connection to the outputs in capture order, keeping the original\n\t"+
+			"gaps between its requests. Connections don't wait for each other. --output-http workers can still\n\t"+
+			"reorder the requests of a connection, add --output-http-session to keep their order.")
+	flag.DurationVar(&Settings.ReplayTiming.MaxGap, "replay-timing-max-gap", time.Minute,
+		"Longer gaps between the requests of a connection are shortened to this.")
+}
+
+func setOutputQueueConfig() {
+	Settings.OutputQueueConfig.Policy = QueueBlock
+	flag.IntVar(&Settings.OutputQueueConfig.Size, "output-queue-size", 0,
+		"Put each output behind its own queue of this many messages, so that a slow or failing output\n\t"+
+			"doesn't hold up the others. 0 writes to the outputs directly.")
+	flag.Var(&Settings.OutputQueueConfig.Policy, "output-queue-policy",
+		"What to do when an output queue is full: block, drop-newest or drop-oldest.")
+}
+
+func setMiddlewareConfig() {
+	Settings.MiddlewareConfig.Protocol = MiddlewareHex
+	flag.Var(&Settings.MiddlewareConfig.Protocol, "middleware-protocol",
+		"How messages are framed between Gor and --middleware: hex (one hex encoded message per line),\n\t"+
+			"binary (length-prefixed frames) or json (one JSON frame per line). binary and json expect an answer\n\t"+
+			"for each message and support --middleware-window, --middleware-timeout and --middleware-heartbeat.")
+	flag.IntVar(&Settings.MiddlewareConfig.Window, "middleware-window", 1000,
+		"How many messages can be sent to the middleware without an answer, reading the inputs waits for it.")
+	flag.DurationVar(&Settings.MiddlewareConfig.Timeout, "middleware-timeout", 30*time.Second,
+		"A message not answered by the middleware within this is dropped, freeing its place in the window.")
+	flag.DurationVar(&Settings.MiddlewareConfig.Heartbeat, "middleware-heartbeat", 5*time.Second,
+		"Ping the middleware this often, it is restarted if a ping is not answered in time. 0 disables it.")
+	flag.DurationVar(&Settings.MiddlewareConfig.MaxBackoff, "middleware-max-backoff", 30*time.Second,
+		"The middleware is restarted when it exits, waiting twice as long after each exit up to this.")
+}
+
+func setMonitorConfig() {
+	flag.Float64Var(&Settings.MonitorConfig.CPUThreshold, "monitor-cpu-threshold", CPUThreshold,
+		"CPU usage of goreplay in percent of all cores. When it stays above it for --monitor-duration,\n\t"+
+			"goreplay lowers the input-raw sampling rate step by step and shuts down if that is not enough. 0 disables it.")
+	flag.Float64Var(&Settings.MonitorConfig.MemThreshold, "monitor-mem-threshold", MemThreshold,
+		"Memory (RSS) usage of goreplay in percent of the physical memory, handled like --monitor-cpu-threshold.\n\t"+
+			"0 disables it.")
+	flag.DurationVar(&Settings.MonitorConfig.Duration, "monitor-duration", TimeOfDuration*time.Second,
+		"How long the usage has to stay above a threshold before load is shed, and below before it is restored.")
+}
+
+func setNotifyConfig() {
+	flag.Var(&Settings.NotifyConfig.Targets, "notify",
+		"Where to send notices on exit-after, the logreplay record limit and fatal errors, as type:target.\n\t"+
+			"Type is webhook (posts the notice as JSON), wecom, slack or file (appends JSON lines):\n\t"+
+			"gor --input-raw :80 --output-http staging.com "+
+			"--notify wecom:https://qyapi.weixin.qq.com/cgi-bin/webhook/send?key=x")
+	flag.DurationVar(&Settings.NotifyConfig.Timeout, "notify-timeout", 5*time.Second,
+		"Timeout of sending one notice.")
+	flag.IntVar(&Settings.NotifyConfig.Retries, "notify-retries", 2,
+		"How many times a failed notice is retried.")
+}
+
+func setAdminConfig() {
+	flag.StringVar(&Settings.AdminConfig.Address, "http-admin", "",
+		"Serve the admin API on this local address, to list plugins and change http rules,\n\t"+
+			"limits and the logreplay sample rate at runtime: --http-admin 127.0.0.1:9091")
+	flag.StringVar(&Settings.AdminConfig.Token, "http-admin-token", "",
+		"If set, admin API requests have to send the header \"Authorization: Bearer <token>\".")
+}
+
 func setModifierConfig() {
-	flag.Var(&Settings.ModifierConfig.Headers, "http-set-header",
+	modifierVar(&Settings.ModifierConfig.Headers, "http-set-header",
 		"Inject additional headers to http reqest:\n\t"+
 			"gor --input-raw :8080 --output-http staging.com --http-set-header 'User-Agent: Gor'")
-	flag.Var(&Settings.ModifierConfig.HeaderRewrite, "http-rewrite-header",
+	modifierVar(&Settings.ModifierConfig.HeaderRewrite, "http-rewrite-header",
 		"Rewrite the request header based on a mapping:\n\t"+
 			"gor --input-raw :8080 --output-http staging.com "+
 			"--http-rewrite-header Host: (.*).example.com,$1.beta.example.com")
-	flag.Var(&Settings.ModifierConfig.Params, "http-set-param",
+	modifierVar(&Settings.ModifierConfig.Params, "http-set-param",
 		"Set request url param, if param already exists it will be overwritten:\n\t"+
 			"gor --input-raw :8080 --output-http staging.com --http-set-param api_key=1")
-	flag.Var(&Settings.ModifierConfig.Methods, "http-allow-method",
+	modifierVar(&Settings.ModifierConfig.Methods, "http-allow-method",
 		"Whitelist of HTTP methods to replay. Anything else will be dropped:\n\t"+
 			"gor --input-raw :8080 --output-http staging.com"+
 			" --http-allow-method GET --http-allow-method OPTIONS")
-	flag.Var(&Settings.ModifierConfig.URLRegexp, "http-allow-url",
+	modifierVar(&Settings.ModifierConfig.URLRegexp, "http-allow-url",
 		"A regexp to match requests against. "+
 			"Filter get matched against full url with domain. Anything else will be dropped:\n\t "+
 			"gor --input-raw :8080 --output-http staging.com --http-allow-url ^www.")
-	flag.Var(&Settings.ModifierConfig.URLNegativeRegexp, "http-disallow-url",
+	modifierVar(&Settings.ModifierConfig.URLNegativeRegexp, "http-disallow-url",
 		"A regexp to match requests against. Filter get matched against full url with domain. "+
 			"Anything else will be forwarded:\n\t "+
 			"gor --input-raw :8080 --output-http staging.com --http-disallow-url ^www.")
-	flag.Var(&Settings.ModifierConfig.URLRewrite, "http-rewrite-url",
+	modifierVar(&Settings.ModifierConfig.URLRewrite, "http-rewrite-url",
 		"Rewrite the request url based on a mapping:\n\t"+
 			"gor --input-raw :8080 --output-http staging.com "+
 			"--http-rewrite-url /v1/user/([^\\/]+)/ping:/v2/user/$1/ping")
-	flag.Var(&Settings.ModifierConfig.HeaderFilters, "http-allow-header",
+	modifierVar(&Settings.ModifierConfig.HeaderFilters, "http-allow-header",
 		"A regexp to match a specific header against."+
 			" Requests with non-matching headers will be dropped:\n\t "+
 			"gor --input-raw :8080 --output-http staging.com --http-allow-header api-version:^v1")
-	flag.Var(&Settings.ModifierConfig.HeaderNegativeFilters, "http-disallow-header",
+	modifierVar(&Settings.ModifierConfig.HeaderNegativeFilters, "http-disallow-header",
 		"A regexp to match a specific header against. "+
 			"Requests with matching headers will be dropped:\n\t "+
 			"gor --input-raw :8080 --output-http staging.com --http-disallow-header"+
 			" \"User-Agent: Replayed by Gor\"")
-	flag.Var(&Settings.ModifierConfig.HeaderBasicAuthFilters, "http-basic-auth-filter",
+	modifierVar(&Settings.ModifierConfig.HeaderBasicAuthFilters, "http-basic-auth-filter",
 		"A regexp to match the decoded basic auth string against. "+
 			"Requests with non-matching headers will be dropped:\n\t "+
 			"gor --input-raw :8080 --output-http staging.com"+
 			" --http-basic-auth-filter \"^customer[0-9].*\"")
-	flag.Var(&Settings.ModifierConfig.HeaderHashFilters, "http-header-limiter",
+	modifierVar(&Settings.ModifierConfig.HeaderHashFilters, "http-header-limiter",
 		"Takes a fraction of requests, consistently taking or rejecting a request "+
 			"based on the FNV32-1A hash of a specific header:\n\t "+
 			"gor --input-raw :8080 --output-http staging.com --http-header-limiter user-id:25%")
-	flag.Var(&Settings.ModifierConfig.ParamHashFilters, "http-param-limiter",
+	modifierVar(&Settings.ModifierConfig.ParamHashFilters, "http-param-limiter",
 		"Takes a fraction of requests, consistently taking or rejecting a request "+
 			"based on the FNV32-1A hash of a specific GET param:\n\t "+
 			"gor --input-raw :8080 --output-http staging.com --http-param-limiter user_id:25%")
 }
 
+// modifierVar 注册 http 改写规则的 flag, 同时在 ModifierRules 中记下命令行的取值
+func modifierVar(value flag.Value, name, usage string) {
+	flag.Var(modifierValue{Value: value, name: name}, name, usage)
+}
+
+type modifierValue struct {
+	flag.Value
+	name string
+}
+
+// Set 设置成功后记下 value
+func (v modifierValue) Set(value string) error {
+	if err := v.Value.Set(value); err != nil {
+		return err
+	}
+	if Settings.ModifierRules == nil {
+		Settings.ModifierRules = make(map[string][]string)
+	}
+	Settings.ModifierRules[v.name] = append(Settings.ModifierRules[v.name], value)
+
+	return nil
+}
+
+func setProtobufConfig() {
+	flag.Var(&Settings.ProtobufConfig.DescriptorSets, "proto-descriptor-set",
+		"FileDescriptorSet used to decode grpc messages, can be repeated: \n\t"+
+			"protoc --include_imports --descriptor_set_out=helloworld.pb helloworld.proto")
+	flag.Var(&Settings.ProtobufConfig.Files, "proto-file",
+		".proto file used to decode grpc messages, can be repeated")
+	flag.Var(&Settings.ProtobufConfig.ImportPaths, "proto-import-path",
+		"Directory where the imports of --proto-file are searched, can be repeated")
+	flag.StringVar(&Settings.ProtobufConfig.Reflection, "proto-reflection", "",
+		"Load the descriptors from the grpc server reflection of this address, for example localhost:50051, "+
+			"or https://localhost:50051 for h2 over TLS")
+	flag.DurationVar(&Settings.ProtobufConfig.Timeout, "proto-reflection-timeout", 5*time.Second,
+		"Timeout of --proto-reflection")
+}
+
 func setInputUDPConfig() {
 	flag.Var(&Settings.InputUDP, "input-udp",
 		"Capture traffic from given port (use RAW sockets and require *sudo* access):\n\t"+
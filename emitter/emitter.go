@@ -3,8 +3,10 @@ package emitter
 
 import (
 	"fmt"
+	"hash/fnv"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"goreplay/byteutils"
@@ -14,6 +16,7 @@ import (
 	"goreplay/logger"
 	"goreplay/plugins"
 	"goreplay/plugins/middleware"
+	"goreplay/plugins/transformer"
 	"goreplay/protocol"
 	"goreplay/size"
 )
@@ -24,6 +27,11 @@ type Settings struct {
 	PrettifyHTTP   bool
 	Split          bool
 	ModifierConfig config.HTTPModifierConfig
+	Pipelines      config.Pipelines // Pipelines 不为空时按管道路由, 不再发往所有输出
+	Protocol       string           // Protocol 解析协议头的协议, 用于管道的 service, api 条件
+	OutputQueue    config.OutputQueueConfig
+	Timing         config.ReplayTimingConfig // Timing 按连接保持录制时的请求间隔
+	Transformers   transformer.Chain         // Transformers 在改写之后依次修改消息
 }
 
 // Emitter represents an abject to manage plugins communication
@@ -31,13 +39,29 @@ type Emitter struct {
 	sync.WaitGroup
 	inOutPlugins *plugins.InOutPlugins
 	settings     Settings
+	modifier     atomic.Value // *http.Modifier, 可以在运行时替换
+	outputs      []plugins.PluginWriter
+	queues       []*outputQueue
 }
 
 // NewEmitter creates and initializes new Emitter object.
 func NewEmitter(settings Settings) *Emitter {
-	return &Emitter{
+	e := &Emitter{
 		settings: settings,
 	}
+	e.SetModifierConfig(settings.ModifierConfig)
+
+	return e
+}
+
+// SetModifierConfig 替换 http 改写规则, 之后读到的请求使用新规则
+func (e *Emitter) SetModifierConfig(conf config.HTTPModifierConfig) {
+	e.modifier.Store(http.NewHTTPModifier(&conf))
+}
+
+func (e *Emitter) httpModifier() *http.Modifier {
+	m, _ := e.modifier.Load().(*http.Modifier)
+	return m
 }
 
 // Start initialize loop for sending data from inputs to outputs
@@ -47,6 +71,15 @@ func (e *Emitter) Start(inOutPlugins *plugins.InOutPlugins, middlewareCmd string
 	}
 
 	e.inOutPlugins = inOutPlugins
+	e.outputs = inOutPlugins.Outputs
+	if e.settings.OutputQueue.Size > 0 {
+		e.outputs = make([]plugins.PluginWriter, 0, len(inOutPlugins.Outputs))
+		for i, w := range inOutPlugins.Outputs {
+			q := newOutputQueue(w, inOutPlugins.OutputAddress(i), e.settings.OutputQueue)
+			e.queues = append(e.queues, q)
+			e.outputs = append(e.outputs, q)
+		}
+	}
 
 	if middlewareCmd != "" {
 		midWare := middleware.NewMiddleware(middlewareCmd)
@@ -59,20 +92,29 @@ func (e *Emitter) Start(inOutPlugins *plugins.InOutPlugins, middlewareCmd string
 		e.Add(1)
 		go func() {
 			defer e.Done()
-			e.copyMulty(midWare, inOutPlugins.Outputs...)
+			e.copyMulty(midWare, e.newRouter(""), e.outputs...)
 		}()
 
 		return
 	}
 
-	for _, in := range inOutPlugins.Inputs {
+	for i, in := range inOutPlugins.Inputs {
 		e.Add(1)
-		go func(in plugins.PluginReader) {
+		go func(in plugins.PluginReader, r *router) {
 			defer e.Done()
-			e.copyMulty(in, inOutPlugins.Outputs...)
-		}(in)
+			e.copyMulty(in, r, e.outputs...)
+		}(in, e.newRouter(inOutPlugins.InputAddress(i)))
+	}
+
+}
+
+// newRouter 没有管道时返回 nil, 发往所有输出
+func (e *Emitter) newRouter(address string) *router {
+	if len(e.settings.Pipelines) == 0 {
+		return nil
 	}
 
+	return newRouter(e.settings, address, e.outputs, e.inOutPlugins.OutputAddress)
 }
 
 // Close closes all the goroutine and waits for it to finish.
@@ -86,20 +128,42 @@ func (e *Emitter) Close() {
 	if len(e.inOutPlugins.All) > 0 {
 		// wait for everything to stop
 		e.Wait()
+
+		// 不会再写入队列
+		for _, q := range e.queues {
+			q.close()
+		}
+		e.queues = nil
+		e.settings.Transformers.Close()
 	}
 
 	e.inOutPlugins.All = nil // avoid Close to make changes again
 }
 
-// copyMulty copies from 1 reader to multiple writers
-func (e *Emitter) copyMulty(src plugins.PluginReader, writers ...plugins.PluginWriter) {
+// copyMulty copies from 1 reader to multiple writers, or to the pipelines of r
+func (e *Emitter) copyMulty(src plugins.PluginReader, r *router, writers ...plugins.PluginWriter) {
 	var ok bool
 	wIndex := 0
-	modifier := http.NewHTTPModifier(&e.settings.ModifierConfig)
 	filteredRequests := make(map[string]int64)
 	filteredRequestsLastCleanTime := time.Now().UnixNano()
 	filteredCount := 0
 
+	write := func(msg *plugins.Message) error {
+		if msg.ConnectionClosed {
+			closeConnection(writers, msg.ConnectionID)
+			return nil
+		}
+		if r != nil {
+			return r.write(msg)
+		}
+		return e.splitOutput(&writers, &wIndex, msg)
+	}
+	if e.settings.Timing.Enabled {
+		s := newScheduler(e.settings.Timing, write)
+		defer s.close()
+		write = s.submit
+	}
+
 	for {
 		msg, err := src.PluginRead()
 		if err != nil {
@@ -117,6 +181,15 @@ func (e *Emitter) copyMulty(src plugins.PluginReader, writers ...plugins.PluginW
 			return
 		}
 
+		if msg != nil && msg.ConnectionClosed {
+			// 没有数据, 跟在这个连接之前的消息后面交给输出
+			if err = write(msg); err != nil {
+				logger.Debug2(fmt.Sprintf("[EMITTER] error during copy: %q", err))
+				return
+			}
+			continue
+		}
+
 		if checkMsg(msg) {
 			if len(msg.Data) > int(e.settings.CopyBufferSize) {
 				logger.Debug2(fmt.Sprintf("[EMITTER] len(msg.Data) = %d > %d",
@@ -124,11 +197,14 @@ func (e *Emitter) copyMulty(src plugins.PluginReader, writers ...plugins.PluginW
 				msg.Data = msg.Data[:e.settings.CopyBufferSize]
 			}
 
-			if filteredRequests, ok = e.prettify(modifier, msg, src, filteredRequests, &filteredCount); !ok {
+			if filteredRequests, ok = e.prettify(e.httpModifier(), msg, src, filteredRequests, &filteredCount); !ok {
+				continue
+			}
+			if msg = e.settings.Transformers.Transform(msg); msg == nil {
 				continue
 			}
 
-			if err := e.splitOutput(&writers, &wIndex, msg); err != nil {
+			if err = write(msg); err != nil {
 				logger.Debug2(fmt.Sprintf("[EMITTER] error during copy: %q", err))
 				return
 			}
@@ -165,6 +241,13 @@ func (e *Emitter) garbageCollect(requests map[string]int64, lastCleanTime *int64
 func (e *Emitter) splitOutput(writers *[]plugins.PluginWriter,
 	index *int, msg *plugins.Message) error {
 	if e.settings.Split {
+		if e.settings.Timing.Enabled && msg.ConnectionID != "" {
+			// 同一个连接的消息发往同一个输出
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(msg.ConnectionID))
+			_, err := (*writers)[h.Sum32()%uint32(len(*writers))].PluginWrite(msg)
+			return err
+		}
 		// Simple round robin
 		if _, err := (*writers)[*index].PluginWrite(msg); err != nil {
 			return err
@@ -184,6 +267,15 @@ func (e *Emitter) splitOutput(writers *[]plugins.PluginWriter,
 	return nil
 }
 
+// closeConnection 通知输出录制的连接已经关闭
+func closeConnection(writers []plugins.PluginWriter, connectionID string) {
+	for _, w := range writers {
+		if c, ok := w.(plugins.ConnectionCloser); ok {
+			c.CloseConnection(connectionID)
+		}
+	}
+}
+
 // ignoreError 判断错误类型,若为ErrorStopped和EOF则跳过
 func ignoreError(err error) bool {
 	if err == errors.ErrorStopped || err == io.EOF {
@@ -3,6 +3,7 @@ package emitter
 import (
 	"errors"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -14,6 +15,7 @@ import (
 	rerror "goreplay/errors"
 	"goreplay/plugins"
 	"goreplay/plugins/middleware"
+	"goreplay/plugins/transformer"
 	"goreplay/protocol"
 )
 
@@ -229,6 +231,150 @@ func (s *testUnitEmitterSuite) TestGarbageCollect() {
 	}
 }
 
+func (s *testUnitEmitterSuite) TestSetModifierConfig() {
+	emitter := NewEmitter(Settings{})
+	s.Nil(emitter.httpModifier())
+
+	emitter.SetModifierConfig(config.HTTPModifierConfig{Methods: config.HTTPMethods{[]byte("GET")}})
+	modifier := emitter.httpModifier()
+	s.Require().NotNil(modifier)
+	s.Empty(modifier.Rewrite([]byte("POST / HTTP/1.1\r\n\r\n")))
+	s.NotEmpty(modifier.Rewrite([]byte("GET / HTTP/1.1\r\n\r\n")))
+
+	emitter.SetModifierConfig(config.HTTPModifierConfig{})
+	s.Nil(emitter.httpModifier())
+}
+
+func (s *testUnitEmitterSuite) TestCloseConnection() {
+	for _, tt := range []struct {
+		name     string
+		settings Settings
+	}{
+		{name: "direct"},
+		{name: "queue", settings: Settings{OutputQueue: config.OutputQueueConfig{Size: 10}}},
+		{name: "timing", settings: Settings{Timing: config.ReplayTimingConfig{Enabled: true}}},
+	} {
+		s.Run(tt.name, func() {
+			closer := &closerOutput{}
+			written := 0
+			writers := []plugins.PluginWriter{closer, newTestOutput(func(*plugins.Message) { written++ })}
+			var q *outputQueue
+			if tt.settings.OutputQueue.Size > 0 {
+				q = newOutputQueue(closer, "close-connection", tt.settings.OutputQueue)
+				writers[0] = q
+			}
+			input := &sliceInput{done: make(chan struct{}), msgs: []*plugins.Message{
+				connMessage("a", protocol.RequestPayload, 1, "a1"),
+				{ConnectionID: "a", ConnectionClosed: true},
+				connMessage("a", protocol.RequestPayload, 2, "a2"),
+				{ConnectionID: "b", ConnectionClosed: true},
+			}}
+			tt.settings.CopyBufferSize = 1 << 20
+			e := NewEmitter(tt.settings)
+
+			go func() {
+				s.Eventually(func() bool { return len(closer.got()) == 4 }, time.Second, time.Millisecond)
+				close(input.done)
+			}()
+			e.copyMulty(input, nil, writers...)
+			if q != nil {
+				q.close()
+			}
+
+			got := closer.got()
+			s.Require().Len(got, 4)
+			s.Contains(got, "close b")
+			s.Equal([]string{"a1", "close a", "a2"}, filter(got, "a"))
+			// 没有实现 ConnectionCloser 的输出只收到消息
+			s.Equal(2, written)
+		})
+	}
+}
+
+// bang 在请求后追加 !, 丢弃录制的响应
+type bang struct {
+	transformer.Passthrough
+}
+
+func (bang) Request(msg *plugins.Message) *plugins.Message {
+	msg.Data = append(msg.Data, '!')
+	return msg
+}
+
+func (bang) OriginalResponse(*plugins.Message) *plugins.Message {
+	return nil
+}
+
+func (s *testUnitEmitterSuite) TestTransformers() {
+	closer := &closerOutput{}
+	input := &sliceInput{done: make(chan struct{}), msgs: []*plugins.Message{
+		connMessage("a", protocol.RequestPayload, 1, "request"),
+		connMessage("a", protocol.ResponsePayload, 2, "response"),
+		connMessage("a", protocol.ReplayedResponsePayload, 3, "replayed"),
+	}}
+	close(input.done)
+	e := NewEmitter(Settings{CopyBufferSize: 1 << 20, Transformers: transformer.Chain{bang{}, bang{}}})
+
+	e.copyMulty(input, nil, closer)
+	s.Equal([]string{"request!!", "replayed"}, closer.got())
+}
+
+// sliceInput 依次读出 msgs, 之后等到 done 关闭
+type sliceInput struct {
+	msgs []*plugins.Message
+	done chan struct{}
+}
+
+func (i *sliceInput) PluginRead() (*plugins.Message, error) {
+	if len(i.msgs) == 0 {
+		<-i.done
+		return nil, rerror.ErrorStopped
+	}
+	msg := i.msgs[0]
+	i.msgs = i.msgs[1:]
+
+	return msg, nil
+}
+
+// closerOutput 按顺序记录写出的消息和关闭的连接
+type closerOutput struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *closerOutput) PluginWrite(msg *plugins.Message) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, string(msg.Data))
+
+	return len(msg.Data), nil
+}
+
+func (o *closerOutput) CloseConnection(connectionID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, "close "+connectionID)
+}
+
+func (o *closerOutput) got() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]string(nil), o.events...)
+}
+
+// filter 包含 sub 的事件
+func filter(events []string, sub string) []string {
+	var out []string
+	for _, e := range events {
+		if strings.Contains(e, sub) {
+			out = append(out, e)
+		}
+	}
+
+	return out
+}
+
 // testInput used for testing purpose, it allows emitting requests on demand
 type testInput struct {
 	data       chan []byte
@@ -282,7 +428,8 @@ type writeCallback func(*plugins.Message)
 
 // TestOutput used in testing to intercept any output into callback
 type testOutput struct {
-	cb writeCallback
+	cb  writeCallback
+	err error // err 不为空时写入返回该错误
 }
 
 // newTestOutput constructor for TestOutput, accepts callback which get called on each incoming Write
@@ -295,6 +442,9 @@ func newTestOutput(cb writeCallback) plugins.PluginWriter {
 
 // PluginWrite write message to this plugin
 func (i *testOutput) PluginWrite(msg *plugins.Message) (int, error) {
+	if i.err != nil {
+		return 0, i.err
+	}
 	i.cb(msg)
 
 	return len(msg.Data) + len(msg.Meta), nil
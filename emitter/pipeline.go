@@ -0,0 +1,222 @@
+package emitter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"goreplay/codec"
+	"goreplay/config"
+	"goreplay/logger"
+	"goreplay/plugins"
+	"goreplay/proto"
+	"goreplay/protocol"
+)
+
+// routeTTL 等待响应的最长时间, 超时后清理请求的路由
+const routeTTL = 60 * time.Second
+
+// CheckPipelines 检查管道引用的输入和输出是否存在
+func CheckPipelines(pipelines config.Pipelines, inOutPlugins *plugins.InOutPlugins) error {
+	for _, pipeline := range pipelines {
+		for _, address := range pipeline.Inputs {
+			if !hasAddress(address, len(inOutPlugins.Inputs), inOutPlugins.InputAddress) {
+				return fmt.Errorf("pipeline %s: no input %q", pipeline.Name, address)
+			}
+		}
+
+		for _, address := range pipeline.Outputs {
+			if !hasAddress(address, len(inOutPlugins.Outputs), inOutPlugins.OutputAddress) {
+				return fmt.Errorf("pipeline %s: no output %q", pipeline.Name, address)
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasAddress(address string, n int, addressOf func(int) string) bool {
+	for i := 0; i < n; i++ {
+		if addressOf(i) == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pipeline 一个输入使用的管道
+type pipeline struct {
+	config.Pipeline
+	writers []plugins.PluginWriter
+	index   int // --split-output 时轮询的位置
+}
+
+// match 全部条件满足才匹配, header 在需要时才解析
+func (p *pipeline) match(msg *plugins.Message, header func() *codec.ProtocolHeader) bool {
+	for _, m := range p.Matches {
+		var ok bool
+		switch m.Kind {
+		case config.MatchPath:
+			ok = bytes.HasPrefix(proto.Path(msg.Data), []byte(m.Value))
+		case config.MatchService:
+			ok = header() != nil && header().ServiceName == m.Value
+		case config.MatchAPI:
+			ok = header() != nil && header().APIName == m.Value
+		case config.MatchIP:
+			ip := net.ParseIP(msg.SrcAddr)
+			ok = ip != nil && m.IPNet.Contains(ip)
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+type route struct {
+	writers []plugins.PluginWriter
+	time    int64
+}
+
+// router 一个输入的路由, 请求发往匹配的管道, 响应发往请求所在的输出
+type router struct {
+	pipelines     []*pipeline
+	split         bool
+	codec         codec.HeaderCodec
+	routes        map[string]route // requestID -> 请求写入的输出
+	lastCleanTime int64
+}
+
+// newRouter 使用没有限定输入, 或者限定了 address 的管道, addressOf 返回第 i 个输出的地址
+func newRouter(settings Settings, address string, outputs []plugins.PluginWriter,
+	addressOf func(int) string) *router {
+	r := &router{
+		split:         settings.Split,
+		codec:         codec.GetHeaderCodec(settings.Protocol),
+		routes:        make(map[string]route),
+		lastCleanTime: time.Now().UnixNano(),
+	}
+
+	for _, conf := range settings.Pipelines {
+		if len(conf.Inputs) > 0 && !contains(conf.Inputs, address) {
+			continue
+		}
+
+		p := &pipeline{Pipeline: conf}
+		for i, w := range outputs {
+			if contains(conf.Outputs, addressOf(i)) {
+				p.writers = append(p.writers, w)
+			}
+		}
+		r.pipelines = append(r.pipelines, p)
+	}
+
+	return r
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write 写入一条消息, 多个管道使用同一个输出时只写一次
+func (r *router) write(msg *plugins.Message) error {
+	id := protocol.PayloadID(msg.Meta)
+	rt, known := r.routes[string(id)]
+	switch {
+	case protocol.IsRequestPayload(msg.Meta):
+		rt = route{writers: r.match(msg), time: time.Now().UnixNano()}
+		r.routes[string(id)] = rt
+	case known:
+		delete(r.routes, string(id))
+	default:
+		// 没有见过请求的响应, 比如开始抓包前发出的请求, 按响应本身匹配
+		rt.writers = r.match(msg)
+	}
+	r.garbageCollect()
+
+	for _, dst := range rt.writers {
+		if _, err := dst.PluginWrite(msg); err != nil {
+			logger.Error(fmt.Sprintf("writers %T, err: %v", dst, err))
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// match 找到消息匹配的输出
+func (r *router) match(msg *plugins.Message) []plugins.PluginWriter {
+	var header *codec.ProtocolHeader
+	decoded := false
+	decode := func() *codec.ProtocolHeader {
+		if !decoded {
+			decoded = true
+			if h, err := r.codec.Decode(msg.Data, msg.ConnectionID); err == nil {
+				header = &h
+			}
+		}
+		return header
+	}
+
+	var writers []plugins.PluginWriter
+	for _, p := range r.pipelines {
+		if len(p.writers) == 0 || !p.match(msg, decode) {
+			continue
+		}
+
+		if !r.split {
+			writers = appendWriters(writers, p.writers...)
+			continue
+		}
+
+		// Simple round robin
+		writers = appendWriters(writers, p.writers[p.index])
+		p.index = (p.index + 1) % len(p.writers)
+	}
+
+	return writers
+}
+
+func appendWriters(writers []plugins.PluginWriter, add ...plugins.PluginWriter) []plugins.PluginWriter {
+	for _, w := range add {
+		exist := false
+		for _, dst := range writers {
+			if dst == w {
+				exist = true
+				break
+			}
+		}
+
+		if !exist {
+			writers = append(writers, w)
+		}
+	}
+
+	return writers
+}
+
+// garbageCollect 清理没有等到响应的请求
+func (r *router) garbageCollect() {
+	now := time.Now().UnixNano()
+	if now-r.lastCleanTime <= int64(routeTTL) {
+		return
+	}
+
+	for k, v := range r.routes {
+		if now-v.time > int64(routeTTL) {
+			delete(r.routes, k)
+		}
+	}
+	r.lastCleanTime = now
+}
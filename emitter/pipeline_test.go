@@ -0,0 +1,158 @@
+package emitter
+
+import (
+	"time"
+
+	"goreplay/config"
+	"goreplay/plugins"
+	"goreplay/protocol"
+)
+
+func (s *testUnitEmitterSuite) pipelines(values ...string) config.Pipelines {
+	var pipelines config.Pipelines
+	for _, v := range values {
+		s.Require().NoError(pipelines.Set(v))
+	}
+
+	return pipelines
+}
+
+func (s *testUnitEmitterSuite) TestCheckPipelines() {
+	plug := &plugins.InOutPlugins{
+		Inputs:          []plugins.PluginReader{newTestInput()},
+		Outputs:         []plugins.PluginWriter{newTestOutput(nil)},
+		InputAddresses:  []string{":80"},
+		OutputAddresses: []string{"staging.com"},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		pipeline string
+		wantErr  string
+	}{
+		{name: "ok", pipeline: "api in=:80 out=staging.com|10"},
+		{name: "no input", pipeline: "api in=:81 out=staging.com", wantErr: `no input ":81"`},
+		{name: "no output", pipeline: "api out=dev.com", wantErr: `no output "dev.com"`},
+	} {
+		s.Run(tt.name, func() {
+			err := CheckPipelines(s.pipelines(tt.pipeline), plug)
+			if tt.wantErr == "" {
+				s.NoError(err)
+				return
+			}
+			s.Require().Error(err)
+			s.Contains(err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func (s *testUnitEmitterSuite) TestRouter() {
+	request := func(id, path, ip string) *plugins.Message {
+		return &plugins.Message{
+			Meta:    protocol.PayloadHeader(protocol.RequestPayload, []byte(id), time.Now().UnixNano(), -1),
+			Data:    []byte("GET " + path + " HTTP/1.1\r\nHost: a.com\r\n\r\n"),
+			SrcAddr: ip,
+		}
+	}
+	response := func(id string) *plugins.Message {
+		return &plugins.Message{
+			Meta: protocol.PayloadHeader(protocol.ResponsePayload, []byte(id), time.Now().UnixNano(), 1),
+			Data: []byte("HTTP/1.1 200 OK\r\n\r\n"),
+		}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		pipelines []string
+		split     bool
+		input     string
+		messages  []*plugins.Message
+		want      map[string][]string // 输出 -> 收到的 requestID
+	}{
+		{
+			name:      "path",
+			pipelines: []string{"api out=a match=path:/api", "all out=b"},
+			messages:  []*plugins.Message{request("1", "/api/v1", ""), request("2", "/home", "")},
+			want:      map[string][]string{"a": {"1"}, "b": {"1", "2"}},
+		},
+		{
+			name:      "response follows request",
+			pipelines: []string{"api out=a match=path:/api"},
+			messages: []*plugins.Message{request("1", "/api", ""), request("2", "/home", ""),
+				response("2"), response("1")},
+			want: map[string][]string{"a": {"1", "1"}},
+		},
+		{
+			name:      "input",
+			pipelines: []string{"other in=:81 out=a", "this in=:80 out=b"},
+			input:     ":80",
+			messages:  []*plugins.Message{request("1", "/", "")},
+			want:      map[string][]string{"b": {"1"}},
+		},
+		{
+			name:      "ip",
+			pipelines: []string{"office out=a match=ip:10.0.0.0/8", "host out=b match=ip:192.168.1.1"},
+			messages:  []*plugins.Message{request("1", "/", "10.1.2.3"), request("2", "/", "192.168.1.1")},
+			want:      map[string][]string{"a": {"1"}, "b": {"2"}},
+		},
+		{
+			name:      "service",
+			pipelines: []string{"echo out=a match=service:EchoHttp match=api:/grpc.helloworld.EchoHttp/SayHello"},
+			messages: []*plugins.Message{request("1", "/grpc.helloworld.EchoHttp/SayHello", ""),
+				request("2", "/grpc.helloworld.EchoHttp/Other", "")},
+			want: map[string][]string{"a": {"1"}},
+		},
+		{
+			name:      "split",
+			pipelines: []string{"all out=a,b", "api out=b match=path:/api"},
+			split:     true,
+			messages: []*plugins.Message{request("1", "/api", ""), request("2", "/api", ""),
+				response("1")},
+			want: map[string][]string{"a": {"1", "1"}, "b": {"1", "2", "1"}},
+		},
+	} {
+		s.Run(tt.name, func() {
+			got := make(map[string][]string)
+			plug := &plugins.InOutPlugins{OutputAddresses: []string{"a", "b"}}
+			for _, address := range plug.OutputAddresses {
+				address := address
+				plug.Outputs = append(plug.Outputs, newTestOutput(func(msg *plugins.Message) {
+					got[address] = append(got[address], string(protocol.PayloadID(msg.Meta)))
+				}))
+			}
+
+			r := newRouter(Settings{Pipelines: s.pipelines(tt.pipelines...), Split: tt.split, Protocol: "http"},
+				tt.input, plug.Outputs, plug.OutputAddress)
+			for _, msg := range tt.messages {
+				s.NoError(r.write(msg))
+			}
+			s.Equal(tt.want, got)
+		})
+	}
+}
+
+func (s *testUnitEmitterSuite) TestStartPipelines() {
+	done := make(chan *plugins.Message, 1)
+	input := newTestInput()
+	plug := &plugins.InOutPlugins{
+		Inputs:          []plugins.PluginReader{input},
+		Outputs:         []plugins.PluginWriter{newTestOutput(func(msg *plugins.Message) { done <- msg })},
+		InputAddresses:  []string{":80"},
+		OutputAddresses: []string{"a"},
+	}
+	plug.All = []interface{}{input, plug.Outputs[0]}
+
+	emitter := NewEmitter(Settings{Pipelines: s.pipelines("api in=:80 out=a match=path:/api")})
+	emitter.Start(plug, "")
+
+	input.data <- []byte("GET /home HTTP/1.1\r\n\r\n")
+	input.data <- []byte("GET /api HTTP/1.1\r\n\r\n")
+	select {
+	case msg := <-done:
+		s.Equal("GET /api HTTP/1.1\r\n\r\n", string(msg.Data))
+	case <-time.After(time.Second):
+		s.Fail("no message routed")
+	}
+
+	emitter.Close()
+}
@@ -0,0 +1,115 @@
+package emitter
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"goreplay/config"
+	"goreplay/logger"
+	"goreplay/metrics"
+	"goreplay/plugins"
+)
+
+// 输出队列的 prometheus 指标, 按输出的地址区分
+var (
+	queueLengthMetric = metrics.NewGaugeVec("gor_emitter_queue_messages",
+		"Messages waiting in the emitter queue of the output.", "output")
+	queueDroppedMetric = metrics.NewCounterVec("gor_emitter_queue_dropped_total",
+		"Messages dropped because the emitter queue of the output was full.", "output")
+	queueErrorsMetric = metrics.NewCounterVec("gor_emitter_queue_errors_total",
+		"Messages the output failed to write.", "output")
+)
+
+// outputQueue 输出的有界队列, 由单独的 goroutine 写入输出, 慢的或出错的输出不影响其他输出
+type outputQueue struct {
+	writer  plugins.PluginWriter
+	address string
+	policy  config.QueuePolicy
+	queue   chan *plugins.Message
+	dropped *metrics.Counter
+	errors  *metrics.Counter
+	failed  int32 // 是否已经打印过错误
+}
+
+// newOutputQueue 启动写入 writer 的 goroutine
+func newOutputQueue(writer plugins.PluginWriter, address string, conf config.OutputQueueConfig) *outputQueue {
+	q := &outputQueue{
+		writer:  writer,
+		address: address,
+		policy:  conf.Policy,
+		queue:   make(chan *plugins.Message, conf.Size),
+		dropped: queueDroppedMetric.With(address),
+		errors:  queueErrorsMetric.With(address),
+	}
+	queueLengthMetric.Func(func() float64 {
+		return float64(len(q.queue))
+	}, address)
+
+	go q.run()
+
+	return q
+}
+
+// PluginWrite 消息放入队列, 队列满时按 policy 等待或丢弃
+func (q *outputQueue) PluginWrite(msg *plugins.Message) (int, error) {
+	switch q.policy {
+	case config.QueueDropNewest:
+		select {
+		case q.queue <- msg:
+		default:
+			q.dropped.Inc()
+		}
+	case config.QueueDropOldest:
+		for !q.offer(msg) {
+			select {
+			case <-q.queue:
+				q.dropped.Inc()
+			default:
+			}
+		}
+	default:
+		q.queue <- msg
+	}
+
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// CloseConnection 连接关闭也放入队列, 保持和消息的顺序, 不会因为队列满丢弃
+func (q *outputQueue) CloseConnection(connectionID string) {
+	if _, ok := q.writer.(plugins.ConnectionCloser); ok {
+		q.queue <- &plugins.Message{ConnectionID: connectionID, ConnectionClosed: true}
+	}
+}
+
+func (q *outputQueue) offer(msg *plugins.Message) bool {
+	select {
+	case q.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// run 写入出错只计数, 继续写后面的消息
+func (q *outputQueue) run() {
+	for msg := range q.queue {
+		if msg.ConnectionClosed {
+			closeConnection([]plugins.PluginWriter{q.writer}, msg.ConnectionID)
+			continue
+		}
+		if _, err := q.writer.PluginWrite(msg); err != nil {
+			q.errors.Inc()
+			if atomic.CompareAndSwapInt32(&q.failed, 0, 1) {
+				logger.Error(fmt.Sprintf("[EMITTER] output %s: %v, following errors are only counted", q.address, err))
+			} else {
+				logger.Debug2(fmt.Sprintf("[EMITTER] output %s: %v", q.address, err))
+			}
+		}
+	}
+}
+
+// close 在不再写入后调用, 队列中剩下的消息写完后 goroutine 退出
+func (q *outputQueue) close() {
+	close(q.queue)
+	queueLengthMetric.Delete(q.address)
+}
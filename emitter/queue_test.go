@@ -0,0 +1,108 @@
+package emitter
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"goreplay/config"
+	"goreplay/plugins"
+)
+
+// blockedOutput 第一条消息阻塞到 release 关闭
+type blockedOutput struct {
+	started chan struct{}
+	release chan struct{}
+	mu      sync.Mutex
+	got     []string
+}
+
+func (o *blockedOutput) PluginWrite(msg *plugins.Message) (int, error) {
+	o.mu.Lock()
+	o.got = append(o.got, string(msg.Data))
+	first := len(o.got) == 1
+	o.mu.Unlock()
+
+	if first {
+		close(o.started)
+		<-o.release
+	}
+
+	return len(msg.Data), nil
+}
+
+func (o *blockedOutput) messages() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]string(nil), o.got...)
+}
+
+func (s *testUnitEmitterSuite) TestOutputQueuePolicy() {
+	for _, tt := range []struct {
+		policy  config.QueuePolicy
+		want    []string
+		dropped float64
+	}{
+		{policy: config.QueueBlock, want: []string{"1", "2", "3", "4"}},
+		{policy: config.QueueDropNewest, want: []string{"1", "2"}, dropped: 2},
+		{policy: config.QueueDropOldest, want: []string{"1", "4"}, dropped: 2},
+	} {
+		s.Run(string(tt.policy), func() {
+			out := &blockedOutput{started: make(chan struct{}), release: make(chan struct{})}
+			q := newOutputQueue(out, "queue-"+string(tt.policy), config.OutputQueueConfig{Size: 1, Policy: tt.policy})
+			before := q.dropped.Value()
+
+			_, _ = q.PluginWrite(&plugins.Message{Data: []byte("1")})
+			<-out.started
+			_, _ = q.PluginWrite(&plugins.Message{Data: []byte("2")})
+			if tt.policy == config.QueueBlock {
+				// 队列已满, 放入 3 会等到 release
+				go func() {
+					_, _ = q.PluginWrite(&plugins.Message{Data: []byte("3")})
+					_, _ = q.PluginWrite(&plugins.Message{Data: []byte("4")})
+					q.close()
+				}()
+			} else {
+				_, _ = q.PluginWrite(&plugins.Message{Data: []byte("3")})
+				_, _ = q.PluginWrite(&plugins.Message{Data: []byte("4")})
+				q.close()
+			}
+			close(out.release)
+
+			s.Eventually(func() bool { return len(out.messages()) == len(tt.want) }, time.Second, time.Millisecond)
+			s.Equal(tt.want, out.messages())
+			s.Equal(tt.dropped, q.dropped.Value()-before)
+		})
+	}
+}
+
+func (s *testUnitEmitterSuite) TestOutputQueueIsolation() {
+	input := newTestInput()
+	received := make(chan *plugins.Message, 10)
+	failing := newTestOutput(nil)
+	failing.(*testOutput).err = errors.New("mock err")
+	plug := &plugins.InOutPlugins{
+		Inputs:          []plugins.PluginReader{input},
+		Outputs:         []plugins.PluginWriter{failing, newTestOutput(func(msg *plugins.Message) { received <- msg })},
+		OutputAddresses: []string{"failing", "working"},
+	}
+	plug.All = []interface{}{input, plug.Outputs[0], plug.Outputs[1]}
+
+	emitter := NewEmitter(Settings{OutputQueue: config.OutputQueueConfig{Size: 10, Policy: config.QueueBlock}})
+	emitter.Start(plug, "")
+
+	errs := queueErrorsMetric.With("failing")
+	before := errs.Value()
+	for i := 0; i < 3; i++ {
+		input.EmitGET()
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			s.FailNow("output stopped after the other output failed")
+		}
+	}
+	s.Eventually(func() bool { return errs.Value()-before == 3 }, time.Second, time.Millisecond)
+
+	emitter.Close()
+}
@@ -0,0 +1,187 @@
+package emitter
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"goreplay/config"
+	"goreplay/errors"
+	"goreplay/plugins"
+	"goreplay/protocol"
+)
+
+const (
+	laneQueueSize = 1000        // 每个连接最多等待的消息数, 满了之后阻塞输入
+	defaultMaxGap = time.Minute // 没有设置 --replay-timing-max-gap 时
+)
+
+// scheduler 按录制的连接重放: 同一个连接的消息按录制的顺序写出, 请求之间保持录制时的间隔,
+// 不同的连接互不等待. 没有 ConnectionID 的消息, 比如来自 --input-file 的, 直接写出.
+// 连接关闭的消息跟在这个连接的消息后面
+type scheduler struct {
+	maxGap  time.Duration
+	write   func(msg *plugins.Message) error
+	writeMu sync.Mutex // write 不是并发安全的
+
+	mu    sync.Mutex
+	lanes map[string]chan *plugins.Message // 按 ConnectionID
+	err   error                            // 第一个写出错误
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newScheduler(conf config.ReplayTimingConfig, write func(msg *plugins.Message) error) *scheduler {
+	if conf.MaxGap <= 0 {
+		conf.MaxGap = defaultMaxGap
+	}
+
+	return &scheduler{
+		maxGap: conf.MaxGap,
+		write:  write,
+		lanes:  make(map[string]chan *plugins.Message),
+		stop:   make(chan struct{}),
+	}
+}
+
+// submit 把消息交给它所在连接的 goroutine, 之前有写出错误时返回这个错误
+func (s *scheduler) submit(msg *plugins.Message) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	lane, ok := s.lanes[msg.ConnectionID]
+	if msg.ConnectionID == "" || (!ok && msg.ConnectionClosed) {
+		defer s.mu.Unlock()
+		return s.send(msg)
+	}
+
+	if !ok {
+		lane = make(chan *plugins.Message, laneQueueSize)
+		s.lanes[msg.ConnectionID] = lane
+		s.wg.Add(1)
+		go s.run(msg.ConnectionID, lane)
+	}
+	select {
+	case lane <- msg:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	s.mu.Unlock()
+
+	// lane 满了, 不持有 mu 等待. 有发送方在等待时 lane 不会变空, 所以不会退出
+	select {
+	case lane <- msg:
+		return nil
+	case <-s.stop:
+		return errors.ErrorStopped
+	}
+}
+
+// run 写出一个连接的消息. 请求在上一个请求写出后, 等录制时它们之间的间隔再写出, 间隔最多 maxGap.
+// 超过 maxGap 没有消息时退出, 之后的消息当作新的连接
+func (s *scheduler) run(id string, lane chan *plugins.Message) {
+	defer s.wg.Done()
+
+	var (
+		last int64 // 上一个请求录制的时间
+		sent time.Time
+	)
+	idle := time.NewTimer(s.maxGap)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-idle.C:
+			s.mu.Lock()
+			if len(lane) == 0 {
+				delete(s.lanes, id)
+				s.mu.Unlock()
+				return
+			}
+			s.mu.Unlock()
+		case msg := <-lane:
+			if !msg.ConnectionClosed && protocol.IsRequestPayload(msg.Meta) {
+				ts := timestamp(msg.Meta)
+				if last != 0 && !s.wait(sent.Add(s.gap(ts-last))) {
+					return
+				}
+				last, sent = ts, time.Now()
+			}
+
+			if err := s.send(msg); err != nil {
+				s.mu.Lock()
+				if s.err == nil {
+					s.err = err
+				}
+				s.mu.Unlock()
+			}
+		}
+
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(s.maxGap)
+	}
+}
+
+// gap 录制时的间隔, 乱序的请求不等待
+func (s *scheduler) gap(d int64) time.Duration {
+	switch {
+	case d < 0:
+		return 0
+	case time.Duration(d) > s.maxGap:
+		return s.maxGap
+	}
+
+	return time.Duration(d)
+}
+
+// wait 等到 t, 停止时返回 false
+func (s *scheduler) wait(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+func (s *scheduler) send(msg *plugins.Message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.write(msg)
+}
+
+// close 停止所有连接的 goroutine, 还在等待的消息不再写出
+func (s *scheduler) close() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// timestamp 消息录制的时间
+func timestamp(meta []byte) int64 {
+	m := protocol.PayloadMeta(meta)
+	if len(m) < 3 {
+		return 0
+	}
+	ts, _ := strconv.ParseInt(string(m[2]), 10, 64)
+
+	return ts
+}
@@ -0,0 +1,138 @@
+package emitter
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"goreplay/config"
+	"goreplay/plugins"
+	"goreplay/protocol"
+)
+
+// timedWrite 写出的消息和写出的时间
+type timedWrite struct {
+	data string
+	at   time.Time
+}
+
+// timedOutput 记录写出的消息
+type timedOutput struct {
+	mu  sync.Mutex
+	got []timedWrite
+	err error
+}
+
+func (o *timedOutput) write(msg *plugins.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.got = append(o.got, timedWrite{data: string(msg.Data), at: time.Now()})
+
+	return o.err
+}
+
+// written 等到写出 n 条消息
+func (o *timedOutput) written(n int) []timedWrite {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		o.mu.Lock()
+		if len(o.got) >= n {
+			o.mu.Unlock()
+			break
+		}
+		o.mu.Unlock()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]timedWrite(nil), o.got...)
+}
+
+// connMessage 连接 conn 上录制于 ms 毫秒的消息
+func connMessage(conn string, payloadType byte, ms int64, data string) *plugins.Message {
+	return &plugins.Message{ConnectionID: conn, Data: []byte(data),
+		Meta: protocol.PayloadHeader(payloadType, protocol.UUID(), ms*int64(time.Millisecond), 0)}
+}
+
+func (s *testUnitEmitterSuite) TestSchedulerTiming() {
+	out := &timedOutput{}
+	sched := newScheduler(config.ReplayTimingConfig{Enabled: true, MaxGap: 300 * time.Millisecond}, out.write)
+	defer sched.close()
+
+	start := time.Now()
+	for _, msg := range []*plugins.Message{
+		connMessage("a", protocol.RequestPayload, 1000, "a1"),
+		connMessage("a", protocol.ResponsePayload, 1010, "a1 response"),
+		connMessage("a", protocol.RequestPayload, 1200, "a2"),
+		// 更长的间隔缩短到 300ms
+		connMessage("a", protocol.RequestPayload, 9000, "a3"),
+		connMessage("b", protocol.RequestPayload, 5000, "b1"),
+		connMessage("b", protocol.RequestPayload, 5100, "b2"),
+		{Data: []byte("file"), Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 0)},
+	} {
+		s.Require().NoError(sched.submit(msg))
+	}
+
+	got := out.written(7)
+	s.Require().Len(got, 7)
+	at := make(map[string]time.Duration)
+	var order []string
+	for _, w := range got {
+		at[w.data] = w.at.Sub(start)
+		if w.data[0] == 'a' {
+			order = append(order, w.data)
+		}
+	}
+
+	s.Equal([]string{"a1", "a1 response", "a2", "a3"}, order)
+	s.Less(int64(at["a1"]), int64(50*time.Millisecond))
+	s.Less(int64(at["a1 response"]), int64(50*time.Millisecond))
+	s.Less(int64(at["file"]), int64(50*time.Millisecond))
+	s.InDelta(int64(200*time.Millisecond), int64(at["a2"]-at["a1"]), float64(50*time.Millisecond))
+	s.InDelta(int64(300*time.Millisecond), int64(at["a3"]-at["a2"]), float64(50*time.Millisecond))
+	// b 不等 a
+	s.Less(int64(at["b1"]), int64(50*time.Millisecond))
+	s.InDelta(int64(100*time.Millisecond), int64(at["b2"]-at["b1"]), float64(50*time.Millisecond))
+}
+
+func (s *testUnitEmitterSuite) TestSchedulerLanes() {
+	out := &timedOutput{err: errors.New("output failed")}
+	sched := newScheduler(config.ReplayTimingConfig{Enabled: true, MaxGap: 50 * time.Millisecond}, out.write)
+
+	s.Require().NoError(sched.submit(connMessage("a", protocol.RequestPayload, 1000, "a1")))
+	s.Len(out.written(1), 1)
+
+	// 空闲超过 MaxGap 的连接退出
+	time.Sleep(150 * time.Millisecond)
+	sched.mu.Lock()
+	s.Empty(sched.lanes)
+	sched.mu.Unlock()
+
+	// 写出错误在下一次 submit 时返回
+	s.Equal(out.err, sched.submit(connMessage("a", protocol.RequestPayload, 1010, "a2")))
+
+	// 关闭时还在等待的消息不再写出
+	out.err = nil
+	sched.err = nil
+	sched.maxGap = time.Minute
+	s.Require().NoError(sched.submit(connMessage("b", protocol.RequestPayload, 1000, "b1")))
+	s.Require().NoError(sched.submit(connMessage("b", protocol.RequestPayload, 31000, "b2")))
+	s.Len(out.written(2), 2)
+	sched.close()
+	s.Len(out.written(2), 2)
+}
+
+func (s *testUnitEmitterSuite) TestSplitOutputByConnection() {
+	var got [2][]string
+	outputs := []plugins.PluginWriter{
+		newTestOutput(func(msg *plugins.Message) { got[0] = append(got[0], string(msg.Data)) }),
+		newTestOutput(func(msg *plugins.Message) { got[1] = append(got[1], string(msg.Data)) }),
+	}
+	e := NewEmitter(Settings{Split: true, Timing: config.ReplayTimingConfig{Enabled: true}})
+
+	index := 0
+	for i := 0; i < 3; i++ {
+		s.NoError(e.splitOutput(&outputs, &index, connMessage("a", protocol.RequestPayload, 1, "a")))
+	}
+	s.Zero(index)
+	s.True(len(got[0]) == 3 || len(got[1]) == 3)
+}
@@ -0,0 +1,46 @@
+#! /usr/bin/env python3
+# -*- coding: utf-8 -*-
+
+# Echo middleware for --middleware-protocol json: every message is answered,
+# requests to /health are dropped and pings are answered with pongs.
+
+import sys
+import json
+import base64
+
+
+def log(msg):
+    """
+    Logging to STDERR as STDOUT and STDIN used for data transfer
+    """
+    sys.stderr.write(str(msg) + '\n')
+    sys.stderr.flush()
+
+
+def answer(frame):
+    sys.stdout.write(json.dumps(frame) + '\n')
+    sys.stdout.flush()
+
+
+def process_stdin():
+    for line in sys.stdin:
+        frame = json.loads(line)
+
+        if frame['type'] == 'ping':
+            answer({'type': 'pong', 'id': frame['id']})
+            continue
+
+        data = base64.b64decode(frame['data'])
+        (raw_metadata, payload) = data.split(b'\n', 1)
+        log('Request type: {}'.format(raw_metadata.split(b' ')[0].decode('ascii')))
+
+        if payload.startswith(b'GET /health '):
+            answer({'type': 'drop', 'id': frame['id']})
+            continue
+
+        frame['data'] = base64.b64encode(raw_metadata + b'\n' + payload).decode('ascii')
+        answer(frame)
+
+
+if __name__ == '__main__':
+    process_stdin()
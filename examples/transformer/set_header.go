@@ -0,0 +1,51 @@
+/*
+This transformer sets a header on every replayed request, in process. Build it as a Go plugin and load it
+with --transformer-plugin, the options of --transformer are the header and its value:
+
+	go build -tags purego -o gor .
+	go build -tags purego -buildmode=plugin -o set_header.so ./examples/transformer
+	gor --input-raw :80 --transformer-plugin ./set_header.so --transformer "set-header:X-Replayed:1" \
+		--output-http staging.com
+
+The plugin must be built with the same Go version, module versions and build tags as gor. The purego tag
+avoids the assembly of xxhash, which can not be linked dynamically.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"goreplay/plugins"
+	"goreplay/plugins/transformer"
+	"goreplay/proto"
+)
+
+func init() {
+	transformer.Register("set-header", transformer.BuilderFunc(newSetHeader))
+}
+
+type setHeader struct {
+	transformer.Passthrough
+	name, value []byte
+}
+
+func newSetHeader(options string) (transformer.Transformer, error) {
+	i := strings.Index(options, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("need header:value, got %q", options)
+	}
+
+	return &setHeader{name: []byte(options[:i]), value: []byte(options[i+1:])}, nil
+}
+
+// Request sets the header, responses pass through Passthrough
+func (t *setHeader) Request(msg *plugins.Message) *plugins.Message {
+	msg.Data = proto.SetHeader(msg.Data, t.name, t.value)
+
+	return msg
+}
+
+// main is needed to build the package, a plugin does not run it
+func main() {}
@@ -1,12 +1,41 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
+	"goreplay/config"
 	"goreplay/logger"
+	"goreplay/logreplay"
+	"goreplay/message"
+	"goreplay/remote"
 )
 
-// ExitProccess 退出goreplay
+// ExitProccess 退出goreplay, 通知模块负责人已经录制的时长
 func ExitProccess(d time.Duration) {
 	logger.Info("exit goreplay after ", d)
+
+	msg := &message.ExitRobotMsg{Module: exitModule(&config.Settings.OutputLogReplayConfig), Time: d}
+	if err := message.Notify(&message.Notice{
+		Title:   "goreplay 录制提醒",
+		Content: msg.ReadMsg(),
+		Level:   message.LevelInfo,
+	}); err != nil {
+		logger.Error("exit notify error: ", err)
+	}
+}
+
+// exitModule 获取模块信息, 失败时只使用配置中的 id. 没有使用 logreplay 时为空
+func exitModule(conf *config.LogReplayOutputConfig) logreplay.Module {
+	if conf.ModuleID == "" {
+		return logreplay.Module{}
+	}
+
+	rsp := &logreplay.GetModuleRsp{}
+	if err := remote.Send(logreplay.GetGetModuleURL, &logreplay.GetModuleReq{ModuleID: conf.ModuleID}, rsp); err != nil {
+		logger.Debug(fmt.Sprintf("get module %s error: %v", conf.ModuleID, err))
+		return logreplay.Module{AppID: conf.APPID, ModuleID: conf.ModuleID}
+	}
+
+	return rsp.Module
 }
@@ -0,0 +1,253 @@
+package framer
+
+import (
+	"errors"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	hpackEntryOverhead = 32 // 每个表项在名字和值之外占用的大小, RFC 7541 4.1
+	hpackStaticLen     = 61
+)
+
+// ErrHPACKInvalid the header block is not valid hpack
+var ErrHPACKInvalid = errors.New("hpack: invalid header block")
+
+// hpackStaticTable RFC 7541 附录 A 的静态表
+var hpackStaticTable = [hpackStaticLen]hpack.HeaderField{
+	{Name: ":authority"}, {Name: ":method", Value: "GET"}, {Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"}, {Name: ":path", Value: "/index.html"}, {Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"}, {Name: ":status", Value: "200"}, {Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"}, {Name: ":status", Value: "304"}, {Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"}, {Name: ":status", Value: "500"}, {Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"}, {Name: "accept-language"}, {Name: "accept-ranges"},
+	{Name: "accept"}, {Name: "access-control-allow-origin"}, {Name: "age"}, {Name: "allow"},
+	{Name: "authorization"}, {Name: "cache-control"}, {Name: "content-disposition"},
+	{Name: "content-encoding"}, {Name: "content-language"}, {Name: "content-length"},
+	{Name: "content-location"}, {Name: "content-range"}, {Name: "content-type"}, {Name: "cookie"},
+	{Name: "date"}, {Name: "etag"}, {Name: "expect"}, {Name: "expires"}, {Name: "from"}, {Name: "host"},
+	{Name: "if-match"}, {Name: "if-modified-since"}, {Name: "if-none-match"}, {Name: "if-range"},
+	{Name: "if-unmodified-since"}, {Name: "last-modified"}, {Name: "link"}, {Name: "location"},
+	{Name: "max-forwards"}, {Name: "proxy-authenticate"}, {Name: "proxy-authorization"}, {Name: "range"},
+	{Name: "referer"}, {Name: "refresh"}, {Name: "retry-after"}, {Name: "server"}, {Name: "set-cookie"},
+	{Name: "strict-transport-security"}, {Name: "transfer-encoding"}, {Name: "user-agent"}, {Name: "vary"},
+	{Name: "via"}, {Name: "www-authenticate"},
+}
+
+// hpackEntry 动态表的表项, known 为 false 时名字没有见过
+type hpackEntry struct {
+	hpack.HeaderField
+	known bool
+}
+
+// HPACKDecoder keeps the hpack dynamic table of one direction of a connection. Unlike hpack.Decoder
+// it doesn't fail on entries it has never seen: when the capture starts in the middle of a connection
+// or a header block is missed, the table holds only the entries added since, which are still at the
+// right index. Fields referring to older entries are left out and counted as missing
+type HPACKDecoder struct {
+	entries []hpackEntry // entries 最新的在最后
+	size    uint32
+	maxSize uint32 // maxSize 当前的大小上限, 由 dynamic table size update 设置
+	synced  bool   // synced 动态表中的表项都是已知的
+}
+
+// NewHPACKDecoder returns a decoder with the default table size of 4096. synced tells whether the
+// table is followed from the start of the connection
+func NewHPACKDecoder(synced bool) *HPACKDecoder {
+	return &HPACKDecoder{maxSize: http2InitHeaderTableSize, synced: synced}
+}
+
+// Synced tells whether every entry the encoder can refer to is known
+func (d *HPACKDecoder) Synced() bool {
+	return d.synced
+}
+
+// SetAllowedMaxDynamicTableSize SETTINGS_HEADER_TABLE_SIZE of the peer, the encoder shrinks its
+// table to it
+func (d *HPACKDecoder) SetAllowedMaxDynamicTableSize(v uint32) {
+	if d.maxSize > v {
+		d.setMaxSize(v)
+	}
+}
+
+// Decode decodes a whole header block, missing is the number of fields left out because they
+// refer to unknown entries. After an error the table is emptied, it is no longer known what the
+// rest of the block added
+func (d *HPACKDecoder) Decode(block []byte) (fields []hpack.HeaderField, missing int, err error) {
+	for p := block; len(p) > 0; {
+		var (
+			hf    hpack.HeaderField
+			known bool
+		)
+		if hf, known, p, err = d.decodeField(p); err != nil {
+			d.Reset()
+			return fields, missing, err
+		}
+		switch {
+		case !known:
+			missing++
+		case hf.Name != "":
+			fields = append(fields, hf)
+		}
+	}
+
+	return fields, missing, nil
+}
+
+// decodeField 解码一个字段, 表大小更新返回空的名字
+func (d *HPACKDecoder) decodeField(p []byte) (hf hpack.HeaderField, known bool, rest []byte, err error) {
+	b := p[0]
+	switch {
+	case b&0x80 != 0: // indexed
+		idx, rest, err := hpackVarInt(7, p)
+		if err != nil || idx == 0 {
+			return hf, false, nil, ErrHPACKInvalid
+		}
+		hf, known = d.at(idx)
+		return hf, known, rest, nil
+	case b&0xc0 == 0x40: // literal with incremental indexing
+		return d.decodeLiteral(6, p, true)
+	case b&0xe0 == 0x20: // dynamic table size update
+		size, rest, err := hpackVarInt(5, p)
+		if err != nil {
+			return hf, false, nil, err
+		}
+		d.setMaxSize(uint32(size))
+		return hf, true, rest, nil
+	default: // literal without indexing, never indexed
+		hf, known, rest, err = d.decodeLiteral(4, p, false)
+		hf.Sensitive = b&0xf0 == 0x10
+		return hf, known, rest, err
+	}
+}
+
+func (d *HPACKDecoder) decodeLiteral(n byte, p []byte, index bool) (hpack.HeaderField, bool,
+	[]byte, error) {
+	var hf hpack.HeaderField
+	nameIdx, p, err := hpackVarInt(n, p)
+	if err != nil {
+		return hf, false, nil, err
+	}
+
+	known := true
+	if nameIdx > 0 {
+		var named hpack.HeaderField
+		named, known = d.at(nameIdx)
+		hf.Name = named.Name
+	} else if hf.Name, p, err = hpackString(p); err != nil {
+		return hf, false, nil, err
+	}
+	if hf.Value, p, err = hpackString(p); err != nil {
+		return hf, false, nil, err
+	}
+
+	// 名字未知的表项也要加入, 之后的表项序号才是对的
+	if index {
+		d.add(hpackEntry{HeaderField: hf, known: known})
+	}
+
+	return hf, known, p, nil
+}
+
+// at 静态表或者动态表中的表项, 动态表从 62 开始, 最新的在前
+func (d *HPACKDecoder) at(idx uint64) (hpack.HeaderField, bool) {
+	if idx <= hpackStaticLen {
+		return hpackStaticTable[idx-1], true
+	}
+
+	i := idx - hpackStaticLen - 1
+	if i >= uint64(len(d.entries)) {
+		return hpack.HeaderField{}, false
+	}
+	e := d.entries[len(d.entries)-1-int(i)]
+
+	return e.HeaderField, e.known
+}
+
+func (d *HPACKDecoder) add(e hpackEntry) {
+	d.entries = append(d.entries, e)
+	d.size += e.Size()
+	d.evict()
+
+	// 表项加起来已经放不下一个更早的表项时, 编码端的表中不会有我们不知道的表项
+	if !d.synced && d.size+hpackEntryOverhead > d.maxSize {
+		d.synced = true
+		for _, e := range d.entries {
+			d.synced = d.synced && e.known
+		}
+	}
+}
+
+func (d *HPACKDecoder) setMaxSize(v uint32) {
+	d.maxSize = v
+	d.evict()
+	if v == 0 {
+		// 动态表被清空
+		d.synced = true
+	}
+}
+
+func (d *HPACKDecoder) evict() {
+	n := 0
+	for d.size > d.maxSize && n < len(d.entries) {
+		d.size -= d.entries[n].Size()
+		n++
+	}
+	d.entries = append(d.entries[:0], d.entries[n:]...)
+}
+
+// Reset forgets the table, for example after a header block was missed
+func (d *HPACKDecoder) Reset() {
+	d.entries, d.size, d.synced = nil, 0, false
+}
+
+// hpackVarInt n 位前缀的整数, RFC 7541 5.1
+func hpackVarInt(n byte, p []byte) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, ErrHPACKInvalid
+	}
+
+	mask := uint64(1)<<n - 1
+	v := uint64(p[0]) & mask
+	p = p[1:]
+	if v < mask {
+		return v, p, nil
+	}
+
+	for shift := uint(0); len(p) > 0 && shift < 63; shift += 7 {
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+	}
+
+	return 0, nil, ErrHPACKInvalid
+}
+
+// hpackString 字符串, 可能是 huffman 编码的, RFC 7541 5.2
+func hpackString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, ErrHPACKInvalid
+	}
+
+	huffman := p[0]&0x80 != 0
+	n, p, err := hpackVarInt(7, p)
+	if err != nil || n > uint64(len(p)) {
+		return "", nil, ErrHPACKInvalid
+	}
+
+	s, p := p[:n], p[n:]
+	if !huffman {
+		return string(s), p, nil
+	}
+
+	v, err := hpack.HuffmanDecodeToString(s)
+	if err != nil {
+		return "", nil, ErrHPACKInvalid
+	}
+
+	return v, p, nil
+}
@@ -0,0 +1,123 @@
+package framer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2/hpack"
+)
+
+// TestUnitHPACK hpack decoder unit test execute
+func TestUnitHPACK(t *testing.T) {
+	suite.Run(t, new(hpackSuite))
+}
+
+type hpackSuite struct {
+	suite.Suite
+	buf bytes.Buffer
+	enc *hpack.Encoder
+}
+
+// SetupTest 每个用例一个新的连接
+func (s *hpackSuite) SetupTest() {
+	s.buf.Reset()
+	s.enc = hpack.NewEncoder(&s.buf)
+}
+
+// block 用连接的 encoder 编码一个 header block
+func (s *hpackSuite) block(fields ...hpack.HeaderField) []byte {
+	s.buf.Reset()
+	for _, hf := range fields {
+		s.Require().NoError(s.enc.WriteField(hf))
+	}
+
+	return append([]byte{}, s.buf.Bytes()...)
+}
+
+func request(path string) []hpack.HeaderField {
+	return []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":path", Value: path},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "x-user", Value: "alice"},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+	}
+}
+
+func (s *hpackSuite) TestDecode() {
+	first := s.block(request("/helloworld.Greeter/SayHello")...)
+	second := s.block(request("/helloworld.Greeter/SayBye")...)
+
+	s.Run("from the start", func() {
+		d := NewHPACKDecoder(true)
+		for _, tt := range []struct {
+			block []byte
+			want  []hpack.HeaderField
+		}{
+			{block: first, want: request("/helloworld.Greeter/SayHello")},
+			{block: second, want: request("/helloworld.Greeter/SayBye")},
+		} {
+			fields, missing, err := d.Decode(tt.block)
+			s.NoError(err)
+			s.Zero(missing)
+			s.Equal(tt.want, fields)
+		}
+		s.True(d.Synced())
+	})
+
+	s.Run("middle of the connection", func() {
+		// 第一个 block 没有抓到, 引用它加入的表项的字段被跳过
+		d := NewHPACKDecoder(false)
+		fields, missing, err := d.Decode(second)
+		s.NoError(err)
+		s.Equal(2, missing)
+		s.Equal([]hpack.HeaderField{{Name: ":method", Value: "POST"},
+			{Name: ":path", Value: "/helloworld.Greeter/SayBye"},
+			{Name: "authorization", Value: "secret", Sensitive: true}}, fields)
+		s.False(d.Synced())
+
+		// 之后加入的表项按正确的序号引用
+		fields, missing, err = d.Decode(s.block(hpack.HeaderField{Name: ":path", Value: "/helloworld.Greeter/SayBye"}))
+		s.NoError(err)
+		s.Zero(missing)
+		s.Equal([]hpack.HeaderField{{Name: ":path", Value: "/helloworld.Greeter/SayBye"}}, fields)
+	})
+}
+
+func (s *hpackSuite) TestResync() {
+	d := NewHPACKDecoder(false)
+	_, _, _ = d.Decode(s.block(request("/a")...))
+	s.False(d.Synced())
+
+	s.Run("table size update", func() {
+		// 对端把动态表改为 0, encoder 在下一个 block 开头清空动态表
+		d.SetAllowedMaxDynamicTableSize(0)
+		s.enc.SetMaxDynamicTableSizeLimit(0)
+		s.True(d.Synced())
+
+		s.enc.SetMaxDynamicTableSizeLimit(4096)
+		s.enc.SetMaxDynamicTableSize(4096)
+		fields, missing, err := d.Decode(s.block(request("/b")...))
+		s.NoError(err)
+		s.Zero(missing)
+		s.Equal(request("/b"), fields)
+	})
+
+	s.Run("table filled", func() {
+		d := NewHPACKDecoder(false)
+		long := hpack.HeaderField{Name: "x-payload", Value: string(bytes.Repeat([]byte("x"), 4040))}
+		_, _, err := d.Decode(s.block(long))
+		s.NoError(err)
+		s.True(d.Synced())
+	})
+
+	s.Run("invalid block", func() {
+		d := NewHPACKDecoder(true)
+		_, _, err := d.Decode([]byte{0x80})
+		s.ErrorIs(err, ErrHPACKInvalid)
+		_, _, err = d.Decode([]byte{0x40, 0x85, 'a'})
+		s.ErrorIs(err, ErrHPACKInvalid)
+		s.False(d.Synced())
+	})
+}
@@ -0,0 +1,563 @@
+package framer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// mysql commands
+const (
+	MySQLComQuit             byte = 0x01
+	MySQLComInitDB           byte = 0x02
+	MySQLComQuery            byte = 0x03
+	MySQLComFieldList        byte = 0x04
+	MySQLComPing             byte = 0x0e
+	MySQLComStmtPrepare      byte = 0x16
+	MySQLComStmtExecute      byte = 0x17
+	MySQLComStmtSendLongData byte = 0x18
+	MySQLComStmtClose        byte = 0x19
+	MySQLComStmtReset        byte = 0x1a
+)
+
+// mysql packet headers
+const (
+	MySQLHeaderLen    = 4
+	MySQLMaxPacketLen = 1<<24 - 1
+	MySQLOK           = 0x00
+	MySQLEOF          = 0xfe
+	MySQLErr          = 0xff
+	MySQLLocalInfile  = 0xfb
+	MySQLHandshakeV10 = 0x0a
+)
+
+// mysql capability flags
+const (
+	MySQLClientLongPassword         uint32 = 0x00000001
+	MySQLClientLongFlag             uint32 = 0x00000004
+	MySQLClientConnectWithDB        uint32 = 0x00000008
+	MySQLClientProtocol41           uint32 = 0x00000200
+	MySQLClientTransactions         uint32 = 0x00002000
+	MySQLClientSecureConnection     uint32 = 0x00008000
+	MySQLClientMultiResults         uint32 = 0x00020000
+	MySQLClientPSMultiResults       uint32 = 0x00040000
+	MySQLClientPluginAuth           uint32 = 0x00080000
+	MySQLClientPluginAuthLenencData uint32 = 0x00200000
+	MySQLClientDeprecateEOF         uint32 = 0x01000000
+)
+
+const (
+	mysqlEOFMaxLen                   = 7 // EOF packets are 5 bytes, OK packets used as EOF at least 7
+	mysqlMoreResults                 = 0x0008
+	mysqlStmtsCacheLen               = 65535
+	mysqlCapabilityUpperShift        = 16
+	mysqlGreetingAuthDataPart1Len    = 8
+	mysqlGreetingReservedLen         = 10
+	mysqlGreetingMinAuthDataPart2Len = 13
+	mysqlOKPrepareLen                = 9
+)
+
+var (
+	// ErrMySQLShort the payload doesn't hold a whole mysql packet yet
+	ErrMySQLShort = errors.New("mysql: short payload")
+	// ErrMySQLInvalid the payload is not what the mysql protocol expects
+	ErrMySQLInvalid = errors.New("mysql: invalid payload")
+)
+
+// MySQLPacket a logical mysql packet, payloads of MySQLMaxPacketLen bytes are joined with the next ones
+type MySQLPacket struct {
+	SeqID   byte
+	Payload []byte
+	Len     int // bytes taken on the wire, headers included
+}
+
+// ReadMySQLPacket reads the logical packet at the start of data
+func ReadMySQLPacket(data []byte) (MySQLPacket, error) {
+	var p MySQLPacket
+	for {
+		if len(data)-p.Len < MySQLHeaderLen {
+			return p, ErrMySQLShort
+		}
+
+		h := data[p.Len:]
+		n := int(uint32(h[0]) | uint32(h[1])<<8 | uint32(h[2])<<16)
+		if len(h) < MySQLHeaderLen+n {
+			return p, ErrMySQLShort
+		}
+
+		if p.Len == 0 {
+			p.SeqID = h[3]
+			p.Payload = h[MySQLHeaderLen : MySQLHeaderLen+n]
+		} else {
+			p.Payload = append(append([]byte{}, p.Payload...), h[MySQLHeaderLen:MySQLHeaderLen+n]...)
+		}
+		p.Len += MySQLHeaderLen + n
+
+		if n < MySQLMaxPacketLen {
+			return p, nil
+		}
+	}
+}
+
+// MySQLCommand returns the command byte and its arguments of a captured command message
+func MySQLCommand(data []byte) (byte, []byte, error) {
+	p, err := ReadMySQLPacket(data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if p.SeqID != 0 || len(p.Payload) == 0 {
+		return 0, nil, ErrMySQLInvalid
+	}
+
+	return p.Payload[0], p.Payload[1:], nil
+}
+
+// MySQLCommandName name of the command, used when there is no statement to describe it
+func MySQLCommandName(cmd byte) string {
+	switch cmd {
+	case MySQLComQuit:
+		return "COM_QUIT"
+	case MySQLComInitDB:
+		return "COM_INIT_DB"
+	case MySQLComQuery:
+		return "COM_QUERY"
+	case MySQLComFieldList:
+		return "COM_FIELD_LIST"
+	case MySQLComPing:
+		return "COM_PING"
+	case MySQLComStmtPrepare:
+		return "COM_STMT_PREPARE"
+	case MySQLComStmtExecute:
+		return "COM_STMT_EXECUTE"
+	case MySQLComStmtSendLongData:
+		return "COM_STMT_SEND_LONG_DATA"
+	case MySQLComStmtClose:
+		return "COM_STMT_CLOSE"
+	case MySQLComStmtReset:
+		return "COM_STMT_RESET"
+	}
+
+	return fmt.Sprintf("COM_0x%02x", cmd)
+}
+
+// MySQLHasResponse the server doesn't answer some commands
+func MySQLHasResponse(cmd byte) bool {
+	switch cmd {
+	case MySQLComQuit, MySQLComStmtSendLongData, MySQLComStmtClose:
+		return false
+	}
+
+	return true
+}
+
+// MySQLGreeting what we need of the server's initial handshake packet
+type MySQLGreeting struct {
+	Capabilities uint32
+	AuthData     []byte
+	AuthPlugin   string
+}
+
+// ParseMySQLGreeting parses the payload of a protocol v10 initial handshake packet
+func ParseMySQLGreeting(payload []byte) (*MySQLGreeting, error) {
+	if len(payload) == 0 || payload[0] != MySQLHandshakeV10 {
+		return nil, ErrMySQLInvalid
+	}
+
+	r := &mysqlReader{buf: payload, pos: 1}
+	r.nulString() // server version
+	r.skip(4)     // connection id
+	authData := append([]byte{}, r.bytes(mysqlGreetingAuthDataPart1Len)...)
+	r.skip(1) // filler
+	capLow := r.uint16()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	g := &MySQLGreeting{Capabilities: uint32(capLow), AuthData: authData}
+	if r.pos == len(payload) {
+		return g, nil
+	}
+
+	r.skip(1) // character set
+	r.skip(2) // status flags
+	g.Capabilities |= uint32(r.uint16()) << mysqlCapabilityUpperShift
+	authDataLen := int(r.byte())
+	r.skip(mysqlGreetingReservedLen)
+
+	if g.Capabilities&MySQLClientSecureConnection != 0 {
+		n := authDataLen - mysqlGreetingAuthDataPart1Len
+		if n < mysqlGreetingMinAuthDataPart2Len {
+			n = mysqlGreetingMinAuthDataPart2Len
+		}
+		part2 := r.bytes(n)
+		// the last byte is a NUL terminator
+		if len(part2) > 0 {
+			part2 = part2[:len(part2)-1]
+		}
+		g.AuthData = append(g.AuthData, part2...)
+	}
+
+	if g.Capabilities&MySQLClientPluginAuth != 0 {
+		g.AuthPlugin = r.nulString()
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return g, nil
+}
+
+// MySQLHandshakeCapabilities capabilities of a client handshake response payload
+func MySQLHandshakeCapabilities(payload []byte) (uint32, error) {
+	if len(payload) < 4 {
+		return 0, ErrMySQLInvalid
+	}
+
+	return binary.LittleEndian.Uint32(payload), nil
+}
+
+// MySQLLenEncInt reads a length encoded integer, returning its value and size
+func MySQLLenEncInt(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, ErrMySQLShort
+	}
+
+	var n int
+	switch b[0] {
+	case 0xfc:
+		n = 2
+	case 0xfd:
+		n = 3
+	case 0xfe:
+		n = 8
+	case 0xfb, 0xff:
+		return 0, 0, ErrMySQLInvalid
+	default:
+		return uint64(b[0]), 1, nil
+	}
+
+	if len(b) < n+1 {
+		return 0, 0, ErrMySQLShort
+	}
+
+	var v uint64
+	for i := n; i > 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+
+	return v, n + 1, nil
+}
+
+// response parsing states
+const (
+	mysqlRespFirst = iota
+	mysqlRespColumns
+	mysqlRespColumnsEOF
+	mysqlRespRows
+	mysqlRespPrepareParams
+	mysqlRespPrepareParamsEOF
+	mysqlRespPrepareColumns
+	mysqlRespPrepareColumnsEOF
+	mysqlRespDone
+)
+
+// MySQLResponse follows the packets of the response to one command to tell where it ends
+type MySQLResponse struct {
+	// DeprecateEOF CLIENT_DEPRECATE_EOF was negotiated. It is learned from result sets when
+	// the handshake wasn't seen, and matters only for the end of prepare responses.
+	DeprecateEOF bool
+	// StmtID statement id of a successful prepare
+	StmtID uint32
+
+	cmd       byte
+	state     int
+	remaining uint64
+	columns   uint64
+}
+
+// NewMySQLResponse response to cmd
+func NewMySQLResponse(cmd byte, deprecateEOF bool) *MySQLResponse {
+	return &MySQLResponse{cmd: cmd, DeprecateEOF: deprecateEOF}
+}
+
+// Done the last packet of the response has been seen
+func (r *MySQLResponse) Done() bool {
+	return r.state == mysqlRespDone
+}
+
+// Next feeds the payload of the next packet, it reports whether the response ends with it
+func (r *MySQLResponse) Next(payload []byte) (bool, error) {
+	if r.state == mysqlRespDone {
+		return true, ErrMySQLInvalid
+	}
+
+	if len(payload) == 0 {
+		return false, ErrMySQLInvalid
+	}
+
+	var err error
+	switch r.state {
+	case mysqlRespFirst:
+		err = r.first(payload)
+	case mysqlRespColumns:
+		r.countDown(mysqlRespColumnsEOF)
+	case mysqlRespColumnsEOF:
+		if isMySQLEOF(payload) {
+			r.state = mysqlRespRows
+			break
+		}
+
+		r.DeprecateEOF = true
+		r.row(payload)
+	case mysqlRespRows:
+		r.row(payload)
+	case mysqlRespPrepareParams:
+		r.countDown(mysqlRespPrepareParamsEOF)
+		if r.state == mysqlRespPrepareParamsEOF && r.DeprecateEOF {
+			r.prepareColumns()
+		}
+	case mysqlRespPrepareParamsEOF:
+		if isMySQLEOF(payload) {
+			r.prepareColumns()
+			break
+		}
+
+		// no EOF, this is the first column definition
+		r.DeprecateEOF = true
+		r.prepareColumns()
+		r.countDown(mysqlRespPrepareColumnsEOF)
+		if r.state == mysqlRespPrepareColumnsEOF {
+			r.state = mysqlRespDone
+		}
+	case mysqlRespPrepareColumns:
+		r.countDown(mysqlRespPrepareColumnsEOF)
+		if r.state == mysqlRespPrepareColumnsEOF && r.DeprecateEOF {
+			r.state = mysqlRespDone
+		}
+	case mysqlRespPrepareColumnsEOF:
+		if !isMySQLEOF(payload) {
+			return false, ErrMySQLInvalid
+		}
+		r.state = mysqlRespDone
+	}
+
+	return r.state == mysqlRespDone, err
+}
+
+func (r *MySQLResponse) first(payload []byte) error {
+	switch {
+	case payload[0] == MySQLErr, payload[0] == MySQLLocalInfile:
+		r.state = mysqlRespDone
+	case payload[0] == MySQLOK && r.cmd == MySQLComStmtPrepare:
+		// OK_Prepare: status, statement id(4), columns(2), params(2), filler, warnings(2)
+		if len(payload) < mysqlOKPrepareLen {
+			return ErrMySQLInvalid
+		}
+		r.StmtID = binary.LittleEndian.Uint32(payload[1:])
+		r.columns = uint64(binary.LittleEndian.Uint16(payload[5:]))
+		r.remaining = uint64(binary.LittleEndian.Uint16(payload[7:]))
+		r.state = mysqlRespPrepareParams
+		if r.remaining == 0 {
+			r.prepareColumns()
+		}
+	case payload[0] == MySQLOK:
+		r.end(payload)
+	case r.cmd == MySQLComQuery || r.cmd == MySQLComStmtExecute:
+		n, _, err := MySQLLenEncInt(payload)
+		if err != nil {
+			return ErrMySQLInvalid
+		}
+		r.remaining = n
+		r.state = mysqlRespColumns
+	case r.cmd == MySQLComFieldList:
+		// column definitions ended by an EOF packet
+		r.state = mysqlRespRows
+		r.row(payload)
+	default:
+		// COM_STATISTICS and friends answer with one packet
+		r.state = mysqlRespDone
+	}
+
+	return nil
+}
+
+func (r *MySQLResponse) countDown(next int) {
+	if r.remaining > 0 {
+		r.remaining--
+	}
+
+	if r.remaining == 0 {
+		r.state = next
+	}
+}
+
+func (r *MySQLResponse) prepareColumns() {
+	r.remaining = r.columns
+	r.state = mysqlRespPrepareColumns
+	if r.remaining == 0 {
+		r.state = mysqlRespDone
+	}
+}
+
+func (r *MySQLResponse) row(payload []byte) {
+	switch {
+	case payload[0] == MySQLErr:
+		r.state = mysqlRespDone
+	case payload[0] == MySQLEOF && len(payload) < MySQLMaxPacketLen:
+		r.end(payload)
+	}
+}
+
+// end handles OK and EOF packets closing a result, more results may follow
+func (r *MySQLResponse) end(payload []byte) {
+	r.state = mysqlRespDone
+	if mysqlStatus(payload)&mysqlMoreResults != 0 {
+		r.state = mysqlRespFirst
+	}
+}
+
+func isMySQLEOF(payload []byte) bool {
+	return payload[0] == MySQLEOF && len(payload) < mysqlEOFMaxLen
+}
+
+// mysqlStatus status flags of OK and EOF packets
+func mysqlStatus(payload []byte) uint16 {
+	if isMySQLEOF(payload) {
+		if len(payload) < 5 {
+			return 0
+		}
+
+		return binary.LittleEndian.Uint16(payload[3:])
+	}
+
+	pos := 1
+	for i := 0; i < 2; i++ { // affected rows, last insert id
+		_, n, err := MySQLLenEncInt(payload[pos:])
+		if err != nil {
+			return 0
+		}
+		pos += n
+	}
+
+	if len(payload) < pos+2 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint16(payload[pos:])
+}
+
+// mysqlReader reads handshake fields, the first error sticks
+type mysqlReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *mysqlReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if len(r.buf)-r.pos < n {
+		r.err = ErrMySQLInvalid
+		return nil
+	}
+	r.pos += n
+
+	return r.buf[r.pos-n : r.pos]
+}
+
+func (r *mysqlReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *mysqlReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *mysqlReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *mysqlReader) nulString() string {
+	if r.err != nil {
+		return ""
+	}
+
+	for i := r.pos; i < len(r.buf); i++ {
+		if r.buf[i] == 0 {
+			s := string(r.buf[r.pos:i])
+			r.pos = i + 1
+			return s
+		}
+	}
+
+	// the plugin name of old servers isn't terminated
+	s := string(r.buf[r.pos:])
+	r.pos = len(r.buf)
+
+	return s
+}
+
+var (
+	mysqlStmts     = lru.New(mysqlStmtsCacheLen)
+	mysqlStmtsLock sync.Mutex
+)
+
+func mysqlStmtKey(connectionID string, stmtID uint32) string {
+	return fmt.Sprintf("%s_%d", connectionID, stmtID)
+}
+
+// PutMySQLStatement remembers the sql of a prepared statement of a connection
+func PutMySQLStatement(connectionID string, stmtID uint32, sql string) {
+	mysqlStmtsLock.Lock()
+	mysqlStmts.Add(mysqlStmtKey(connectionID, stmtID), sql)
+	mysqlStmtsLock.Unlock()
+}
+
+// MySQLStatement sql of a prepared statement of a connection
+func MySQLStatement(connectionID string, stmtID uint32) (string, bool) {
+	mysqlStmtsLock.Lock()
+	defer mysqlStmtsLock.Unlock()
+
+	if sql, ok := mysqlStmts.Get(mysqlStmtKey(connectionID, stmtID)); ok {
+		return sql.(string), true
+	}
+
+	return "", false
+}
+
+// DelMySQLStatement forgets a closed statement
+func DelMySQLStatement(connectionID string, stmtID uint32) {
+	mysqlStmtsLock.Lock()
+	mysqlStmts.Remove(mysqlStmtKey(connectionID, stmtID))
+	mysqlStmtsLock.Unlock()
+}
+
+// MySQLCommandSQL statement of a COM_QUERY, COM_STMT_PREPARE or COM_STMT_EXECUTE whose prepare was recorded
+func MySQLCommandSQL(cmd byte, args []byte, connectionID string) (string, bool) {
+	switch cmd {
+	case MySQLComQuery, MySQLComStmtPrepare:
+		return string(args), true
+	case MySQLComStmtExecute:
+		if len(args) < 4 {
+			return "", false
+		}
+		return MySQLStatement(connectionID, binary.LittleEndian.Uint32(args))
+	}
+
+	return "", false
+}
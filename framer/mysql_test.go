@@ -0,0 +1,233 @@
+package framer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitMySQL mysql test execute
+func TestUnitMySQL(t *testing.T) {
+	suite.Run(t, new(TestUnitMySQLSuite))
+}
+
+// TestUnitMySQLSuite mysql test suite
+type TestUnitMySQLSuite struct {
+	suite.Suite
+}
+
+func mysqlPacket(seq byte, payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...)
+}
+
+// mysqlOK OK packet payload with status flags
+func mysqlOK(header byte, status uint16) []byte {
+	p := []byte{header, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(p[3:], status)
+	return p
+}
+
+// mysqlEOF classic EOF packet payload with status flags
+func mysqlEOF(status uint16) []byte {
+	p := []byte{MySQLEOF, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(p[3:], status)
+	return p
+}
+
+// TestReadMySQLPacket test ReadMySQLPacket method
+func (t *TestUnitMySQLSuite) TestReadMySQLPacket() {
+	big := bytes.Repeat([]byte{'a'}, MySQLMaxPacketLen)
+	joined := append(mysqlPacket(0, big), mysqlPacket(1, []byte("bc"))...)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantSeq     byte
+		wantPayload []byte
+		wantLen     int
+		wantErr     error
+	}{
+		{name: "packet", data: append(mysqlPacket(3, []byte("abc")), 1, 2), wantSeq: 3, wantPayload: []byte("abc"),
+			wantLen: 7},
+		{name: "empty payload", data: mysqlPacket(1, nil), wantSeq: 1, wantPayload: []byte{}, wantLen: 4},
+		{name: "joined payloads", data: joined, wantPayload: append(big, 'b', 'c'), wantLen: len(joined)},
+		{name: "short header", data: []byte{3, 0}, wantErr: ErrMySQLShort},
+		{name: "short payload", data: mysqlPacket(0, []byte("abc"))[:6], wantErr: ErrMySQLShort},
+		{name: "short joined payload", data: mysqlPacket(0, big), wantErr: ErrMySQLShort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			p, err := ReadMySQLPacket(tt.data)
+			t.Equal(tt.wantErr, err)
+			if err != nil {
+				return
+			}
+
+			t.Equal(tt.wantSeq, p.SeqID)
+			t.Equal(tt.wantPayload, p.Payload)
+			t.Equal(tt.wantLen, p.Len)
+		})
+	}
+}
+
+// TestMySQLCommand test MySQLCommand method
+func (t *TestUnitMySQLSuite) TestMySQLCommand() {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantCmd  byte
+		wantArgs string
+		wantErr  error
+	}{
+		{name: "query", data: mysqlPacket(0, []byte("\x03SELECT 1")), wantCmd: MySQLComQuery, wantArgs: "SELECT 1"},
+		{name: "ping", data: mysqlPacket(0, []byte{MySQLComPing}), wantCmd: MySQLComPing},
+		{name: "not a command", data: mysqlPacket(1, []byte("\x03SELECT 1")), wantErr: ErrMySQLInvalid},
+		{name: "empty", data: mysqlPacket(0, nil), wantErr: ErrMySQLInvalid},
+		{name: "short", data: []byte{9, 0, 0, 0, 3}, wantErr: ErrMySQLShort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			cmd, args, err := MySQLCommand(tt.data)
+			t.Equal(tt.wantErr, err)
+			t.Equal(tt.wantCmd, cmd)
+			t.Equal(tt.wantArgs, string(args))
+		})
+	}
+}
+
+// TestParseMySQLGreeting test ParseMySQLGreeting method
+func (t *TestUnitMySQLSuite) TestParseMySQLGreeting() {
+	caps := MySQLClientProtocol41 | MySQLClientSecureConnection | MySQLClientPluginAuth | MySQLClientDeprecateEOF
+	greeting := []byte{MySQLHandshakeV10}
+	greeting = append(greeting, "8.0.30\x00"...)
+	greeting = append(greeting, 1, 0, 0, 0)
+	greeting = append(greeting, "abcdefgh\x00"...)
+	greeting = append(greeting, byte(caps), byte(caps>>8), 45, 2, 0, byte(caps>>16), byte(caps>>24), 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, "ijklmnopqrst\x00"...)
+	greeting = append(greeting, "caching_sha2_password\x00"...)
+
+	g, err := ParseMySQLGreeting(greeting)
+	t.Require().NoError(err)
+	t.Equal(caps, g.Capabilities)
+	t.Equal("abcdefghijklmnopqrst", string(g.AuthData))
+	t.Equal("caching_sha2_password", g.AuthPlugin)
+
+	_, err = ParseMySQLGreeting(greeting[:20])
+	t.Equal(ErrMySQLInvalid, err)
+	_, err = ParseMySQLGreeting([]byte{MySQLErr, 1, 2})
+	t.Equal(ErrMySQLInvalid, err)
+}
+
+// TestMySQLLenEncInt test MySQLLenEncInt method
+func (t *TestUnitMySQLSuite) TestMySQLLenEncInt() {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    uint64
+		wantLen int
+		wantErr error
+	}{
+		{name: "one byte", b: []byte{250}, want: 250, wantLen: 1},
+		{name: "two bytes", b: []byte{0xfc, 0x34, 0x12}, want: 0x1234, wantLen: 3},
+		{name: "three bytes", b: []byte{0xfd, 0x56, 0x34, 0x12}, want: 0x123456, wantLen: 4},
+		{name: "eight bytes", b: []byte{0xfe, 1, 0, 0, 0, 0, 0, 0, 1}, want: 1<<56 + 1, wantLen: 9},
+		{name: "null", b: []byte{0xfb}, wantErr: ErrMySQLInvalid},
+		{name: "short", b: []byte{0xfc, 1}, wantErr: ErrMySQLShort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			v, n, err := MySQLLenEncInt(tt.b)
+			t.Equal(tt.wantErr, err)
+			t.Equal(tt.want, v)
+			t.Equal(tt.wantLen, n)
+		})
+	}
+}
+
+// TestMySQLResponse test MySQLResponse, the response ends with the last payload
+func (t *TestUnitMySQLSuite) TestMySQLResponse() {
+	column := []byte("\x03def\x00\x01t\x01t\x01a\x01a\x0c\x21\x00\x0b\x00\x00\x00\x03\x00\x00\x00\x00\x00")
+	row := []byte("\x011")
+	prepareOK := func(columns, params byte) []byte {
+		return []byte{MySQLOK, 1, 0, 0, 0, columns, 0, params, 0, 0, 0, 0}
+	}
+
+	tests := []struct {
+		name         string
+		cmd          byte
+		deprecateEOF bool
+		payloads     [][]byte
+		wantDeprEOF  bool
+		wantStmtID   uint32
+	}{
+		{name: "ok", cmd: MySQLComQuery, payloads: [][]byte{mysqlOK(MySQLOK, 0)}},
+		{name: "error", cmd: MySQLComQuery, payloads: [][]byte{[]byte("\xff\x48\x04#HY000No tables used")}},
+		{name: "local infile", cmd: MySQLComQuery, payloads: [][]byte{[]byte("\xfbdata.csv")}},
+		{name: "result set", cmd: MySQLComQuery,
+			payloads: [][]byte{{1}, column, mysqlEOF(0), row, row, mysqlEOF(0)}},
+		{name: "result set without EOF", cmd: MySQLComQuery, deprecateEOF: true,
+			payloads: [][]byte{{1}, column, row, mysqlOK(MySQLEOF, 0)}, wantDeprEOF: true},
+		{name: "learns EOF is deprecated", cmd: MySQLComQuery,
+			payloads: [][]byte{{1}, column, mysqlOK(MySQLEOF, 0)}, wantDeprEOF: true},
+		{name: "error in rows", cmd: MySQLComQuery,
+			payloads: [][]byte{{1}, column, mysqlEOF(0), row, []byte("\xff\x48\x04#HY000oops")}},
+		{name: "more results", cmd: MySQLComQuery,
+			payloads: [][]byte{{1}, column, mysqlEOF(0), row, mysqlEOF(mysqlMoreResults), mysqlOK(MySQLOK, 0)}},
+		{name: "binary result set", cmd: MySQLComStmtExecute,
+			payloads: [][]byte{{1}, column, mysqlEOF(0), {0, 0, 1}, mysqlEOF(0)}},
+		{name: "prepare", cmd: MySQLComStmtPrepare,
+			payloads: [][]byte{prepareOK(1, 2), column, column, mysqlEOF(0), column, mysqlEOF(0)}, wantStmtID: 1},
+		{name: "prepare without EOF", cmd: MySQLComStmtPrepare, deprecateEOF: true,
+			payloads: [][]byte{prepareOK(1, 1), column, column}, wantDeprEOF: true, wantStmtID: 1},
+		{name: "prepare learns EOF is deprecated", cmd: MySQLComStmtPrepare,
+			payloads: [][]byte{prepareOK(2, 1), column, column, column}, wantDeprEOF: true, wantStmtID: 1},
+		{name: "prepare without params", cmd: MySQLComStmtPrepare,
+			payloads: [][]byte{prepareOK(1, 0), column, mysqlEOF(0)}, wantStmtID: 1},
+		{name: "prepare without columns", cmd: MySQLComStmtPrepare,
+			payloads: [][]byte{prepareOK(0, 1), column, mysqlEOF(0)}, wantStmtID: 1},
+		{name: "field list", cmd: MySQLComFieldList, payloads: [][]byte{column, column, mysqlEOF(0)}},
+		{name: "statistics", cmd: 0x09, payloads: [][]byte{[]byte("Uptime: 10")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			r := NewMySQLResponse(tt.cmd, tt.deprecateEOF)
+			for i, payload := range tt.payloads {
+				done, err := r.Next(payload)
+				t.Require().NoError(err)
+				t.Equal(i == len(tt.payloads)-1, done, "payload %d", i)
+			}
+
+			t.True(r.Done())
+			t.Equal(tt.wantDeprEOF, r.DeprecateEOF)
+			t.Equal(tt.wantStmtID, r.StmtID)
+		})
+	}
+}
+
+// TestMySQLStatement test the prepared statement registry
+func (t *TestUnitMySQLSuite) TestMySQLStatement() {
+	PutMySQLStatement("conn", 1, "SELECT ?")
+
+	sql, ok := MySQLStatement("conn", 1)
+	t.True(ok)
+	t.Equal("SELECT ?", sql)
+
+	_, ok = MySQLStatement("other", 1)
+	t.False(ok)
+
+	sql, ok = MySQLCommandSQL(MySQLComStmtExecute, []byte{1, 0, 0, 0, 0, 1, 0, 0, 0}, "conn")
+	t.True(ok)
+	t.Equal("SELECT ?", sql)
+
+	DelMySQLStatement("conn", 1)
+	_, ok = MySQLStatement("conn", 1)
+	t.False(ok)
+}
@@ -0,0 +1,276 @@
+package framer
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	respMaxLineLen = 64 << 10
+	respMaxDepth   = 64
+	respNull       = -1 // length of null bulk strings and arrays
+	respStreamed   = -2 // length of RESP3 streamed strings and aggregates
+)
+
+// RESPPush type byte of RESP3 out of band push messages, they don't answer any command
+const RESPPush = '>'
+
+var (
+	// ErrRESPShort the payload doesn't hold a whole RESP value yet
+	ErrRESPShort = errors.New("resp: short payload")
+	// ErrRESPInvalid the payload is not RESP
+	ErrRESPInvalid = errors.New("resp: invalid payload")
+)
+
+// RESPMessageLen returns the length of the RESP2/RESP3 value at the start of payload,
+// ErrRESPShort is returned until all of it has been received
+func RESPMessageLen(payload []byte) (int, error) {
+	return respValueEnd(payload, 0, 0)
+}
+
+// RESPCommandLen is RESPMessageLen for commands, which may also be sent inline
+func RESPCommandLen(payload []byte) (int, error) {
+	if len(payload) > 0 && !isRESPType(payload[0]) {
+		return respInlineLen(payload)
+	}
+
+	return respValueEnd(payload, 0, 0)
+}
+
+// RESPCommand returns the upper cased name of the command at the start of payload
+func RESPCommand(payload []byte) (string, error) {
+	if len(payload) == 0 {
+		return "", ErrRESPShort
+	}
+
+	if payload[0] != '*' {
+		if isRESPType(payload[0]) {
+			return "", ErrRESPInvalid
+		}
+
+		n, err := respInlineLen(payload)
+		if err != nil {
+			return "", err
+		}
+
+		fields := strings.Fields(string(payload[:n]))
+		if len(fields) == 0 {
+			return "", ErrRESPInvalid
+		}
+
+		return strings.ToUpper(fields[0]), nil
+	}
+
+	count, pos, err := respLength(payload, 0)
+	if err != nil {
+		return "", err
+	}
+
+	if count < 1 {
+		return "", ErrRESPInvalid
+	}
+
+	if pos >= len(payload) {
+		return "", ErrRESPShort
+	}
+
+	if payload[pos] != '$' {
+		return "", ErrRESPInvalid
+	}
+
+	n, start, err := respLength(payload, pos)
+	if err != nil {
+		return "", err
+	}
+
+	if n <= 0 {
+		return "", ErrRESPInvalid
+	}
+
+	if len(payload) < start+n {
+		return "", ErrRESPShort
+	}
+
+	return strings.ToUpper(string(payload[start : start+n])), nil
+}
+
+func isRESPType(t byte) bool {
+	switch t {
+	case '+', '-', ':', '$', '*', '_', ',', '#', '(', '!', '=', '%', '~', '>', '|':
+		return true
+	}
+
+	return false
+}
+
+// respInlineLen inline commands end with the first new line
+func respInlineLen(payload []byte) (int, error) {
+	i := bytes.IndexByte(payload, '\n')
+	if i == -1 {
+		if len(payload) > respMaxLineLen {
+			return 0, ErrRESPInvalid
+		}
+
+		return 0, ErrRESPShort
+	}
+
+	return i + 1, nil
+}
+
+// respLine returns the content of the line starting at pos and the position after its CRLF
+func respLine(b []byte, pos int) ([]byte, int, error) {
+	i := bytes.Index(b[pos:], []byte("\r\n"))
+	if i == -1 {
+		if len(b)-pos > respMaxLineLen {
+			return nil, 0, ErrRESPInvalid
+		}
+
+		return nil, 0, ErrRESPShort
+	}
+
+	return b[pos+1 : pos+i], pos + i + 2, nil
+}
+
+// respLength parses the length line of a bulk or aggregate value
+func respLength(b []byte, pos int) (int, int, error) {
+	line, next, err := respLine(b, pos)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(line) == 1 && line[0] == '?' {
+		return respStreamed, next, nil
+	}
+
+	n, err := strconv.Atoi(string(line))
+	if err != nil || n < respNull {
+		return 0, 0, ErrRESPInvalid
+	}
+
+	return n, next, nil
+}
+
+// respValueEnd returns the position after the value starting at pos
+func respValueEnd(b []byte, pos, depth int) (int, error) {
+	if depth > respMaxDepth {
+		return 0, ErrRESPInvalid
+	}
+
+	if pos >= len(b) {
+		return 0, ErrRESPShort
+	}
+
+	switch b[pos] {
+	case '+', '-', ':', '_', ',', '#', '(':
+		_, next, err := respLine(b, pos)
+		return next, err
+	case '$', '!', '=':
+		return respBulkEnd(b, pos)
+	case '*', '~', '>':
+		return respAggregateEnd(b, pos, depth, 1)
+	case '%':
+		return respAggregateEnd(b, pos, depth, 2)
+	case '|':
+		// attributes are followed by the value they describe
+		next, err := respAggregateEnd(b, pos, depth, 2)
+		if err != nil {
+			return 0, err
+		}
+
+		return respValueEnd(b, next, depth+1)
+	default:
+		return 0, ErrRESPInvalid
+	}
+}
+
+func respBulkEnd(b []byte, pos int) (int, error) {
+	n, next, err := respLength(b, pos)
+	if err != nil {
+		return 0, err
+	}
+
+	if n == respNull {
+		return next, nil
+	}
+
+	if n != respStreamed {
+		return respBulkData(b, next, n)
+	}
+
+	// streamed string: ;<len>\r\n<data>\r\n chunks ended by ;0\r\n
+	for {
+		if next >= len(b) {
+			return 0, ErrRESPShort
+		}
+
+		if b[next] != ';' {
+			return 0, ErrRESPInvalid
+		}
+
+		if n, next, err = respLength(b, next); err != nil {
+			return 0, err
+		}
+
+		if n <= 0 {
+			return next, nil
+		}
+
+		if next, err = respBulkData(b, next, n); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// respBulkData checks the n bytes at pos are followed by CRLF
+func respBulkData(b []byte, pos, n int) (int, error) {
+	end := pos + n + 2
+	if len(b) < end {
+		return 0, ErrRESPShort
+	}
+
+	if b[end-2] != '\r' || b[end-1] != '\n' {
+		return 0, ErrRESPInvalid
+	}
+
+	return end, nil
+}
+
+// respAggregateEnd skips an aggregate of n*per elements
+func respAggregateEnd(b []byte, pos, depth, per int) (int, error) {
+	n, next, err := respLength(b, pos)
+	if err != nil {
+		return 0, err
+	}
+
+	if n == respNull {
+		return next, nil
+	}
+
+	if n != respStreamed {
+		for i := 0; i < n*per; i++ {
+			if next, err = respValueEnd(b, next, depth+1); err != nil {
+				return 0, err
+			}
+		}
+
+		return next, nil
+	}
+
+	// streamed aggregate ended by .\r\n
+	for {
+		if next >= len(b) {
+			return 0, ErrRESPShort
+		}
+
+		if b[next] == '.' {
+			_, next, err = respLine(b, next)
+			return next, err
+		}
+
+		if next, err = respValueEnd(b, next, depth+1); err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package framer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitRESP resp test execute
+func TestUnitRESP(t *testing.T) {
+	suite.Run(t, new(TestUnitRESPSuite))
+}
+
+// TestUnitRESPSuite resp test suite
+type TestUnitRESPSuite struct {
+	suite.Suite
+}
+
+// TestRESPMessageLen test RESPMessageLen method
+func (t *TestUnitRESPSuite) TestRESPMessageLen() {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr error
+	}{
+		{name: "simple string", payload: "+OK\r\n"},
+		{name: "error", payload: "-ERR unknown command\r\n"},
+		{name: "integer", payload: ":1000\r\n"},
+		{name: "bulk string", payload: "$5\r\nhello\r\n"},
+		{name: "empty bulk string", payload: "$0\r\n\r\n"},
+		{name: "null bulk string", payload: "$-1\r\n"},
+		{name: "null array", payload: "*-1\r\n"},
+		{name: "command", payload: "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nva\r\nl\r\n"},
+		{name: "nested array", payload: "*2\r\n*1\r\n:1\r\n$-1\r\n"},
+		{name: "resp3 map", payload: "%2\r\n+a\r\n:1\r\n+b\r\n#t\r\n"},
+		{name: "resp3 scalars", payload: "*4\r\n_\r\n,1.5\r\n(3492890328409238509324850943850943825024385\r\n=7\r\ntxt:abc\r\n"},
+		{name: "resp3 attribute", payload: "|1\r\n+ttl\r\n:3\r\n$1\r\nv\r\n"},
+		{name: "resp3 streamed string", payload: "$?\r\n;2\r\nab\r\n;1\r\nc\r\n;0\r\n"},
+		{name: "resp3 streamed array", payload: "*?\r\n:1\r\n:2\r\n.\r\n"},
+		{name: "short line", payload: "+OK", wantErr: ErrRESPShort},
+		{name: "short bulk", payload: "$5\r\nhel", wantErr: ErrRESPShort},
+		{name: "short array", payload: "*2\r\n:1\r\n", wantErr: ErrRESPShort},
+		{name: "bad length", payload: "$x\r\n", wantErr: ErrRESPInvalid},
+		{name: "bad bulk end", payload: "$1\r\nab\r\n", wantErr: ErrRESPInvalid},
+		{name: "not resp", payload: "PING\r\n", wantErr: ErrRESPInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			// trailing bytes belong to the next value
+			n, err := RESPMessageLen([]byte(tt.payload + "+NEXT\r\n"))
+			if tt.wantErr != nil {
+				_, err = RESPMessageLen([]byte(tt.payload))
+				t.Equal(tt.wantErr, err)
+				return
+			}
+
+			t.Require().NoError(err)
+			t.Equal(len(tt.payload), n)
+		})
+	}
+}
+
+// TestRESPCommandLen test RESPCommandLen method
+func (t *TestUnitRESPSuite) TestRESPCommandLen() {
+	tests := []struct {
+		name    string
+		payload string
+		want    int
+		wantErr error
+	}{
+		{name: "array", payload: "*1\r\n$4\r\nPING\r\n+NEXT\r\n", want: 14},
+		{name: "inline", payload: "PING\r\nPING\r\n", want: 6},
+		{name: "inline without CR", payload: "PING\n", want: 5},
+		{name: "short inline", payload: "PI", wantErr: ErrRESPShort},
+		{name: "empty", wantErr: ErrRESPShort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			n, err := RESPCommandLen([]byte(tt.payload))
+			t.Equal(tt.wantErr, err)
+			t.Equal(tt.want, n)
+		})
+	}
+}
+
+// TestRESPCommand test RESPCommand method
+func (t *TestUnitRESPSuite) TestRESPCommand() {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+		wantErr error
+	}{
+		{name: "array", payload: "*2\r\n$3\r\nget\r\n$1\r\nk\r\n", want: "GET"},
+		{name: "inline", payload: "ping hello\r\n", want: "PING"},
+		{name: "short", payload: "*2\r\n$3\r\nGE", wantErr: ErrRESPShort},
+		{name: "reply", payload: "+OK\r\n", wantErr: ErrRESPInvalid},
+		{name: "empty array", payload: "*0\r\n", wantErr: ErrRESPInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			cmd, err := RESPCommand([]byte(tt.payload))
+			t.Equal(tt.wantErr, err)
+			t.Equal(tt.want, cmd)
+		})
+	}
+}
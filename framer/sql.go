@@ -0,0 +1,303 @@
+package framer
+
+import (
+	"strings"
+)
+
+// SQLStatement what a sql statement does, as far as replaying it is concerned
+type SQLStatement struct {
+	Type     string // upper-cased leading keyword, SELECT for WITH ... SELECT
+	Table    string // first table the statement reads or writes, db.table when qualified
+	ReadOnly bool   // the statement can't change any data
+}
+
+// sqlToken a keyword, an identifier or a punctuation character of a statement
+type sqlToken struct {
+	text   string // upper-cased for words
+	raw    string // text as written, unquoted for quoted identifiers
+	ident  bool   // word or quoted identifier, usable as a table name
+	quoted bool   // quoted identifier, never a keyword
+	depth  int    // parenthesis depth
+}
+
+// keyword reports whether the token is the keyword kw
+func (t sqlToken) keyword(kw string) bool {
+	return !t.quoted && t.text == kw
+}
+
+// ParseSQL classifies a single sql statement, multiple statements are never read-only
+func ParseSQL(sql string) SQLStatement {
+	return parseSQLTokens(sqlTokens(sql))
+}
+
+func parseSQLTokens(tokens []sqlToken) SQLStatement {
+	var st SQLStatement
+
+	// leading parenthesis of (SELECT ...) UNION (SELECT ...)
+	i := 0
+	for i < len(tokens) && tokens[i].text == "(" {
+		i++
+	}
+	if i == len(tokens) || !tokens[i].ident || tokens[i].quoted {
+		return st
+	}
+
+	st.Type = tokens[i].text
+	switch st.Type {
+	case "WITH":
+		st.Type = sqlMainKeyword(tokens[i+1:], tokens[i].depth)
+	case "EXPLAIN", "DESCRIBE", "DESC":
+		// EXPLAIN ANALYZE executes the statement, other statements are classified by the one they wrap
+		wrapped, analyze := sqlExplained(tokens[i+1:])
+		if wrapped != nil {
+			inner := parseSQLTokens(wrapped)
+			st.Table = inner.Table
+			st.ReadOnly = !analyze && inner.ReadOnly
+			return st
+		}
+		if analyze {
+			return st
+		}
+	}
+
+	st.Table = sqlTable(st.Type, tokens[i:])
+	st.ReadOnly = sqlReadOnly(st.Type, tokens)
+
+	return st
+}
+
+// sqlMainKeyword the statement following the common table expressions of a WITH clause
+func sqlMainKeyword(tokens []sqlToken, depth int) string {
+	for _, t := range tokens {
+		if t.depth != depth || t.quoted {
+			continue
+		}
+
+		switch t.text {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE", "TABLE", "VALUES":
+			return t.text
+		}
+	}
+
+	return "WITH"
+}
+
+// sqlExplained the statement after EXPLAIN and its options, nil when a table is described
+func sqlExplained(tokens []sqlToken) (wrapped []sqlToken, analyze bool) {
+	i := 0
+	for i < len(tokens) && !tokens[i].quoted {
+		switch tokens[i].text {
+		case "ANALYZE":
+			analyze = true
+		case "EXTENDED", "PARTITIONS":
+		case "FORMAT":
+			// FORMAT = JSON
+			if i+2 < len(tokens) && tokens[i+1].text == "=" {
+				i += 2
+			}
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE", "TABLE", "VALUES", "WITH", "(":
+			return tokens[i:], analyze
+		default:
+			return nil, analyze
+		}
+		i++
+	}
+
+	return nil, analyze
+}
+
+func sqlTable(typ string, tokens []sqlToken) string {
+	var after string
+	switch typ {
+	case "SELECT", "DELETE":
+		after = "FROM"
+	case "INSERT", "REPLACE":
+		after = "INTO"
+	case "UPDATE":
+		after = "UPDATE"
+	case "CREATE", "ALTER", "DROP", "TRUNCATE", "TABLE":
+		after = "TABLE"
+	case "DESCRIBE", "DESC", "EXPLAIN":
+		after = typ
+	default:
+		return ""
+	}
+
+	// the first token is the statement keyword, clauses of subqueries are deeper
+	depth := tokens[0].depth
+	for i, t := range tokens {
+		if !t.keyword(after) || t.depth != depth {
+			continue
+		}
+
+		return sqlTableName(tokens[i+1:])
+	}
+
+	// INSERT t VALUES ..., INTO is optional
+	if after == "INTO" && len(tokens) > 0 {
+		return sqlTableName(tokens[1:])
+	}
+
+	return ""
+}
+
+// sqlTableName reads a possibly qualified table name, skipping modifiers in front of it
+func sqlTableName(tokens []sqlToken) string {
+	i := 0
+	for i < len(tokens) && !tokens[i].quoted && sqlModifiers[tokens[i].text] {
+		i++
+	}
+
+	var name []string
+	for i < len(tokens) && tokens[i].ident && !(!tokens[i].quoted && sqlKeywords[tokens[i].text]) {
+		name = append(name, tokens[i].raw)
+		if i+1 >= len(tokens) || tokens[i+1].text != "." {
+			break
+		}
+		i += 2
+	}
+
+	return strings.Join(name, ".")
+}
+
+func sqlReadOnly(typ string, tokens []sqlToken) bool {
+	for i, t := range tokens {
+		// a second statement
+		if t.text == ";" && i != len(tokens)-1 {
+			return false
+		}
+	}
+
+	switch typ {
+	case "SHOW", "DESCRIBE", "DESC", "EXPLAIN":
+		return true
+	case "SELECT", "TABLE", "VALUES":
+	default:
+		return false
+	}
+
+	for i, t := range tokens {
+		if t.quoted {
+			continue
+		}
+
+		switch t.text {
+		case "INSERT", "UPDATE", "DELETE", "REPLACE", "INTO":
+			// data changing CTEs are not mysql, SELECT ... INTO writes files or variables
+			return false
+		case "FOR", "LOCK":
+			// locking reads: FOR UPDATE, FOR SHARE, LOCK IN SHARE MODE
+			if i+1 < len(tokens) && (tokens[i+1].text == "UPDATE" || tokens[i+1].text == "SHARE" ||
+				tokens[i+1].text == "IN") {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// sqlModifiers keywords which may stand between a statement keyword and its table
+var sqlModifiers = map[string]bool{
+	"LOW_PRIORITY": true, "DELAYED": true, "HIGH_PRIORITY": true, "QUICK": true, "IGNORE": true,
+	"INTO": true, "TEMPORARY": true, "IF": true, "NOT": true, "EXISTS": true, "TABLE": true,
+}
+
+// sqlKeywords keywords which can't be a table name
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "WHERE": true, "SET": true, "VALUES": true, "VALUE": true, "AS": true, "JOIN": true,
+	"ON": true, "USING": true, "LIMIT": true, "ORDER": true, "GROUP": true, "WITH": true, "PARTITION": true,
+	"DUAL": true, "FORMAT": true, "ANALYZE": true, "EXTENDED": true, "LIKE": true,
+}
+
+// sqlTokens splits the statement into tokens, comments and literals are dropped.
+// The body of mysql executable comments, /*! ... */ and /*!50000 ... */, is run by the server and tokenized
+func sqlTokens(sql string) []sqlToken {
+	var (
+		tokens     []sqlToken
+		depth      int
+		executable bool // inside /*! ... */
+	)
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#', c == '-' && strings.HasPrefix(sql[i:], "-- "):
+			i = sqlSkipTo(sql, i, "\n")
+		case c == '/' && strings.HasPrefix(sql[i:], "/*!"):
+			// the optional version is the minimum server version running the body
+			i += 3
+			for i < len(sql) && sql[i] >= '0' && sql[i] <= '9' {
+				i++
+			}
+			executable = true
+		case executable && c == '*' && strings.HasPrefix(sql[i:], "*/"):
+			i += 2
+			executable = false
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			i = sqlSkipTo(sql, i+2, "*/")
+		case c == '\'' || c == '"':
+			i = sqlSkipQuoted(sql, i)
+		case c == '`':
+			end := sqlSkipQuoted(sql, i)
+			name := strings.TrimSuffix(sql[i+1:end], "`")
+			name = strings.ReplaceAll(name, "``", "`")
+			tokens = append(tokens, sqlToken{text: name, raw: name, ident: true, quoted: true, depth: depth})
+			i = end
+		case isSQLWordChar(c):
+			j := i
+			for j < len(sql) && isSQLWordChar(sql[j]) {
+				j++
+			}
+			tokens = append(tokens, sqlToken{text: strings.ToUpper(sql[i:j]), raw: sql[i:j], ident: true, depth: depth})
+			i = j
+		default:
+			if c == ')' {
+				depth--
+			}
+			tokens = append(tokens, sqlToken{text: string(c), raw: string(c), depth: depth})
+			if c == '(' {
+				depth++
+			}
+			i++
+		}
+	}
+
+	return tokens
+}
+
+func isSQLWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= 0x80
+}
+
+// sqlSkipTo position after the next end, or the end of sql
+func sqlSkipTo(sql string, i int, end string) int {
+	if n := strings.Index(sql[i:], end); n >= 0 {
+		return i + n + len(end)
+	}
+
+	return len(sql)
+}
+
+// sqlSkipQuoted position after the quoted literal or identifier starting at i
+func sqlSkipQuoted(sql string, i int) int {
+	quote := sql[i]
+	for j := i + 1; j < len(sql); j++ {
+		switch {
+		case sql[j] == '\\' && quote != '`':
+			j++
+		case sql[j] == quote:
+			// a doubled quote stands for itself
+			if j+1 < len(sql) && sql[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+
+	return len(sql)
+}
@@ -0,0 +1,86 @@
+package framer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitSQL sql test execute
+func TestUnitSQL(t *testing.T) {
+	suite.Run(t, new(TestUnitSQLSuite))
+}
+
+// TestUnitSQLSuite sql test suite
+type TestUnitSQLSuite struct {
+	suite.Suite
+}
+
+// TestParseSQL test ParseSQL method
+func (t *TestUnitSQLSuite) TestParseSQL() {
+	tests := []struct {
+		name string
+		sql  string
+		want SQLStatement
+	}{
+		{name: "select", sql: "select * from users where id = 1",
+			want: SQLStatement{Type: "SELECT", Table: "users", ReadOnly: true}},
+		{name: "qualified table", sql: "SELECT a FROM `shop`.`order` o JOIN items i ON o.id = i.oid",
+			want: SQLStatement{Type: "SELECT", Table: "shop.order", ReadOnly: true}},
+		{name: "subquery", sql: "SELECT (SELECT max(id) FROM b) FROM a",
+			want: SQLStatement{Type: "SELECT", Table: "a", ReadOnly: true}},
+		{name: "comments and strings", sql: "/* from x */ SELECT 'into; from y' -- from z\nFROM t # tail",
+			want: SQLStatement{Type: "SELECT", Table: "t", ReadOnly: true}},
+		{name: "without table", sql: "SELECT 1", want: SQLStatement{Type: "SELECT", ReadOnly: true}},
+		{name: "union", sql: "(SELECT a FROM t1) UNION (SELECT a FROM t2)",
+			want: SQLStatement{Type: "SELECT", Table: "t1", ReadOnly: true}},
+		{name: "with select", sql: "WITH c AS (SELECT id FROM a) SELECT * FROM c",
+			want: SQLStatement{Type: "SELECT", Table: "c", ReadOnly: true}},
+		{name: "with delete", sql: "WITH c AS (SELECT id FROM a) DELETE FROM b WHERE id IN (SELECT id FROM c)",
+			want: SQLStatement{Type: "DELETE", Table: "b"}},
+		{name: "for update", sql: "SELECT * FROM t WHERE id = 1 FOR UPDATE",
+			want: SQLStatement{Type: "SELECT", Table: "t"}},
+		{name: "share mode", sql: "SELECT * FROM t LOCK IN SHARE MODE", want: SQLStatement{Type: "SELECT", Table: "t"}},
+		{name: "into outfile", sql: "SELECT * FROM t INTO OUTFILE '/tmp/t'",
+			want: SQLStatement{Type: "SELECT", Table: "t"}},
+		{name: "quoted keywords", sql: "SELECT `update`, \"for update\" FROM `into`",
+			want: SQLStatement{Type: "SELECT", Table: "into", ReadOnly: true}},
+		{name: "multiple statements", sql: "SELECT 1; DROP TABLE t", want: SQLStatement{Type: "SELECT"}},
+		{name: "trailing semicolon", sql: "SELECT 1;", want: SQLStatement{Type: "SELECT", ReadOnly: true}},
+		{name: "insert", sql: "INSERT INTO t (a) VALUES (1)", want: SQLStatement{Type: "INSERT", Table: "t"}},
+		{name: "insert without into", sql: "insert ignore t values (1)", want: SQLStatement{Type: "INSERT", Table: "t"}},
+		{name: "replace", sql: "REPLACE LOW_PRIORITY INTO db.t SET a = 1",
+			want: SQLStatement{Type: "REPLACE", Table: "db.t"}},
+		{name: "update", sql: "UPDATE IGNORE t SET a = 'x\\'' WHERE b = 2", want: SQLStatement{Type: "UPDATE", Table: "t"}},
+		{name: "delete", sql: "DELETE QUICK FROM t WHERE a = 1", want: SQLStatement{Type: "DELETE", Table: "t"}},
+		{name: "create", sql: "CREATE TABLE IF NOT EXISTS t (a int)", want: SQLStatement{Type: "CREATE", Table: "t"}},
+		{name: "show", sql: "SHOW TABLES", want: SQLStatement{Type: "SHOW", ReadOnly: true}},
+		{name: "describe", sql: "DESC t", want: SQLStatement{Type: "DESC", Table: "t", ReadOnly: true}},
+		{name: "explain", sql: "EXPLAIN SELECT * FROM t", want: SQLStatement{Type: "EXPLAIN", Table: "t", ReadOnly: true}},
+		{name: "explain format", sql: "EXPLAIN FORMAT=JSON SELECT * FROM db.t",
+			want: SQLStatement{Type: "EXPLAIN", Table: "db.t", ReadOnly: true}},
+		{name: "explain table", sql: "EXPLAIN t", want: SQLStatement{Type: "EXPLAIN", Table: "t", ReadOnly: true}},
+		{name: "explain delete", sql: "EXPLAIN DELETE FROM t", want: SQLStatement{Type: "EXPLAIN", Table: "t"}},
+		{name: "explain analyze delete", sql: "EXPLAIN ANALYZE DELETE FROM t WHERE a = 1",
+			want: SQLStatement{Type: "EXPLAIN", Table: "t"}},
+		{name: "explain analyze select", sql: "EXPLAIN ANALYZE SELECT * FROM t",
+			want: SQLStatement{Type: "EXPLAIN", Table: "t"}},
+		{name: "describe select", sql: "DESCRIBE SELECT 1; DROP TABLE t", want: SQLStatement{Type: "DESCRIBE"}},
+		{name: "executable comment", sql: "SELECT * FROM t /*!INTO OUTFILE '/tmp/x'*/",
+			want: SQLStatement{Type: "SELECT", Table: "t"}},
+		{name: "versioned executable comment", sql: "SELECT * FROM t /*!50000 FOR UPDATE*/",
+			want: SQLStatement{Type: "SELECT", Table: "t"}},
+		{name: "executable comment table", sql: "SELECT * FROM /*!50000 `t2` */ t",
+			want: SQLStatement{Type: "SELECT", Table: "t2", ReadOnly: true}},
+		{name: "optimizer hint", sql: "SELECT /*+ MAX_EXECUTION_TIME(1) */ * FROM t",
+			want: SQLStatement{Type: "SELECT", Table: "t", ReadOnly: true}},
+		{name: "set", sql: "SET autocommit = 0", want: SQLStatement{Type: "SET"}},
+		{name: "empty", sql: " -- nothing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			t.Equal(tt.want, ParseSQL(tt.sql))
+		})
+	}
+}
@@ -0,0 +1,496 @@
+package framer
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// thrift message types
+const (
+	ThriftCall      byte = 1
+	ThriftReply     byte = 2
+	ThriftException byte = 3
+	ThriftOneway    byte = 4
+)
+
+const (
+	thriftBinaryVersionMask = 0xffff0000
+	thriftBinaryVersion1    = 0x80010000
+	thriftCompactProtocolID = 0x82
+	thriftCompactVersion    = 1
+	thriftMaxFrameSize      = 16 << 20
+	thriftMaxNameLen        = 64 << 10
+	thriftMaxDepth          = 64
+)
+
+// binary protocol field types, see TType in the thrift spec
+const (
+	thriftStop   = 0
+	thriftBool   = 2
+	thriftByte   = 3
+	thriftDouble = 4
+	thriftI16    = 6
+	thriftI32    = 8
+	thriftI64    = 10
+	thriftString = 11
+	thriftStruct = 12
+	thriftMap    = 13
+	thriftSet    = 14
+	thriftList   = 15
+	thriftUUID   = 16
+)
+
+// compact protocol field types
+const (
+	compactBoolTrue  = 1
+	compactBoolFalse = 2
+	compactByte      = 3
+	compactI16       = 4
+	compactI32       = 5
+	compactI64       = 6
+	compactDouble    = 7
+	compactBinary    = 8
+	compactList      = 9
+	compactSet       = 10
+	compactMap       = 11
+	compactStruct    = 12
+	compactUUID      = 13
+)
+
+var (
+	// ErrThriftShort the payload doesn't hold a whole thrift message yet
+	ErrThriftShort = errors.New("thrift: short payload")
+	// ErrThriftInvalid the payload is not a thrift message
+	ErrThriftInvalid = errors.New("thrift: invalid payload")
+)
+
+// ThriftHeader header of a thrift message
+type ThriftHeader struct {
+	Name      string // 方法名, multiplexed 协议下为 "service:method"
+	Type      byte   // ThriftCall, ThriftReply, ThriftException or ThriftOneway
+	SeqID     int32
+	Framed    bool // framed transport
+	Compact   bool // compact protocol, otherwise binary protocol
+	FrameSize int  // framed transport only, frame length without the 4 bytes size prefix
+	headerLen int  // bytes taken by transport and message header
+}
+
+// ParseThriftHeader parses the header of the thrift message at the start of payload,
+// framed or buffered transport with binary or compact protocol
+func ParseThriftHeader(payload []byte) (*ThriftHeader, error) {
+	if len(payload) >= 4 {
+		size := binary.BigEndian.Uint32(payload)
+		if size > 0 && size <= thriftMaxFrameSize {
+			if h, err := parseThriftMessageHeader(payload[4:]); err == nil {
+				h.Framed = true
+				h.FrameSize = int(size)
+				h.headerLen += 4
+
+				return h, nil
+			}
+		}
+	}
+
+	return parseThriftMessageHeader(payload)
+}
+
+// ThriftMessageLen returns the length of the whole thrift message at the start of payload,
+// ErrThriftShort is returned until all of it has been received
+func ThriftMessageLen(payload []byte) (int, error) {
+	h, err := ParseThriftHeader(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	if h.Framed {
+		if len(payload) < h.FrameSize+4 {
+			return 0, ErrThriftShort
+		}
+
+		return h.FrameSize + 4, nil
+	}
+
+	r := &thriftReader{buf: payload, pos: h.headerLen}
+	if h.Compact {
+		err = r.skipCompact(compactStruct, 0)
+	} else {
+		err = r.skipBinary(thriftStruct, 0)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return r.pos, nil
+}
+
+func parseThriftMessageHeader(b []byte) (*ThriftHeader, error) {
+	if len(b) == 0 {
+		return nil, ErrThriftShort
+	}
+
+	if b[0] == thriftCompactProtocolID {
+		return parseCompactHeader(b)
+	}
+
+	return parseBinaryHeader(b)
+}
+
+func parseBinaryHeader(b []byte) (*ThriftHeader, error) {
+	r := &thriftReader{buf: b}
+	v, err := r.i32()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &ThriftHeader{}
+	if uint32(v)&thriftBinaryVersionMask == thriftBinaryVersion1 {
+		h.Type = byte(v)
+		if h.Name, err = r.name(r.i32); err != nil {
+			return nil, err
+		}
+	} else {
+		// old non strict encoding: name, type, seqid
+		r.pos = 0
+		if h.Name, err = r.name(r.i32); err != nil {
+			return nil, err
+		}
+
+		if h.Type, err = r.byte(); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.Type < ThriftCall || h.Type > ThriftOneway {
+		return nil, ErrThriftInvalid
+	}
+
+	if h.SeqID, err = r.i32(); err != nil {
+		return nil, err
+	}
+	h.headerLen = r.pos
+
+	return h, nil
+}
+
+func parseCompactHeader(b []byte) (*ThriftHeader, error) {
+	r := &thriftReader{buf: b, pos: 1}
+	tv, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	if tv&0x1f != thriftCompactVersion {
+		return nil, ErrThriftInvalid
+	}
+
+	h := &ThriftHeader{Compact: true, Type: tv >> 5}
+	if h.Type < ThriftCall || h.Type > ThriftOneway {
+		return nil, ErrThriftInvalid
+	}
+
+	seqID, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	h.SeqID = int32(seqID)
+
+	if h.Name, err = r.name(r.varint32); err != nil {
+		return nil, err
+	}
+	h.headerLen = r.pos
+
+	return h, nil
+}
+
+// thriftReader reads thrift encoded values without allocating them
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) skip(n int) error {
+	if n < 0 {
+		return ErrThriftInvalid
+	}
+
+	if len(r.buf)-r.pos < n {
+		return ErrThriftShort
+	}
+	r.pos += n
+
+	return nil
+}
+
+func (r *thriftReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, ErrThriftShort
+	}
+	r.pos++
+
+	return r.buf[r.pos-1], nil
+}
+
+func (r *thriftReader) i16() (int16, error) {
+	if len(r.buf)-r.pos < 2 {
+		return 0, ErrThriftShort
+	}
+	r.pos += 2
+
+	return int16(binary.BigEndian.Uint16(r.buf[r.pos-2:])), nil
+}
+
+func (r *thriftReader) i32() (int32, error) {
+	if len(r.buf)-r.pos < 4 {
+		return 0, ErrThriftShort
+	}
+	r.pos += 4
+
+	return int32(binary.BigEndian.Uint32(r.buf[r.pos-4:])), nil
+}
+
+func (r *thriftReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n == 0 {
+		return 0, ErrThriftShort
+	}
+
+	if n < 0 {
+		return 0, ErrThriftInvalid
+	}
+	r.pos += n
+
+	return v, nil
+}
+
+// varint32 reads a compact length, they are not zigzag encoded
+func (r *thriftReader) varint32() (int32, error) {
+	v, err := r.uvarint()
+	if err != nil {
+		return 0, err
+	}
+
+	if v > math.MaxInt32 {
+		return 0, ErrThriftInvalid
+	}
+
+	return int32(v), nil
+}
+
+// name reads a method name whose length is read by readLen
+func (r *thriftReader) name(readLen func() (int32, error)) (string, error) {
+	n, err := readLen()
+	if err != nil {
+		return "", err
+	}
+
+	if n <= 0 || n > thriftMaxNameLen {
+		return "", ErrThriftInvalid
+	}
+
+	start := r.pos
+	if err = r.skip(int(n)); err != nil {
+		return "", err
+	}
+
+	name := r.buf[start:r.pos]
+	for _, c := range name {
+		if c < 0x20 || c > 0x7e {
+			return "", ErrThriftInvalid
+		}
+	}
+
+	return string(name), nil
+}
+
+// skipBinary skips a binary protocol value of type t
+func (r *thriftReader) skipBinary(t byte, depth int) error {
+	if depth > thriftMaxDepth {
+		return ErrThriftInvalid
+	}
+
+	switch t {
+	case thriftBool, thriftByte:
+		return r.skip(1)
+	case thriftI16:
+		return r.skip(2)
+	case thriftI32:
+		return r.skip(4)
+	case thriftDouble, thriftI64:
+		return r.skip(8)
+	case thriftUUID:
+		return r.skip(16)
+	case thriftString:
+		n, err := r.i32()
+		if err != nil {
+			return err
+		}
+
+		return r.skip(int(n))
+	case thriftStruct:
+		for {
+			ft, err := r.byte()
+			if err != nil {
+				return err
+			}
+
+			if ft == thriftStop {
+				return nil
+			}
+
+			if _, err = r.i16(); err != nil {
+				return err
+			}
+
+			if err = r.skipBinary(ft, depth+1); err != nil {
+				return err
+			}
+		}
+	case thriftMap:
+		kt, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		vt, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		return r.skipBinaryElems(depth, kt, vt)
+	case thriftSet, thriftList:
+		et, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		return r.skipBinaryElems(depth, et)
+	default:
+		return ErrThriftInvalid
+	}
+}
+
+// skipBinaryElems reads a container size and skips that many groups of types
+func (r *thriftReader) skipBinaryElems(depth int, types ...byte) error {
+	n, err := r.i32()
+	if err != nil {
+		return err
+	}
+
+	if n < 0 {
+		return ErrThriftInvalid
+	}
+
+	for i := int32(0); i < n; i++ {
+		for _, t := range types {
+			if err = r.skipBinary(t, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// skipCompact skips a compact protocol value of type t
+func (r *thriftReader) skipCompact(t byte, depth int) error {
+	if depth > thriftMaxDepth {
+		return ErrThriftInvalid
+	}
+
+	switch t {
+	case compactBoolTrue, compactBoolFalse, compactByte:
+		return r.skip(1)
+	case compactI16, compactI32, compactI64:
+		_, err := r.uvarint()
+		return err
+	case compactDouble:
+		return r.skip(8)
+	case compactUUID:
+		return r.skip(16)
+	case compactBinary:
+		n, err := r.varint32()
+		if err != nil {
+			return err
+		}
+
+		return r.skip(int(n))
+	case compactStruct:
+		return r.skipCompactStruct(depth)
+	case compactMap:
+		n, err := r.varint32()
+		if err != nil || n == 0 {
+			return err
+		}
+
+		kv, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		for i := int32(0); i < n; i++ {
+			if err = r.skipCompact(kv>>4, depth+1); err != nil {
+				return err
+			}
+
+			if err = r.skipCompact(kv&0x0f, depth+1); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case compactList, compactSet:
+		st, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		n := int32(st >> 4)
+		if n == 0x0f {
+			if n, err = r.varint32(); err != nil {
+				return err
+			}
+		}
+
+		for i := int32(0); i < n; i++ {
+			if err = r.skipCompact(st&0x0f, depth+1); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return ErrThriftInvalid
+	}
+}
+
+func (r *thriftReader) skipCompactStruct(depth int) error {
+	for {
+		fh, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		if fh == thriftStop {
+			return nil
+		}
+
+		// a zero delta means the field id follows as a zigzag varint
+		if fh>>4 == 0 {
+			if _, err = r.uvarint(); err != nil {
+				return err
+			}
+		}
+
+		ft := fh & 0x0f
+		// bool fields carry their value in the type
+		if ft == compactBoolTrue || ft == compactBoolFalse {
+			continue
+		}
+
+		if err = r.skipCompact(ft, depth+1); err != nil {
+			return err
+		}
+	}
+}
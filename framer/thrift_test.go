@@ -0,0 +1,154 @@
+package framer
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitThrift thrift test execute
+func TestUnitThrift(t *testing.T) {
+	suite.Run(t, new(TestUnitThriftSuite))
+}
+
+// TestUnitThriftSuite thrift test suite
+type TestUnitThriftSuite struct {
+	suite.Suite
+}
+
+// binaryArgs {1: i32 1, 2: string "hi", 3: list<i64> [1], 4: map<string,bool> {"k": true}, 5: struct {1: double}}
+var binaryArgs = []byte{
+	thriftI32, 0, 1, 0, 0, 0, 1,
+	thriftString, 0, 2, 0, 0, 0, 2, 'h', 'i',
+	thriftList, 0, 3, thriftI64, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1,
+	thriftMap, 0, 4, thriftString, thriftBool, 0, 0, 0, 1, 0, 0, 0, 1, 'k', 1,
+	thriftStruct, 0, 5, thriftDouble, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, thriftStop,
+	thriftStop,
+}
+
+// compactArgs the same arguments as binaryArgs, plus a bool field
+var compactArgs = []byte{
+	0x15, 0x02,
+	0x18, 0x02, 'h', 'i',
+	0x19, 0x16, 0x02,
+	0x1b, 0x01, 0x81, 0x01, 'k', 0x01,
+	0x1c, 0x17, 0, 0, 0, 0, 0, 0, 0, 0, thriftStop,
+	0x11,
+	thriftStop,
+}
+
+func strictBinaryMessage(name string, typ byte, seqID int32, args []byte) []byte {
+	b := appendUint32(nil, thriftBinaryVersion1|uint32(typ))
+	b = appendUint32(b, uint32(len(name)))
+	b = append(b, name...)
+	b = appendUint32(b, uint32(seqID))
+
+	return append(b, args...)
+}
+
+func oldBinaryMessage(name string, typ byte, seqID int32, args []byte) []byte {
+	b := appendUint32(nil, uint32(len(name)))
+	b = append(b, name...)
+	b = append(b, typ)
+	b = appendUint32(b, uint32(seqID))
+
+	return append(b, args...)
+}
+
+func compactMessage(name string, typ byte, seqID int32, args []byte) []byte {
+	b := []byte{thriftCompactProtocolID, typ<<5 | thriftCompactVersion}
+	b = appendUvarint(b, uint64(uint32(seqID)))
+	b = appendUvarint(b, uint64(len(name)))
+	b = append(b, name...)
+
+	return append(b, args...)
+}
+
+func framed(msg []byte) []byte {
+	return append(appendUint32(nil, uint32(len(msg))), msg...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+
+	return append(b, buf[:]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+// TestParseThriftHeader test ParseThriftHeader and ThriftMessageLen
+func (t *TestUnitThriftSuite) TestParseThriftHeader() {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    ThriftHeader
+		wantErr error
+	}{
+		{
+			name:    "binary buffered",
+			payload: strictBinaryMessage("add", ThriftCall, 7, binaryArgs),
+			want:    ThriftHeader{Name: "add", Type: ThriftCall, SeqID: 7},
+		},
+		{
+			name:    "binary framed",
+			payload: framed(strictBinaryMessage("Calc:add", ThriftReply, 8, binaryArgs)),
+			want:    ThriftHeader{Name: "Calc:add", Type: ThriftReply, SeqID: 8, Framed: true},
+		},
+		{
+			name:    "binary non strict",
+			payload: oldBinaryMessage("ping", ThriftOneway, 9, binaryArgs),
+			want:    ThriftHeader{Name: "ping", Type: ThriftOneway, SeqID: 9},
+		},
+		{
+			name:    "compact buffered",
+			payload: compactMessage("add", ThriftException, 300, compactArgs),
+			want:    ThriftHeader{Name: "add", Type: ThriftException, SeqID: 300, Compact: true},
+		},
+		{
+			name:    "compact framed",
+			payload: framed(compactMessage("add", ThriftCall, 1, compactArgs)),
+			want:    ThriftHeader{Name: "add", Type: ThriftCall, SeqID: 1, Compact: true, Framed: true},
+		},
+		{
+			name:    "not thrift",
+			payload: []byte("GET / HTTP/1.1\r\n\r\n"),
+			wantErr: ErrThriftInvalid,
+		},
+		{
+			name:    "short header",
+			payload: []byte{0x80, 0x01},
+			wantErr: ErrThriftShort,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			h, err := ParseThriftHeader(tt.payload)
+			if tt.wantErr != nil {
+				t.Equal(tt.wantErr, err)
+				return
+			}
+
+			t.Require().NoError(err)
+			t.Equal(tt.want.Name, h.Name)
+			t.Equal(tt.want.Type, h.Type)
+			t.Equal(tt.want.SeqID, h.SeqID)
+			t.Equal(tt.want.Framed, h.Framed)
+			t.Equal(tt.want.Compact, h.Compact)
+
+			// the whole message is needed, a byte less is short
+			n, err := ThriftMessageLen(append(tt.payload, 0xff))
+			t.Require().NoError(err)
+			t.Equal(len(tt.payload), n)
+
+			_, err = ThriftMessageLen(tt.payload[:len(tt.payload)-1])
+			t.Equal(ErrThriftShort, err)
+		})
+	}
+}
@@ -27,5 +27,5 @@ require (
 	golang.org/x/sys v0.0.0-20211103235746-7861aae1554b
 	golang.org/x/text v0.3.7 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -19,11 +19,16 @@ import (
 
 	"github.com/shirou/gopsutil/process"
 
+	"goreplay/admin"
 	"goreplay/config"
 	"goreplay/emitter"
 	"goreplay/logger"
 	"goreplay/logreplay"
+	"goreplay/message"
+	"goreplay/metrics"
+	"goreplay/monitor"
 	"goreplay/plugins"
+	"goreplay/plugins/transformer"
 	"goreplay/remote"
 
 	_ "go.uber.org/automaxprocs"
@@ -51,14 +56,29 @@ func main() {
 		logger.Fatal(http.ListenAndServe(args[1], loggingMiddleware(http.FileServer(http.Dir(dir)))))
 	} else {
 		flag.Parse()
+		if config.Settings.ConfigFile != "" {
+			if err := config.LoadFile(config.Settings.ConfigFile); err != nil {
+				logger.Fatal(err)
+			}
+		}
 		if config.Settings.LogPath != "" {
 			logger.Info("log output path: ", config.Settings.LogPath)
 		}
 
+		if err := message.Init(&config.Settings.NotifyConfig); err != nil {
+			logger.Fatal("notify error: ", err)
+		}
+
 		if config.Settings.OnlyOneProcess {
 			limitProcess()
 		}
 
+		if config.Settings.HTTPMetrics != "" {
+			if err := metrics.Start(config.Settings.HTTPMetrics); err != nil {
+				logger.Fatal("http-metrics error: ", err)
+			}
+		}
+
 		inOutPlugins = plugins.NewPlugins(plugins.InitPluginSettings())
 	}
 
@@ -85,12 +105,29 @@ func main() {
 		CopyBufferSize: config.Settings.CopyBufferSize,
 		Split:          config.Settings.SplitOutput,
 		ModifierConfig: config.Settings.ModifierConfig,
+		Pipelines:      config.Settings.Pipelines,
+		Protocol:       config.Settings.RAWInputConfig.Protocol,
+		OutputQueue:    config.Settings.OutputQueueConfig,
+		Timing:         config.Settings.ReplayTiming,
 	}
+	if err := emitter.CheckPipelines(emitterSettings.Pipelines, inOutPlugins); err != nil {
+		logger.Fatal("pipeline error: ", err)
+	}
+	emitterSettings.Transformers = newTransformers()
 	emitter := emitter.NewEmitter(emitterSettings)
 
 	go emitter.Start(inOutPlugins, config.Settings.Middleware)
+
+	if config.Settings.AdminConfig.Address != "" {
+		if err := admin.Start(config.Settings.AdminConfig, inOutPlugins, emitter); err != nil {
+			logger.Fatal("http-admin error: ", err)
+		}
+	}
 	goExitAfter(closeCh)
 
+	overloadCh := make(chan struct{})
+	goWatchdog(inOutPlugins, overloadCh)
+
 	c := make(chan os.Signal, 1)
 	// signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM,
 	// syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
@@ -103,12 +140,29 @@ func main() {
 		exit = 1
 	case <-closeCh:
 		exit = 0
+	case <-overloadCh:
+		exit = 1
 	}
 
 	emitter.Close()
 	os.Exit(exit)
 }
 
+// newTransformers 加载 --transformer-plugin, 按 --transformer 新建
+func newTransformers() transformer.Chain {
+	for _, path := range config.Settings.TransformerPlugins {
+		if err := transformer.Open(path); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	chain, err := transformer.NewChain(config.Settings.Transformers)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	return chain
+}
+
 // goExitAfter 预处理 exit_after 时间到之后的退出逻辑。
 func goExitAfter(closeCh chan int) {
 	// exit_after == -1：表示外部没有进行设置，应该初始化成默认值。
@@ -117,26 +171,37 @@ func goExitAfter(closeCh chan int) {
 		config.Settings.ExitAfter = 6 * time.Hour
 		time.AfterFunc(config.Settings.ExitAfter/2, func() {
 			logger.Info(fmt.Sprintf("gor run timeout is half,time: %s\n", config.Settings.ExitAfter/2))
-			// 用户未使用 logreplay 进行流量收集的情况。
-			if config.Settings.OutputLogReplayConfig.ModuleID == "" {
-				logger.Debug2("goreplay run no output logreplay")
-				return
-			}
 			ExitProccess(config.Settings.ExitAfter / 2)
 		})
 	}
 
 	time.AfterFunc(config.Settings.ExitAfter, func() {
 		logger.Info("gor run timeout %s\n", config.Settings.ExitAfter)
-		if config.Settings.OutputLogReplayConfig.ModuleID == "" {
-			logger.Debug2("goreplay run output logreplay with empty moduleID")
-		} else {
-			ExitProccess(config.Settings.ExitAfter)
-		}
+		ExitProccess(config.Settings.ExitAfter)
 		close(closeCh)
 	})
 }
 
+// goWatchdog 资源持续超过阈值时先降低 input 的采样率, 仍然超过时通知退出
+func goWatchdog(inOutPlugins *plugins.InOutPlugins, overloadCh chan struct{}) {
+	var shedders []monitor.Shedder
+	for _, in := range inOutPlugins.Inputs {
+		if s, ok := in.(monitor.Shedder); ok {
+			shedders = append(shedders, s)
+		}
+	}
+
+	w, err := monitor.NewWatchdog(config.Settings.MonitorConfig, shedders, func() {
+		close(overloadCh)
+	})
+	if err != nil {
+		logger.Error("start watchdog error: ", err)
+		return
+	}
+
+	w.Start()
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rb, _ := httputil.DumpRequest(r, false)
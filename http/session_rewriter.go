@@ -0,0 +1,279 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+
+	"goreplay/config"
+	"goreplay/proto"
+)
+
+const (
+	sessionExchanges = 10000 // 等待另一个响应的请求数
+	sessionLimit     = 10000 // 记住的会话数
+	valueLimit       = 256   // 每个会话记住的 cookie 数和 token 数, NAT 后的客户端共用一个会话
+	minTokenLen      = 8     // 更短的 token 不替换, 避免改到请求中无关的内容
+)
+
+// SessionRewriter 回放时把请求中录制的 cookie 和 token 换成回放服务返回的值.
+// 同一个请求的录制响应和回放响应都到了之后, 比较二者的 Set-Cookie 和 token, 按会话记下录制的值对应的回放值,
+// 之后这个会话的请求在发出前替换
+type SessionRewriter struct {
+	cookies bool
+	tokens  config.HTTPTokens
+
+	mu        sync.Mutex
+	exchanges *lru.Cache // 请求的 uuid -> *exchange
+	sessions  *lru.Cache // 会话 -> *sessionValues
+}
+
+// exchange 一个请求的录制响应和回放响应
+type exchange struct {
+	original, replayed []byte
+}
+
+// sessionValues 会话中录制的值对应的回放值
+type sessionValues struct {
+	cookies boundedValues // cookie 的 name=录制的值 -> 回放的值
+	tokens  boundedValues
+}
+
+// boundedValues 录制的值 -> 回放的值, 超过 valueLimit 时丢掉最早记下的
+type boundedValues struct {
+	values map[string]string
+	order  []string
+}
+
+func (b *boundedValues) set(from, to string) {
+	if b.values == nil {
+		b.values = make(map[string]string)
+	}
+	if _, ok := b.values[from]; !ok {
+		b.order = append(b.order, from)
+		if len(b.order) > valueLimit {
+			delete(b.values, b.order[0])
+			b.order = b.order[1:]
+		}
+	}
+	b.values[from] = to
+}
+
+// NewSessionRewriter 没有开启 --output-http-rewrite-cookies 和 --output-http-rewrite-token 时返回 nil
+func NewSessionRewriter(conf *config.HTTPOutputConfig) *SessionRewriter {
+	if !conf.RewriteCookies && len(conf.RewriteTokens) == 0 {
+		return nil
+	}
+
+	return &SessionRewriter{
+		cookies:   conf.RewriteCookies,
+		tokens:    conf.RewriteTokens,
+		exchanges: lru.New(sessionExchanges),
+		sessions:  lru.New(sessionLimit),
+	}
+}
+
+// OriginalResponse 录制的响应, id 是请求的 uuid
+func (r *SessionRewriter) OriginalResponse(session string, id, payload []byte) {
+	r.response(session, id, payload, false)
+}
+
+// ReplayedResponse 回放服务返回的响应, id 是请求的 uuid
+func (r *SessionRewriter) ReplayedResponse(session string, id, payload []byte) {
+	r.response(session, id, payload, true)
+}
+
+func (r *SessionRewriter) response(session string, id, payload []byte, replayed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ex := &exchange{}
+	if v, ok := r.exchanges.Get(string(id)); ok {
+		ex = v.(*exchange)
+	}
+	if replayed {
+		ex.replayed = payload
+	} else {
+		ex.original = payload
+	}
+	if ex.original == nil || ex.replayed == nil {
+		r.exchanges.Add(string(id), ex)
+		return
+	}
+	r.exchanges.Remove(string(id))
+
+	r.learn(session, PrettifyHTTP(ex.original), PrettifyHTTP(ex.replayed))
+}
+
+// learn 记下两个响应中不同的 cookie 和 token
+func (r *SessionRewriter) learn(session string, original, replayed []byte) {
+	values := r.values(session)
+	if r.cookies {
+		replayedCookies := setCookies(replayed)
+		for name, value := range setCookies(original) {
+			if v, ok := replayedCookies[name]; ok && v != value {
+				values.cookies.set(name+"="+value, v)
+			}
+		}
+	}
+
+	for _, t := range r.tokens {
+		from, to := token(original, t), token(replayed, t)
+		if len(from) >= minTokenLen && to != "" && from != to {
+			values.tokens.set(from, to)
+		}
+	}
+}
+
+// values 会话的值, 没有时新建
+func (r *SessionRewriter) values(session string) *sessionValues {
+	if v, ok := r.sessions.Get(session); ok {
+		return v.(*sessionValues)
+	}
+
+	values := new(sessionValues)
+	r.sessions.Add(session, values)
+
+	return values
+}
+
+// Rewrite 替换请求中这个会话记下的 cookie 和 token, 不修改 payload
+func (r *SessionRewriter) Rewrite(session string, payload []byte) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.sessions.Get(session)
+	if !ok {
+		return payload
+	}
+	values := v.(*sessionValues)
+
+	if cookie := proto.Header(payload, []byte("Cookie")); len(values.cookies.values) > 0 && len(cookie) > 0 {
+		if rewritten, changed := rewriteCookie(string(cookie), values.cookies.values); changed {
+			payload = proto.SetHeader(append([]byte(nil), payload...), []byte("Cookie"), []byte(rewritten))
+		}
+	}
+
+	if len(values.tokens.values) > 0 {
+		payload = replaceTokens(payload, values.tokens.values)
+	}
+
+	return payload
+}
+
+// setCookies 响应的 Set-Cookie, name -> value
+func setCookies(payload []byte) map[string]string {
+	cookies := make(map[string]string)
+	for _, line := range proto.ParseHeaders(payload)["Set-Cookie"] {
+		pair := strings.SplitN(line, ";", 2)[0]
+		if i := strings.Index(pair, "="); i > 0 {
+			cookies[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+		}
+	}
+
+	return cookies
+}
+
+// rewriteCookie 替换 Cookie 头中记下的值
+func rewriteCookie(cookie string, values map[string]string) (string, bool) {
+	changed := false
+	pairs := strings.Split(cookie, ";")
+	for i, pair := range pairs {
+		trimmed := strings.TrimSpace(pair)
+		if to, ok := values[trimmed]; ok {
+			name := trimmed[:strings.Index(trimmed, "=")]
+			pairs[i] = strings.Replace(pair, trimmed, name+"="+to, 1)
+			changed = true
+		}
+	}
+
+	return strings.Join(pairs, ";"), changed
+}
+
+// token 响应中 t 的值, 没有时返回空
+func token(payload []byte, t config.HTTPToken) string {
+	switch t.Kind {
+	case config.TokenHeader:
+		return string(proto.Header(payload, []byte(t.Name)))
+	case config.TokenBody:
+		m := t.Regexp.FindSubmatch(proto.Body(payload))
+		if len(m) > 1 {
+			return string(m[1])
+		}
+		if len(m) == 1 {
+			return string(m[0])
+		}
+	case config.TokenJSON:
+		return jsonToken(proto.Body(payload), t.Name)
+	}
+
+	return ""
+}
+
+// jsonToken json body 中 path 的字符串或数字, path 用 . 分隔, 数组用下标
+func jsonToken(body []byte, path string) string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v interface{}
+	if decoder.Decode(&v) != nil {
+		return ""
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+
+	switch value := v.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	}
+
+	return ""
+}
+
+// replaceTokens 替换请求行, header 和 body 中的 token, body 长度变化时更新 Content-Length
+func replaceTokens(payload []byte, tokens map[string]string) []byte {
+	end := proto.MIMEHeadersEndPos(payload)
+	if end < 0 || end > len(payload) {
+		end = len(payload)
+	}
+	head, body := payload[:end], payload[end:]
+
+	changed := false
+	for from, to := range tokens {
+		if bytes.Contains(head, []byte(from)) {
+			head = bytes.ReplaceAll(head, []byte(from), []byte(to))
+			changed = true
+		}
+		if bytes.Contains(body, []byte(from)) {
+			body = bytes.ReplaceAll(body, []byte(from), []byte(to))
+			changed = true
+		}
+	}
+	if !changed {
+		return payload
+	}
+
+	if len(body) != len(payload)-end && len(proto.Header(head, []byte("Content-Length"))) > 0 {
+		head = proto.SetHeader(append([]byte(nil), head...), []byte("Content-Length"), []byte(strconv.Itoa(len(body))))
+	}
+
+	return append(append([]byte(nil), head...), body...)
+}
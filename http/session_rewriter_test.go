@@ -0,0 +1,121 @@
+package http
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+)
+
+type sessionRewriterSuite struct {
+	suite.Suite
+}
+
+func TestUnitSessionRewriter(t *testing.T) {
+	suite.Run(t, new(sessionRewriterSuite))
+}
+
+// loginResponse 登录的响应, 带 session cookie 和 csrf token
+func loginResponse(session, csrf string) []byte {
+	body := `{"data":{"csrf_token":"` + csrf + `","ids":[7]},"form":"<input name=\"csrf\" value=\"` + csrf + `\">"}`
+
+	return []byte("HTTP/1.1 200 OK\r\nSet-Cookie: session=" + session + "; Path=/; HttpOnly\r\n" +
+		"Set-Cookie: theme=dark\r\nX-CSRF-Token: " + csrf + "\r\nContent-Length: " + strconv.Itoa(len(body)) +
+		"\r\n\r\n" + body)
+}
+
+func (s *sessionRewriterSuite) TestRewrite() {
+	const request = "POST /api/order?csrf=recorded-csrf HTTP/1.1\r\nCookie: theme=dark; session=recorded-session\r\n" +
+		"X-CSRF-Token: recorded-csrf\r\nContent-Length: 18\r\n\r\ncsrf=recorded-csrf"
+
+	for _, tt := range []struct {
+		name   string
+		conf   config.HTTPOutputConfig
+		tokens []string
+		want   string
+	}{
+		{
+			name: "cookies",
+			conf: config.HTTPOutputConfig{RewriteCookies: true},
+			want: "POST /api/order?csrf=recorded-csrf HTTP/1.1\r\nCookie: theme=dark; session=replayed-session\r\n" +
+				"X-CSRF-Token: recorded-csrf\r\nContent-Length: 18\r\n\r\ncsrf=recorded-csrf",
+		},
+		{
+			name:   "json token",
+			tokens: []string{"json:data.csrf_token"},
+			want: "POST /api/order?csrf=replayed-csrf-token HTTP/1.1\r\nCookie: theme=dark; session=recorded-session\r\n" +
+				"X-CSRF-Token: replayed-csrf-token\r\nContent-Length: 24\r\n\r\ncsrf=replayed-csrf-token",
+		},
+		{
+			name:   "header and body tokens",
+			conf:   config.HTTPOutputConfig{RewriteCookies: true},
+			tokens: []string{"header:X-CSRF-Token", `body:name="csrf" value="([^"]+)"`},
+			want: "POST /api/order?csrf=replayed-csrf-token HTTP/1.1\r\nCookie: theme=dark; session=replayed-session\r\n" +
+				"X-CSRF-Token: replayed-csrf-token\r\nContent-Length: 24\r\n\r\ncsrf=replayed-csrf-token",
+		},
+		{
+			name:   "short or missing tokens",
+			tokens: []string{"json:data.ids.0", "json:data.missing", "header:X-Missing"},
+			want:   request,
+		},
+	} {
+		s.Run(tt.name, func() {
+			for _, t := range tt.tokens {
+				s.Require().NoError(tt.conf.RewriteTokens.Set(t))
+			}
+			r := NewSessionRewriter(&tt.conf)
+			s.Require().NotNil(r)
+
+			// 录制响应和回放响应的顺序不固定
+			r.ReplayedResponse("10.0.0.1", []byte("1"), loginResponse("replayed-session", "replayed-csrf-token"))
+			payload := []byte(request)
+			s.Equal(request, string(r.Rewrite("10.0.0.1", payload)), "only one response seen")
+			r.OriginalResponse("10.0.0.1", []byte("1"), loginResponse("recorded-session", "recorded-csrf"))
+
+			s.Equal(tt.want, string(r.Rewrite("10.0.0.1", payload)))
+			s.Equal(request, string(payload), "payload is not modified")
+			s.Equal(request, string(r.Rewrite("10.0.0.2", payload)), "other session")
+		})
+	}
+
+	s.Nil(NewSessionRewriter(&config.HTTPOutputConfig{}))
+}
+
+func (s *sessionRewriterSuite) TestValueLimit() {
+	conf := config.HTTPOutputConfig{RewriteCookies: true}
+	s.Require().NoError(conf.RewriteTokens.Set("header:X-CSRF-Token"))
+	r := NewSessionRewriter(&conf)
+
+	// 同一个 NAT 后的很多客户端登录, 最早记下的值被丢掉
+	for i := 0; i <= valueLimit; i++ {
+		id := []byte(strconv.Itoa(i))
+		r.OriginalResponse("10.0.0.1", id, loginResponse("recorded-session-"+string(id), "recorded-csrf-"+string(id)))
+		r.ReplayedResponse("10.0.0.1", id, loginResponse("replayed-session-"+string(id), "replayed-csrf-"+string(id)))
+	}
+
+	v, _ := r.sessions.Get("10.0.0.1")
+	values := v.(*sessionValues)
+	s.Len(values.cookies.values, valueLimit)
+	s.Len(values.tokens.values, valueLimit)
+
+	request := func(i int) string {
+		return "GET / HTTP/1.1\r\nCookie: session=recorded-session-" + strconv.Itoa(i) +
+			"\r\nX-CSRF-Token: recorded-csrf-" + strconv.Itoa(i) + "\r\n\r\n"
+	}
+	s.Equal(request(0), string(r.Rewrite("10.0.0.1", []byte(request(0)))))
+	s.Equal("GET / HTTP/1.1\r\nCookie: session=replayed-session-1\r\nX-CSRF-Token: replayed-csrf-1\r\n\r\n",
+		string(r.Rewrite("10.0.0.1", []byte(request(1)))))
+}
+
+func (s *sessionRewriterSuite) TestTokens() {
+	var tokens config.HTTPTokens
+	s.NoError(tokens.Set("json:a.b"))
+	s.NoError(tokens.Set("header:X-Token"))
+	s.NoError(tokens.Set("body:token=(\\w+)"))
+	s.Len(tokens, 3)
+	s.Error(tokens.Set("json:"))
+	s.Error(tokens.Set("cookie:session"))
+	s.Error(tokens.Set("body:("))
+}
@@ -5,6 +5,7 @@ package logger
 import (
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -48,6 +49,12 @@ var lvl level
 var previousDebugTime = time.Now()
 var debugMutex sync.Mutex
 var once sync.Once
+var fatalHook func(msg string)
+
+// SetFatalHook 设置 Fatal 退出前的回调, 比如发送通知
+func SetFatalHook(hook func(msg string)) {
+	fatalHook = hook
+}
 
 // Init init logger, new zaplog error, use fmt.Println
 func Init(logLevel int, logPath string) {
@@ -111,9 +118,21 @@ func Error(args ...interface{}) {
 // Fatal output panic level log
 func Fatal(args ...interface{}) {
 	print(fatalLevel, args...)
+	if fatalHook != nil {
+		fatalHook(join(args))
+	}
 	os.Exit(1)
 }
 
+func join(args []interface{}) string {
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString(fmt.Sprint(arg))
+	}
+
+	return b.String()
+}
+
 func print(level level, args ...interface{}) {
 	if log == nil {
 		Init(config.Settings.Verbose, config.Settings.LogPath)
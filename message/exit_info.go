@@ -22,6 +22,14 @@ func (msg *ExitRobotMsg) ReadMsg() string {
 	owners := strings.Join(msg.Module.Owners, ",")
 	ipAddress := msg.getLocalIPAdd()
 
+	// 没有使用 logreplay 时没有模块信息
+	if msg.Module.ModuleID == "" {
+		return fmt.Sprintf(`goreplay后台录制提醒
+			   IP address:<font color="comment">%s</font>
+			   goreplay 服务通知，已经录制了%s
+			   如不需要进一步录制，请前往相应容器关闭！`, ipAddress, msg.Time)
+	}
+
 	return fmt.Sprintf(
 		`goreplay后台录制提醒 %s服务录制详情，请相关同事注意。
 			   app_id:<font color="comment">%s</font>
@@ -0,0 +1,264 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"goreplay/config"
+	"goreplay/logger"
+)
+
+// 通知级别
+const (
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+const (
+	notifyTimeout      = 5 * time.Second
+	notifyRetryBackoff = 500 * time.Millisecond
+)
+
+// Notice 一条通知, Content 为 markdown
+type Notice struct {
+	Title   string    `json:"title"`
+	Content string    `json:"content"`
+	Level   string    `json:"level"`
+	Time    time.Time `json:"time"`
+}
+
+// Notifier 发送通知
+type Notifier interface {
+	Notify(n *Notice) error
+}
+
+// NotifierBuilder 由 --notify 的目标新建 Notifier
+type NotifierBuilder func(target string, conf *config.NotifyConfig) (Notifier, error)
+
+var (
+	builders = map[string]NotifierBuilder{
+		"webhook": newWebhookNotifier,
+		"wecom":   newWeComNotifier,
+		"slack":   newSlackNotifier,
+		"file":    newFileNotifier,
+	}
+	notifiers []Notifier
+	lock      sync.RWMutex
+)
+
+// RegisterNotifier 注册通知类型
+func RegisterNotifier(name string, builder NotifierBuilder) {
+	lock.Lock()
+	builders[name] = builder
+	lock.Unlock()
+}
+
+// NewNotifier 由 type:target 新建 Notifier, 比如 wecom:https://qyapi.weixin.qq.com/cgi-bin/webhook/send?key=xx
+func NewNotifier(option string, conf *config.NotifyConfig) (Notifier, error) {
+	i := strings.Index(option, ":")
+	if i <= 0 || i == len(option)-1 {
+		return nil, fmt.Errorf("invalid notify %q, want type:target", option)
+	}
+
+	lock.RLock()
+	builder, ok := builders[option[:i]]
+	lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown notify type %q", option[:i])
+	}
+
+	return builder(option[i+1:], conf)
+}
+
+// Init 按配置初始化通知, 致命错误退出前也会发送通知
+func Init(conf *config.NotifyConfig) error {
+	var ns []Notifier
+	for _, option := range conf.Targets {
+		n, err := NewNotifier(option, conf)
+		if err != nil {
+			return err
+		}
+		ns = append(ns, n)
+	}
+
+	lock.Lock()
+	notifiers = ns
+	lock.Unlock()
+
+	logger.SetFatalHook(func(msg string) {
+		_ = Notify(&Notice{Title: "goreplay 异常退出", Content: msg, Level: LevelError})
+	})
+
+	return nil
+}
+
+// Notify 发送通知到所有 Notifier, 返回最后一个错误
+func Notify(n *Notice) error {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+
+	lock.RLock()
+	ns := notifiers
+	lock.RUnlock()
+
+	var lastErr error
+	for _, notifier := range ns {
+		if err := notifier.Notify(n); err != nil {
+			logger.Error(fmt.Sprintf("[NOTIFY] send %q error: %v", n.Title, err))
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// httpNotifier 把通知 POST 到 url, 失败时重试
+type httpNotifier struct {
+	url     string
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	body    func(n *Notice) interface{}
+	check   func(body []byte) error
+}
+
+func newHTTPNotifier(url string, conf *config.NotifyConfig, body func(n *Notice) interface{}) *httpNotifier {
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = notifyTimeout
+	}
+
+	return &httpNotifier{
+		url:     url,
+		client:  &http.Client{Timeout: timeout},
+		retries: conf.Retries,
+		backoff: notifyRetryBackoff,
+		body:    body,
+	}
+}
+
+// Notify 发送通知
+func (h *httpNotifier) Notify(n *Notice) error {
+	data, err := json.Marshal(h.body(n))
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err = h.post(data); err == nil || attempt >= h.retries {
+			return err
+		}
+
+		logger.Debug(fmt.Sprintf("[NOTIFY] retry %s: %v", h.url, err))
+		time.Sleep(h.backoff)
+	}
+}
+
+func (h *httpNotifier) post(data []byte) error {
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notify %s failed with status %d: %s", h.url, resp.StatusCode, body)
+	}
+
+	if h.check != nil {
+		return h.check(body)
+	}
+
+	return nil
+}
+
+// newWebhookNotifier 通用 webhook, 发送 Notice 的 json
+func newWebhookNotifier(target string, conf *config.NotifyConfig) (Notifier, error) {
+	return newHTTPNotifier(target, conf, func(n *Notice) interface{} {
+		return n
+	}), nil
+}
+
+// newWeComNotifier 企业微信机器人, 发送 markdown 消息
+func newWeComNotifier(target string, conf *config.NotifyConfig) (Notifier, error) {
+	h := newHTTPNotifier(target, conf, func(n *Notice) interface{} {
+		return map[string]interface{}{
+			"msgtype":  "markdown",
+			"markdown": map[string]string{"content": fmt.Sprintf("**%s**\n%s", n.Title, n.Content)},
+		}
+	})
+
+	// 企业微信出错时也返回 200, 错误码在 body 中
+	h.check = func(body []byte) error {
+		var rsp struct {
+			ErrCode int    `json:"errcode"`
+			ErrMsg  string `json:"errmsg"`
+		}
+		if err := json.Unmarshal(body, &rsp); err != nil {
+			return err
+		}
+		if rsp.ErrCode != 0 {
+			return fmt.Errorf("wecom errcode %d: %s", rsp.ErrCode, rsp.ErrMsg)
+		}
+		return nil
+	}
+
+	return h, nil
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]+>`)
+
+// newSlackNotifier slack incoming webhook, 去掉 slack 不支持的 html 标签
+func newSlackNotifier(target string, conf *config.NotifyConfig) (Notifier, error) {
+	return newHTTPNotifier(target, conf, func(n *Notice) interface{} {
+		return map[string]string{"text": fmt.Sprintf("*%s*\n%s", n.Title, htmlTag.ReplaceAllString(n.Content, ""))}
+	}), nil
+}
+
+// fileNotifier 把通知按 json 行追加到本地文件
+type fileNotifier struct {
+	sync.Mutex
+	path string
+}
+
+func newFileNotifier(target string, _ *config.NotifyConfig) (Notifier, error) {
+	return &fileNotifier{path: target}, nil
+}
+
+// Notify 写入通知
+func (f *fileNotifier) Notify(n *Notice) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
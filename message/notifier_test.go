@@ -0,0 +1,162 @@
+package message
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+)
+
+// TestUnitNotifier notifier test execute
+func TestUnitNotifier(t *testing.T) {
+	suite.Run(t, new(notifierSuite))
+}
+
+type notifierSuite struct {
+	suite.Suite
+}
+
+// startStub 本地 http 桩, 前 failures 次返回 500, 记录收到的 body
+func startStub(failures int32, reply string, delay time.Duration) (*httptest.Server, chan map[string]interface{}) {
+	bodies := make(chan map[string]interface{}, 16)
+	var n int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+
+		var body map[string]interface{}
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &body)
+		bodies <- body
+
+		if atomic.AddInt32(&n, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(reply))
+	}))
+
+	return server, bodies
+}
+
+func (s *notifierSuite) newNotifier(option string, conf *config.NotifyConfig) Notifier {
+	n, err := NewNotifier(option, conf)
+	s.Require().NoError(err)
+	if h, ok := n.(*httpNotifier); ok {
+		h.backoff = time.Millisecond
+	}
+
+	return n
+}
+
+func (s *notifierSuite) TestHTTPNotifier() {
+	notice := &Notice{Title: "goreplay", Content: `app_id:<font color="comment">1</font>`, Level: LevelInfo,
+		Time: time.Unix(1, 0).UTC()}
+
+	tests := []struct {
+		name      string
+		typ       string
+		failures  int32
+		reply     string
+		delay     time.Duration
+		wantCalls int
+		wantBody  map[string]interface{}
+		wantErr   bool
+	}{
+		{name: "webhook", typ: "webhook", wantCalls: 1, wantBody: map[string]interface{}{
+			"title": "goreplay", "content": notice.Content, "level": "info", "time": "1970-01-01T00:00:01Z"}},
+		{name: "wecom", typ: "wecom", reply: `{"errcode":0,"errmsg":"ok"}`, wantCalls: 1,
+			wantBody: map[string]interface{}{"msgtype": "markdown",
+				"markdown": map[string]interface{}{"content": "**goreplay**\n" + notice.Content}}},
+		{name: "wecom error", typ: "wecom", reply: `{"errcode":93000,"errmsg":"invalid webhook url"}`,
+			wantCalls: 3, wantErr: true},
+		{name: "slack", typ: "slack", wantCalls: 1,
+			wantBody: map[string]interface{}{"text": "*goreplay*\napp_id:1"}},
+		{name: "retry", typ: "webhook", failures: 2, wantCalls: 3},
+		{name: "give up", typ: "webhook", failures: 3, wantCalls: 3, wantErr: true},
+		{name: "timeout", typ: "slack", delay: 100 * time.Millisecond, wantCalls: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			server, bodies := startStub(tt.failures, tt.reply, tt.delay)
+			defer server.Close()
+
+			n := s.newNotifier(tt.typ+":"+server.URL, &config.NotifyConfig{Timeout: 50 * time.Millisecond, Retries: 2})
+			err := n.Notify(notice)
+			if tt.wantErr {
+				s.Error(err)
+			} else {
+				s.NoError(err)
+			}
+
+			// 超时的请求在 server 端稍后才记录
+			for i := 0; i < tt.wantCalls; i++ {
+				select {
+				case body := <-bodies:
+					if tt.wantBody != nil {
+						s.Equal(tt.wantBody, body)
+					}
+				case <-time.After(time.Second):
+					s.FailNow("notice is not sent")
+				}
+			}
+			s.Empty(bodies)
+		})
+	}
+}
+
+func (s *notifierSuite) TestNewNotifier() {
+	for _, option := range []string{"webhook", "webhook:", ":http://a", "sms:10086"} {
+		_, err := NewNotifier(option, &config.NotifyConfig{})
+		s.Error(err, option)
+	}
+}
+
+func (s *notifierSuite) TestNotify() {
+	server, bodies := startStub(0, "", 0)
+	defer server.Close()
+
+	path := filepath.Join(s.T().TempDir(), "notice.log")
+	s.Require().NoError(Init(&config.NotifyConfig{
+		Targets: config.MultiOption{"webhook:" + server.URL, "file:" + path},
+	}))
+	defer func() {
+		s.NoError(Init(&config.NotifyConfig{}))
+	}()
+
+	s.NoError(Notify(&Notice{Title: "first", Level: LevelWarn}))
+	s.NoError(Notify(&Notice{Title: "second", Level: LevelError}))
+
+	s.Equal("first", (<-bodies)["title"])
+	s.Equal("second", (<-bodies)["title"])
+
+	data, err := ioutil.ReadFile(path)
+	s.Require().NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	s.Require().Len(lines, 2)
+
+	var notice Notice
+	s.Require().NoError(json.Unmarshal([]byte(lines[1]), &notice))
+	s.Equal("second", notice.Title)
+	s.Equal(LevelError, notice.Level)
+	s.False(notice.Time.IsZero())
+}
+
+func (s *notifierSuite) TestExitRobotMsg() {
+	msg := &ExitRobotMsg{Time: time.Hour}
+	s.Contains(msg.ReadMsg(), "已经录制了1h0m0s")
+	s.NotContains(msg.ReadMsg(), "module_id")
+
+	msg.Module.ModuleID = "m1"
+	s.Contains(msg.ReadMsg(), `module_id:<font color="comment">m1</font>`)
+}
@@ -0,0 +1,407 @@
+// Package metrics 以 prometheus text 格式导出 goreplay 的运行指标
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"goreplay/logger"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets 默认的延迟分桶, 单位秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default 默认的 Registry, 插件的指标都注册在这里
+var Default = NewRegistry()
+
+// metric 一个时间序列
+type metric interface {
+	write(w io.Writer, name, labels string)
+}
+
+// Registry 保存所有指标
+type Registry struct {
+	sync.Mutex
+	vecs map[string]*vec
+}
+
+// NewRegistry 新建 Registry
+func NewRegistry() *Registry {
+	return &Registry{vecs: make(map[string]*vec)}
+}
+
+// register 同名的指标只注册一次
+func (r *Registry) register(name, help, typ string, labels []string, newMetric func() metric) *vec {
+	r.Lock()
+	defer r.Unlock()
+
+	if v, ok := r.vecs[name]; ok {
+		if v.typ != typ || len(v.labels) != len(labels) {
+			panic(fmt.Sprintf("metrics: %s registered with different type or labels", name))
+		}
+		return v
+	}
+
+	v := &vec{name: name, help: help, typ: typ, labels: labels, newMetric: newMetric,
+		series: make(map[string]*series)}
+	r.vecs[name] = v
+
+	return v
+}
+
+// WriteTo 按 prometheus text 格式写入所有指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	names := make([]string, 0, len(r.vecs))
+	for name := range r.vecs {
+		names = append(names, name)
+	}
+	vecs := make([]*vec, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		vecs = append(vecs, r.vecs[name])
+	}
+	r.Unlock()
+
+	var buf bytes.Buffer
+	for _, v := range vecs {
+		v.write(&buf)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP 输出所有指标
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	if _, err := r.WriteTo(w); err != nil {
+		logger.Debug("[METRICS] write metrics error: ", err)
+	}
+}
+
+// Start 在 addr 上监听 /metrics, 监听失败时返回错误
+func Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logger.Error("[METRICS] serve error: ", err)
+		}
+	}()
+
+	logger.Info("[METRICS] serving prometheus metrics on ", ln.Addr().String(), "/metrics")
+
+	return nil
+}
+
+type series struct {
+	labels string
+	metric metric
+}
+
+// vec 同名指标按 label 值区分的一组时间序列
+type vec struct {
+	sync.Mutex
+	name, help, typ string
+	labels          []string
+	newMetric       func() metric
+	series          map[string]*series
+}
+
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// with 返回 label 值对应的时间序列, 不存在时新建
+func (v *vec) with(values []string) metric {
+	key := v.key(values)
+
+	v.Lock()
+	defer v.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: formatLabels(v.labels, values), metric: v.newMetric()}
+		v.series[key] = s
+	}
+
+	return s.metric
+}
+
+// Func 时间序列的值在抓取时由 fn 计算, 用于已经计数的字段, 同一组 label 值会覆盖之前的 fn
+func (v *vec) Func(fn func() float64, values ...string) {
+	key := v.key(values)
+
+	v.Lock()
+	v.series[key] = &series{labels: formatLabels(v.labels, values), metric: funcMetric(fn)}
+	v.Unlock()
+}
+
+// Delete 删除 label 值对应的时间序列, 插件关闭时调用
+func (v *vec) Delete(values ...string) {
+	key := v.key(values)
+
+	v.Lock()
+	delete(v.series, key)
+	v.Unlock()
+}
+
+func (v *vec) write(w io.Writer) {
+	v.Lock()
+	all := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		all = append(all, s)
+	}
+	v.Unlock()
+
+	if len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].labels < all[j].labels
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ)
+	for _, s := range all {
+		s.metric.write(w, v.name, s.labels)
+	}
+}
+
+// CounterVec 按 label 区分的 Counter
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec 在 Default 中注册 CounterVec
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{Default.register(name, help, "counter", labels, func() metric {
+		return new(Counter)
+	})}
+}
+
+// With 返回 label 值对应的 Counter
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values).(*Counter)
+}
+
+// GaugeVec 按 label 区分的 Gauge
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec 在 Default 中注册 GaugeVec
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{Default.register(name, help, "gauge", labels, func() metric {
+		return new(Gauge)
+	})}
+}
+
+// With 返回 label 值对应的 Gauge
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values).(*Gauge)
+}
+
+// HistogramVec 按 label 区分的 Histogram
+type HistogramVec struct {
+	*vec
+}
+
+// NewHistogramVec 在 Default 中注册 HistogramVec, buckets 为递增的上界
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{Default.register(name, help, "histogram", labels, func() metric {
+		return newHistogram(buckets)
+	})}
+}
+
+// With 返回 label 值对应的 Histogram
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values).(*Histogram)
+}
+
+// Counter 只增不减的计数, 为 nil 时忽略
+type Counter struct {
+	bits uint64
+}
+
+// Inc 加一
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add 增加 delta, delta 不能为负
+func (c *Counter) Add(delta float64) {
+	if c == nil {
+		return
+	}
+	addFloat(&c.bits, delta)
+}
+
+// Value 当前的值
+func (c *Counter) Value() float64 {
+	if c == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+func (c *Counter) write(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, c.Value())
+}
+
+// Gauge 可增可减的值, 为 nil 时忽略
+type Gauge struct {
+	bits uint64
+}
+
+// Set 设置当前值
+func (g *Gauge) Set(value float64) {
+	if g == nil {
+		return
+	}
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+// Add 增加 delta, 可以为负
+func (g *Gauge) Add(delta float64) {
+	if g == nil {
+		return
+	}
+	addFloat(&g.bits, delta)
+}
+
+// Value 当前的值
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) write(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, g.Value())
+}
+
+// Histogram 按分桶统计观测值的分布, 为 nil 时忽略
+type Histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(value float64) {
+	if h == nil {
+		return
+	}
+
+	i := sort.SearchFloat64s(h.buckets, value)
+
+	h.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+	h.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	h.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.Unlock()
+
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += counts[i]
+		writeSample(w, name+"_bucket", withLabel(labels, "le", formatFloat(upper)), float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", withLabel(labels, "le", "+Inf"), float64(count))
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+type funcMetric func() float64
+
+func (f funcMetric) write(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, f())
+}
+
+func addFloat(bits *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(bits, old, next) {
+			return
+		}
+	}
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatLabels(names, values []string) string {
+	var labels string
+	for i, name := range names {
+		labels = withLabel(labels, name, values[i])
+	}
+	return labels
+}
+
+func withLabel(labels, name, value string) string {
+	if labels != "" {
+		labels += ","
+	}
+	return labels + name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
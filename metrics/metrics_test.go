@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitMetrics metrics test execute
+func TestUnitMetrics(t *testing.T) {
+	suite.Run(t, new(metricsSuite))
+}
+
+type metricsSuite struct {
+	suite.Suite
+	origin *Registry
+}
+
+func (s *metricsSuite) SetupTest() {
+	s.origin = Default
+	Default = NewRegistry()
+}
+
+func (s *metricsSuite) TearDownTest() {
+	Default = s.origin
+}
+
+func (s *metricsSuite) text() string {
+	var buf bytes.Buffer
+	_, err := Default.WriteTo(&buf)
+	s.Require().NoError(err)
+
+	return buf.String()
+}
+
+func (s *metricsSuite) TestWrite() {
+	tests := []struct {
+		name   string
+		record func()
+		want   string
+	}{
+		{name: "counter", record: func() {
+			v := NewCounterVec("packets_total", "Captured packets.", "input")
+			v.With(":80").Inc()
+			v.With(":80").Add(2)
+			v.With(":8080").Inc()
+		}, want: "# HELP packets_total Captured packets.\n# TYPE packets_total counter\n" +
+			"packets_total{input=\":80\"} 3\npackets_total{input=\":8080\"} 1\n"},
+		{name: "gauge", record: func() {
+			g := NewGaugeVec("queue_length", "Queue length.").With()
+			g.Set(5)
+			g.Add(-1.5)
+		}, want: "# HELP queue_length Queue length.\n# TYPE queue_length gauge\nqueue_length 3.5\n"},
+		{name: "func", record: func() {
+			NewGaugeVec("workers", "Workers.", "output").Func(func() float64 { return 7 }, "http")
+		}, want: "# HELP workers Workers.\n# TYPE workers gauge\nworkers{output=\"http\"} 7\n"},
+		{name: "deleted", record: func() {
+			v := NewGaugeVec("workers", "Workers.", "output")
+			v.Func(func() float64 { return 7 }, "http")
+			v.Delete("http")
+		}, want: ""},
+		{name: "histogram", record: func() {
+			h := NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "output").With("http")
+			h.Observe(0.05)
+			h.Observe(0.1)
+			h.Observe(0.5)
+			h.Observe(3)
+		}, want: "# HELP latency_seconds Latency.\n# TYPE latency_seconds histogram\n" +
+			"latency_seconds_bucket{output=\"http\",le=\"0.1\"} 2\n" +
+			"latency_seconds_bucket{output=\"http\",le=\"1\"} 3\n" +
+			"latency_seconds_bucket{output=\"http\",le=\"+Inf\"} 4\n" +
+			"latency_seconds_sum{output=\"http\"} 3.65\nlatency_seconds_count{output=\"http\"} 4\n"},
+		{name: "escape", record: func() {
+			NewCounterVec("errors_total", "Errors\nof \\output.", "address").With("a\"b\\c\n").Inc()
+		}, want: "# HELP errors_total Errors\\nof \\\\output.\n# TYPE errors_total counter\n" +
+			"errors_total{address=\"a\\\"b\\\\c\\n\"} 1\n"},
+		{name: "sorted", record: func() {
+			NewCounterVec("b_total", "B.").With().Inc()
+			NewCounterVec("a_total", "A.").With().Inc()
+		}, want: "# HELP a_total A.\n# TYPE a_total counter\na_total 1\n" +
+			"# HELP b_total B.\n# TYPE b_total counter\nb_total 1\n"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			Default = NewRegistry()
+			tt.record()
+			s.Equal(tt.want, s.text())
+		})
+	}
+}
+
+func (s *metricsSuite) TestRegister() {
+	a := NewCounterVec("replays_total", "Replays.", "result")
+	b := NewCounterVec("replays_total", "Replays.", "result")
+	a.With("success").Inc()
+	b.With("success").Inc()
+	s.Equal(2.0, a.With("success").Value())
+
+	s.Panics(func() { NewGaugeVec("replays_total", "Replays.", "result") })
+	s.Panics(func() { a.With("success", "extra") })
+}
+
+func (s *metricsSuite) TestNil() {
+	var (
+		c *Counter
+		g *Gauge
+		h *Histogram
+	)
+	s.NotPanics(func() {
+		c.Inc()
+		g.Set(1)
+		h.Observe(1)
+	})
+	s.Zero(c.Value())
+	s.Zero(g.Value())
+}
+
+func (s *metricsSuite) TestServeHTTP() {
+	NewCounterVec("packets_total", "Captured packets.").With().Inc()
+
+	server := httptest.NewServer(Default)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	s.Equal(contentType, resp.Header.Get("Content-Type"))
+	s.Contains(string(body), "packets_total 1\n")
+}
+
+func (s *metricsSuite) TestStart() {
+	s.Error(Start("invalid address"))
+}
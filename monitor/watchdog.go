@@ -0,0 +1,192 @@
+// Package monitor 监控 goreplay 进程的资源占用
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+
+	"goreplay/config"
+	"goreplay/logger"
+)
+
+const checkInterval = time.Second
+
+// Shedder 可以降低负载的插件
+type Shedder interface {
+	// Shed 降低一级负载, 返回动作的描述, 已经无法再降低时返回 false
+	Shed() (string, bool)
+	// Restore 恢复一级负载, 返回动作的描述, 已经完全恢复时返回 false
+	Restore() (string, bool)
+}
+
+// UsageFunc 返回进程的 CPU 和内存占用百分比
+type UsageFunc func() (cpu float64, mem float64, err error)
+
+// Watchdog CPU 或内存持续超过阈值时先降低负载, 仍然超过时关闭 goreplay;
+// 持续低于阈值时逐级恢复负载
+type Watchdog struct {
+	conf     config.MonitorConfig
+	usage    UsageFunc
+	shedders []Shedder
+	shutdown func()
+	interval time.Duration
+
+	over     time.Duration // 持续超过阈值的时间
+	under    time.Duration // 降低负载后持续低于阈值的时间
+	shed     int           // 尚未恢复的降低次数
+	stopped  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewWatchdog 新建 Watchdog, shutdown 在降低负载无效时调用一次
+func NewWatchdog(conf config.MonitorConfig, shedders []Shedder, shutdown func()) (*Watchdog, error) {
+	usage, err := ProcessUsage(os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+
+	return newWatchdog(conf, usage, shedders, shutdown), nil
+}
+
+func newWatchdog(conf config.MonitorConfig, usage UsageFunc, shedders []Shedder, shutdown func()) *Watchdog {
+	if conf.Duration < checkInterval {
+		conf.Duration = checkInterval
+	}
+
+	return &Watchdog{
+		conf:     conf,
+		usage:    usage,
+		shedders: shedders,
+		shutdown: shutdown,
+		interval: checkInterval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// ProcessUsage 返回进程的资源占用, CPU 为占全部核的百分比, 内存为 RSS 占物理内存的百分比
+func ProcessUsage(pid int) (UsageFunc, error) {
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// 第一次调用只记录 CPU 时间
+	if _, err = p.Percent(0); err != nil {
+		return nil, err
+	}
+
+	return func() (float64, float64, error) {
+		cpu, err := p.Percent(0)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		mem, err := p.MemoryPercent()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		return cpu / float64(runtime.NumCPU()), float64(mem), nil
+	}, nil
+}
+
+// Start 开始监控
+func (w *Watchdog) Start() {
+	logger.Info(fmt.Sprintf("[WATCHDOG] cpu threshold: %.1f%%, memory threshold: %.1f%%, duration: %s",
+		w.conf.CPUThreshold, w.conf.MemThreshold, w.conf.Duration))
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.check()
+			}
+		}
+	}()
+}
+
+// Stop 停止监控
+func (w *Watchdog) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *Watchdog) check() {
+	if w.stopped {
+		return
+	}
+
+	cpu, mem, err := w.usage()
+	if err != nil {
+		logger.Debug("[WATCHDOG] get process usage error: ", err)
+		return
+	}
+
+	if w.exceeded(cpu, mem) {
+		w.under = 0
+		w.over += w.interval
+		if w.over >= w.conf.Duration {
+			w.over = 0
+			w.act(cpu, mem)
+		}
+		return
+	}
+
+	w.over = 0
+	if w.shed == 0 {
+		return
+	}
+
+	w.under += w.interval
+	if w.under >= w.conf.Duration {
+		w.under = 0
+		w.restore(cpu, mem)
+	}
+}
+
+// exceeded 阈值为 0 时不检查
+func (w *Watchdog) exceeded(cpu, mem float64) bool {
+	return (w.conf.CPUThreshold > 0 && cpu > w.conf.CPUThreshold) ||
+		(w.conf.MemThreshold > 0 && mem > w.conf.MemThreshold)
+}
+
+func (w *Watchdog) act(cpu, mem float64) {
+	for _, s := range w.shedders {
+		if action, ok := s.Shed(); ok {
+			w.shed++
+			logger.Warn(fmt.Sprintf("[WATCHDOG] cpu %.1f%%, memory %.1f%% over threshold for %s, shed load: %s",
+				cpu, mem, w.conf.Duration, action))
+			return
+		}
+	}
+
+	w.stopped = true
+	logger.Error(fmt.Sprintf("[WATCHDOG] cpu %.1f%%, memory %.1f%% over threshold for %s, "+
+		"nothing left to shed, shutting down", cpu, mem, w.conf.Duration))
+	w.shutdown()
+}
+
+func (w *Watchdog) restore(cpu, mem float64) {
+	for i := len(w.shedders) - 1; i >= 0; i-- {
+		if action, ok := w.shedders[i].Restore(); ok {
+			w.shed--
+			logger.Info(fmt.Sprintf("[WATCHDOG] cpu %.1f%%, memory %.1f%% under threshold for %s, restore load: %s",
+				cpu, mem, w.conf.Duration, action))
+			return
+		}
+	}
+
+	w.shed = 0
+}
@@ -0,0 +1,114 @@
+package monitor
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+)
+
+// TestUnitWatchdog watchdog test execute
+func TestUnitWatchdog(t *testing.T) {
+	suite.Run(t, new(watchdogSuite))
+}
+
+type watchdogSuite struct {
+	suite.Suite
+}
+
+// fakeShedder 最多降低 levels 级
+type fakeShedder struct {
+	levels int
+	shed   int
+}
+
+func (f *fakeShedder) Shed() (string, bool) {
+	if f.shed >= f.levels {
+		return "", false
+	}
+	f.shed++
+	return "shed", true
+}
+
+func (f *fakeShedder) Restore() (string, bool) {
+	if f.shed == 0 {
+		return "", false
+	}
+	f.shed--
+	return "restore", true
+}
+
+func (s *watchdogSuite) TestCheck() {
+	type usage struct{ cpu, mem float64 }
+	high, low, highMem := usage{cpu: 90}, usage{cpu: 10}, usage{cpu: 10, mem: 95}
+
+	repeat := func(u usage, n int) []usage {
+		var us []usage
+		for i := 0; i < n; i++ {
+			us = append(us, u)
+		}
+		return us
+	}
+	concat := func(parts ...[]usage) []usage {
+		var us []usage
+		for _, p := range parts {
+			us = append(us, p...)
+		}
+		return us
+	}
+
+	tests := []struct {
+		name         string
+		levels       int
+		usages       []usage
+		wantShed     int
+		wantShutdown bool
+	}{
+		{name: "under threshold", levels: 1, usages: repeat(low, 10)},
+		{name: "short spike", levels: 1, usages: concat(repeat(high, 2), repeat(low, 1), repeat(high, 2))},
+		{name: "shed", levels: 2, usages: repeat(high, 3), wantShed: 1},
+		{name: "memory", levels: 2, usages: repeat(highMem, 3), wantShed: 1},
+		{name: "shed twice", levels: 2, usages: repeat(high, 6), wantShed: 2},
+		{name: "shutdown", levels: 1, usages: repeat(high, 6), wantShed: 1, wantShutdown: true},
+		{name: "restore", levels: 2, usages: concat(repeat(high, 6), repeat(low, 3)), wantShed: 1},
+		{name: "restore all", levels: 2, usages: concat(repeat(high, 6), repeat(low, 9))},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			var next int
+			shutdown := 0
+			shedder := &fakeShedder{levels: tt.levels}
+			w := newWatchdog(config.MonitorConfig{CPUThreshold: 85, MemThreshold: 85, Duration: 3 * time.Second},
+				func() (float64, float64, error) {
+					u := tt.usages[next]
+					next++
+					return u.cpu, u.mem, nil
+				}, []Shedder{shedder}, func() { shutdown++ })
+
+			for range tt.usages {
+				w.check()
+			}
+
+			s.Equal(tt.wantShed, shedder.shed)
+			if tt.wantShutdown {
+				s.Equal(1, shutdown)
+			} else {
+				s.Zero(shutdown)
+			}
+		})
+	}
+}
+
+func (s *watchdogSuite) TestProcessUsage() {
+	usage, err := ProcessUsage(os.Getpid())
+	s.Require().NoError(err)
+
+	cpu, mem, err := usage()
+	s.NoError(err)
+	s.GreaterOrEqual(cpu, 0.0)
+	s.Greater(mem, 0.0)
+}
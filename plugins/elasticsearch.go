@@ -0,0 +1,424 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goreplay/logger"
+	"goreplay/protocol"
+)
+
+const (
+	esBatchSize     = 500
+	esFlushInterval = time.Second
+	esQueueLen      = 1000
+	esMaxRetries    = 3
+	esRetryBackoff  = 100 * time.Millisecond
+	esPairTimeout   = 5 * time.Second
+	esTimeout       = 10 * time.Second
+)
+
+// ESRequestResponse 导出到 ElasticSearch 的文档, Resp_* 为回放的响应, OrigResp_* 为录制的响应
+type ESRequestResponse struct {
+	ID                   string    `json:"ID"`
+	ReqURL               string    `json:"Req_URL"`
+	ReqMethod            string    `json:"Req_Method"`
+	ReqUserAgent         string    `json:"Req_User-Agent"`
+	ReqAcceptLanguage    string    `json:"Req_Accept-Language,omitempty"`
+	ReqAccept            string    `json:"Req_Accept,omitempty"`
+	ReqAcceptEncoding    string    `json:"Req_Accept-Encoding,omitempty"`
+	ReqIfModifiedSince   string    `json:"Req_If-Modified-Since,omitempty"`
+	ReqConnection        string    `json:"Req_Connection,omitempty"`
+	ReqCookies           string    `json:"Req_Cookies,omitempty"`
+	RespStatus           string    `json:"Resp_Status"`
+	RespStatusCode       string    `json:"Resp_Status-Code"`
+	RespProto            string    `json:"Resp_Proto,omitempty"`
+	RespContentLength    string    `json:"Resp_Content-Length,omitempty"`
+	RespContentType      string    `json:"Resp_Content-Type,omitempty"`
+	RespTransferEncoding string    `json:"Resp_Transfer-Encoding,omitempty"`
+	RespContentEncoding  string    `json:"Resp_Content-Encoding,omitempty"`
+	RespExpires          string    `json:"Resp_Expires,omitempty"`
+	RespCacheControl     string    `json:"Resp_Cache-Control,omitempty"`
+	RespVary             string    `json:"Resp_Vary,omitempty"`
+	RespSetCookie        string    `json:"Resp_Set-Cookie,omitempty"`
+	OrigRespStatus       string    `json:"OrigResp_Status,omitempty"`
+	OrigRespStatusCode   string    `json:"OrigResp_Status-Code,omitempty"`
+	OrigRespContentLen   string    `json:"OrigResp_Content-Length,omitempty"`
+	Rtt                  int64     `json:"RTT"`
+	OrigRtt              int64     `json:"Orig_RTT,omitempty"`
+	Timestamp            time.Time `json:"Timestamp"`
+}
+
+// esPart 请求, 录制的响应或回放的响应
+type esPart struct {
+	kind      byte
+	uuid      string
+	timestamp int64
+	latency   int64
+	data      []byte
+}
+
+// esRecord 按 uuid 配对中的记录
+type esRecord struct {
+	parts   [3]*esPart
+	created time.Time
+}
+
+func (r *esRecord) part(kind byte) *esPart {
+	return r.parts[kind-protocol.RequestPayload]
+}
+
+func (r *esRecord) complete() bool {
+	return r.parts[0] != nil && r.parts[1] != nil && r.parts[2] != nil
+}
+
+type esDoc struct {
+	id     string
+	source []byte
+}
+
+// ESPlugin 将请求, 录制的响应和回放的响应按 uuid 配对, 通过 _bulk 接口批量写入 ElasticSearch
+type ESPlugin struct {
+	URL   string
+	Index string
+
+	client  *http.Client
+	parts   chan *esPart
+	pending map[string]*esRecord
+	batch   []esDoc
+
+	batchSize     int
+	flushInterval time.Duration
+	pairTimeout   time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// parseESURI 解析 host:port/index 或 http://host:port/index
+func parseESURI(uri string) (string, string, error) {
+	if !strings.Contains(uri, "://") {
+		uri = "http://" + uri
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+
+	index := strings.Trim(u.Path, "/")
+	if u.Host == "" || index == "" || strings.Contains(index, "/") {
+		return "", "", fmt.Errorf("invalid elasticsearch uri %q, want host:port/index", uri)
+	}
+
+	u.Path, u.RawPath, u.RawQuery, u.Fragment = "", "", "", ""
+
+	return u.String(), index, nil
+}
+
+// NewESPlugin 新建 ESPlugin
+func NewESPlugin(uri string) (*ESPlugin, error) {
+	addr, index, err := parseESURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ESPlugin{
+		URL:           addr,
+		Index:         index,
+		client:        &http.Client{Timeout: esTimeout},
+		parts:         make(chan *esPart, esQueueLen),
+		pending:       make(map[string]*esRecord),
+		batchSize:     esBatchSize,
+		flushInterval: esFlushInterval,
+		pairTimeout:   esPairTimeout,
+		maxRetries:    esMaxRetries,
+		retryBackoff:  esRetryBackoff,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	go p.run()
+
+	return p, nil
+}
+
+// Add 加入一个请求或响应, 队列满时阻塞
+func (p *ESPlugin) Add(meta, data []byte) {
+	fields := protocol.PayloadMeta(meta)
+	if len(fields) < 4 || len(fields[0]) == 0 ||
+		fields[0][0] < protocol.RequestPayload || fields[0][0] > protocol.ReplayedResponsePayload {
+		return
+	}
+
+	part := &esPart{
+		kind: fields[0][0],
+		uuid: string(fields[1]),
+		data: append([]byte(nil), data...),
+	}
+	part.timestamp, _ = strconv.ParseInt(string(fields[2]), 10, 64)
+	part.latency, _ = strconv.ParseInt(string(fields[3]), 10, 64)
+
+	select {
+	case <-p.stop:
+	case p.parts <- part:
+	}
+}
+
+// Close 导出剩余的记录后关闭
+func (p *ESPlugin) Close() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	<-p.done
+
+	return nil
+}
+
+func (p *ESPlugin) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case part := <-p.parts:
+			p.pair(part)
+		case <-ticker.C:
+			p.expire(time.Now().Add(-p.pairTimeout))
+			p.flush()
+		case <-p.stop:
+			for len(p.parts) > 0 {
+				p.pair(<-p.parts)
+			}
+			p.expire(time.Now().Add(time.Hour))
+			p.flush()
+			return
+		}
+	}
+}
+
+func (p *ESPlugin) pair(part *esPart) {
+	r, ok := p.pending[part.uuid]
+	if !ok {
+		r = &esRecord{created: time.Now()}
+		p.pending[part.uuid] = r
+	}
+
+	r.parts[part.kind-protocol.RequestPayload] = part
+	if r.complete() {
+		delete(p.pending, part.uuid)
+		p.push(r)
+	}
+}
+
+// expire 导出 deadline 之前开始配对的记录, 没有请求的记录直接丢弃
+func (p *ESPlugin) expire(deadline time.Time) {
+	for id, r := range p.pending {
+		if r.created.After(deadline) {
+			continue
+		}
+
+		delete(p.pending, id)
+		if r.part(protocol.RequestPayload) != nil {
+			p.push(r)
+		}
+	}
+}
+
+func (p *ESPlugin) push(r *esRecord) {
+	doc, err := esDocument(r)
+	if err != nil {
+		logger.Debug("[ELASTICSEARCH] skip record: ", err)
+		return
+	}
+
+	source, err := json.Marshal(doc)
+	if err != nil {
+		logger.Debug("[ELASTICSEARCH] skip record: ", err)
+		return
+	}
+
+	p.batch = append(p.batch, esDoc{id: doc.ID, source: source})
+	if len(p.batch) >= p.batchSize {
+		p.flush()
+	}
+}
+
+func (p *ESPlugin) flush() {
+	if len(p.batch) == 0 {
+		return
+	}
+
+	docs := p.batch
+	p.batch = nil
+	p.bulk(docs)
+}
+
+// bulk 发送一批文档, 整批或部分失败时按指数退避重试
+func (p *ESPlugin) bulk(docs []esDoc) {
+	backoff := p.retryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := p.send(docs)
+		if err == nil && len(retry) == 0 {
+			return
+		}
+
+		if attempt >= p.maxRetries {
+			logger.Warn(fmt.Sprintf("[ELASTICSEARCH] drop %d documents after %d retries: %v",
+				len(retry), attempt, err))
+			return
+		}
+
+		logger.Debug(fmt.Sprintf("[ELASTICSEARCH] retry %d documents: %v", len(retry), err))
+		docs = retry
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string          `json:"_id"`
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// send 发送一次 _bulk 请求, 返回需要重试的文档
+func (p *ESPlugin) send(docs []esDoc) ([]esDoc, error) {
+	var body bytes.Buffer
+	for _, doc := range docs {
+		action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": p.Index, "_id": doc.id}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc.source)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.URL+"/_bulk", &body)
+	if err != nil {
+		return docs, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return docs, err
+	}
+	defer resp.Body.Close()
+
+	if esRetryable(resp.StatusCode) {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return docs, fmt.Errorf("bulk request failed with status %d", resp.StatusCode)
+	}
+
+	var result esBulkResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode >= 300 {
+		logger.Warn(fmt.Sprintf("[ELASTICSEARCH] drop %d documents, bulk status %d: %v",
+			len(docs), resp.StatusCode, err))
+		return nil, nil
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+
+	var retry []esDoc
+	for i, item := range result.Items {
+		for _, status := range item {
+			switch {
+			case i >= len(docs) || status.Status < 300:
+			case esRetryable(status.Status):
+				retry = append(retry, docs[i])
+			default:
+				logger.Warn(fmt.Sprintf("[ELASTICSEARCH] drop document %s: %s", status.ID, status.Error))
+			}
+		}
+	}
+	if len(retry) > 0 {
+		err = fmt.Errorf("%d documents are rejected", len(retry))
+	}
+
+	return retry, err
+}
+
+func esRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// esDocument 由配对的请求和响应生成文档
+func esDocument(r *esRecord) (*ESRequestResponse, error) {
+	reqPart := r.part(protocol.RequestPayload)
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqPart.data)))
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &ESRequestResponse{
+		ID:                 reqPart.uuid,
+		ReqURL:             req.URL.String(),
+		ReqMethod:          req.Method,
+		ReqUserAgent:       req.UserAgent(),
+		ReqAcceptLanguage:  req.Header.Get("Accept-Language"),
+		ReqAccept:          req.Header.Get("Accept"),
+		ReqAcceptEncoding:  req.Header.Get("Accept-Encoding"),
+		ReqIfModifiedSince: req.Header.Get("If-Modified-Since"),
+		ReqConnection:      req.Header.Get("Connection"),
+		ReqCookies:         req.Header.Get("Cookie"),
+		Timestamp:          time.Unix(0, reqPart.timestamp),
+	}
+
+	if part := r.part(protocol.ReplayedResponsePayload); part != nil {
+		if resp, err := esReadResponse(part.data, req); err == nil {
+			doc.RespStatus = resp.Status
+			doc.RespStatusCode = strconv.Itoa(resp.StatusCode)
+			doc.RespProto = resp.Proto
+			doc.RespContentLength = resp.Header.Get("Content-Length")
+			doc.RespContentType = resp.Header.Get("Content-Type")
+			doc.RespTransferEncoding = strings.Join(resp.TransferEncoding, ",")
+			doc.RespContentEncoding = resp.Header.Get("Content-Encoding")
+			doc.RespExpires = resp.Header.Get("Expires")
+			doc.RespCacheControl = resp.Header.Get("Cache-Control")
+			doc.RespVary = resp.Header.Get("Vary")
+			doc.RespSetCookie = resp.Header.Get("Set-Cookie")
+		}
+		doc.Rtt = time.Duration(part.latency).Milliseconds()
+	}
+
+	if part := r.part(protocol.ResponsePayload); part != nil {
+		if resp, err := esReadResponse(part.data, req); err == nil {
+			doc.OrigRespStatus = resp.Status
+			doc.OrigRespStatusCode = strconv.Itoa(resp.StatusCode)
+			doc.OrigRespContentLen = resp.Header.Get("Content-Length")
+		}
+		// 录制的响应从请求开始到响应开始计时
+		doc.OrigRtt = time.Duration(part.timestamp - reqPart.timestamp).Milliseconds()
+	}
+
+	return doc, nil
+}
+
+func esReadResponse(data []byte, req *http.Request) (*http.Response, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	return resp, nil
+}
@@ -0,0 +1,80 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+
+	"goreplay/config"
+	"goreplay/logger"
+	"goreplay/protobuf"
+	"goreplay/protocol"
+)
+
+// grpcPathCacheSize 等待响应的请求数, 超过后最早的请求的响应不再解码
+const grpcPathCacheSize = 10000
+
+// grpcDecoder 把 grpc 请求和响应解码为 JSON, 响应按对应请求的方法解码
+type grpcDecoder struct {
+	registry *protobuf.Registry
+	mu       sync.Mutex
+	paths    *lru.Cache // paths 请求 id 到请求的 path
+}
+
+// newGRPCDecoder 加载 protobuf 描述, 加载失败时退出
+func newGRPCDecoder(conf *config.ProtobufConfig) *grpcDecoder {
+	if conf == nil || !conf.Enabled() {
+		logger.Fatal("decoding grpc messages requires --proto-descriptor-set, --proto-file or --proto-reflection")
+		return nil
+	}
+
+	registry, err := protobuf.Load(conf)
+	if err != nil {
+		logger.Fatal("[PROTOBUF] load descriptors error: ", err)
+		return nil
+	}
+	logger.Info("[PROTOBUF] grpc methods: ", registry.Methods())
+
+	return &grpcDecoder{registry: registry, paths: lru.New(grpcPathCacheSize)}
+}
+
+// decode 返回消息解码后的 JSON
+func (d *grpcDecoder) decode(msg *Message) ([]byte, error) {
+	id := string(protocol.PayloadID(msg.Meta))
+	if protocol.IsRequestPayload(msg.Meta) {
+		req, err := d.registry.DecodeRequest(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		d.paths.Add(id, req["path"])
+		d.mu.Unlock()
+		return json.Marshal(req)
+	}
+
+	d.mu.Lock()
+	path, ok := d.paths.Get(id)
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no grpc request for response %s", id)
+	}
+	resp, err := d.registry.DecodeResponse(path.(string), msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(resp)
+}
+
+// decodeData 解码失败时使用原来的数据
+func (d *grpcDecoder) decodeData(msg *Message) []byte {
+	data, err := d.decode(msg)
+	if err != nil {
+		logger.Debug2("[PROTOBUF] decode grpc message error: ", err)
+		return msg.Data
+	}
+
+	return data
+}
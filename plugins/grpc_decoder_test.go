@@ -0,0 +1,112 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"goreplay/config"
+	"goreplay/logreplay"
+	"goreplay/protobuf"
+	"goreplay/protocol"
+)
+
+// TestUnitGRPCDecoder grpc message decode unit test execute
+func TestUnitGRPCDecoder(t *testing.T) {
+	suite.Run(t, new(grpcDecoderSuite))
+}
+
+type grpcDecoderSuite struct {
+	suite.Suite
+	registry *protobuf.Registry
+}
+
+func (s *grpcDecoderSuite) SetupTest() {
+	s.registry = protobuf.NewRegistry()
+	s.Require().NoError(s.registry.AddProtoFile("../protobuf/data/helloworld.proto",
+		[]string{"../protobuf/data"}))
+}
+
+// frames 一个 grpc 请求或响应, body 是 name 或 message 字段为 value 的消息
+func (s *grpcDecoderSuite) frames(path, value string) []byte {
+	var hbuf, buf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	fields := []hpack.HeaderField{{Name: ":status", Value: "200"}}
+	if path != "" {
+		fields = []hpack.HeaderField{{Name: ":method", Value: "POST"}, {Name: ":path", Value: path}}
+	}
+	for _, hf := range fields {
+		s.Require().NoError(enc.WriteField(hf))
+	}
+
+	msg := append([]byte{0, 0, 0, 0, byte(len(value) + 2), 0x0a, byte(len(value))}, value...)
+	fw := http2.NewFramer(&buf, nil)
+	s.Require().NoError(fw.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: hbuf.Bytes(),
+		EndHeaders: true}))
+	s.Require().NoError(fw.WriteData(1, true, msg))
+
+	return buf.Bytes()
+}
+
+func (s *grpcDecoderSuite) TestStdoutOutput() {
+	var out bytes.Buffer
+	o := &StdoutOutput{writer: &out, decoder: &grpcDecoder{registry: s.registry, paths: lru.New(10)}}
+	id := protocol.UUID()
+
+	for _, tt := range []struct {
+		name string
+		msg  *Message
+		want string
+	}{
+		{
+			name: "request",
+			msg: &Message{Meta: protocol.PayloadHeader(protocol.RequestPayload, id, 1, 0),
+				Data: s.frames("/helloworld.Greeter/SayHello", "alice")},
+			want: `{"messages":[{"name":"alice"}],"metadata":{},"path":"/helloworld.Greeter/SayHello"}`,
+		},
+		{
+			name: "replayed response",
+			msg: &Message{Meta: protocol.PayloadHeader(protocol.ReplayedResponsePayload, id, 1, 1),
+				Data: s.frames("", "hi")},
+			want: `{"messages":[{"message":"hi"}],"metadata":{}}`,
+		},
+		{
+			name: "response without request",
+			msg: &Message{Meta: protocol.PayloadHeader(protocol.ResponsePayload, protocol.UUID(), 1, 1),
+				Data: []byte("raw")},
+			want: "raw",
+		},
+	} {
+		s.Run(tt.name, func() {
+			out.Reset()
+			_, err := o.PluginWrite(tt.msg)
+			s.NoError(err)
+			s.Equal(string(tt.msg.Meta)+tt.want+protocol.PayloadSeparator, out.String())
+		})
+	}
+}
+
+func (s *grpcDecoderSuite) TestLogReplayDecodeProtobuf() {
+	o := &LogReplayOutput{protobuf: s.registry, conf: &config.LogReplayOutputConfig{
+		SerializeType: config.SerializeTypePB}}
+
+	data := &logreplay.GoReplayMessage{}
+	o.decodeProtobuf(data, s.frames("/helloworld.Greeter/SayHello", "alice"), s.frames("", "hi"))
+	s.Equal(config.SerializeTypePB, data.SerializeType)
+	request, _ := json.Marshal(data.Request)
+	s.JSONEq(`{"path":"/helloworld.Greeter/SayHello","metadata":{},"messages":[{"name":"alice"}]}`,
+		string(request))
+	response, _ := json.Marshal(data.Response)
+	s.JSONEq(`{"metadata":{},"messages":[{"message":"hi"}]}`, string(response))
+
+	// 解码失败时只有二进制
+	data = &logreplay.GoReplayMessage{}
+	o.decodeProtobuf(data, s.frames("/helloworld.Greeter/Nope", "alice"), s.frames("", "hi"))
+	s.Nil(data.Request)
+	s.Empty(data.SerializeType)
+}
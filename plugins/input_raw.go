@@ -4,25 +4,37 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/gopacket"
+
 	"goreplay/byteutils"
 	"goreplay/capture"
 	"goreplay/config"
 	"goreplay/errors"
 	"goreplay/logger"
+	"goreplay/metrics"
 	"goreplay/proto"
 	"goreplay/protocol"
 	"goreplay/tcp"
+	"goreplay/tcp/decrypt"
 )
 
-const hostSplit = ","
+const (
+	hostSplit = ","
+	// rawSampleRateMax 采样率的分母, 与 input-raw-logreplay-sample-rate 一致
+	rawSampleRateMax = 16
+	// rawShedLevelMax 每降一级采样率减半, 最后一级暂停录制
+	rawShedLevelMax = 5
+)
 
 // RAWInput used for intercepting traffic for given address
 type RAWInput struct {
@@ -33,6 +45,12 @@ type RAWInput struct {
 	message        chan *tcp.Message
 	cancelListener context.CancelFunc
 	selectHostMap  map[string]bool // 指定录制的host的map
+	shedLevel      int32           // 降低负载的级别, 按连接采样, 保留 (16>>shedLevel)/16 的连接
+	address        string
+	packets        *metrics.Counter
+	requests       *metrics.Counter
+	responses      *metrics.Counter
+	shed           *metrics.Counter
 }
 
 // NewRAWInput constructor for RAWInput. Accepts raw input config as arguments.
@@ -41,6 +59,11 @@ func NewRAWInput(address string, config config.RAWInputConfig) (i *RAWInput) {
 	i.RAWInputConfig = config
 	i.message = make(chan *tcp.Message, 1000)
 	i.Quit = make(chan bool)
+	i.address = address
+	i.packets = rawPacketsMetric.With(address)
+	i.requests = rawMessagesMetric.With(address, "request")
+	i.responses = rawMessagesMetric.With(address, "response")
+	i.shed = rawShedMetric.With(address)
 	var host, _port string
 	var err error
 	var port int
@@ -68,13 +91,7 @@ func NewRAWInput(address string, config config.RAWInputConfig) (i *RAWInput) {
 
 		logger.Info(fmt.Sprintf("listening %s:%d", i.Host, i.Port))
 
-		// 请求报文  来源端口跟15取模后 符合采样条件
-		sampleSrcPort := fmt.Sprintf(" and (( tcp[0:2] & 0x0f) < %d)", config.LogreplaySampleRate)
-		// 响应报文  目标端口跟15取模后, 符合采样条件
-		sampleDstPort := fmt.Sprintf(" and (( tcp[2:2] & 0x0f) < %d)", config.LogreplaySampleRate)
-
-		i.BPFFilter = fmt.Sprintf("(tcp dst port %d and dst host %s %s) or (tcp src port %d and src host %s %s)",
-			port, i.Host, sampleSrcPort, port, i.Host, sampleDstPort)
+		i.BPFFilter = i.logreplayFilter(config.LogreplaySampleRate)
 
 		// 设置默认的BufferTimeout, 避免cpu空转
 		if i.BufferTimeout == 0 {
@@ -87,6 +104,46 @@ func NewRAWInput(address string, config config.RAWInputConfig) (i *RAWInput) {
 	return
 }
 
+// logreplayFilter 按采样率只抓取部分连接的 BPF filter
+func (i *RAWInput) logreplayFilter(rate int) string {
+	// 请求报文  来源端口跟15取模后 符合采样条件
+	sampleSrcPort := fmt.Sprintf(" and (( tcp[0:2] & 0x0f) < %d)", rate)
+	// 响应报文  目标端口跟15取模后, 符合采样条件
+	sampleDstPort := fmt.Sprintf(" and (( tcp[2:2] & 0x0f) < %d)", rate)
+
+	return fmt.Sprintf("(tcp dst port %d and dst host %s %s) or (tcp src port %d and src host %s %s)",
+		i.Port, i.Host, sampleSrcPort, i.Port, i.Host, sampleDstPort)
+}
+
+// SampleRate 返回 logreplay 录制的采样率, 没有开启 logreplay 录制时返回 false
+func (i *RAWInput) SampleRate() (int, bool) {
+	i.Lock()
+	defer i.Unlock()
+
+	return i.LogreplaySampleRate, i.Logreplay
+}
+
+// SetSampleRate 修改 logreplay 录制的采样率, 替换抓包的 BPF filter, 不会中断录制
+func (i *RAWInput) SetSampleRate(rate int) error {
+	if !i.Logreplay {
+		return fmt.Errorf("input-raw %s:%d is not recording for logreplay", i.Host, i.Port)
+	}
+	if rate < 0 || rate > rawSampleRateMax {
+		return fmt.Errorf("sample rate %d out of range [0, %d]", rate, rawSampleRateMax)
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	if err := i.listener.SetBPFFilter(i.logreplayFilter(rate)); err != nil {
+		return err
+	}
+	i.LogreplaySampleRate = rate
+	logger.Info(fmt.Sprintf("[INPUT-RAW] %s:%d logreplay sample rate %d/%d", i.Host, i.Port, rate, rawSampleRateMax))
+
+	return nil
+}
+
 // checkSelectHost 检测输入的host是否合法，并且保存到selectHostMap中
 func (i *RAWInput) checkSelectHost(hostStr string) {
 	logger.Info(fmt.Sprintf("filter record msg, target host value:%s", hostStr))
@@ -200,6 +257,9 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 			msgTCP = nil
 		}()
 	}
+	if msgTCP.Closed() {
+		return &Message{ConnectionID: msgTCP.ConnectionID(), ConnectionClosed: true}, nil
+	}
 	if msgTCP.LostData > 0 {
 		logger.Debug("tcp包有被截断, 考虑使用--input-raw-override-snaplen :   ", msgTCP.Length, msgTCP.LostData)
 	}
@@ -210,6 +270,8 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 		if i.RealIPHeader != "" {
 			msg.Data = proto.SetHeader(msg.Data, []byte(i.RealIPHeader), []byte(msgTCP.SrcAddr))
 		}
+		// 请求包记录来源地址, 用于 --pipeline 按 ip 路由
+		msg.SrcAddr, _, _ = net.SplitHostPort(msgTCP.SrcAddr)
 	}
 
 	// 在请求的时候，根据host进行流量的筛选
@@ -238,6 +300,9 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 	msg.Meta = protocol.PayloadHeader(msgType, msgTCP.UUID(), msgTCP.Start.UnixNano(),
 		msgTCP.End.UnixNano()-msgTCP.Start.UnixNano())
 	msg.ConnectionID = msgTCP.ConnectionID()
+	if i.KeepPackets {
+		msg.Packets = rawPackets(msgTCP)
+	}
 
 	logger.Debug3(fmt.Sprintf("[INPUT-RAW] msg meta: %s", byteutils.SliceToString(msg.Meta)))
 
@@ -257,6 +322,19 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 	return &msg, nil
 }
 
+// rawPackets 消息的原始数据包, 按协议拆分出的多个包来自同一个原始包时只保留一个
+func rawPackets(msgTCP *tcp.Message) []gopacket.Packet {
+	packets := make([]gopacket.Packet, 0, len(msgTCP.Packets()))
+	for _, pckt := range msgTCP.Packets() {
+		if pckt.Raw == nil || (len(packets) > 0 && packets[len(packets)-1] == pckt.Raw) {
+			continue
+		}
+		packets = append(packets, pckt.Raw)
+	}
+
+	return packets
+}
+
 func (i *RAWInput) listen(address string) {
 	var err error
 	i.listener, err = capture.NewListener(i.Host, i.Port, "", i.Engine, i.TrackResponse)
@@ -270,15 +348,35 @@ func (i *RAWInput) listen(address string) {
 	}
 	pool := tcp.NewMessagePool(i.CopyBufferSize, i.Expire, i.handler)
 	pool.MatchUUID(i.TrackResponse)
+	pool.KeepRaw(i.KeepPackets)
 
 	// listen address: ip+port
 	pool.Address(address)
 	// set business protocol
 	pool.Protocol(i.Protocol)
+	// 连接关闭和消息走同一个 channel, 输出按顺序收到
+	pool.OnClose(i.handler)
+	if i.TLSKeylog != "" {
+		keys, err := decrypt.OpenKeyLog(i.TLSKeylog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool.Decrypter(decrypt.New(keys, address))
+	}
+
+	poolSizeMetric.Func(func() float64 {
+		return float64(pool.Size())
+	}, address)
+	poolTimeoutsMetric.Func(func() float64 {
+		return float64(pool.Timeouts())
+	}, address)
 
 	var ctx context.Context
 	ctx, i.cancelListener = context.WithCancel(context.Background())
-	errCh := i.listener.ListenBackground(ctx, pool.Handler)
+	errCh := i.listener.ListenBackground(ctx, func(packet gopacket.Packet) {
+		i.packets.Inc()
+		pool.Handler(packet)
+	})
 	select {
 	case err := <-errCh:
 		log.Fatal(err)
@@ -288,9 +386,68 @@ func (i *RAWInput) listen(address string) {
 }
 
 func (i *RAWInput) handler(m *tcp.Message) {
+	switch {
+	case m.Closed():
+	case m.IsIncoming:
+		i.requests.Inc()
+	default:
+		i.responses.Inc()
+	}
+
+	if level := atomic.LoadInt32(&i.shedLevel); level > 0 && !sampled(m, rawSampleRateMax>>level) {
+		i.shed.Inc()
+		return
+	}
+
 	i.message <- m
 }
 
+// sampled 按客户端地址采样, 同一连接的请求和响应同时保留或丢弃
+func sampled(m *tcp.Message, rate int32) bool {
+	client := m.SrcAddr
+	if !m.IsIncoming {
+		client = m.DstAddr
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(client))
+
+	return int32(h.Sum32()%rawSampleRateMax) < rate
+}
+
+// Shed 采样率减半, 降到 0 时暂停录制
+func (i *RAWInput) Shed() (string, bool) {
+	level := atomic.LoadInt32(&i.shedLevel)
+	if level >= rawShedLevelMax {
+		return "", false
+	}
+
+	atomic.StoreInt32(&i.shedLevel, level+1)
+
+	return i.sampleAction(level + 1), true
+}
+
+// Restore 采样率加倍
+func (i *RAWInput) Restore() (string, bool) {
+	level := atomic.LoadInt32(&i.shedLevel)
+	if level == 0 {
+		return "", false
+	}
+
+	atomic.StoreInt32(&i.shedLevel, level-1)
+
+	return i.sampleAction(level - 1), true
+}
+
+func (i *RAWInput) sampleAction(level int32) string {
+	rate := rawSampleRateMax >> level
+	if rate == 0 {
+		return fmt.Sprintf("pause input-raw %s:%d", i.Host, i.Port)
+	}
+
+	return fmt.Sprintf("input-raw %s:%d sample rate %d/%d", i.Host, i.Port, rate, rawSampleRateMax)
+}
+
 // String input address
 func (i *RAWInput) String() string {
 	return fmt.Sprintf("Intercepting traffic from: %s:%d", i.Host, i.Port)
@@ -308,6 +465,8 @@ func (i *RAWInput) GetStats() []tcp.Stats {
 
 // Close closes the input raw listener
 func (i *RAWInput) Close() error {
+	poolSizeMetric.Delete(i.address)
+	poolTimeoutsMetric.Delete(i.address)
 	i.cancelListener()
 	close(i.Quit)
 	return nil
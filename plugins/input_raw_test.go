@@ -156,3 +156,49 @@ func (s *inputRawSuite) TestPluginRead() {
 		})
 	}
 }
+
+func (s *inputRawSuite) TestShed() {
+	i := &RAWInput{message: make(chan *tcp.Message, 64)}
+
+	count := func() int {
+		for n := 0; n < 32; n++ {
+			m := &tcp.Message{}
+			m.IsIncoming = true
+			m.SrcAddr = fmt.Sprintf("10.0.0.%d:5000", n)
+			i.handler(m)
+
+			resp := &tcp.Message{}
+			resp.DstAddr = m.SrcAddr
+			i.handler(resp)
+		}
+
+		n := len(i.message)
+		for len(i.message) > 0 {
+			<-i.message
+		}
+		return n
+	}
+
+	s.Equal(64, count())
+
+	for _, want := range []int32{1, 2, 3, 4, 5} {
+		_, ok := i.Shed()
+		s.True(ok)
+		s.Equal(want, i.shedLevel)
+		// 同一连接的请求和响应同时保留或丢弃
+		s.Equal(0, count()%2)
+	}
+	s.Equal(0, count())
+
+	_, ok := i.Shed()
+	s.False(ok)
+
+	for _, want := range []int32{4, 3, 2, 1, 0} {
+		_, ok = i.Restore()
+		s.True(ok)
+		s.Equal(want, i.shedLevel)
+	}
+	_, ok = i.Restore()
+	s.False(ok)
+	s.Equal(64, count())
+}
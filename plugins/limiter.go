@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"goreplay/logger"
@@ -13,14 +14,18 @@ import (
 
 // Limiter is a wrapper for input or output plugin which adds rate limiting
 type Limiter struct {
-	plugin    interface{}
-	limit     int
-	isPercent bool
+	plugin  interface{}
+	options atomic.Value // *limitOptions, 可以在运行时替换
 
 	currentRPS  int
 	currentTime int64
 }
 
+type limitOptions struct {
+	limit     int
+	isPercent bool
+}
+
 func parseLimitOptions(options string) (limit int, isPercent bool) {
 	if n := strings.Index(options, "%"); n > 0 {
 		limit, _ = strconv.Atoi(options[:n])
@@ -37,27 +42,66 @@ func parseLimitOptions(options string) (limit int, isPercent bool) {
 // `options` allow to sprcify relatve or absolute limiting
 func NewLimiter(plugin interface{}, options string) PluginReadWriter {
 	l := new(Limiter)
-	l.limit, l.isPercent = parseLimitOptions(options)
+	limit, isPercent := parseLimitOptions(options)
+	l.options.Store(&limitOptions{limit: limit, isPercent: isPercent})
 	l.plugin = plugin
 	l.currentTime = time.Now().UnixNano()
 
 	// FileInput have its own rate limiting.
 	// Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
-	if fi, ok := l.plugin.(*FileInput); ok && l.isPercent {
-		fi.speedFactor = float64(l.limit) / float64(100)
+	if fi, ok := l.plugin.(*FileInput); ok && isPercent {
+		fi.speedFactor = float64(limit) / float64(100)
 	}
 
 	return l
 }
 
+// SetLimit 在运行时替换限流配置, 格式与插件的 "|" 选项相同, 比如 10 或 50%
+func (l *Limiter) SetLimit(options string) error {
+	limit, isPercent := parseLimitOptions(options)
+	if limit <= 0 || (isPercent && limit > 100) {
+		return fmt.Errorf("invalid limit %q", options)
+	}
+
+	// FileInput 的百分比限流是读取速度, 只在启动时设置
+	if _, ok := l.plugin.(*FileInput); ok && (isPercent || l.limitOptions().isPercent) {
+		return fmt.Errorf("percentage limit of file input can't be changed at runtime")
+	}
+
+	l.options.Store(&limitOptions{limit: limit, isPercent: isPercent})
+
+	return nil
+}
+
+// Limit 当前的限流配置
+func (l *Limiter) Limit() string {
+	opts := l.limitOptions()
+	if opts.isPercent {
+		return fmt.Sprintf("%d%%", opts.limit)
+	}
+
+	return strconv.Itoa(opts.limit)
+}
+
+// Plugin 被限流的插件
+func (l *Limiter) Plugin() interface{} {
+	return l.plugin
+}
+
+func (l *Limiter) limitOptions() *limitOptions {
+	return l.options.Load().(*limitOptions)
+}
+
 func (l *Limiter) isLimited() bool {
+	opts := l.limitOptions()
+
 	// File input have its own limiting algorithm
-	if _, ok := l.plugin.(*FileInput); ok && l.isPercent {
+	if _, ok := l.plugin.(*FileInput); ok && opts.isPercent {
 		return false
 	}
 
-	if l.isPercent {
-		return l.limit <= rand.Intn(100)
+	if opts.isPercent {
+		return opts.limit <= rand.Intn(100)
 	}
 
 	if (time.Now().UnixNano() - l.currentTime) > time.Second.Nanoseconds() {
@@ -65,7 +109,7 @@ func (l *Limiter) isLimited() bool {
 		l.currentRPS = 0
 	}
 
-	if l.currentRPS >= l.limit {
+	if l.currentRPS >= opts.limit {
 		return true
 	}
 
@@ -90,6 +134,13 @@ func (l *Limiter) PluginWrite(msg *Message) (n int, err error) {
 	return 0, nil
 }
 
+// CloseConnection 连接关闭不限流
+func (l *Limiter) CloseConnection(connectionID string) {
+	if c, ok := l.plugin.(ConnectionCloser); ok {
+		c.CloseConnection(connectionID)
+	}
+}
+
 // PluginRead reads message from this plugin
 func (l *Limiter) PluginRead() (msg *Message, err error) {
 	if r, ok := l.plugin.(PluginReader); ok {
@@ -100,13 +151,13 @@ func (l *Limiter) PluginRead() (msg *Message, err error) {
 	}
 
 	if l.isLimited() {
-		logger.Info(fmt.Sprintf("[debug] isLimited true: %T, %d , %d", l.plugin, l.limit, l.currentRPS))
+		logger.Info(fmt.Sprintf("[debug] isLimited true: %T, %s , %d", l.plugin, l.Limit(), l.currentRPS))
 
 		return nil, nil
 	}
 
 	if msg != nil {
-		logger.Info(fmt.Sprintf("[debug] isLimited: %T, %d , %d,  %s,  %v", l.plugin, l.limit, l.currentRPS, msg.Data, err))
+		logger.Info(fmt.Sprintf("[debug] isLimited: %T, %s , %d,  %s,  %v", l.plugin, l.Limit(), l.currentRPS, msg.Data, err))
 
 	}
 
@@ -115,7 +166,8 @@ func (l *Limiter) PluginRead() (msg *Message, err error) {
 
 // String limit string
 func (l *Limiter) String() string {
-	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, l.limit, l.isPercent)
+	opts := l.limitOptions()
+	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, opts.limit, opts.isPercent)
 }
 
 // Close closes the resources.
@@ -0,0 +1,80 @@
+package plugins
+
+import (
+	"time"
+
+	"goreplay/metrics"
+)
+
+// 插件的 prometheus 指标, --http-metrics 开启时导出
+var (
+	rawPacketsMetric = metrics.NewCounterVec("gor_input_raw_packets_total",
+		"Packets captured by input-raw.", "input")
+	rawMessagesMetric = metrics.NewCounterVec("gor_input_raw_messages_total",
+		"Messages reassembled by input-raw, by type request or response.", "input", "type")
+	rawShedMetric = metrics.NewCounterVec("gor_input_raw_messages_shed_total",
+		"Messages dropped by input-raw because the watchdog lowered the sample rate.", "input")
+	poolSizeMetric = metrics.NewGaugeVec("gor_message_pool_messages",
+		"Messages being reassembled in the message pool.", "input")
+	poolTimeoutsMetric = metrics.NewCounterVec("gor_message_pool_timeouts_total",
+		"Messages dispatched by the message pool after input-raw-expire.", "input")
+
+	outputQueueMetric = metrics.NewGaugeVec("gor_output_queue_length",
+		"Messages waiting in the output queue.", "output", "address")
+	outputWorkersMetric = metrics.NewGaugeVec("gor_output_workers",
+		"Workers of the output.", "output", "address")
+	replayLatencyMetric = metrics.NewHistogramVec("gor_output_replay_latency_seconds",
+		"Latency of replayed requests.", metrics.DefBuckets, "output", "address")
+	replayErrorsMetric = metrics.NewCounterVec("gor_output_replay_errors_total",
+		"Replayed requests which failed.", "output", "address")
+
+	logreplayReplayMetric = metrics.NewCounterVec("gor_logreplay_replay_total",
+		"Requests replayed to output-logreplay-target, by result.", "module", "result")
+	logreplayReportMetric = metrics.NewCounterVec("gor_logreplay_report_records_total",
+		"Records reported to logreplay, by result success or failure.", "module", "result")
+	logreplaySpoolRecordsMetric = metrics.NewGaugeVec("gor_logreplay_spool_records",
+		"Records waiting in output-logreplay-spool.", "module")
+	logreplaySpoolBytesMetric = metrics.NewGaugeVec("gor_logreplay_spool_bytes",
+		"Bytes of the records waiting in output-logreplay-spool.", "module")
+)
+
+// outputMetrics 一个 output 的指标
+type outputMetrics struct {
+	labels  []string
+	latency *metrics.Histogram
+	errors  *metrics.Counter
+}
+
+// newOutputMetrics 注册 output 的队列长度和 worker 数, 二者在抓取时计算
+func newOutputMetrics(output, address string, queue, workers func() float64) *outputMetrics {
+	m := &outputMetrics{
+		labels:  []string{output, address},
+		latency: replayLatencyMetric.With(output, address),
+		errors:  replayErrorsMetric.With(output, address),
+	}
+	outputQueueMetric.Func(queue, m.labels...)
+	outputWorkersMetric.Func(workers, m.labels...)
+
+	return m
+}
+
+// observe 记录一次回放, 失败的回放只计入错误数
+func (m *outputMetrics) observe(latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.errors.Inc()
+		return
+	}
+	m.latency.Observe(latency.Seconds())
+}
+
+// close 删除抓取时计算的指标, 避免引用已经关闭的 output
+func (m *outputMetrics) close() {
+	if m == nil {
+		return
+	}
+	outputQueueMetric.Delete(m.labels...)
+	outputWorkersMetric.Delete(m.labels...)
+}
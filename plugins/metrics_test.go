@@ -0,0 +1,58 @@
+package plugins
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/metrics"
+)
+
+// TestUnitOutputMetrics output metrics test execute
+func TestUnitOutputMetrics(t *testing.T) {
+	suite.Run(t, new(outputMetricsSuite))
+}
+
+type outputMetricsSuite struct {
+	suite.Suite
+}
+
+func (s *outputMetricsSuite) text() string {
+	var buf bytes.Buffer
+	_, err := metrics.Default.WriteTo(&buf)
+	s.Require().NoError(err)
+
+	return buf.String()
+}
+
+func (s *outputMetricsSuite) TestOutputMetrics() {
+	queue := make(chan *Message, 10)
+	queue <- &Message{}
+	m := newOutputMetrics("binary", "metrics-test:80", func() float64 {
+		return float64(len(queue))
+	}, func() float64 {
+		return 3
+	})
+
+	m.observe(20*time.Millisecond, nil)
+	m.observe(time.Second, errors.New("dial error"))
+
+	text := s.text()
+	s.Contains(text, `gor_output_queue_length{output="binary",address="metrics-test:80"} 1`)
+	s.Contains(text, `gor_output_workers{output="binary",address="metrics-test:80"} 3`)
+	s.Contains(text, `gor_output_replay_latency_seconds_bucket{output="binary",address="metrics-test:80",le="0.025"} 1`)
+	s.Contains(text, `gor_output_replay_latency_seconds_count{output="binary",address="metrics-test:80"} 1`)
+	s.Contains(text, `gor_output_replay_errors_total{output="binary",address="metrics-test:80"} 1`)
+
+	m.close()
+	s.NotContains(s.text(), `gor_output_queue_length{output="binary",address="metrics-test:80"}`)
+
+	var closed *outputMetrics
+	s.NotPanics(func() {
+		closed.observe(time.Second, nil)
+		closed.close()
+	})
+}
@@ -4,16 +4,18 @@ package middleware
 import (
 	"bufio"
 	"context"
-	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"goreplay/errors"
 	"goreplay/http"
+	"goreplay/metrics"
 	"goreplay/protocol"
 
 	"goreplay/config"
@@ -22,61 +24,257 @@ import (
 	"goreplay/plugins"
 )
 
+const (
+	minBackoff        = 100 * time.Millisecond // minBackoff 进程退出后第一次重启的等待
+	defaultMaxBackoff = 30 * time.Second
+	defaultWindow     = 1000
+	defaultTimeout    = 30 * time.Second
+)
+
+// 消息丢弃的原因
+const (
+	dropFiltered    = "filtered"    // dropFiltered middleware 用 drop 帧丢弃
+	dropMalformed   = "malformed"   // dropMalformed middleware 发出的帧无法解码
+	dropCrash       = "crash"       // dropCrash 进程退出时还没有应答
+	dropTimeout     = "timeout"     // dropTimeout 在 Timeout 内没有应答, 包括应答的帧无法解码
+	dropUnavailable = "unavailable" // dropUnavailable 进程重启期间读到的消息
+)
+
+var (
+	droppedMetric = metrics.NewCounterVec("gor_middleware_dropped_total",
+		"Messages lost on the way through the middleware", "reason")
+	restartsMetric = metrics.NewCounterVec("gor_middleware_restarts_total", "Restarts of the middleware command")
+)
+
 // Middleware represents a middleware object
 type Middleware struct {
 	command       string
+	conf          config.MiddlewareConfig
+	codec         codec
 	data          chan *plugins.Message
-	Stdin         io.Writer
-	Stdout        io.Reader
+	window        chan struct{} // binary 和 json 协议中每个还没有应答的消息占一个位置, hex 协议时为 nil
+	ctx           context.Context
 	commandCancel context.CancelFunc
 	stop          chan bool // Channel used only to indicate goroutine should shutdown
+
+	mu       sync.Mutex
+	child    *child // 正在运行的进程, 重启期间为 nil
+	nextID   uint64
+	inflight map[uint64]time.Time // 发给 child 还没有应答的消息和发送时间
+}
+
+// child 一次启动的 middleware 进程
+type child struct {
+	ping   uint64     // 等待应答的 ping 的 ID, 0 表示没有. 放在开头保证 atomic 操作对齐
+	reads  uint64     // 从 stdout 读到的帧数, heartbeat 用来判断进程是否还在应答
+	busy   int32      // 1 表示读到的消息在等待发往输出, 这时不读 stdout, ping 的应答会推迟
+	mu     sync.Mutex // 保证帧不会交叉写入
+	cmd    *exec.Cmd
+	stdin  io.Writer
+	stdout io.Reader
 }
 
 // NewMiddleware returns new middleware
 func NewMiddleware(command string) *Middleware {
+	return newMiddleware(command, config.Settings.MiddlewareConfig)
+}
+
+func newMiddleware(command string, conf config.MiddlewareConfig) *Middleware {
+	if conf.Window < 1 {
+		conf.Window = defaultWindow
+	}
+	if conf.MaxBackoff < minBackoff {
+		conf.MaxBackoff = defaultMaxBackoff
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultTimeout
+	}
+
 	m := new(Middleware)
 	m.command = command
+	m.conf = conf
+	m.codec = newCodec(conf.Protocol)
 	m.data = make(chan *plugins.Message, 1000)
 	m.stop = make(chan bool)
+	m.inflight = make(map[uint64]time.Time)
+	if _, ok := m.codec.(hexCodec); !ok {
+		m.window = make(chan struct{}, conf.Window)
+		go m.expire()
+	}
+	m.ctx, m.commandCancel = context.WithCancel(context.Background())
+
+	// 第一次同步启动, 之后读到的消息不会因为进程还没有启动而丢弃
+	c, err := m.start()
+	go m.run(c, err)
+
+	return m
+}
+
+// run 等待进程退出后按 backoff 重启, 直到 Close
+func (m *Middleware) run(c *child, err error) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		if err == nil {
+			err = m.wait(c)
+		}
+
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+
+		restartsMetric.With().Inc()
+		if time.Since(started) > m.conf.MaxBackoff {
+			backoff = minBackoff
+		}
+		logger.Warn(fmt.Sprintf("[MIDDLEWARE] %q exited: %v, restarting in %s", m.command, err, backoff))
 
-	commands := strings.Split(command, " ")
-	ctx, cancl := context.WithCancel(context.Background())
-	m.commandCancel = cancl
-	cmd := exec.CommandContext(ctx, commands[0], commands[1:]...)
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > m.conf.MaxBackoff {
+			backoff = m.conf.MaxBackoff
+		}
 
-	m.Stdout, _ = cmd.StdoutPipe()
-	m.Stdin, _ = cmd.StdinPipe()
+		c, err = m.start()
+	}
+}
 
+// start 启动进程, 之后的消息发给它
+func (m *Middleware) start() (*child, error) {
+	commands := strings.Split(m.command, " ")
+	cmd := exec.CommandContext(m.ctx, commands[0], commands[1:]...)
 	cmd.Stderr = os.Stderr
 
-	go m.read(m.Stdout)
+	c := &child{cmd: cmd}
+	var err error
+	if c.stdin, err = cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if c.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
 
-	go func() {
-		err := cmd.Start()
+	m.mu.Lock()
+	m.child = c
+	m.mu.Unlock()
 
-		if err != nil {
-			log.Fatal(err)
+	return c, nil
+}
+
+// wait 读取进程的输出直到 stdout 关闭, 之后结束进程, 没有应答的消息计为丢弃
+func (m *Middleware) wait(c *child) error {
+	done := make(chan struct{})
+	if m.window != nil && m.conf.Heartbeat > 0 {
+		go m.heartbeat(c, done)
+	}
+
+	m.read(c)
+	close(done)
+	_ = c.cmd.Process.Kill()
+
+	m.mu.Lock()
+	m.child = nil
+	lost := len(m.inflight)
+	m.inflight = make(map[uint64]time.Time)
+	m.mu.Unlock()
+
+	for i := 0; i < lost; i++ {
+		<-m.window
+	}
+	droppedMetric.With(dropCrash).Add(float64(lost))
+
+	return c.cmd.Wait()
+}
+
+// expire 超过 Timeout 没有应答的消息计为丢弃, 让出 window 中的位置.
+// 应答的帧无法解码时不知道是哪个消息的应答, 只能这样找回位置
+func (m *Middleware) expire() {
+	ticker := time.NewTicker(m.conf.Timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			expired := 0
+			for id, sent := range m.inflight {
+				if now.Sub(sent) >= m.conf.Timeout {
+					delete(m.inflight, id)
+					expired++
+				}
+			}
+			m.mu.Unlock()
+
+			for i := 0; i < expired; i++ {
+				<-m.window
+			}
+			droppedMetric.With(dropTimeout).Add(float64(expired))
 		}
+	}
+}
 
-		err = cmd.Wait()
+// heartbeat 定时发送 ping, 上一个 ping 没有应答, 而且一个间隔内没有读到任何帧时结束进程.
+// ping 排在还没有应答的消息之后, 进程慢但是还在应答时要等它
+func (m *Middleware) heartbeat(c *child, done chan struct{}) {
+	ticker := time.NewTicker(m.conf.Heartbeat)
+	defer ticker.Stop()
 
-		if err != nil {
-			log.Fatal(err)
+	wasBusy := false
+	var reads uint64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
 		}
-	}()
 
-	return m
+		// 输出慢时不读 stdout, 等 Gor 继续读取一个间隔之后再检查
+		busy := atomic.LoadInt32(&c.busy) == 1
+		progress := atomic.LoadUint64(&c.reads) != reads
+		reads = atomic.LoadUint64(&c.reads)
+		if busy || wasBusy {
+			wasBusy = busy
+			continue
+		}
+		if atomic.LoadUint64(&c.ping) != 0 && progress {
+			continue
+		}
+		if atomic.LoadUint64(&c.ping) != 0 {
+			logger.Warn(fmt.Sprintf("[MIDDLEWARE] %q didn't answer ping in %s", m.command, m.conf.Heartbeat))
+			_ = c.cmd.Process.Kill()
+			return
+		}
+
+		m.mu.Lock()
+		m.nextID++
+		id := m.nextID
+		m.mu.Unlock()
+		atomic.StoreUint64(&c.ping, id)
+
+		// 进程不读 stdin 时写入会阻塞, 不能挡住下一次检查
+		go func() {
+			_ = m.write(c, &frame{Type: framePing, ID: id})
+		}()
+	}
 }
 
 // ReadFrom start a worker to read from this plugin
 func (m *Middleware) ReadFrom(plugin plugins.PluginReader) {
 	logger.Debug2("[MIDDLEWARE-MASTER] Starting reading from", plugin)
-	go m.copy(m.Stdin, plugin)
+	go m.copy(plugin)
 }
 
-func (m *Middleware) copy(to io.Writer, from plugins.PluginReader) {
-	var buf, dst []byte
-
+func (m *Middleware) copy(from plugins.PluginReader) {
 	for {
 		msg, err := from.PluginRead()
 		if err != nil {
@@ -86,43 +284,132 @@ func (m *Middleware) copy(to io.Writer, from plugins.PluginReader) {
 			continue
 		}
 
+		buf := msg.Data
 		if config.Settings.PrettifyHTTP {
 			buf = http.PrettifyHTTP(msg.Data)
 		}
-		dst = make([]byte, len(buf)*2+1)
-		hex.Encode(dst, buf)
-		dst[len(buf)*2] = '\n'
+		m.send(append(append([]byte(nil), msg.Meta...), buf...))
+	}
+}
 
-		_, _ = to.Write(dst)
+// send 把消息发给正在运行的进程, window 满时等待应答
+func (m *Middleware) send(data []byte) {
+	if m.window != nil {
+		select {
+		case <-m.stop:
+			return
+		case m.window <- struct{}{}:
+		}
+	}
 
+	m.mu.Lock()
+	c := m.child
+	var id uint64
+	if c != nil && m.window != nil {
+		m.nextID++
+		id = m.nextID
+		m.inflight[id] = time.Now()
+	}
+	m.mu.Unlock()
+
+	if c == nil {
+		if m.window != nil {
+			<-m.window
+		}
+		droppedMetric.With(dropUnavailable).Inc()
+		return
+	}
+
+	// 有 ID 的消息写入失败时进程已经退出, 在 wait 中计数
+	if err := m.write(c, &frame{Type: frameMessage, ID: id, Data: data}); err != nil && m.window == nil {
+		droppedMetric.With(dropCrash).Inc()
 	}
 }
 
-func (m *Middleware) read(from io.Reader) {
-	reader := bufio.NewReader(from)
-	var line []byte
-	var e error
+func (m *Middleware) write(c *child, f *frame) error {
+	b, err := m.codec.encode(f)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.stdin.Write(b)
 
+	return err
+}
+
+// answered 消息有了应答, 让出 window 中的位置. 返回 false 表示 ID 不在等待应答,
+// 已经超时计为丢弃, 或者不是 Gor 发出的
+func (m *Middleware) answered(id uint64) bool {
+	if m.window == nil {
+		return true
+	}
+
+	m.mu.Lock()
+	_, ok := m.inflight[id]
+	delete(m.inflight, id)
+	m.mu.Unlock()
+
+	if ok {
+		<-m.window
+	}
+
+	return ok
+}
+
+// read 读取进程发出的帧直到 stdout 关闭
+func (m *Middleware) read(c *child) {
+	reader := bufio.NewReader(c.stdout)
 	for {
-		if line, e = reader.ReadBytes('\n'); e != nil {
-			if e == io.EOF {
-				continue
-			} else {
-				break
-			}
+		f, err := m.codec.decode(reader)
+		if err == nil || err == errMalformed {
+			atomic.AddUint64(&c.reads, 1)
 		}
-
-		buf := make([]byte, len(line)/2-1)
-		if _, err := hex.Decode(buf, line[:len(line)-1]); err != nil {
-			logger.Debug(fmt.Sprintf("[MIDDLEWARE] failed to decode err: %q", err))
+		if err == errMalformed {
+			// 有 ID 的消息在超时时计数
+			if m.window == nil {
+				droppedMetric.With(dropMalformed).Inc()
+			}
 			continue
 		}
-		var msg plugins.Message
-		msg.Meta, msg.Data = protocol.PayloadMetaWithBody(buf)
-		select {
-		case <-m.stop:
+		if err != nil {
+			if err != io.EOF {
+				logger.Warn(fmt.Sprintf("[MIDDLEWARE] failed to read from %q: %v", m.command, err))
+			}
 			return
-		case m.data <- &msg:
+		}
+
+		switch f.Type {
+		case framePong:
+			atomic.CompareAndSwapUint64(&c.ping, f.ID, 0)
+		case frameDrop:
+			if m.answered(f.ID) {
+				droppedMetric.With(dropFiltered).Inc()
+			}
+		case frameMessage:
+			if !m.answered(f.ID) {
+				logger.Debug(fmt.Sprintf("[MIDDLEWARE] %q answered unknown or expired message %d", m.command, f.ID))
+				continue
+			}
+			if len(f.Data) == 0 {
+				droppedMetric.With(dropMalformed).Inc()
+				continue
+			}
+
+			var msg plugins.Message
+			msg.Meta, msg.Data = protocol.PayloadMetaWithBody(f.Data)
+			atomic.StoreInt32(&c.busy, 1)
+			select {
+			case <-m.stop:
+				return
+			case m.data <- &msg:
+			}
+			atomic.StoreInt32(&c.busy, 0)
+		default:
+			if m.answered(f.ID) {
+				droppedMetric.With(dropMalformed).Inc()
+			}
 		}
 	}
 }
@@ -145,7 +432,7 @@ func (m *Middleware) String() string {
 
 // Close closes this plugin
 func (m *Middleware) Close() error {
-	m.commandCancel()
 	close(m.stop)
+	m.commandCancel()
 	return nil
 }
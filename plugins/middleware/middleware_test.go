@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+	"goreplay/errors"
+	"goreplay/plugins"
+	"goreplay/protocol"
+)
+
+// TestUnitMiddleware middleware unit test execute
+func TestUnitMiddleware(t *testing.T) {
+	suite.Run(t, new(middlewareSuite))
+}
+
+type middlewareSuite struct {
+	suite.Suite
+	helper string
+}
+
+// SetupSuite 测试二进制的 init 会向 stdout 输出, 用脚本把 stdout 丢弃, helper 的输出写到 fd 3
+func (s *middlewareSuite) SetupSuite() {
+	s.helper = filepath.Join(s.T().TempDir(), "helper.sh")
+	script := "#!/bin/sh\nexec '" + os.Args[0] + "' -test.run='^TestMiddlewareHelper$' -- \"$1\" 3>&1 1>/dev/null\n"
+	s.Require().NoError(ioutil.WriteFile(s.helper, []byte(script), 0755))
+}
+
+// TestMiddlewareHelper 测试中启动的 middleware 进程, 参数 -- 之后是协议和行为:
+// hex 先输出一行无法解码的内容, 然后原样返回; json 和 binary 丢弃 body 中有 drop 的消息, 遇到 crash 时退出;
+// deaf- 开头时不应答 ping, slow- 开头时每个消息等 50ms 再应答, garbage- 开头时用无法解码的内容应答消息
+func TestMiddlewareHelper(t *testing.T) {
+	mode := ""
+	for i, arg := range os.Args {
+		if arg == "--" && i+1 < len(os.Args) {
+			mode = os.Args[i+1]
+		}
+	}
+	if mode == "" {
+		return
+	}
+
+	in, out := bufio.NewReader(os.Stdin), bufio.NewWriter(os.NewFile(3, "out"))
+	if mode == config.MiddlewareHex {
+		_, _ = out.WriteString("zz\n")
+		for {
+			line, err := in.ReadBytes('\n')
+			if err != nil {
+				os.Exit(0)
+			}
+			_, _ = out.Write(line)
+			_ = out.Flush()
+		}
+	}
+
+	kind := ""
+	if i := strings.Index(mode, "-"); i >= 0 {
+		kind, mode = mode[:i], mode[i+1:]
+	}
+	c := newCodec(config.MiddlewareProtocol(mode))
+	for {
+		f, err := c.decode(in)
+		if err != nil {
+			os.Exit(0)
+		}
+		switch {
+		case f.Type == framePing && kind == "deaf":
+			continue
+		case f.Type == framePing:
+			f.Type = framePong
+		case kind == "garbage":
+			_, _ = out.WriteString("zz\n")
+			_ = out.Flush()
+			continue
+		case kind == "slow":
+			time.Sleep(50 * time.Millisecond)
+		case bytes.Contains(f.Data, []byte("crash")):
+			os.Exit(1)
+		case bytes.Contains(f.Data, []byte("drop")):
+			f.Type, f.Data = frameDrop, nil
+		}
+		b, _ := c.encode(f)
+		_, _ = out.Write(b)
+		_ = out.Flush()
+	}
+}
+
+// command 运行 TestMiddlewareHelper 的命令
+func (s *middlewareSuite) command(mode string) string {
+	return s.helper + " " + mode
+}
+
+// chanReader 从 channel 读消息的输入
+type chanReader chan *plugins.Message
+
+func (r chanReader) PluginRead() (*plugins.Message, error) {
+	msg, ok := <-r
+	if !ok {
+		return nil, errors.ErrorStopped
+	}
+
+	return msg, nil
+}
+
+func request(path string) *plugins.Message {
+	return &plugins.Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 0),
+		Data: []byte("GET " + path + " HTTP/1.1\r\n\r\n"),
+	}
+}
+
+// receive 读取 middleware 发出的下一个消息的 body
+func (s *middlewareSuite) receive(m *Middleware) string {
+	got := make(chan *plugins.Message, 1)
+	go func() {
+		msg, err := m.PluginRead()
+		if err == nil {
+			got <- msg
+		}
+	}()
+
+	select {
+	case msg := <-got:
+		s.Equal(byte(protocol.RequestPayload), msg.Meta[0])
+		return string(msg.Data)
+	case <-time.After(5 * time.Second):
+		s.Fail("no message from the middleware")
+		return ""
+	}
+}
+
+func (s *middlewareSuite) TestProtocols() {
+	for _, tt := range []struct {
+		protocol      string
+		want          []string
+		wantFiltered  float64
+		wantMalformed float64
+	}{
+		{protocol: config.MiddlewareHex, want: []string{"/a", "/drop", "/b"}, wantMalformed: 1},
+		{protocol: config.MiddlewareJSON, want: []string{"/a", "/b"}, wantFiltered: 1},
+		{protocol: config.MiddlewareBinary, want: []string{"/a", "/b"}, wantFiltered: 1},
+	} {
+		s.Run(tt.protocol, func() {
+			filtered, malformed := droppedMetric.With(dropFiltered).Value(), droppedMetric.With(dropMalformed).Value()
+
+			// window 为 1 时下一个消息要等上一个的应答
+			m := newMiddleware(s.command(tt.protocol),
+				config.MiddlewareConfig{Protocol: config.MiddlewareProtocol(tt.protocol), Window: 1})
+			defer m.Close()
+			in := make(chanReader, 3)
+			m.ReadFrom(in)
+			for _, path := range []string{"/a", "/drop", "/b"} {
+				in <- request(path)
+			}
+
+			for _, path := range tt.want {
+				s.Equal("GET "+path+" HTTP/1.1\r\n\r\n", s.receive(m))
+			}
+			s.Equal(tt.wantFiltered, droppedMetric.With(dropFiltered).Value()-filtered)
+			s.Equal(tt.wantMalformed, droppedMetric.With(dropMalformed).Value()-malformed)
+		})
+	}
+}
+
+func (s *middlewareSuite) TestRestart() {
+	restarts, crashed := restartsMetric.With().Value(), droppedMetric.With(dropCrash).Value()
+
+	m := newMiddleware(s.command(config.MiddlewareBinary), config.MiddlewareConfig{Protocol: config.MiddlewareBinary})
+	defer m.Close()
+	in := make(chanReader, 2)
+	m.ReadFrom(in)
+
+	in <- request("/crash")
+	s.Eventually(func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return restartsMetric.With().Value()-restarts == 1 && m.child != nil
+	}, 5*time.Second, time.Millisecond)
+	s.Equal(float64(1), droppedMetric.With(dropCrash).Value()-crashed)
+	s.Empty(m.window, "window is released")
+
+	in <- request("/after")
+	s.Equal("GET /after HTTP/1.1\r\n\r\n", s.receive(m))
+}
+
+func (s *middlewareSuite) TestHeartbeat() {
+	restarts := restartsMetric.With().Value()
+
+	m := newMiddleware(s.command("deaf-"+config.MiddlewareJSON),
+		config.MiddlewareConfig{Protocol: config.MiddlewareJSON, Heartbeat: 20 * time.Millisecond})
+	s.Eventually(func() bool { return restartsMetric.With().Value()-restarts >= 1 }, 5*time.Second, time.Millisecond)
+	s.NoError(m.Close())
+
+	// 应答 ping 时不重启, 间隔要比进程启动的时间长
+	restarts = restartsMetric.With().Value()
+	m = newMiddleware(s.command(config.MiddlewareJSON),
+		config.MiddlewareConfig{Protocol: config.MiddlewareJSON, Heartbeat: 200 * time.Millisecond})
+	time.Sleep(time.Second)
+	s.NoError(m.Close())
+	s.Equal(float64(0), restartsMetric.With().Value()-restarts)
+
+	// 慢的进程还在应答时, 排在消息后面的 ping 晚于一个间隔应答也不重启
+	restarts = restartsMetric.With().Value()
+	m = newMiddleware(s.command("slow-"+config.MiddlewareJSON),
+		config.MiddlewareConfig{Protocol: config.MiddlewareJSON, Heartbeat: 200 * time.Millisecond})
+	defer m.Close()
+	in := make(chanReader, 20)
+	m.ReadFrom(in)
+	for i := 0; i < 20; i++ {
+		in <- request("/slow")
+	}
+	for i := 0; i < 20; i++ {
+		s.Equal("GET /slow HTTP/1.1\r\n\r\n", s.receive(m))
+	}
+	s.Equal(float64(0), restartsMetric.With().Value()-restarts)
+}
+
+func (s *middlewareSuite) TestTimeout() {
+	timeout, malformed := droppedMetric.With(dropTimeout).Value(), droppedMetric.With(dropMalformed).Value()
+
+	// 应答都无法解码, 超时后 window 的位置要让出来, 否则第 3 个消息之后不能再发送
+	m := newMiddleware(s.command("garbage-"+config.MiddlewareJSON), config.MiddlewareConfig{
+		Protocol: config.MiddlewareJSON, Window: 2, Timeout: 100 * time.Millisecond})
+	defer m.Close()
+	in := make(chanReader, 5)
+	m.ReadFrom(in)
+	for i := 0; i < 5; i++ {
+		in <- request("/garbage")
+	}
+
+	s.Eventually(func() bool { return droppedMetric.With(dropTimeout).Value()-timeout == 5 },
+		5*time.Second, time.Millisecond)
+	s.Empty(m.window, "window is released")
+	s.Equal(float64(0), droppedMetric.With(dropMalformed).Value()-malformed)
+}
+
+func (s *middlewareSuite) TestCodecs() {
+	f := &frame{Type: frameMessage, ID: 7, Data: []byte("1 x 1 0\nGET / HTTP/1.1\r\n\r\n")}
+	for _, c := range []codec{hexCodec{}, jsonCodec{}, binaryCodec{}} {
+		b, err := c.encode(f)
+		s.Require().NoError(err)
+		got, err := c.decode(bufio.NewReader(bytes.NewReader(b)))
+		s.Require().NoError(err)
+		s.Equal(f.Data, got.Data)
+	}
+
+	_, err := jsonCodec{}.decode(bufio.NewReader(strings.NewReader("{\n")))
+	s.Equal(errMalformed, err)
+	_, err = binaryCodec{}.decode(bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 9, 9, 0, 0, 0, 0, 0, 0, 0, 1})))
+	s.Equal(errMalformed, err)
+	_, err = binaryCodec{}.decode(bufio.NewReader(bytes.NewReader([]byte{0xff, 0, 0, 0})))
+	s.EqualError(err, "invalid frame length 4278190080")
+}
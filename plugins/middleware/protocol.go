@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"goreplay/config"
+)
+
+// 帧的类型
+const (
+	frameMessage = "message" // frameMessage Gor 发出的消息, 或者 middleware 对这个消息的应答
+	frameDrop    = "drop"    // frameDrop middleware 丢弃了 ID 对应的消息
+	framePing    = "ping"    // framePing Gor 发出的心跳
+	framePong    = "pong"    // framePong 心跳的应答, ID 与 ping 相同
+)
+
+const (
+	binaryHeaderLen = 13      // binaryHeaderLen 4 字节长度, 1 字节类型, 8 字节 ID
+	maxFrameSize    = 1 << 30 // maxFrameSize 更长的 binary 帧认为数据流已经错位
+)
+
+// binary 协议中帧类型的编码
+var binaryTypes = []string{1: frameMessage, 2: frameDrop, 3: framePing, 4: framePong}
+
+// errMalformed 帧的内容无法解码, 可以继续读下一帧
+var errMalformed = errors.New("malformed frame")
+
+// frame middleware 协议的一帧, Data 是 meta 行加上 payload, 与 hex 协议解码后的内容相同
+type frame struct {
+	Type string `json:"type"`
+	ID   uint64 `json:"id"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// codec 帧的编码方式, 对应 --middleware-protocol
+type codec interface {
+	encode(f *frame) ([]byte, error)
+	// decode 读取下一帧, 内容错误时返回 errMalformed, 其他错误之后不能再读
+	decode(r *bufio.Reader) (*frame, error)
+}
+
+func newCodec(protocol config.MiddlewareProtocol) codec {
+	switch protocol {
+	case config.MiddlewareBinary:
+		return binaryCodec{}
+	case config.MiddlewareJSON:
+		return jsonCodec{}
+	}
+
+	return hexCodec{}
+}
+
+// hexCodec 每行一个 hex 编码的消息, 只有 ID 为 0 的 message 帧
+type hexCodec struct{}
+
+func (hexCodec) encode(f *frame) ([]byte, error) {
+	dst := make([]byte, hex.EncodedLen(len(f.Data))+1)
+	hex.Encode(dst, f.Data)
+	dst[len(dst)-1] = '\n'
+
+	return dst, nil
+}
+
+func (hexCodec) decode(r *bufio.Reader) (*frame, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimRight(line, "\r\n")
+	data := make([]byte, hex.DecodedLen(len(line)))
+	if _, err = hex.Decode(data, line); err != nil || len(data) == 0 {
+		return nil, errMalformed
+	}
+
+	return &frame{Type: frameMessage, Data: data}, nil
+}
+
+// jsonCodec 每行一个 JSON 帧, data 为 base64
+type jsonCodec struct{}
+
+func (jsonCodec) encode(f *frame) ([]byte, error) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
+
+func (jsonCodec) decode(r *bufio.Reader) (*frame, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	f := new(frame)
+	if json.Unmarshal(line, f) != nil {
+		return nil, errMalformed
+	}
+
+	return f, nil
+}
+
+// binaryCodec 大端的 4 字节长度, 1 字节类型和 8 字节 ID, 之后是 data. 长度不包括自己的 4 字节
+type binaryCodec struct{}
+
+func (binaryCodec) encode(f *frame) ([]byte, error) {
+	typ := 0
+	for i, t := range binaryTypes {
+		if t != "" && t == f.Type {
+			typ = i
+		}
+	}
+	if typ == 0 {
+		return nil, fmt.Errorf("unknown frame type %q", f.Type)
+	}
+
+	b := make([]byte, binaryHeaderLen+len(f.Data))
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	b[4] = byte(typ)
+	binary.BigEndian.PutUint64(b[5:], f.ID)
+	copy(b[binaryHeaderLen:], f.Data)
+
+	return b, nil
+}
+
+func (binaryCodec) decode(r *bufio.Reader) (*frame, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n < binaryHeaderLen-4 || n > maxFrameSize {
+		return nil, fmt.Errorf("invalid frame length %d", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if int(b[0]) >= len(binaryTypes) || binaryTypes[b[0]] == "" {
+		return nil, errMalformed
+	}
+
+	return &frame{Type: binaryTypes[b[0]], ID: binary.BigEndian.Uint64(b[1:]), Data: b[binaryHeaderLen-4:]}, nil
+}
@@ -25,6 +25,7 @@ type BinaryOutput struct {
 	needWorker    chan int
 	quit          chan struct{}
 	config        *config.BinaryOutputConfig
+	metrics       *outputMetrics
 }
 
 // NewBinaryOutput constructor for BinaryOutput
@@ -39,6 +40,11 @@ func NewBinaryOutput(address string, config *config.BinaryOutputConfig) PluginRe
 	o.responses = make(chan response, 1000)
 	o.needWorker = make(chan int, 1)
 	o.quit = make(chan struct{})
+	o.metrics = newOutputMetrics("binary", address, func() float64 {
+		return float64(len(o.queue))
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&o.activeWorkers))
+	})
 
 	// Initial workers count
 	if o.config.Workers == 0 {
@@ -146,12 +152,22 @@ func (o *BinaryOutput) sendRequest(client *client.TCPClient, msg *Message) {
 
 	uuid := protocol.PayloadID(msg.Meta)
 	start := time.Now()
-	resp, err := client.Send(msg.Data)
+	var (
+		resp []byte
+		err  error
+	)
+	// 能识别出完整响应的协议复用连接, 其他协议发完即关闭写端
+	if read := protocolResponseReader(o.config.Protocol, msg.Data); read != nil {
+		resp, err = client.RoundTrip(msg.Data, read)
+	} else {
+		resp, err = client.Send(msg.Data)
+	}
 	if err != nil {
 		logger.Warn("[OUTPUT-BINARY]Request error:", err)
 	}
 	// 计时
 	stop := time.Now()
+	o.metrics.observe(stop.Sub(start), err)
 	if o.config.TrackResponses {
 		o.responses <- response{resp, uuid, start.UnixNano(),
 			stop.UnixNano() - start.UnixNano()}
@@ -166,6 +182,7 @@ func (o *BinaryOutput) String() string {
 // Close closes this plugin for reading
 func (o *BinaryOutput) Close() error {
 	close(o.quit)
+	o.metrics.close()
 
 	return nil
 }
@@ -0,0 +1,95 @@
+package plugins
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/codec"
+	"goreplay/config"
+	"goreplay/framer"
+	"goreplay/protocol"
+)
+
+// TestUnitBinaryOutput binary output unit test execute
+func TestUnitBinaryOutput(t *testing.T) {
+	suite.Run(t, new(binaryOutputSuite))
+}
+
+type binaryOutputSuite struct {
+	suite.Suite
+}
+
+// startRedisServer answers every command with "+<COMMAND>", on connections kept open
+func startRedisServer(s *suite.Suite) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				var buf []byte
+				for {
+					line, err := r.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					buf = append(buf, line...)
+
+					if _, err = framer.RESPCommandLen(buf); err != nil {
+						continue
+					}
+
+					cmd, _ := framer.RESPCommand(buf)
+					buf = nil
+					_, _ = conn.Write([]byte("+" + strings.ToUpper(cmd) + "\r\n"))
+				}
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func (s *binaryOutputSuite) TestRedisTrackResponse() {
+	ln := startRedisServer(&s.Suite)
+	defer ln.Close()
+
+	o := NewBinaryOutput(ln.Addr().String(), &config.BinaryOutputConfig{
+		Workers:        1,
+		Timeout:        time.Second,
+		TrackResponses: true,
+		Protocol:       codec.RedisName,
+	}).(*BinaryOutput)
+	defer o.Close()
+
+	for cmd, want := range map[string]string{
+		"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n": "+GET\r\n",
+		"PING\r\n":                       "+PING\r\n",
+	} {
+		id := protocol.UUID()
+		_, err := o.PluginWrite(&Message{
+			Meta: protocol.PayloadHeader(protocol.RequestPayload, id, 1, 1),
+			Data: []byte(cmd),
+		})
+		s.Require().NoError(err)
+
+		msg, err := o.PluginRead()
+		s.Require().NoError(err)
+		s.Equal(id, protocol.PayloadID(msg.Meta))
+		s.Equal(byte(protocol.ReplayedResponsePayload), msg.Meta[0])
+		s.Equal(want, string(msg.Data))
+	}
+}
@@ -0,0 +1,493 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+
+	"goreplay/codec"
+	"goreplay/config"
+	"goreplay/logger"
+	"goreplay/protocol"
+)
+
+const (
+	comparatorCacheSize     = 10000
+	comparatorStatsInterval = time.Minute
+	comparatorMaxValueLen   = 256
+	comparatorUnknown       = "unknown"
+)
+
+// 差异类型
+const (
+	DiffChanged = "changed" // 两边都有, 值不同
+	DiffMissing = "missing" // 只在录制的响应中
+	DiffAdded   = "added"   // 只在回放的响应中
+)
+
+// ComparatorStats 单个接口的比对统计
+type ComparatorStats struct {
+	Match    uint64 `json:"match"`
+	Mismatch uint64 `json:"mismatch"`
+}
+
+// ComparatorDiff 录制的响应和回放的响应的一处差异
+type ComparatorDiff struct {
+	Field    string      `json:"field"`
+	Kind     string      `json:"kind"`
+	Original interface{} `json:"original"`
+	Replayed interface{} `json:"replayed"`
+}
+
+// ComparatorRecord 写入 jsonl 文件的一条差异记录
+type ComparatorRecord struct {
+	ID        string           `json:"id"`
+	Endpoint  string           `json:"endpoint"`
+	Timestamp time.Time        `json:"timestamp"`
+	Diffs     []ComparatorDiff `json:"diffs"`
+}
+
+// comparatorEntry 按 uuid 等待配对的请求和响应
+type comparatorEntry struct {
+	endpoint    string
+	timestamp   int64
+	original    []byte
+	replayed    []byte
+	hasOriginal bool
+	hasReplayed bool
+}
+
+// ComparatorOutput 按 uuid 配对录制的响应('2')和回放的响应('3'), 比较状态码, 指定的头部和 body,
+// 按接口统计一致和不一致的数量, 并把差异写入 jsonl 文件
+type ComparatorOutput struct {
+	sync.Mutex
+	path    string
+	conf    *config.ComparatorOutputConfig
+	codec   codec.HeaderCodec
+	cache   *lru.Cache
+	stats   map[string]*ComparatorStats
+	ignores [][]string
+	file    *os.File
+	writer  *bufio.Writer
+	stop    chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+// NewComparatorOutput 新建 ComparatorOutput, path 为差异文件的路径
+func NewComparatorOutput(path string, conf *config.ComparatorOutputConfig) *ComparatorOutput {
+	if conf.CacheSize <= 0 {
+		conf.CacheSize = comparatorCacheSize
+	}
+
+	if conf.StatsInterval <= 0 {
+		conf.StatsInterval = comparatorStatsInterval
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Fatal("[OUTPUT-COMPARATOR] open diff file error:", err)
+	}
+
+	o := &ComparatorOutput{
+		path:   path,
+		conf:   conf,
+		codec:  codec.GetHeaderCodec(conf.Protocol),
+		cache:  lru.New(conf.CacheSize),
+		stats:  make(map[string]*ComparatorStats),
+		file:   file,
+		writer: bufio.NewWriter(file),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	for _, rule := range conf.IgnoreFields {
+		o.ignores = append(o.ignores, strings.Split(rule, "."))
+	}
+
+	go o.report()
+
+	return o
+}
+
+// PluginWrite 收集请求, 录制的响应和回放的响应, 配对后比较
+func (o *ComparatorOutput) PluginWrite(msg *Message) (int, error) {
+	meta := protocol.PayloadMeta(msg.Meta)
+	if len(meta) < 3 || len(meta[0]) == 0 {
+		return len(msg.Data), nil
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	id := string(meta[1])
+	e := o.entry(id)
+	switch meta[0][0] {
+	case protocol.RequestPayload:
+		e.endpoint = o.endpoint(msg)
+		e.timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+	case protocol.ResponsePayload:
+		e.original, e.hasOriginal = append([]byte(nil), msg.Data...), true
+	case protocol.ReplayedResponsePayload:
+		e.replayed, e.hasReplayed = append([]byte(nil), msg.Data...), true
+	}
+
+	if e.hasOriginal && e.hasReplayed {
+		o.cache.Remove(id)
+		o.compare(id, e)
+	}
+
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+func (o *ComparatorOutput) entry(id string) *comparatorEntry {
+	if v, ok := o.cache.Get(id); ok {
+		return v.(*comparatorEntry)
+	}
+
+	e := &comparatorEntry{endpoint: comparatorUnknown}
+	o.cache.Add(id, e)
+
+	return e
+}
+
+// endpoint http 请求取 method 和 path, 其他协议取接口名
+func (o *ComparatorOutput) endpoint(msg *Message) string {
+	if req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg.Data))); err == nil {
+		return req.Method + " " + req.URL.Path
+	}
+
+	if header, err := o.codec.Decode(msg.Data, msg.ConnectionID); err == nil && header.APIName != "" {
+		return header.APIName
+	}
+
+	return comparatorUnknown
+}
+
+func (o *ComparatorOutput) compare(id string, e *comparatorEntry) {
+	stats, ok := o.stats[e.endpoint]
+	if !ok {
+		stats = new(ComparatorStats)
+		o.stats[e.endpoint] = stats
+	}
+
+	diffs := o.Diff(e.original, e.replayed)
+	if len(diffs) == 0 {
+		stats.Match++
+		return
+	}
+	stats.Mismatch++
+
+	line, err := json.Marshal(&ComparatorRecord{
+		ID:        id,
+		Endpoint:  e.endpoint,
+		Timestamp: time.Unix(0, e.timestamp),
+		Diffs:     diffs,
+	})
+	if err != nil {
+		logger.Debug("[OUTPUT-COMPARATOR] marshal diff error: ", err)
+		return
+	}
+
+	if _, err = o.writer.Write(append(line, '\n')); err != nil {
+		logger.Error("[OUTPUT-COMPARATOR] write diff error: ", err)
+	}
+}
+
+// Diff 比较录制的响应和回放的响应, 两边都是 http 响应时比较状态码, 指定的头部和 body, 否则只比较 body
+func (o *ComparatorOutput) Diff(original, replayed []byte) []ComparatorDiff {
+	var diffs []ComparatorDiff
+
+	origResp, origBody, origErr := comparatorReadResponse(original)
+	replayResp, replayBody, replayErr := comparatorReadResponse(replayed)
+	if origErr != nil || replayErr != nil {
+		return o.diffBody(original, replayed, diffs)
+	}
+
+	if origResp.StatusCode != replayResp.StatusCode {
+		diffs = append(diffs, ComparatorDiff{Field: "status", Kind: DiffChanged,
+			Original: origResp.StatusCode, Replayed: replayResp.StatusCode})
+	}
+
+	for _, name := range o.conf.Headers {
+		origValue, replayValue := origResp.Header.Get(name), replayResp.Header.Get(name)
+		if origValue == replayValue {
+			continue
+		}
+
+		diff := ComparatorDiff{Field: "header." + http.CanonicalHeaderKey(name), Kind: DiffChanged,
+			Original: origValue, Replayed: replayValue}
+		if _, ok := replayResp.Header[http.CanonicalHeaderKey(name)]; !ok {
+			diff.Kind, diff.Replayed = DiffMissing, nil
+		} else if _, ok = origResp.Header[http.CanonicalHeaderKey(name)]; !ok {
+			diff.Kind, diff.Original = DiffAdded, nil
+		}
+		diffs = append(diffs, diff)
+	}
+
+	return o.diffBody(origBody, replayBody, diffs)
+}
+
+// diffBody 两边都是 json 时按结构比较, 否则按字节比较
+func (o *ComparatorOutput) diffBody(original, replayed []byte, diffs []ComparatorDiff) []ComparatorDiff {
+	var origValue, replayValue interface{}
+	if comparatorUnmarshal(original, &origValue) == nil && comparatorUnmarshal(replayed, &replayValue) == nil {
+		return o.diffJSON(nil, origValue, replayValue, diffs)
+	}
+
+	if !bytes.Equal(original, replayed) {
+		diffs = append(diffs, ComparatorDiff{Field: "body", Kind: DiffChanged,
+			Original: comparatorTruncate(original), Replayed: comparatorTruncate(replayed)})
+	}
+
+	return diffs
+}
+
+func (o *ComparatorOutput) diffJSON(path []string, original, replayed interface{},
+	diffs []ComparatorDiff) []ComparatorDiff {
+	if o.ignored(path) {
+		return diffs
+	}
+
+	switch origValue := original.(type) {
+	case map[string]interface{}:
+		if replayValue, ok := replayed.(map[string]interface{}); ok {
+			return o.diffObject(path, origValue, replayValue, diffs)
+		}
+	case []interface{}:
+		if replayValue, ok := replayed.([]interface{}); ok {
+			return o.diffArray(path, origValue, replayValue, diffs)
+		}
+	}
+
+	if !reflect.DeepEqual(original, replayed) {
+		diffs = append(diffs, ComparatorDiff{Field: comparatorField(path), Kind: DiffChanged,
+			Original: original, Replayed: replayed})
+	}
+
+	return diffs
+}
+
+func (o *ComparatorOutput) diffObject(path []string, original, replayed map[string]interface{},
+	diffs []ComparatorDiff) []ComparatorDiff {
+	keys := make([]string, 0, len(original)+len(replayed))
+	for k := range original {
+		keys = append(keys, k)
+	}
+	for k := range replayed {
+		if _, ok := original[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		diffs = o.diffMember(append(path[:len(path):len(path)], k), original, replayed, k, diffs)
+	}
+
+	return diffs
+}
+
+func (o *ComparatorOutput) diffMember(path []string, original, replayed map[string]interface{}, key string,
+	diffs []ComparatorDiff) []ComparatorDiff {
+	origValue, inOriginal := original[key]
+	replayValue, inReplayed := replayed[key]
+	switch {
+	case inOriginal && inReplayed:
+		return o.diffJSON(path, origValue, replayValue, diffs)
+	case o.ignored(path):
+		return diffs
+	case inOriginal:
+		return append(diffs, ComparatorDiff{Field: comparatorField(path), Kind: DiffMissing, Original: origValue})
+	default:
+		return append(diffs, ComparatorDiff{Field: comparatorField(path), Kind: DiffAdded, Replayed: replayValue})
+	}
+}
+
+func (o *ComparatorOutput) diffArray(path []string, original, replayed []interface{},
+	diffs []ComparatorDiff) []ComparatorDiff {
+	for i := 0; i < len(original) || i < len(replayed); i++ {
+		elemPath := append(path[:len(path):len(path)], strconv.Itoa(i))
+		switch {
+		case i < len(original) && i < len(replayed):
+			diffs = o.diffJSON(elemPath, original[i], replayed[i], diffs)
+		case o.ignored(elemPath):
+		case i < len(original):
+			diffs = append(diffs, ComparatorDiff{Field: comparatorField(elemPath), Kind: DiffMissing,
+				Original: original[i]})
+		default:
+			diffs = append(diffs, ComparatorDiff{Field: comparatorField(elemPath), Kind: DiffAdded,
+				Replayed: replayed[i]})
+		}
+	}
+
+	return diffs
+}
+
+// ignored 忽略规则按 . 分段, * 匹配任意一段; 只有一段的规则匹配任意层级的同名字段
+func (o *ComparatorOutput) ignored(path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+
+	for _, rule := range o.ignores {
+		if len(rule) == 1 {
+			if rule[0] == path[len(path)-1] {
+				return true
+			}
+			continue
+		}
+
+		if len(rule) != len(path) {
+			continue
+		}
+
+		matched := true
+		for i := range rule {
+			if rule[i] != "*" && rule[i] != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Stats 各接口的比对统计
+func (o *ComparatorOutput) Stats() map[string]ComparatorStats {
+	o.Lock()
+	defer o.Unlock()
+
+	stats := make(map[string]ComparatorStats, len(o.stats))
+	for endpoint, s := range o.stats {
+		stats[endpoint] = *s
+	}
+
+	return stats
+}
+
+// report 定时输出统计并刷新差异文件
+func (o *ComparatorOutput) report() {
+	defer close(o.done)
+
+	ticker := time.NewTicker(o.conf.StatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			o.flush()
+		case <-o.stop:
+			o.flush()
+			return
+		}
+	}
+}
+
+func (o *ComparatorOutput) flush() {
+	stats := o.Stats()
+	endpoints := make([]string, 0, len(stats))
+	for endpoint := range stats {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	for _, endpoint := range endpoints {
+		logger.Info(fmt.Sprintf("[OUTPUT-COMPARATOR] %s match: %d, mismatch: %d",
+			endpoint, stats[endpoint].Match, stats[endpoint].Mismatch))
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if err := o.writer.Flush(); err != nil {
+		logger.Error("[OUTPUT-COMPARATOR] flush diff file error: ", err)
+	}
+}
+
+// String output address
+func (o *ComparatorOutput) String() string {
+	return "Comparator output: " + o.path
+}
+
+// Close 输出最终统计并关闭差异文件
+func (o *ComparatorOutput) Close() error {
+	o.Lock()
+	if o.closed {
+		o.Unlock()
+		return nil
+	}
+	o.closed = true
+	o.Unlock()
+
+	close(o.stop)
+	<-o.done
+
+	return o.file.Close()
+}
+
+// comparatorReadResponse 解析 http 响应, 返回解压后的 body
+func comparatorReadResponse(data []byte) (*http.Response, []byte, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if gz, err := gzip.NewReader(resp.Body); err == nil {
+			body = gz
+		}
+	}
+
+	// 截断的 body 只比较已有的部分
+	b, _ := ioutil.ReadAll(body)
+
+	return resp, b, nil
+}
+
+func comparatorUnmarshal(data []byte, v interface{}) error {
+	if !json.Valid(data) {
+		return fmt.Errorf("invalid json")
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	return d.Decode(v)
+}
+
+func comparatorField(path []string) string {
+	if len(path) == 0 {
+		return "body"
+	}
+
+	return "body." + strings.Join(path, ".")
+}
+
+func comparatorTruncate(b []byte) string {
+	if len(b) > comparatorMaxValueLen {
+		return string(b[:comparatorMaxValueLen]) + "..."
+	}
+
+	return string(b)
+}
@@ -0,0 +1,135 @@
+package plugins
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+	"goreplay/protocol"
+)
+
+// TestUnitComparatorOutput comparator output unit test execute
+func TestUnitComparatorOutput(t *testing.T) {
+	suite.Run(t, new(comparatorOutputSuite))
+}
+
+type comparatorOutputSuite struct {
+	suite.Suite
+}
+
+func comparatorResponse(status string, headers string, body string) []byte {
+	return []byte("HTTP/1.1 " + status + "\r\n" + headers + "Content-Length: " + strconv.Itoa(len(body)) +
+		"\r\n\r\n" + body)
+}
+
+func (s *comparatorOutputSuite) newOutput(conf *config.ComparatorOutputConfig) (*ComparatorOutput, string) {
+	path := filepath.Join(s.T().TempDir(), "diffs.jsonl")
+	return NewComparatorOutput(path, conf), path
+}
+
+func (s *comparatorOutputSuite) TestDiff() {
+	o, _ := s.newOutput(&config.ComparatorOutputConfig{
+		Headers:      config.MultiOption{"content-type", "X-Version"},
+		IgnoreFields: config.MultiOption{"timestamp", "data.items.*.trace_id"},
+	})
+	defer o.Close()
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write([]byte(`{"a":1}`))
+	_ = w.Close()
+
+	tests := []struct {
+		name     string
+		original []byte
+		replayed []byte
+		want     []ComparatorDiff
+	}{
+		{name: "same", original: comparatorResponse("200 OK", "Date: 1\r\n", "ok"),
+			replayed: comparatorResponse("200 OK", "Date: 2\r\n", "ok")},
+		{name: "status", original: comparatorResponse("200 OK", "", "ok"),
+			replayed: comparatorResponse("500 Internal Server Error", "", "ok"),
+			want:     []ComparatorDiff{{Field: "status", Kind: DiffChanged, Original: 200, Replayed: 500}}},
+		{name: "headers", original: comparatorResponse("200 OK", "Content-Type: text/plain\r\nX-Version: 1\r\n", ""),
+			replayed: comparatorResponse("200 OK", "Content-Type: text/html\r\n", ""),
+			want: []ComparatorDiff{
+				{Field: "header.Content-Type", Kind: DiffChanged, Original: "text/plain", Replayed: "text/html"},
+				{Field: "header.X-Version", Kind: DiffMissing, Original: "1"},
+			}},
+		{name: "text body", original: comparatorResponse("200 OK", "", "ok"),
+			replayed: comparatorResponse("200 OK", "", "ko"),
+			want:     []ComparatorDiff{{Field: "body", Kind: DiffChanged, Original: "ok", Replayed: "ko"}}},
+		{name: "json body",
+			original: comparatorResponse("200 OK", "", `{"id":1,"name":"a","timestamp":1,"tags":["x"],`+
+				`"data":{"items":[{"trace_id":"t1","v":1}],"timestamp":2}}`),
+			replayed: comparatorResponse("200 OK", "", `{"data":{"timestamp":3,"items":[{"v":1,"trace_id":"t2"}]},`+
+				`"tags":["x","y"],"name":"b","timestamp":4,"extra":null}`),
+			want: []ComparatorDiff{
+				{Field: "body.extra", Kind: DiffAdded},
+				{Field: "body.id", Kind: DiffMissing, Original: json.Number("1")},
+				{Field: "body.name", Kind: DiffChanged, Original: "a", Replayed: "b"},
+				{Field: "body.tags.1", Kind: DiffAdded, Replayed: "y"},
+			}},
+		{name: "json type", original: comparatorResponse("200 OK", "", `{"a":[1]}`),
+			replayed: comparatorResponse("200 OK", "", `{"a":{"0":1}}`),
+			want: []ComparatorDiff{{Field: "body.a", Kind: DiffChanged,
+				Original: []interface{}{json.Number("1")}, Replayed: map[string]interface{}{"0": json.Number("1")}}}},
+		{name: "gzip body", original: comparatorResponse("200 OK", "Content-Encoding: gzip\r\n", gz.String()),
+			replayed: comparatorResponse("200 OK", "", `{"a":1}`)},
+		{name: "binary", original: []byte("\x00\x01ok"), replayed: []byte("\x00\x01ko"),
+			want: []ComparatorDiff{{Field: "body", Kind: DiffChanged, Original: "\x00\x01ok", Replayed: "\x00\x01ko"}}},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			s.Equal(tt.want, o.Diff(tt.original, tt.replayed))
+		})
+	}
+}
+
+func (s *comparatorOutputSuite) TestPluginWrite() {
+	o, path := s.newOutput(&config.ComparatorOutputConfig{})
+
+	write := func(kind byte, id string, data string) {
+		_, err := o.PluginWrite(&Message{Meta: protocol.PayloadHeader(kind, []byte(id), 1e9, 1), Data: []byte(data)})
+		s.Require().NoError(err)
+	}
+
+	write(protocol.RequestPayload, "a1", "GET /users?id=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	write(protocol.ResponsePayload, "a1", string(comparatorResponse("200 OK", "", `{"id":1}`)))
+	write(protocol.ReplayedResponsePayload, "a1", string(comparatorResponse("200 OK", "", `{"id":1}`)))
+
+	// 回放的响应先到
+	write(protocol.RequestPayload, "b2", "GET /users?id=2 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	write(protocol.ReplayedResponsePayload, "b2", string(comparatorResponse("404 Not Found", "", "")))
+	write(protocol.ResponsePayload, "b2", string(comparatorResponse("200 OK", "", `{"id":2}`)))
+
+	// 没有配对的响应不统计
+	write(protocol.RequestPayload, "c3", "POST /users HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	write(protocol.ResponsePayload, "c3", string(comparatorResponse("200 OK", "", "")))
+
+	s.Equal(map[string]ComparatorStats{"GET /users": {Match: 1, Mismatch: 1}}, o.Stats())
+	s.Require().NoError(o.Close())
+
+	data, err := ioutil.ReadFile(path)
+	s.Require().NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	s.Require().Len(lines, 1)
+
+	var record ComparatorRecord
+	s.Require().NoError(json.Unmarshal([]byte(lines[0]), &record))
+	s.Equal("b2", record.ID)
+	s.Equal("GET /users", record.Endpoint)
+	s.Equal(int64(1e9), record.Timestamp.UnixNano())
+	s.Require().Len(record.Diffs, 2)
+	s.Equal("status", record.Diffs[0].Field)
+	s.Equal("body", record.Diffs[1].Field)
+}
@@ -46,6 +46,7 @@ type FileOutput struct {
 	payloadType    []byte
 	closed         bool
 	totalFileSize  size.Size
+	decoder        *grpcDecoder // decoder --output-file-decode-pb 时把 grpc 消息解码为 JSON
 
 	config *config.FileOutputConfig
 }
@@ -56,6 +57,9 @@ func NewFileOutput(pathTemplate string, config *config.FileOutputConfig) *FileOu
 	o.pathTemplate = pathTemplate
 	o.config = config
 	o.updateName()
+	if config.DecodeProtobuf {
+		o.decoder = newGRPCDecoder(config.Protobuf)
+	}
 
 	if strings.Contains(pathTemplate, "%r") {
 		o.requestPerFile = true
@@ -237,8 +241,13 @@ func (o *FileOutput) PluginWrite(msg *Message) (int, error) {
 		o.QueueLength = 0
 	}
 
+	data := msg.Data
+	if o.decoder != nil {
+		data = o.decoder.decodeData(msg)
+	}
+
 	length, _ = o.writer.Write(msg.Meta)
-	tempLength, _ = o.writer.Write(msg.Data)
+	tempLength, _ = o.writer.Write(data)
 	length += tempLength
 	tempLength, _ = o.writer.Write(payloadSeparatorAsBytes)
 	length += tempLength
@@ -0,0 +1,157 @@
+package plugins
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"goreplay/client"
+	"goreplay/config"
+	"goreplay/errors"
+	"goreplay/logger"
+	"goreplay/protocol"
+)
+
+// GRPCOutput plugin replays the http2 frames of recorded grpc calls, one call per message as
+// grouped by the grpc framer. Calls are multiplexed on a pool of h2c, or h2 over tls, connections
+// with their own hpack state and stream ids
+type GRPCOutput struct {
+	address   string
+	clients   []*client.GRPCClient
+	queue     chan *Message
+	responses chan response
+	quit      chan struct{}
+	config    *config.GRPCOutputConfig
+	metrics   *outputMetrics
+}
+
+// NewGRPCOutput constructor for GRPCOutput
+// Initialize workers
+func NewGRPCOutput(address string, config *config.GRPCOutputConfig) PluginReadWriter {
+	o := new(GRPCOutput)
+
+	o.config = config
+	if o.config.Workers <= 0 {
+		o.config.Workers = 10
+	}
+	if o.config.Connections <= 0 {
+		o.config.Connections = 1
+	}
+
+	var secure bool
+	o.address, secure = grpcAddress(address)
+	o.clients = make([]*client.GRPCClient, o.config.Connections)
+	for i := range o.clients {
+		o.clients[i] = client.NewGRPCClient(o.address, &client.GRPCClientConfig{
+			Timeout:    o.config.Timeout,
+			Secure:     secure,
+			SkipVerify: o.config.SkipVerify,
+		})
+	}
+
+	o.queue = make(chan *Message, 1000)
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan struct{})
+	o.metrics = newOutputMetrics("grpc", address, func() float64 {
+		return float64(len(o.queue))
+	}, func() float64 {
+		return float64(o.config.Workers)
+	})
+
+	for i := 0; i < o.config.Workers; i++ {
+		go o.startWorker(o.clients[i%len(o.clients)])
+	}
+
+	return o
+}
+
+// grpcAddress https:// 地址使用 h2 over tls, 其他的使用 h2c. 没有端口时使用协议的默认端口
+func grpcAddress(address string) (string, bool) {
+	secure := strings.HasPrefix(address, "https://")
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "https://"), "http://")
+	address = strings.TrimSuffix(address, "/")
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		address = net.JoinHostPort(address, port)
+	}
+
+	return address, secure
+}
+
+func (o *GRPCOutput) startWorker(grpcClient *client.GRPCClient) {
+	for {
+		select {
+		case <-o.quit:
+			return
+		case msg := <-o.queue:
+			o.sendRequest(grpcClient, msg)
+		}
+	}
+}
+
+// PluginWrite writes a message to this plugin
+func (o *GRPCOutput) PluginWrite(msg *Message) (n int, err error) {
+	if !protocol.IsRequestPayload(msg.Meta) {
+		return len(msg.Data), nil
+	}
+
+	o.queue <- msg
+
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// PluginRead reads a message from this plugin
+func (o *GRPCOutput) PluginRead() (*Message, error) {
+	var (
+		resp response
+		msg  Message
+	)
+
+	select {
+	case <-o.quit:
+		return nil, errors.ErrorStopped
+	case resp = <-o.responses:
+	}
+
+	msg.Data = resp.payload
+	msg.Meta = protocol.PayloadHeader(protocol.ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+
+	return &msg, nil
+}
+
+func (o *GRPCOutput) sendRequest(grpcClient *client.GRPCClient, msg *Message) {
+	uuid := protocol.PayloadID(msg.Meta)
+	start := time.Now()
+
+	resp, err := grpcClient.RoundTrip(msg.Data)
+	if err != nil {
+		logger.Warn("[OUTPUT-GRPC]Request error:", err)
+	}
+
+	stop := time.Now()
+	o.metrics.observe(stop.Sub(start), err)
+	if o.config.TrackResponses {
+		o.responses <- response{resp, uuid, start.UnixNano(),
+			stop.UnixNano() - start.UnixNano()}
+	}
+}
+
+// String output address
+func (o *GRPCOutput) String() string {
+	return "gRPC output: " + o.address
+}
+
+// Close closes this plugin for reading
+func (o *GRPCOutput) Close() error {
+	close(o.quit)
+	for _, grpcClient := range o.clients {
+		grpcClient.Disconnect()
+	}
+	o.metrics.close()
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package plugins
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"goreplay/config"
+	"goreplay/framer"
+	"goreplay/protocol"
+)
+
+// TestUnitGRPCOutput grpc output unit test execute
+func TestUnitGRPCOutput(t *testing.T) {
+	suite.Run(t, new(grpcOutputSuite))
+}
+
+type grpcOutputSuite struct {
+	suite.Suite
+}
+
+// serve h2c 服务端, 返回请求的 body
+func (s *grpcOutputSuite) serve() string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	s.T().Cleanup(func() { ln.Close() })
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("content-type", "application/grpc")
+		w.Header().Set("Trailer", "grpc-status")
+		_, _ = w.Write(body)
+		w.Header().Set("grpc-status", "0")
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// grpcCall 录制的一个 grpc 请求, headers 独立编码
+func (s *grpcOutputSuite) grpcCall(streamID uint32, body []byte) []byte {
+	var hbuf, buf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	for _, hf := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/helloworld.Greeter/SayHello"},
+		{Name: ":authority", Value: "localhost"},
+		{Name: "content-type", Value: "application/grpc"},
+	} {
+		s.Require().NoError(enc.WriteField(hf))
+	}
+
+	fr := http2.NewFramer(&buf, nil)
+	s.Require().NoError(fr.WriteHeaders(http2.HeadersFrameParam{StreamID: streamID, BlockFragment: hbuf.Bytes(),
+		EndHeaders: true}))
+	s.Require().NoError(fr.WriteData(streamID, true, body))
+
+	return buf.Bytes()
+}
+
+func (s *grpcOutputSuite) TestPluginWrite() {
+	o := NewGRPCOutput(s.serve(), &config.GRPCOutputConfig{TrackResponses: true, Workers: 2}).(*GRPCOutput)
+	defer o.Close()
+
+	// 同一个录制连接上的两个请求, stream id 不同
+	bodies := map[string][]byte{}
+	for i, streamID := range []uint32{1, 3} {
+		msg := &Message{
+			Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 1),
+			Data: s.grpcCall(streamID, []byte{0, 0, 0, 0, 1, byte('a' + i)}),
+		}
+		bodies[string(protocol.PayloadID(msg.Meta))] = msg.Data
+		_, err := o.PluginWrite(msg)
+		s.Require().NoError(err)
+	}
+
+	for range bodies {
+		msg, err := o.PluginRead()
+		s.Require().NoError(err)
+		s.Equal(byte(protocol.ReplayedResponsePayload), msg.Meta[0])
+
+		req, ok := bodies[string(protocol.PayloadID(msg.Meta))]
+		s.Require().True(ok)
+
+		// 响应在请求录制时的 stream id 上, 可以单独解码
+		fr := framer.NewHTTP2Framer(msg.Data, "", true)
+		headers := map[string]string{}
+		for {
+			frame, err := fr.ReadFrame()
+			if err != nil {
+				break
+			}
+			s.Equal(http2StreamID(req), frame.Header().StreamID)
+			switch f := frame.(type) {
+			case *http2.MetaHeadersFrame:
+				for _, hf := range f.Fields {
+					headers[hf.Name] = hf.Value
+				}
+			case *http2.DataFrame:
+				s.Equal(req[len(req)-6:], f.Data())
+			}
+		}
+		s.Equal("200", headers[":status"])
+		s.Equal("0", headers["grpc-status"])
+	}
+}
+
+func (s *grpcOutputSuite) TestGRPCAddress() {
+	for _, tt := range []struct {
+		address    string
+		want       string
+		wantSecure bool
+	}{
+		{address: "staging:50051", want: "staging:50051"},
+		{address: "http://staging", want: "staging:80"},
+		{address: "https://staging/", want: "staging:443", wantSecure: true},
+		{address: "https://staging:8443", want: "staging:8443", wantSecure: true},
+	} {
+		s.Run(tt.address, func() {
+			got, secure := grpcAddress(tt.address)
+			s.Equal(tt.want, got)
+			s.Equal(tt.wantSecure, secure)
+		})
+	}
+}
@@ -5,15 +5,19 @@ import (
 	"bytes"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"goreplay/config"
 	"goreplay/errors"
+	gorhttp "goreplay/http"
 	"goreplay/logger"
 	"goreplay/protocol"
 	"goreplay/stat"
@@ -39,7 +43,14 @@ type HTTPOutput struct {
 	stopWorker    chan struct{}
 	queue         chan *Message
 	responses     chan *response
+	elasticSearch *ESPlugin
+	metrics       *outputMetrics
 	stop          chan bool // Channel used only to indicate goroutine should shutdown
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*httpSession // --output-http-session 时按 ConnectionID
+
+	rewriter *gorhttp.SessionRewriter // 替换请求中录制的 cookie 和 token
 }
 
 // NewHTTPOutput constructor for HTTPOutput
@@ -77,6 +88,23 @@ func NewHTTPOutput(address string, config *config.HTTPOutputConfig) PluginReadWr
 	// it should not be buffered to avoid races
 	o.stopWorker = make(chan struct{})
 
+	if o.Config.ElasticSearch != "" {
+		o.elasticSearch, err = NewESPlugin(o.Config.ElasticSearch)
+		if err != nil {
+			logger.Fatal("[OUTPUT-HTTP] elasticsearch error:", err)
+		}
+	}
+
+	o.metrics = newOutputMetrics("http", o.Config.RawURL, func() float64 {
+		return float64(len(o.queue))
+	}, func() float64 {
+		return float64(atomic.LoadInt32(&o.activeWorkers) + int32(o.sessionCount()))
+	})
+	if o.Config.Session {
+		o.sessions = make(map[string]*httpSession)
+	}
+
+	o.rewriter = gorhttp.NewSessionRewriter(o.Config)
 	o.client = NewHTTPClient(o.Config)
 	o.activeWorkers += int32(o.Config.WorkersMin)
 	for i := 0; i < o.Config.WorkersMin; i++ {
@@ -121,6 +149,10 @@ func initConfigSize(config *config.HTTPOutputConfig) {
 	if config.WorkerTimeout <= 0 {
 		config.WorkerTimeout = time.Second * 2
 	}
+
+	if config.SessionTimeout <= 0 {
+		config.SessionTimeout = defaultSessionTimeout
+	}
 }
 
 func (o *HTTPOutput) workerMaster() {
@@ -164,9 +196,27 @@ func (o *HTTPOutput) startWorker() {
 // PluginWrite writes message to this plugin
 func (o *HTTPOutput) PluginWrite(msg *Message) (n int, err error) {
 	if !protocol.IsRequestPayload(msg.Meta) {
+		// 录制的响应只用于导出到 ElasticSearch 和替换 cookie, token
+		if o.elasticSearch != nil && protocol.IsOriginPayload(msg.Meta) {
+			o.elasticSearch.Add(msg.Meta, msg.Data)
+		}
+		if o.rewriter != nil && protocol.IsOriginPayload(msg.Meta) {
+			o.rewriter.OriginalResponse(msg.SrcAddr, protocol.PayloadID(msg.Meta), msg.Data)
+		}
 		return len(msg.Data), nil
 	}
 
+	if o.elasticSearch != nil {
+		o.elasticSearch.Add(msg.Meta, msg.Data)
+	}
+
+	if o.Config.Session && msg.ConnectionID != "" {
+		if err = o.writeSession(msg); err != nil {
+			return 0, err
+		}
+		return len(msg.Data) + len(msg.Meta), nil
+	}
+
 	select {
 	case <-o.stop:
 		return 0, errors.ErrorStopped
@@ -215,9 +265,14 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 		return
 	}
 	uuid := protocol.PayloadID(msg.Meta)
+	data := msg.Data
+	if o.rewriter != nil {
+		data = o.rewriter.Rewrite(msg.SrcAddr, data)
+	}
 	start := time.Now()
-	resp, err := client.Send(msg.Data)
+	resp, err := client.Send(data)
 	stop := time.Now()
+	o.metrics.observe(stop.Sub(start), err)
 
 	if err != nil {
 		logger.Debug("[HTTP-OUTPUT] error when sending: ", err)
@@ -226,6 +281,14 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 	if resp == nil {
 		return
 	}
+	if o.rewriter != nil {
+		o.rewriter.ReplayedResponse(msg.SrcAddr, uuid, resp)
+	}
+
+	if o.elasticSearch != nil {
+		o.elasticSearch.Add(protocol.PayloadHeader(protocol.ReplayedResponsePayload, uuid, start.UnixNano(),
+			stop.UnixNano()-start.UnixNano()), resp)
+	}
 
 	if o.Config.TrackResponses {
 		o.responses <- &response{resp, uuid, start.UnixNano(),
@@ -242,6 +305,10 @@ func (o *HTTPOutput) String() string {
 func (o *HTTPOutput) Close() error {
 	close(o.stop)
 	close(o.stopWorker)
+	o.metrics.close()
+	if o.elasticSearch != nil {
+		return o.elasticSearch.Close()
+	}
 	return nil
 }
 
@@ -321,10 +388,14 @@ func (c *HTTPClient) Send(data []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if c.config.TrackResponses {
+	if c.config.TrackResponses || c.config.ElasticSearch != "" ||
+		c.config.RewriteCookies || len(c.config.RewriteTokens) > 0 {
 		return httputil.DumpResponse(resp, true)
 	}
+	// 读完响应, 连接才能用于下一个请求
+	_, err = io.Copy(ioutil.Discard, resp.Body)
 
-	return nil, nil
+	return nil, err
 }
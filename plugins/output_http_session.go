@@ -0,0 +1,123 @@
+package plugins
+
+import (
+	"net/http"
+	"time"
+
+	"goreplay/config"
+	"goreplay/errors"
+)
+
+// defaultSessionTimeout 没有设置 --output-http-session-timeout 时
+const defaultSessionTimeout = time.Minute
+
+// httpSession --output-http-session 时一个录制连接的回放, 请求按顺序在同一个连接上发出
+type httpSession struct {
+	client *HTTPClient
+	queue  chan *Message // ConnectionClosed 的消息表示录制的连接已经关闭
+}
+
+// newSessionClient 最多使用一个连接的 client
+func newSessionClient(conf *config.HTTPOutputConfig) *HTTPClient {
+	client := NewHTTPClient(conf)
+	transport, ok := client.Client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.MaxConnsPerHost = 1
+	transport.MaxIdleConnsPerHost = 1
+	client.Client.Transport = transport
+
+	return client
+}
+
+// writeSession 请求交给它所在连接的会话, 没有会话时新建
+func (o *HTTPOutput) writeSession(msg *Message) error {
+	o.sessionsMu.Lock()
+	s, ok := o.sessions[msg.ConnectionID]
+	if !ok {
+		s = &httpSession{client: newSessionClient(o.Config), queue: make(chan *Message, o.Config.QueueLen)}
+		o.sessions[msg.ConnectionID] = s
+		go o.runSession(msg.ConnectionID, s)
+	}
+	select {
+	case s.queue <- msg:
+		o.sessionsMu.Unlock()
+		return nil
+	default:
+	}
+	o.sessionsMu.Unlock()
+
+	// 队列满了, 不持有锁等待. 有发送方在等待时队列不会变空, 会话不会因为空闲退出
+	select {
+	case <-o.stop:
+		return errors.ErrorStopped
+	case s.queue <- msg:
+		return nil
+	}
+}
+
+// CloseConnection 会话发完之前的请求后关闭连接, 之后同一个 ConnectionID 的请求使用新的会话
+func (o *HTTPOutput) CloseConnection(connectionID string) {
+	if !o.Config.Session {
+		return
+	}
+
+	o.sessionsMu.Lock()
+	s, ok := o.sessions[connectionID]
+	delete(o.sessions, connectionID)
+	o.sessionsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case <-o.stop:
+	case s.queue <- &Message{ConnectionID: connectionID, ConnectionClosed: true}:
+	}
+}
+
+// runSession 按顺序发送会话的请求, 录制的连接关闭或者空闲超过 SessionTimeout 后关闭连接退出
+func (o *HTTPOutput) runSession(id string, s *httpSession) {
+	defer s.client.Client.CloseIdleConnections()
+
+	idle := time.NewTimer(o.Config.SessionTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-o.stop:
+			return
+		case msg := <-s.queue:
+			if msg.ConnectionClosed {
+				return
+			}
+			o.sendRequest(s.client, msg)
+		case <-idle.C:
+			o.sessionsMu.Lock()
+			if o.sessions[id] == s && len(s.queue) == 0 {
+				delete(o.sessions, id)
+				o.sessionsMu.Unlock()
+				return
+			}
+			// 已经 CloseConnection 的会话等待关闭的消息
+			o.sessionsMu.Unlock()
+		}
+
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(o.Config.SessionTimeout)
+	}
+}
+
+// sessionCount 正在回放的录制连接数
+func (o *HTTPOutput) sessionCount() int {
+	o.sessionsMu.Lock()
+	defer o.sessionsMu.Unlock()
+
+	return len(o.sessions)
+}
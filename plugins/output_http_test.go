@@ -1,13 +1,19 @@
 package plugins
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/suite"
 
 	"goreplay/config"
+	"goreplay/protocol"
 )
 
 type httpOutputSuite struct {
@@ -145,3 +151,105 @@ func (s *httpOutputSuite) TestSend() {
 		})
 	}
 }
+
+func (s *httpOutputSuite) TestSession() {
+	var (
+		mu     sync.Mutex
+		paths  = make(map[string][]string) // 按服务端看到的连接
+		closed = make(map[string]bool)
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.RemoteAddr] = append(paths[r.RemoteAddr], r.URL.Path)
+		mu.Unlock()
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			mu.Lock()
+			closed[c.RemoteAddr().String()] = true
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &config.HTTPOutputConfig{Session: true, WorkersMin: 4}).(*HTTPOutput)
+	defer output.Close()
+	request := func(conn, path string) {
+		_, err := output.PluginWrite(&Message{ConnectionID: conn, Data: []byte("GET " + path + " HTTP/1.1\r\n\r\n"),
+			Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 0)})
+		s.Require().NoError(err)
+	}
+	conns := func() map[string][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := make(map[string][]string, len(paths))
+		for addr, p := range paths {
+			got[addr] = append([]string(nil), p...)
+		}
+		return got
+	}
+	connOf := func(path string) string {
+		for addr, p := range conns() {
+			for _, item := range p {
+				if item == path {
+					return addr
+				}
+			}
+		}
+		return ""
+	}
+
+	for i := 0; i < 5; i++ {
+		request("a", "/a"+strconv.Itoa(i))
+		request("b", "/b"+strconv.Itoa(i))
+	}
+	s.Eventually(func() bool { return len(conns()[connOf("/a4")]) == 5 && connOf("/b4") != "" }, time.Second,
+		time.Millisecond)
+	s.Equal([]string{"/a0", "/a1", "/a2", "/a3", "/a4"}, conns()[connOf("/a0")])
+	s.Equal([]string{"/b0", "/b1", "/b2", "/b3", "/b4"}, conns()[connOf("/b0")])
+	s.Equal(2, output.sessionCount())
+
+	// 录制的连接关闭后, 回放的连接也关闭, 之后的请求使用新的连接
+	first := connOf("/a0")
+	output.CloseConnection("a")
+	output.CloseConnection("a")
+	s.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return closed[first]
+	}, time.Second, time.Millisecond)
+	request("a", "/a5")
+	s.Eventually(func() bool { return connOf("/a5") != "" }, time.Second, time.Millisecond)
+	s.NotEqual(first, connOf("/a5"))
+	s.NotEqual(connOf("/b0"), connOf("/a5"))
+}
+
+func (s *httpOutputSuite) TestRewriteCookies() {
+	cookies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies <- r.Header.Get("Cookie")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "replayed"})
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &config.HTTPOutputConfig{Session: true, RewriteCookies: true}).(*HTTPOutput)
+	defer output.Close()
+	write := func(payloadType byte, id, data string) {
+		_, err := output.PluginWrite(&Message{ConnectionID: "a", SrcAddr: "10.0.0.1", Data: []byte(data),
+			Meta: protocol.PayloadHeader(payloadType, []byte(id), 1, 0)})
+		s.Require().NoError(err)
+	}
+
+	write(protocol.RequestPayload, "1", "POST /login HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	write(protocol.ResponsePayload, "1", "HTTP/1.1 200 OK\r\nSet-Cookie: session=recorded\r\nContent-Length: 0\r\n\r\n")
+	s.Equal("", <-cookies)
+	// 等到回放的响应和录制的响应配对
+	s.Eventually(func() bool {
+		return string(output.rewriter.Rewrite("10.0.0.1", []byte("GET / HTTP/1.1\r\nCookie: session=recorded\r\n\r\n"))) ==
+			"GET / HTTP/1.1\r\nCookie: session=replayed\r\n\r\n"
+	}, time.Second, time.Millisecond)
+	write(protocol.RequestPayload, "2", "GET /account HTTP/1.1\r\nCookie: session=recorded\r\n\r\n")
+	s.Equal("session=replayed", <-cookies)
+}
@@ -19,8 +19,11 @@ import (
 	"goreplay/errors"
 	"goreplay/logger"
 	"goreplay/logreplay"
+	"goreplay/message"
+	"goreplay/protobuf"
 	"goreplay/protocol"
 	"goreplay/remote"
+	"goreplay/spool"
 
 	"github.com/coocood/freecache"
 	jsoniter "github.com/json-iterator/go"
@@ -33,6 +36,10 @@ const (
 	cacheSizeMin     = 100
 	recordLimit      = 10000
 	defaultQPSLimit  = 10
+	reportBatchSize  = 100
+
+	spoolMinBackoff = time.Second
+	spoolMaxBackoff = time.Minute
 
 	goreplay              = "goreplay"
 	localhost             = "127.0.0.1"
@@ -58,19 +65,25 @@ const (
 type LogReplayOutput struct {
 	address                                string
 	conf                                   *config.LogReplayOutputConfig
-	tcpClient                              *client.TCPClient
+	replayClients                          chan *client.TCPClient
 	cache                                  *freecache.Cache
 	buf                                    []chan *Message
 	responses                              chan *response
 	stop                                   chan bool // Channel used only to indicate goroutine should shutdown
 	target                                 string
 	recordNum                              uint32 // 已上报的总数
+	reportFail                             uint32 // 上报失败的总数
 	curQPS                                 uint32
 	taskID                                 uint32
 	success, dialFail, writeFail, readFail uint32
 	reportBuf                              chan logreplay.ReportItem
+	spool                                  *spool.Spool   // 不为空时先写入磁盘队列, 再从队列上报
+	reporters                              sync.WaitGroup // 退出时等待上报和写入磁盘队列
 	lastSampleTime                         int64
 	json                                   jsoniter.API
+	limitOnce                              sync.Once
+	metrics                                *outputMetrics
+	protobuf                               *protobuf.Registry // protobuf SerializeType 为 pb 时解码 grpc 消息
 }
 
 // NewLogReplayOutput constructor for LogReplayOutput
@@ -99,16 +112,31 @@ func NewLogReplayOutput(address string, conf *config.LogReplayOutputConfig) Plug
 	}
 
 	if conf.Target != "" {
-		tcpClient := client.NewTCPClient(conf.Target, &client.TCPClientConfig{
-			Debug:   true,
-			Timeout: o.conf.TargetTimeout,
-		})
-		o.tcpClient = tcpClient
+		// every worker may replay at the same time, TCPClient is not safe for concurrent use
+		o.replayClients = make(chan *client.TCPClient, o.conf.Workers)
+		for i := 0; i < o.conf.Workers; i++ {
+			o.replayClients <- client.NewTCPClient(conf.Target, &client.TCPClientConfig{
+				Debug:   true,
+				Timeout: o.conf.TargetTimeout,
+			})
+		}
 	}
 
 	o.reportBuf = make(chan logreplay.ReportItem)
 	o.stop = make(chan bool)
+	if conf.SpoolDir != "" {
+		if o.spool, err = spool.Open(conf.SpoolDir, int64(conf.SpoolSize)); err != nil {
+			logger.Fatal("[LOGREPLAY-OUTPUT] open spool error: ", err)
+		}
+		logger.Info("[LOGREPLAY-OUTPUT] spooled records to report: ", o.spool.Len())
+
+		o.reporters.Add(1)
+		go o.drainSpool()
+	}
 	o.cache = freecache.NewCache(conf.CacheSize * 1024 * 1024)
+	if conf.SerializeType == config.SerializeTypePB {
+		o.protobuf = newGRPCDecoder(conf.Protobuf).registry
+	}
 
 	o.buf = make([]chan *Message, o.conf.Workers)
 	for i := 0; i < o.conf.Workers; i++ {
@@ -116,7 +144,10 @@ func NewLogReplayOutput(address string, conf *config.LogReplayOutputConfig) Plug
 		go o.startWorker(i)
 	}
 
+	o.registerMetrics()
+
 	for i := 0; i < 5; i++ {
+		o.reporters.Add(1)
 		go o.startReporter()
 	}
 
@@ -259,10 +290,49 @@ func (o *LogReplayOutput) createTask() (uint32, error) {
 	return rsp.TaskID, nil
 }
 
+// registerMetrics 注册指标, logreplay 以 module_id 区分
+func (o *LogReplayOutput) registerMetrics() {
+	module := o.conf.ModuleID
+	o.metrics = newOutputMetrics("logreplay", module, func() float64 {
+		var n int
+		for _, buf := range o.buf {
+			n += len(buf)
+		}
+		return float64(n)
+	}, func() float64 {
+		return float64(o.conf.Workers)
+	})
+
+	for result, counter := range map[string]*uint32{
+		"success": &o.success, "dial_fail": &o.dialFail, "write_fail": &o.writeFail, "read_fail": &o.readFail,
+	} {
+		counter := counter
+		logreplayReplayMetric.Func(func() float64 {
+			return float64(atomic.LoadUint32(counter))
+		}, module, result)
+	}
+
+	logreplayReportMetric.Func(func() float64 {
+		return float64(atomic.LoadUint32(&o.recordNum))
+	}, module, "success")
+	logreplayReportMetric.Func(func() float64 {
+		return float64(atomic.LoadUint32(&o.reportFail))
+	}, module, "failure")
+
+	if o.spool != nil {
+		logreplaySpoolRecordsMetric.Func(func() float64 {
+			return float64(o.spool.Len())
+		}, module)
+		logreplaySpoolBytesMetric.Func(func() float64 {
+			return float64(o.spool.Size())
+		}, module)
+	}
+}
+
 func (o *LogReplayOutput) startWorker(bufferIndex int) {
 	for {
 		if atomic.LoadUint32(&o.recordNum) > uint32(o.conf.RecordLimit) {
-			logger.Fatal("[LOGREPLAY-OUTPUT] already access record max limit: ", o.conf.RecordLimit)
+			o.limitOnce.Do(o.exitRecordLimit)
 			return
 		}
 		msg := <-o.buf[bufferIndex]
@@ -275,7 +345,23 @@ func (o *LogReplayOutput) startWorker(bufferIndex int) {
 	}
 }
 
+// exitRecordLimit 录制达到上限, 通知后退出
+func (o *LogReplayOutput) exitRecordLimit() {
+	_ = message.Notify(&message.Notice{
+		Title: "goreplay 录制达到上限",
+		Content: fmt.Sprintf("module_id:<font color=\"comment\">%s</font>\n已经录制了 %d 条, "+
+			"达到 output-logreplay-record-limit: %d, goreplay 退出", o.conf.ModuleID,
+			atomic.LoadUint32(&o.recordNum), o.conf.RecordLimit),
+		Level: message.LevelWarn,
+	})
+
+	logger.Error("[LOGREPLAY-OUTPUT] already access record max limit: ", o.conf.RecordLimit)
+	os.Exit(1)
+}
+
 func (o *LogReplayOutput) startReporter() {
+	defer o.reporters.Done()
+
 	rp := &Reporter{
 		items: []logreplay.ReportItem{},
 		timer: time.NewTicker(3 * time.Second),
@@ -288,17 +374,105 @@ func (o *LogReplayOutput) startReporter() {
 
 func (o *LogReplayOutput) report(items []logreplay.ReportItem) {
 	if len(items) > 0 {
-		rsp := &logreplay.ReportRsp{}
-		err := o.send(logreplay.ReportURL, &logreplay.ReportData{Batch: items}, rsp)
-		if err != nil {
+		if err := o.sendReport(items); err != nil {
+			atomic.AddUint32(&o.reportFail, uint32(len(items)))
 			logger.Warn("[LOGREPLAY-OUTPUT] report LogReplay error: ", err)
+		}
+	}
+}
+
+// sendReport 上报一批记录, 网关返回后统计成功和失败的数量
+func (o *LogReplayOutput) sendReport(items []logreplay.ReportItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	rsp := &logreplay.ReportRsp{}
+	if err := o.send(logreplay.ReportURL, &logreplay.ReportData{Batch: items}, rsp); err != nil {
+		return err
+	}
+
+	atomic.AddUint32(&o.recordNum, uint32(rsp.Succeed))
+	if failed := len(items) - rsp.Succeed; failed > 0 {
+		atomic.AddUint32(&o.reportFail, uint32(failed))
+	}
+	logger.Info("[LOGREPLAY-OUTPUT] 上报总数: ", atomic.LoadUint32(&o.recordNum))
+	logger.Debug2("[LOGREPLAY-OUTPUT] report rsp ", rsp)
+
+	return nil
+}
+
+// spoolItems 记录写入磁盘队列, 队列满时丢弃并计入上报失败
+func (o *LogReplayOutput) spoolItems(items []logreplay.ReportItem) {
+	var lastErr error
+	dropped := 0
+	for _, item := range items {
+		data, err := o.json.Marshal(item)
+		if err == nil {
+			err = o.spool.Put(data)
+		}
+		if err != nil {
+			lastErr = err
+			dropped++
+		}
+	}
+
+	if dropped > 0 {
+		atomic.AddUint32(&o.reportFail, uint32(dropped))
+		logger.Warn(fmt.Sprintf("[LOGREPLAY-OUTPUT] %d records not spooled: %v", dropped, lastErr))
+	}
+}
+
+// drainSpool 按顺序上报磁盘队列中的记录, 失败后指数退避重试
+func (o *LogReplayOutput) drainSpool() {
+	defer o.reporters.Done()
+
+	backoff := spoolMinBackoff
+	for {
+		wait := time.Second
+		n, err := o.reportSpool()
+		switch {
+		case err != nil:
+			logger.Warn(fmt.Sprintf("[LOGREPLAY-OUTPUT] report spooled records error, retry in %s: %v", backoff, err))
+			wait = backoff
+			if backoff *= 2; backoff > spoolMaxBackoff {
+				backoff = spoolMaxBackoff
+			}
+		case n > 0:
+			backoff = spoolMinBackoff
+			wait = 0
+		}
+
+		select {
+		case <-o.stop:
 			return
+		case <-time.After(wait):
 		}
+	}
+}
 
-		atomic.AddUint32(&o.recordNum, uint32(rsp.Succeed))
-		logger.Info("[LOGREPLAY-OUTPUT] 上报总数: ", o.recordNum)
-		logger.Debug2("[LOGREPLAY-OUTPUT] report rsp ", rsp)
+// reportSpool 上报磁盘队列中最早的一批记录, 网关返回后才提交, 返回提交的数量
+func (o *LogReplayOutput) reportSpool() (int, error) {
+	records, err := o.spool.Peek(reportBatchSize)
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+
+	items := make([]logreplay.ReportItem, 0, len(records))
+	for _, record := range records {
+		var item logreplay.ReportItem
+		if err = o.json.Unmarshal(record, &item); err != nil {
+			logger.Warn("[LOGREPLAY-OUTPUT] skip invalid spooled record: ", err)
+			continue
+		}
+		items = append(items, item)
 	}
+
+	if err = o.sendReport(items); err != nil {
+		return 0, err
+	}
+
+	return len(records), o.spool.Commit(len(records))
 }
 
 func (o *LogReplayOutput) isQPSOver() bool {
@@ -386,8 +560,11 @@ func (o *LogReplayOutput) doReplay(msg *Message, header codec.ProtocolHeader) []
 			return nil
 		}
 
-		// TODO tcp send repalay data
-		var err error
+		start := time.Now()
+		rsp, err := o.replay(msg.Data)
+		stop := time.Now()
+		o.metrics.observe(stop.Sub(start), err)
+
 		switch dispatchSendErr(err) {
 		case sendSucc:
 			atomic.AddUint32(&o.success, 1)
@@ -402,9 +579,16 @@ func (o *LogReplayOutput) doReplay(msg *Message, header codec.ProtocolHeader) []
 		if err != nil {
 			logger.Debug3("[LOGREPLAY-OUTPUT]  Request error:", err, " body: ",
 				hex.EncodeToString(msg.Data), "meta: ", string(msg.Meta))
+
+			return nil
 		}
 
-		return nil
+		if o.conf.TrackResponses {
+			o.responses <- &response{rsp, protocol.PayloadID(msg.Meta), start.UnixNano(),
+				stop.UnixNano() - start.UnixNano()}
+		}
+
+		return rsp
 	}
 
 	return nil
@@ -453,6 +637,9 @@ func (o *LogReplayOutput) parseResponse(msg *Message, cacheReq []byte,
 	tag["serverAddr"] = strings.Join(config.Settings.InputRAW, ";")
 	tag["clientAddr"] = msg.SrcAddr
 
+	if o.protobuf != nil {
+		o.decodeProtobuf(data, cacheReq, msg.Data)
+	}
 	data.RequestBytes = o.appendAfterClientPreface(cacheReq)
 	cacheReplayResponse, _ := o.cache.Get(getReqRspKey(uuidStr))
 	data.ReplayBytes = cacheReplayResponse
@@ -461,6 +648,24 @@ func (o *LogReplayOutput) parseResponse(msg *Message, cacheReq []byte,
 	return data, nil
 }
 
+// decodeProtobuf 把 grpc 请求和响应解码到记录的 Request 和 Response, 失败时只有二进制
+func (o *LogReplayOutput) decodeProtobuf(data *logreplay.GoReplayMessage, req, resp []byte) {
+	request, err := o.protobuf.DecodeRequest(req)
+	if err != nil {
+		logger.Debug2("[LOGREPLAY-OUTPUT] decode grpc request error: ", err)
+		return
+	}
+	path, _ := request["path"].(string)
+	response, err := o.protobuf.DecodeResponse(path, resp)
+	if err != nil {
+		logger.Debug2("[LOGREPLAY-OUTPUT] decode grpc response error: ", err)
+		return
+	}
+
+	data.Request, data.Response = request, response
+	data.SerializeType = o.conf.SerializeType
+}
+
 func (o *LogReplayOutput) appendAfterClientPreface(src []byte) []byte {
 	if o.conf.Protocol != codec.GrpcName {
 		return src
@@ -589,8 +794,15 @@ func (o *LogReplayOutput) String() string {
 }
 
 // Close closes the data channel so that data
+// 等待 Reporter 上报或写入磁盘队列中剩下的记录
 func (o *LogReplayOutput) Close() error {
 	close(o.stop)
+	o.metrics.close()
+	o.reporters.Wait()
+	if o.spool != nil {
+		return o.spool.Close()
+	}
+
 	return nil
 }
 
@@ -619,24 +831,6 @@ func checkAddress(address string) {
 	}
 }
 
-// 发送错误归类
-func dispatchSendErr(err error) SendError {
-	if err == nil {
-		return sendSucc
-	}
-
-	if isWriteError(err) {
-		return writeError
-	}
-
-	return readError
-}
-
-func isWriteError(err error) bool {
-
-	return false
-}
-
 // Reporter reports the data to logreplay
 type Reporter struct {
 	items []logreplay.ReportItem
@@ -655,7 +849,7 @@ func (r *Reporter) run() {
 		case item, isOpen := <-r.o.reportBuf:
 			if isOpen {
 				r.items = append(r.items, item)
-				if len(r.items) > 100 {
+				if len(r.items) > reportBatchSize {
 					r.commit()
 				}
 			} else {
@@ -666,6 +860,10 @@ func (r *Reporter) run() {
 			}
 		case <-r.timer.C:
 			r.commit()
+		case <-r.o.stop:
+			r.timer.Stop()
+			stop = true
+			r.commit()
 		}
 	}
 }
@@ -675,7 +873,11 @@ func (r *Reporter) commit() {
 	defer r.lock.Unlock()
 	reqs := r.items
 
-	r.o.report(reqs)
+	if r.o.spool != nil {
+		r.o.spoolItems(reqs)
+	} else {
+		r.o.report(reqs)
+	}
 	r.items = make([]logreplay.ReportItem, 0)
 }
 
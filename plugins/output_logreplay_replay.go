@@ -0,0 +1,180 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/http2"
+
+	"goreplay/client"
+	"goreplay/codec"
+	"goreplay/framer"
+)
+
+const http2FrameHeaderLen = 9
+
+// replay sends a recorded request to the replay target and returns its response
+func (o *LogReplayOutput) replay(data []byte) ([]byte, error) {
+	c := <-o.replayClients
+	defer func() {
+		o.replayClients <- c
+	}()
+
+	switch o.conf.Protocol {
+	case codec.GrpcName:
+		streamID := http2StreamID(data)
+		if streamID == 0 {
+			return nil, &client.OpError{Op: client.OpWrite, Err: fmt.Errorf("no http2 stream found in request")}
+		}
+
+		// captured stream ids and header blocks only make sense on a new connection
+		defer c.Disconnect()
+
+		return c.RoundTrip(o.appendAfterClientPreface(data), readGrpcResponse(streamID))
+	default:
+		read := protocolResponseReader(o.conf.Protocol, data)
+		if read == nil {
+			read = readRawResponse
+		}
+
+		return c.RoundTrip(data, read)
+	}
+}
+
+// readGrpcResponse collects the raw frames of streamID until the server ends the stream.
+// Connection level frames are answered so that the server keeps sending.
+func readGrpcResponse(streamID uint32) client.ResponseReader {
+	return func(r *bufio.Reader, w io.Writer) ([]byte, error) {
+		var (
+			rsp   bytes.Buffer
+			ended bool
+		)
+
+		fw := http2.NewFramer(w, nil)
+		for {
+			raw, fh, err := readHTTP2Frame(r)
+			if err != nil {
+				return nil, err
+			}
+
+			if fh.StreamID == 0 {
+				if err = answerHTTP2ConnFrame(fw, fh, raw[http2FrameHeaderLen:]); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			if fh.StreamID != streamID {
+				continue
+			}
+
+			rsp.Write(raw)
+
+			switch fh.Type {
+			case http2.FrameRSTStream:
+				return rsp.Bytes(), nil
+			case http2.FrameData:
+				// give the window back, big responses would stall otherwise
+				if fh.Length > 0 {
+					_ = fw.WriteWindowUpdate(0, fh.Length)
+					_ = fw.WriteWindowUpdate(streamID, fh.Length)
+				}
+
+				if fh.Flags.Has(http2.FlagDataEndStream) {
+					return rsp.Bytes(), nil
+				}
+			case http2.FrameHeaders:
+				ended = fh.Flags.Has(http2.FlagHeadersEndStream)
+				if ended && fh.Flags.Has(http2.FlagHeadersEndHeaders) {
+					return rsp.Bytes(), nil
+				}
+			case http2.FrameContinuation:
+				if ended && fh.Flags.Has(http2.FlagContinuationEndHeaders) {
+					return rsp.Bytes(), nil
+				}
+			}
+		}
+	}
+}
+
+// answerHTTP2ConnFrame acks SETTINGS and PING, and fails on GOAWAY
+func answerHTTP2ConnFrame(fw *http2.Framer, fh http2.FrameHeader, payload []byte) error {
+	switch fh.Type {
+	case http2.FrameSettings:
+		if !fh.Flags.Has(http2.FlagSettingsAck) {
+			return fw.WriteSettingsAck()
+		}
+	case http2.FramePing:
+		if !fh.Flags.Has(http2.FlagPingAck) && len(payload) == 8 {
+			var data [8]byte
+			copy(data[:], payload)
+
+			return fw.WritePing(true, data)
+		}
+	case http2.FrameGoAway:
+		return fmt.Errorf("http2 goaway received")
+	}
+
+	return nil
+}
+
+// readHTTP2Frame reads one frame, returning it raw together with its parsed header
+func readHTTP2Frame(r io.Reader) ([]byte, http2.FrameHeader, error) {
+	hdr := make([]byte, http2FrameHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, http2.FrameHeader{}, err
+	}
+
+	fh, err := http2.ReadFrameHeader(bytes.NewReader(hdr))
+	if err != nil {
+		return nil, fh, err
+	}
+
+	raw := make([]byte, http2FrameHeaderLen+int(fh.Length))
+	copy(raw, hdr)
+	if _, err = io.ReadFull(r, raw[http2FrameHeaderLen:]); err != nil {
+		return nil, fh, err
+	}
+
+	return raw, fh, nil
+}
+
+// http2StreamID returns the first non zero stream id of the payload
+func http2StreamID(payload []byte) uint32 {
+	fr := framer.NewHTTP2Framer(payload, "", false)
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			return 0
+		}
+
+		if frame.Header().StreamID > 0 {
+			return frame.Header().StreamID
+		}
+	}
+}
+
+// dispatchSendErr 发送错误归类
+func dispatchSendErr(err error) SendError {
+	if err == nil {
+		return sendSucc
+	}
+
+	var opErr *client.OpError
+	if !errors.As(err, &opErr) {
+		return readError
+	}
+
+	switch opErr.Op {
+	case client.OpDial:
+		return dialError
+	case client.OpWrite:
+		return writeError
+	default:
+		return readError
+	}
+}
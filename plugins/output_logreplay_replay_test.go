@@ -0,0 +1,222 @@
+package plugins
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"goreplay/codec"
+	"goreplay/config"
+	"goreplay/protocol"
+)
+
+// TestUnitLogreplayReplay logreplay replay unit test execute
+func TestUnitLogreplayReplay(t *testing.T) {
+	suite.Run(t, new(logreplayReplaySuite))
+}
+
+type logreplayReplaySuite struct {
+	suite.Suite
+}
+
+func (s *logreplayReplaySuite) newOutput(proto, target string) *LogReplayOutput {
+	return NewLogReplayOutput("", &config.LogReplayOutputConfig{
+		ModuleID:            "1",
+		APPKey:              "1",
+		APPID:               "1",
+		Protocol:            proto,
+		CommitID:            "1",
+		Target:              target,
+		TargetTimeout:       time.Second,
+		GatewayAddr:         localhostGateway,
+		ProtocolServiceName: "svc1",
+	}).(*LogReplayOutput)
+}
+
+func (s *logreplayReplaySuite) TestHTTPReplay() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("echo:"), body...))
+	}))
+	defer server.Close()
+
+	o := s.newOutput(codec.HTTPName, server.Listener.Addr().String())
+	defer o.Close()
+
+	msg := &Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 1),
+		Data: []byte("POST /echo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nhi"),
+	}
+
+	for i := 0; i < 2; i++ {
+		rsp := o.doReplay(msg, codec.ProtocolHeader{})
+		s.True(bytes.HasPrefix(rsp, []byte("HTTP/1.1 200 OK")), string(rsp))
+		s.True(bytes.HasSuffix(rsp, []byte("echo:hi")), string(rsp))
+	}
+	s.Equal(uint32(2), o.success)
+}
+
+func (s *logreplayReplaySuite) TestGrpcReplay() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer ln.Close()
+
+	h2 := &http2.Server{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/grpc")
+		w.Header().Set("Trailer", "grpc-status")
+		_, _ = w.Write([]byte{0, 0, 0, 0, 1, 'x'})
+		w.Header().Set("grpc-status", "0")
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go h2.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	o := s.newOutput(codec.GrpcName, ln.Addr().String())
+	defer o.Close()
+
+	msg := &Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 1),
+		Data: grpcRequest(s, 3),
+	}
+
+	rsp := o.doReplay(msg, codec.ProtocolHeader{MethodName: "SayHello"})
+	s.NotEmpty(rsp)
+	s.Equal(uint32(1), o.success)
+
+	// every frame of the response belongs to the replayed stream
+	fr := http2.NewFramer(nil, bytes.NewReader(rsp))
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			break
+		}
+		s.Equal(uint32(3), f.Header().StreamID)
+	}
+}
+
+func (s *logreplayReplaySuite) TestThriftReplay() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer ln.Close()
+
+	// framed, strict binary reply of "add" seqid 1, written in two parts
+	reply := []byte{0, 0, 0, 16, 0x80, 0x01, 0, 0x02, 0, 0, 0, 3, 'a', 'd', 'd', 0, 0, 0, 1, 0}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 1024)
+		for {
+			if _, err = conn.Read(buf); err != nil {
+				return
+			}
+			_, _ = conn.Write(reply[:10])
+			time.Sleep(10 * time.Millisecond)
+			_, _ = conn.Write(reply[10:])
+		}
+	}()
+
+	o := s.newOutput(codec.ThriftName, ln.Addr().String())
+	defer o.Close()
+
+	rsp := o.doReplay(&Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 1),
+		Data: []byte{0, 0, 0, 16, 0x80, 0x01, 0, 0x01, 0, 0, 0, 3, 'a', 'd', 'd', 0, 0, 0, 1, 0},
+	}, codec.ProtocolHeader{})
+	s.Equal(reply, rsp)
+	s.Equal(uint32(1), o.success)
+}
+
+func (s *logreplayReplaySuite) TestRedisReplay() {
+	ln := startRedisServer(&s.Suite)
+	defer ln.Close()
+
+	o := s.newOutput(codec.RedisName, ln.Addr().String())
+	defer o.Close()
+
+	for i := 0; i < 2; i++ {
+		rsp := o.doReplay(&Message{
+			Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 1),
+			Data: []byte("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"),
+		}, codec.ProtocolHeader{})
+		s.Equal("+GET\r\n", string(rsp))
+	}
+	s.Equal(uint32(2), o.success)
+}
+
+func (s *logreplayReplaySuite) TestReplayDialFail() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	o := s.newOutput(codec.HTTPName, addr)
+	defer o.Close()
+
+	rsp := o.doReplay(&Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 1),
+		Data: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+	}, codec.ProtocolHeader{})
+
+	s.Nil(rsp)
+	s.Equal(uint32(0), o.success)
+	s.Equal(uint32(1), o.dialFail)
+}
+
+func (s *logreplayReplaySuite) TestGrpcMethodFilter() {
+	o := s.newOutput(codec.GrpcName, "127.0.0.1:1")
+	o.conf.GrpcReplayMethodName = "SayHello"
+	defer o.Close()
+
+	rsp := o.doReplay(&Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 1),
+		Data: grpcRequest(s, 1),
+	}, codec.ProtocolHeader{MethodName: "SayBye"})
+
+	s.Nil(rsp)
+	s.Equal(uint32(0), o.dialFail)
+}
+
+// grpcRequest builds the frames of a unary grpc call on streamID
+func grpcRequest(s *logreplayReplaySuite, streamID uint32) []byte {
+	var hbuf, buf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	for _, hf := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/helloworld.Greeter/SayHello"},
+		{Name: ":authority", Value: "localhost"},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "te", Value: "trailers"},
+	} {
+		s.Require().NoError(enc.WriteField(hf))
+	}
+
+	fr := http2.NewFramer(&buf, nil)
+	s.Require().NoError(fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+	}))
+	s.Require().NoError(fr.WriteData(streamID, true, []byte{0, 0, 0, 0, 1, 'y'}))
+
+	return buf.Bytes()
+}
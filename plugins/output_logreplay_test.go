@@ -3,13 +3,17 @@ package plugins
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/coocood/freecache"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 
@@ -18,6 +22,7 @@ import (
 	"goreplay/codec/mocks"
 	"goreplay/config"
 	"goreplay/logreplay"
+	"goreplay/spool"
 )
 
 const localhostGateway = "127.0.0.1:80"
@@ -380,3 +385,81 @@ func (s *logreplaySuite) TestRspUnmarshal() {
 		s.T().Logf("rsp: %+v; error: %v", rsp, err)
 	})
 }
+
+// TestUnitLogreplaySpool logreplay spool unit test execute
+func TestUnitLogreplaySpool(t *testing.T) {
+	suite.Run(t, new(logreplaySpoolSuite))
+}
+
+type logreplaySpoolSuite struct {
+	suite.Suite
+}
+
+func (s *logreplaySpoolSuite) newSpoolOutput(dir string) *LogReplayOutput {
+	sp, err := spool.Open(dir, 1<<20)
+	s.Require().NoError(err)
+
+	return &LogReplayOutput{
+		json:      jsoniter.ConfigCompatibleWithStandardLibrary,
+		spool:     sp,
+		stop:      make(chan bool),
+		reportBuf: make(chan logreplay.ReportItem),
+	}
+}
+
+func (s *logreplaySpoolSuite) TestReportSpool() {
+	o := s.newSpoolOutput(s.T().TempDir())
+	o.spoolItems([]logreplay.ReportItem{{Type: reportType, Data: "1"}, {Type: reportType, Data: "2"}})
+	s.Equal(2, o.spool.Len())
+
+	var sent []logreplay.ReportItem
+	fail := true
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data := &logreplay.ReportData{}
+		s.Require().NoError(json.NewDecoder(r.Body).Decode(data))
+		sent = append(sent, data.Batch...)
+		_ = json.NewEncoder(w).Encode(&logreplay.ReportRsp{Succeed: len(data.Batch)})
+	}))
+	defer gateway.Close()
+
+	conf := &config.Settings.OutputLogReplayConfig
+	defer func(addr string) { conf.GatewayAddr = addr }(conf.GatewayAddr)
+	conf.GatewayAddr = strings.TrimPrefix(gateway.URL, "http://")
+
+	// 网关不可用时记录留在队列中
+	n, err := o.reportSpool()
+	s.Error(err)
+	s.Equal(0, n)
+	s.Equal(2, o.spool.Len())
+
+	fail = false
+	n, err = o.reportSpool()
+	s.NoError(err)
+	s.Equal(2, n)
+	s.Equal(0, o.spool.Len())
+	s.Equal([]logreplay.ReportItem{{Type: reportType, Data: "1"}, {Type: reportType, Data: "2"}}, sent)
+	s.Equal(uint32(2), o.recordNum)
+	s.NoError(o.spool.Close())
+}
+
+func (s *logreplaySpoolSuite) TestCloseSpoolsPending() {
+	dir := s.T().TempDir()
+	o := s.newSpoolOutput(dir)
+	o.reporters.Add(1)
+	go o.startReporter()
+
+	o.reportBuf <- logreplay.ReportItem{Type: reportType, Data: "pending"}
+	s.NoError(o.Close())
+
+	// 重启后继续上报退出时没有上报的记录
+	sp, err := spool.Open(dir, 1<<20)
+	s.Require().NoError(err)
+	records, err := sp.Peek(10)
+	s.Require().NoError(err)
+	s.Equal([][]byte{[]byte(`{"type":"goReplay","data":"pending"}`)}, records)
+	s.NoError(sp.Close())
+}
@@ -0,0 +1,175 @@
+package plugins
+
+import (
+	"hash/fnv"
+	"time"
+
+	"goreplay/client"
+	"goreplay/config"
+	"goreplay/errors"
+	"goreplay/framer"
+	"goreplay/logger"
+	"goreplay/protocol"
+)
+
+// MySQLOutput plugin replays recorded mysql commands against a staging database. Commands of a
+// recorded connection go to the same worker, one connection each, so that they keep their order
+// and prepared statements. By default only read-only statements are replayed.
+type MySQLOutput struct {
+	address   string
+	queues    []chan *Message
+	responses chan response
+	quit      chan struct{}
+	config    *config.MySQLOutputConfig
+	metrics   *outputMetrics
+}
+
+// NewMySQLOutput constructor for MySQLOutput
+// Initialize workers
+func NewMySQLOutput(address string, config *config.MySQLOutputConfig) PluginReadWriter {
+	o := new(MySQLOutput)
+
+	o.address = address
+	o.config = config
+
+	if o.config.Workers <= 0 {
+		o.config.Workers = 1
+	}
+
+	o.queues = make([]chan *Message, o.config.Workers)
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan struct{})
+	o.metrics = newOutputMetrics("mysql", address, func() float64 {
+		var n int
+		for _, queue := range o.queues {
+			n += len(queue)
+		}
+		return float64(n)
+	}, func() float64 {
+		return float64(o.config.Workers)
+	})
+
+	for i := range o.queues {
+		o.queues[i] = make(chan *Message, 1000)
+		go o.startWorker(o.queues[i])
+	}
+
+	return o
+}
+
+func (o *MySQLOutput) startWorker(queue chan *Message) {
+	mysqlClient := client.NewMySQLClient(o.address, &client.MySQLClientConfig{
+		User:     o.config.User,
+		Password: o.config.Password,
+		Database: o.config.Database,
+		Timeout:  o.config.Timeout,
+	})
+	defer mysqlClient.Disconnect()
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case msg := <-queue:
+			o.sendRequest(mysqlClient, msg)
+		}
+	}
+}
+
+// PluginWrite writes a message to this plugin
+func (o *MySQLOutput) PluginWrite(msg *Message) (n int, err error) {
+	if !protocol.IsRequestPayload(msg.Meta) {
+		return len(msg.Data), nil
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(msg.ConnectionID))
+	o.queues[h.Sum32()%uint32(len(o.queues))] <- msg
+
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// PluginRead reads a message from this plugin
+func (o *MySQLOutput) PluginRead() (*Message, error) {
+	var (
+		resp response
+		msg  Message
+	)
+
+	select {
+	case <-o.quit:
+		return nil, errors.ErrorStopped
+	case resp = <-o.responses:
+	}
+
+	msg.Data = resp.payload
+	msg.Meta = protocol.PayloadHeader(protocol.ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+
+	return &msg, nil
+}
+
+func (o *MySQLOutput) sendRequest(mysqlClient *client.MySQLClient, msg *Message) {
+	cmd, args, err := framer.MySQLCommand(msg.Data)
+	if err != nil {
+		logger.Debug("[OUTPUT-MYSQL] not a mysql command:", err)
+		return
+	}
+
+	sql, isStmt := framer.MySQLCommandSQL(cmd, args, msg.ConnectionID)
+	if !o.replayable(cmd, sql, isStmt) {
+		logger.Debug3("[OUTPUT-MYSQL] skip", framer.MySQLCommandName(cmd), sql)
+		return
+	}
+
+	uuid := protocol.PayloadID(msg.Meta)
+	start := time.Now()
+
+	var resp []byte
+	payload := append([]byte{cmd}, args...)
+	if cmd == framer.MySQLComStmtExecute {
+		resp, err = mysqlClient.Execute(sql, payload)
+	} else {
+		resp, err = mysqlClient.Command(payload)
+	}
+	if err != nil {
+		logger.Warn("[OUTPUT-MYSQL]Request error:", err)
+	}
+
+	stop := time.Now()
+	o.metrics.observe(stop.Sub(start), err)
+	if o.config.TrackResponses {
+		o.responses <- response{
+			payload:       resp,
+			uuid:          uuid,
+			startedAt:     start.UnixNano(),
+			roundTripTime: stop.UnixNano() - start.UnixNano(),
+		}
+	}
+}
+
+// replayable statements and pings, statements have to be read-only unless that check is turned
+// off. Executes of statements prepared before the recording started have no sql and are skipped.
+func (o *MySQLOutput) replayable(cmd byte, sql string, isStmt bool) bool {
+	if cmd == framer.MySQLComPing {
+		return true
+	}
+
+	if !isStmt {
+		return false
+	}
+
+	return !o.config.ReadOnly || framer.ParseSQL(sql).ReadOnly
+}
+
+// String output address
+func (o *MySQLOutput) String() string {
+	return "MySQL output: " + o.address
+}
+
+// Close closes this plugin for reading
+func (o *MySQLOutput) Close() error {
+	close(o.quit)
+	o.metrics.close()
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+	"goreplay/framer"
+	"goreplay/protocol"
+)
+
+// TestUnitMySQLOutput mysql output unit test execute
+func TestUnitMySQLOutput(t *testing.T) {
+	suite.Run(t, new(mysqlOutputSuite))
+}
+
+type mysqlOutputSuite struct {
+	suite.Suite
+}
+
+const (
+	mysqlTestScramble  = "abcdefghijklmnopqrst"
+	mysqlTestPassword  = "secret"
+	mysqlTestStmtID    = 42
+	mysqlTestOKPayload = "\x00\x00\x00\x02\x00\x00\x00"
+)
+
+func writeMySQLPacket(w io.Writer, seq byte, payload string) error {
+	n := len(payload)
+	_, err := w.Write(append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...))
+	return err
+}
+
+func readMySQLPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, framer.MySQLHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	_, err := io.ReadFull(r, payload)
+
+	return header[3], payload, err
+}
+
+// startMySQLServer logs in clients with mysqlTestPassword, answers ok to everything and
+// records the commands it gets
+func startMySQLServer(s *suite.Suite, commands chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+
+	caps := framer.MySQLClientProtocol41 | framer.MySQLClientSecureConnection | framer.MySQLClientPluginAuth
+	var greeting []byte
+	greeting = append(greeting, framer.MySQLHandshakeV10)
+	greeting = append(greeting, "8.0.30\x00\x01\x00\x00\x00"+mysqlTestScramble[:8]+"\x00"...)
+	greeting = append(greeting, byte(caps), byte(caps>>8), 45, 2, 0, byte(caps>>16), byte(caps>>24), 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, mysqlTestScramble[8:]+"\x00mysql_native_password\x00"...)
+
+	h1 := sha1.Sum([]byte(mysqlTestPassword))
+	h2 := sha1.Sum(h1[:])
+	h3 := sha1.Sum(append([]byte(mysqlTestScramble), h2[:]...))
+	for i := range h1 {
+		h1[i] ^= h3[i]
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				if writeMySQLPacket(conn, 0, string(greeting)) != nil {
+					return
+				}
+
+				_, resp, err := readMySQLPacket(conn)
+				if err != nil || !bytes.Contains(resp, append([]byte{byte(len(h1))}, h1[:]...)) {
+					_ = writeMySQLPacket(conn, 2, "\xff\x15\x04#28000Access denied")
+					return
+				}
+				if writeMySQLPacket(conn, 2, mysqlTestOKPayload) != nil {
+					return
+				}
+
+				serveMySQLCommands(conn, commands)
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func serveMySQLCommands(conn net.Conn, commands chan<- string) {
+	for {
+		_, payload, err := readMySQLPacket(conn)
+		if err != nil || len(payload) == 0 {
+			return
+		}
+
+		cmd := framer.MySQLCommandName(payload[0])
+		reply := mysqlTestOKPayload
+		switch payload[0] {
+		case framer.MySQLComQuery:
+			cmd = string(payload[1:])
+		case framer.MySQLComStmtPrepare:
+			cmd = "PREPARE " + string(payload[1:])
+			// statement id, no column, no param
+			reply = "\x00\x2a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+		case framer.MySQLComStmtExecute:
+			if binary.LittleEndian.Uint32(payload[1:]) != mysqlTestStmtID {
+				reply = "\xff\x13\x02#HY000Unknown prepared statement handler"
+			}
+		}
+
+		commands <- cmd
+		if writeMySQLPacket(conn, 1, reply) != nil {
+			return
+		}
+	}
+}
+
+func mysqlCommandMessage(payload string) *Message {
+	n := len(payload)
+	return &Message{
+		Meta:         protocol.PayloadHeader(protocol.RequestPayload, protocol.UUID(), 1, 1),
+		Data:         append([]byte{byte(n), byte(n >> 8), byte(n >> 16), 0}, payload...),
+		ConnectionID: "mysql-output-test",
+	}
+}
+
+func (s *mysqlOutputSuite) TestReadOnlyReplay() {
+	commands := make(chan string, 16)
+	ln := startMySQLServer(&s.Suite, commands)
+	defer ln.Close()
+
+	o := NewMySQLOutput(ln.Addr().String(), &config.MySQLOutputConfig{
+		User:           "gor",
+		Password:       mysqlTestPassword,
+		ReadOnly:       true,
+		Workers:        2,
+		Timeout:        time.Second,
+		TrackResponses: true,
+	}).(*MySQLOutput)
+	defer o.Close()
+
+	framer.PutMySQLStatement("mysql-output-test", 7, "SELECT * FROM t WHERE id = ?")
+	framer.PutMySQLStatement("mysql-output-test", 8, "DELETE FROM t WHERE id = ?")
+
+	tests := []struct {
+		name         string
+		payload      string
+		wantCommands []string
+		wantResp     string
+	}{
+		{name: "select", payload: "\x03SELECT * FROM t", wantCommands: []string{"SELECT * FROM t"},
+			wantResp: mysqlTestOKPayload},
+		{name: "update", payload: "\x03UPDATE t SET a = 1"},
+		{name: "execute", payload: "\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00\x01\x03\x00\x01\x00\x00\x00",
+			wantCommands: []string{"PREPARE SELECT * FROM t WHERE id = ?", "COM_STMT_EXECUTE"},
+			wantResp:     mysqlTestOKPayload},
+		{name: "execute again", payload: "\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00\x00\x02\x00\x00\x00",
+			wantCommands: []string{"COM_STMT_EXECUTE"}, wantResp: mysqlTestOKPayload},
+		{name: "execute of a delete", payload: "\x17\x08\x00\x00\x00\x00\x01\x00\x00\x00\x01\x03\x00\x01\x00\x00\x00"},
+		{name: "execute of an unknown statement", payload: "\x17\x09\x00\x00\x00\x00\x01\x00\x00\x00"},
+		{name: "ping", payload: "\x0e", wantCommands: []string{"COM_PING"}, wantResp: mysqlTestOKPayload},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			msg := mysqlCommandMessage(tt.payload)
+			_, err := o.PluginWrite(msg)
+			s.Require().NoError(err)
+
+			for _, want := range tt.wantCommands {
+				select {
+				case cmd := <-commands:
+					s.Equal(want, cmd)
+				case <-time.After(time.Second):
+					s.FailNow("command is not replayed", want)
+				}
+			}
+
+			if tt.wantResp == "" {
+				select {
+				case cmd := <-commands:
+					s.Failf("command is replayed", cmd)
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+
+			resp, err := o.PluginRead()
+			s.Require().NoError(err)
+			s.Equal(protocol.PayloadID(msg.Meta), protocol.PayloadID(resp.Meta))
+			s.Equal(byte(protocol.ReplayedResponsePayload), resp.Meta[0])
+			s.Equal("\x07\x00\x00\x01"+tt.wantResp, string(resp.Data))
+		})
+	}
+}
+
+func (s *mysqlOutputSuite) TestAccessDenied() {
+	commands := make(chan string, 1)
+	ln := startMySQLServer(&s.Suite, commands)
+	defer ln.Close()
+
+	o := NewMySQLOutput(ln.Addr().String(), &config.MySQLOutputConfig{
+		User:           "gor",
+		Password:       "wrong",
+		Workers:        1,
+		Timeout:        time.Second,
+		TrackResponses: true,
+	}).(*MySQLOutput)
+	defer o.Close()
+
+	_, err := o.PluginWrite(mysqlCommandMessage("\x0e"))
+	s.Require().NoError(err)
+
+	resp, err := o.PluginRead()
+	s.Require().NoError(err)
+	s.Empty(resp.Data)
+	s.Empty(commands)
+}
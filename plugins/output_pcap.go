@@ -0,0 +1,232 @@
+package plugins
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"goreplay/capture"
+	"goreplay/config"
+	"goreplay/logger"
+)
+
+const (
+	pcapSnaplen = 256 << 10 // pcap 文件头中的抓包长度, 与 tcpdump 默认值相同
+	pcapRecent  = 1024      // 记住最近写入的包, 同一个包属于多个消息时只写一次
+)
+
+// PcapOutput 把 input-raw 消息的原始数据包写入 pcap 文件, 只有通过了 http 过滤规则的消息才会写入.
+// 文件名为 path 加上序号, 比如 api_0.pcap, 达到大小或时长上限后写下一个文件
+type PcapOutput struct {
+	sync.Mutex
+	path   string
+	config *config.PcapOutputConfig
+
+	file     *os.File
+	buf      *bufio.Writer
+	writer   *capture.Writer
+	linkType layers.LinkType
+	index    int
+	size     int64
+	opened   time.Time
+
+	recent     map[gopacket.Packet]struct{}
+	recentList []gopacket.Packet
+	skipped    bool // 是否已经打印过链路类型不同的包
+	closed     bool
+}
+
+// NewPcapOutput constructor for PcapOutput, 序号接着目录中已有的文件
+func NewPcapOutput(path string, config *config.PcapOutputConfig) *PcapOutput {
+	o := &PcapOutput{
+		path:   path,
+		config: config,
+		recent: make(map[gopacket.Packet]struct{}, pcapRecent),
+	}
+
+	ext := filepath.Ext(path)
+	if matches, err := filepath.Glob(strings.TrimSuffix(path, ext) + "_*" + ext); err == nil {
+		for _, name := range matches {
+			if idx := getFileIndex(name); idx >= o.index {
+				o.index = idx + 1
+			}
+		}
+	}
+
+	return o
+}
+
+// PluginWrite 写入消息的原始数据包, 没有数据包的消息被忽略
+func (o *PcapOutput) PluginWrite(msg *Message) (int, error) {
+	if len(msg.Packets) == 0 {
+		return 0, nil
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return 0, fmt.Errorf("pcap output %s is closed", o.path)
+	}
+
+	n := 0
+	for _, packet := range msg.Packets {
+		if _, ok := o.recent[packet]; ok {
+			continue
+		}
+		o.remember(packet)
+
+		written, err := o.writePacket(packet)
+		if err != nil {
+			return n, err
+		}
+		n += written
+	}
+
+	return n, o.buf.Flush()
+}
+
+// remember 记住最近的 pcapRecent 个包
+func (o *PcapOutput) remember(packet gopacket.Packet) {
+	if len(o.recentList) >= pcapRecent {
+		delete(o.recent, o.recentList[0])
+		o.recentList = o.recentList[1:]
+	}
+	o.recent[packet] = struct{}{}
+	o.recentList = append(o.recentList, packet)
+}
+
+func (o *PcapOutput) writePacket(packet gopacket.Packet) (int, error) {
+	linkType, ok := pcapLinkType(packet)
+	if ok && o.file != nil && linkType != o.linkType {
+		ok = false
+	}
+	if !ok {
+		// pcap 文件只能有一种链路类型
+		if !o.skipped {
+			o.skipped = true
+			logger.Warn(fmt.Sprintf("[OUTPUT-PCAP] %s: skip packets with link layer %v, the file is %s",
+				o.path, packet.LinkLayer(), o.linkType))
+		}
+		return 0, nil
+	}
+
+	if o.shouldRotate() {
+		if err := o.rotate(linkType); err != nil {
+			return 0, err
+		}
+	}
+
+	ci := packet.Metadata().CaptureInfo
+	data := packet.Data()
+	ci.CaptureLength = len(data)
+	if ci.Length < ci.CaptureLength {
+		ci.Length = ci.CaptureLength
+	}
+	if err := o.writer.WritePacket(ci, data); err != nil {
+		return 0, err
+	}
+
+	n := 16 + len(data) // 包头 + 数据
+	o.size += int64(n)
+
+	return n, nil
+}
+
+func (o *PcapOutput) shouldRotate() bool {
+	switch {
+	case o.file == nil:
+		return true
+	case o.config.SizeLimit > 0 && o.size >= int64(o.config.SizeLimit):
+		return true
+	case o.config.RotateInterval > 0 && time.Since(o.opened) >= o.config.RotateInterval:
+		return true
+	}
+
+	return false
+}
+
+// rotate 关闭当前文件, 打开下一个序号的文件并写入文件头
+func (o *PcapOutput) rotate(linkType layers.LinkType) error {
+	if err := o.closeFile(); err != nil {
+		return err
+	}
+
+	name := setFileIndex(o.path, o.index)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return fmt.Errorf("open pcap output %s: %v", name, err)
+	}
+	o.index++
+
+	o.file, o.buf = f, bufio.NewWriter(f)
+	o.writer = capture.NewWriterNanos(o.buf)
+	if err = o.writer.WriteFileHeader(pcapSnaplen, linkType); err != nil {
+		return err
+	}
+	o.linkType, o.size, o.opened = linkType, 24, time.Now()
+	logger.Info(fmt.Sprintf("[OUTPUT-PCAP] writing %s", name))
+
+	return nil
+}
+
+func (o *PcapOutput) closeFile() error {
+	if o.file == nil {
+		return nil
+	}
+
+	err := o.buf.Flush()
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	o.file = nil
+
+	return err
+}
+
+// pcapLinkType 由数据包的第一层推断写入文件头的链路类型
+func pcapLinkType(packet gopacket.Packet) (layers.LinkType, bool) {
+	packetLayers := packet.Layers()
+	if len(packetLayers) == 0 {
+		return 0, false
+	}
+
+	switch packetLayers[0].LayerType() {
+	case layers.LayerTypeEthernet:
+		return layers.LinkTypeEthernet, true
+	case layers.LayerTypeLinuxSLL:
+		return layers.LinkTypeLinuxSLL, true
+	case layers.LayerTypeLoopback:
+		// Loop 的协议族是网络字节序, Null 是小端
+		if data := packet.Data(); len(data) > 0 && data[0] == 0 {
+			return layers.LinkTypeLoop, true
+		}
+		return layers.LinkTypeNull, true
+	case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		return layers.LinkTypeRaw, true
+	}
+
+	return 0, false
+}
+
+// String output address
+func (o *PcapOutput) String() string {
+	return "Pcap output: " + o.path
+}
+
+// Close 写完缓存并关闭文件
+func (o *PcapOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.closed = true
+
+	return o.closeFile()
+}
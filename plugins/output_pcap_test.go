@@ -0,0 +1,184 @@
+package plugins
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/config"
+	"goreplay/tcp"
+)
+
+// TestUnitPcapOutput pcap output unit test execute
+func TestUnitPcapOutput(t *testing.T) {
+	suite.Run(t, new(pcapOutputSuite))
+}
+
+type pcapOutputSuite struct {
+	suite.Suite
+	dir string
+}
+
+// SetupTest init before test run
+func (s *pcapOutputSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+}
+
+// packet 以太网或 loopback (Null) 上的 tcp 包, payload 只有一个字节
+func (s *pcapOutputSuite) packet(linkType layers.LinkType, payload byte) gopacket.Packet {
+	return s.tcpPacket(linkType, payload, &layers.TCP{PSH: true, ACK: true})
+}
+
+func (s *pcapOutputSuite) tcpPacket(linkType layers.LinkType, payload byte, tcpLayer *layers.TCP) gopacket.Packet {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcpLayer.SrcPort, tcpLayer.DstPort = 45678, 80
+	s.Require().NoError(tcpLayer.SetNetworkLayerForChecksum(ip))
+
+	var link gopacket.SerializableLayer = &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}, EthernetType: layers.EthernetTypeIPv4}
+	if linkType == layers.LinkTypeNull {
+		link = &layers.Loopback{Family: layers.ProtocolFamilyIPv4}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	s.Require().NoError(gopacket.SerializeLayers(buf,
+		gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		link, ip, tcpLayer, gopacket.Payload{payload}))
+
+	packet := gopacket.NewPacket(buf.Bytes(), linkType, gopacket.Default)
+	n := len(buf.Bytes())
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Unix(int64(payload), 0),
+		CaptureLength: n, Length: n}
+
+	return packet
+}
+
+// readPcap 读出文件的链路类型和每个包的 payload
+func (s *pcapOutputSuite) readPcap(name string) (layers.LinkType, []byte) {
+	f, err := os.Open(name)
+	s.Require().NoError(err)
+	defer f.Close()
+
+	r, err := pcapgo.NewReader(f)
+	s.Require().NoError(err)
+
+	var payloads []byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		app := gopacket.NewPacket(data, r.LinkType(), gopacket.Default).ApplicationLayer()
+		s.Require().NotNil(app)
+		payloads = append(payloads, app.Payload()...)
+	}
+
+	return r.LinkType(), payloads
+}
+
+func (s *pcapOutputSuite) TestPluginWrite() {
+	eth, null := layers.LinkTypeEthernet, layers.LinkTypeNull
+	shared := s.packet(eth, 3)
+
+	for _, tt := range []struct {
+		name     string
+		conf     config.PcapOutputConfig
+		messages [][]gopacket.Packet
+		want     map[string][]byte // 文件名 -> 写入的 payload
+		wantLink layers.LinkType
+	}{
+		{
+			name:     "one file",
+			messages: [][]gopacket.Packet{{s.packet(eth, 1), s.packet(eth, 2)}, nil, {s.packet(eth, 3)}},
+			want:     map[string][]byte{"api_0.pcap": {1, 2, 3}},
+			wantLink: eth,
+		},
+		{
+			name:     "packet shared by messages",
+			messages: [][]gopacket.Packet{{s.packet(eth, 1), shared}, {shared, s.packet(eth, 4)}},
+			want:     map[string][]byte{"api_0.pcap": {1, 3, 4}},
+			wantLink: eth,
+		},
+		{
+			name:     "other link type skipped",
+			messages: [][]gopacket.Packet{{s.packet(null, 1)}, {s.packet(eth, 2)}, {s.packet(null, 3)}},
+			want:     map[string][]byte{"api_0.pcap": {1, 3}},
+			wantLink: null,
+		},
+		{
+			name: "rotate by size",
+			// 文件头 24 字节, 每个包 16 + 60 字节
+			conf:     config.PcapOutputConfig{SizeLimit: 150},
+			messages: [][]gopacket.Packet{{s.packet(eth, 1), s.packet(eth, 2)}, {s.packet(eth, 3)}},
+			want:     map[string][]byte{"api_0.pcap": {1, 2}, "api_1.pcap": {3}},
+			wantLink: eth,
+		},
+	} {
+		s.Run(tt.name, func() {
+			s.SetupTest()
+			o := NewPcapOutput(filepath.Join(s.dir, "api.pcap"), &tt.conf)
+			for _, packets := range tt.messages {
+				_, err := o.PluginWrite(&Message{Data: []byte("GET / HTTP/1.1\r\n\r\n"), Packets: packets})
+				s.Require().NoError(err)
+			}
+			s.Require().NoError(o.Close())
+
+			files, err := filepath.Glob(filepath.Join(s.dir, "*"))
+			s.Require().NoError(err)
+			s.Len(files, len(tt.want))
+			for name, want := range tt.want {
+				linkType, got := s.readPcap(filepath.Join(s.dir, name))
+				s.Equal(tt.wantLink, linkType)
+				s.Equal(want, got, name)
+			}
+		})
+	}
+}
+
+func (s *pcapOutputSuite) TestContinueIndex() {
+	s.Require().NoError(os.WriteFile(filepath.Join(s.dir, "api_3.pcap"), nil, 0644))
+
+	o := NewPcapOutput(filepath.Join(s.dir, "api.pcap"), &config.PcapOutputConfig{})
+	_, err := o.PluginWrite(&Message{Packets: []gopacket.Packet{s.packet(layers.LinkTypeEthernet, 1)}})
+	s.Require().NoError(err)
+	s.Require().NoError(o.Close())
+
+	_, got := s.readPcap(filepath.Join(s.dir, "api_4.pcap"))
+	s.Equal([]byte{1}, got)
+
+	_, err = o.PluginWrite(&Message{Packets: []gopacket.Packet{s.packet(layers.LinkTypeEthernet, 2)}})
+	s.Error(err)
+}
+
+func (s *pcapOutputSuite) TestRawPackets() {
+	syn := s.tcpPacket(layers.LinkTypeEthernet, 1, &layers.TCP{SYN: true})
+	fin := s.tcpPacket(layers.LinkTypeEthernet, 2, &layers.TCP{FIN: true, ACK: true, Seq: 2})
+
+	syn.Metadata().Timestamp, fin.Metadata().Timestamp = time.Now(), time.Now()
+
+	for _, keep := range []bool{true, false} {
+		var msg *tcp.Message
+		pool := tcp.NewMessagePool(0, time.Second, func(m *tcp.Message) { msg = m })
+		pool.KeepRaw(keep)
+		// 重复的原始包只保留一个
+		for _, packet := range []gopacket.Packet{syn, syn, fin} {
+			pool.Handler(packet)
+		}
+
+		s.Require().NotNil(msg)
+		if keep {
+			s.Equal([]gopacket.Packet{syn, fin}, rawPackets(msg))
+		} else {
+			// 没有 --output-pcap 时不保留原始数据包
+			s.Empty(rawPackets(msg))
+		}
+	}
+}
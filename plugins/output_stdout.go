@@ -0,0 +1,43 @@
+package plugins
+
+import (
+	"io"
+	"os"
+
+	"goreplay/config"
+)
+
+// StdoutOutput prints the messages to the console, used for testing inputs
+type StdoutOutput struct {
+	writer  io.Writer
+	decoder *grpcDecoder
+}
+
+// NewStdoutOutput constructor for StdoutOutput
+func NewStdoutOutput(_ string, conf *config.StdoutOutputConfig) *StdoutOutput {
+	o := &StdoutOutput{writer: os.Stdout}
+	if conf.DecodeProtobuf {
+		o.decoder = newGRPCDecoder(conf.Protobuf)
+	}
+
+	return o
+}
+
+// PluginWrite writes message to this plugin
+func (o *StdoutOutput) PluginWrite(msg *Message) (int, error) {
+	data := msg.Data
+	if o.decoder != nil {
+		data = o.decoder.decodeData(msg)
+	}
+
+	// 一次写入, 并发的消息不会交错
+	buf := make([]byte, 0, len(msg.Meta)+len(data)+len(payloadSeparatorAsBytes))
+	buf = append(append(append(buf, msg.Meta...), data...), payloadSeparatorAsBytes...)
+
+	return o.writer.Write(buf)
+}
+
+// String output name
+func (o *StdoutOutput) String() string {
+	return "Stdout Output"
+}
@@ -4,11 +4,16 @@ import (
 	"reflect"
 	"strings"
 
+	"github.com/google/gopacket"
+
 	"goreplay/config"
 )
 
 // Settings plugins` settings
 type Settings struct {
+	OutputStdout       bool `json:"output-stdout"`
+	OutputStdoutConfig config.StdoutOutputConfig
+
 	InputTCP        config.MultiOption `json:"input-tcp"`
 	InputTCPConfig  config.TCPInputConfig
 	OutputTCP       config.MultiOption `json:"output-tcp"`
@@ -19,6 +24,9 @@ type Settings struct {
 	OutputFile       config.MultiOption `json:"output-file"`
 	OutputFileConfig config.FileOutputConfig
 
+	OutputPcap       config.MultiOption `json:"output-pcap"`
+	OutputPcapConfig config.PcapOutputConfig
+
 	InputRAW config.MultiOption `json:"input_raw"`
 	config.RAWInputConfig
 
@@ -31,10 +39,21 @@ type Settings struct {
 	OutputBinary       config.MultiOption `json:"output-binary"`
 	OutputBinaryConfig config.BinaryOutputConfig
 
+	OutputMySQL       config.MultiOption `json:"output-mysql"`
+	OutputMySQLConfig config.MySQLOutputConfig
+
+	OutputGRPC       config.MultiOption `json:"output-grpc"`
+	OutputGRPCConfig config.GRPCOutputConfig
+
+	OutputComparator       config.MultiOption `json:"output-comparator"`
+	OutputComparatorConfig config.ComparatorOutputConfig
+
 	ModifierConfig config.HTTPModifierConfig
 
 	InputUDP       config.MultiOption `json:"input-udp"`
 	InputUDPConfig config.UDPInputConfig
+
+	ProtobufConfig config.ProtobufConfig
 }
 
 // Message represents data accross plugins
@@ -42,7 +61,10 @@ type Message struct {
 	Meta         []byte // metadata
 	Data         []byte // actual data
 	ConnectionID string
-	SrcAddr      string // 记录来源的IP地址, 在包为response包的时候赋值, value为DstAddr
+	SrcAddr      string            // 记录客户端的IP地址, request包为SrcAddr, response包为DstAddr
+	Packets      []gopacket.Packet // 组成消息的原始数据包, 只有 input-raw 在有 --output-pcap 时设置
+	// ConnectionClosed 录制的连接 FIN 或 RST, 消息只有 ConnectionID, 由 emitter 交给 ConnectionCloser
+	ConnectionClosed bool
 }
 
 // PluginReader is an interface for input plugins
@@ -55,6 +77,12 @@ type PluginWriter interface {
 	PluginWrite(msg *Message) (n int, err error)
 }
 
+// ConnectionCloser is implemented by output plugins which keep state per recorded connection. CloseConnection
+// is called in order with the messages written, after the last message of a connection which saw FIN or RST.
+type ConnectionCloser interface {
+	CloseConnection(connectionID string)
+}
+
 // PluginReadWriter is an interface for plugins that support reading and writing
 type PluginReadWriter interface {
 	PluginReader
@@ -66,6 +94,28 @@ type InOutPlugins struct {
 	Inputs  []PluginReader
 	Outputs []PluginWriter
 	All     []interface{}
+
+	// 与 Inputs, Outputs 一一对应的地址, 用于在 --pipeline 中引用插件
+	InputAddresses  []string
+	OutputAddresses []string
+}
+
+// InputAddress 第 i 个输入的地址
+func (p *InOutPlugins) InputAddress(i int) string {
+	if i < len(p.InputAddresses) {
+		return p.InputAddresses[i]
+	}
+
+	return ""
+}
+
+// OutputAddress 第 i 个输出的地址
+func (p *InOutPlugins) OutputAddress(i int) string {
+	if i < len(p.OutputAddresses) {
+		return p.OutputAddresses[i]
+	}
+
+	return ""
 }
 
 // extractLimitOptions detects if plugin get called with limiter support
@@ -104,6 +154,12 @@ func (p *InOutPlugins) registerPlugin(constructor interface{}, options ...interf
 	// Calling our constructor with list of given options
 	plugin := vc.Call(vo)[0].Interface()
 
+	if path == "" {
+		// 没有地址的插件, 比如 --output-logreplay, 使用类型名 logreplay
+		name := reflect.Indirect(reflect.ValueOf(plugin)).Type().Name()
+		path = strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(name, "Output"), "Input"))
+	}
+
 	if limit != "" {
 		plugin = NewLimiter(plugin, limit)
 	}
@@ -111,10 +167,12 @@ func (p *InOutPlugins) registerPlugin(constructor interface{}, options ...interf
 	// Some of the output can be Readers as well because return responses
 	if r, ok := plugin.(PluginReader); ok {
 		p.Inputs = append(p.Inputs, r)
+		p.InputAddresses = append(p.InputAddresses, path)
 	}
 
 	if w, ok := plugin.(PluginWriter); ok {
 		p.Outputs = append(p.Outputs, w)
+		p.OutputAddresses = append(p.OutputAddresses, path)
 	}
 
 	p.All = append(p.All, plugin)
@@ -124,25 +182,36 @@ func (p *InOutPlugins) registerPlugin(constructor interface{}, options ...interf
 // InitPluginSettings 将公共参数转为plugins的私有参数
 func InitPluginSettings() Settings {
 	pluginSettings := Settings{
-		InputTCP:              config.Settings.InputTCP,
-		InputTCPConfig:        config.Settings.InputTCPConfig,
-		OutputTCP:             config.Settings.OutputTCP,
-		OutputTCPConfig:       config.Settings.OutputTCPConfig,
-		InputFile:             config.Settings.InputFile,
-		InputFileLoop:         config.Settings.InputFileLoop,
-		OutputFile:            config.Settings.OutputFile,
-		OutputFileConfig:      config.Settings.OutputFileConfig,
-		InputRAW:              config.Settings.InputRAW,
-		RAWInputConfig:        config.Settings.RAWInputConfig,
-		OutputHTTP:            config.Settings.OutputHTTP,
-		OutputLogReplay:       config.Settings.OutputLogReplay,
-		OutputHTTPConfig:      config.Settings.OutputHTTPConfig,
-		OutputLogReplayConfig: config.Settings.OutputLogReplayConfig,
-		OutputBinary:          config.Settings.OutputBinary,
-		OutputBinaryConfig:    config.Settings.OutputBinaryConfig,
-		ModifierConfig:        config.Settings.ModifierConfig,
-		InputUDP:              config.Settings.InputUDP,
-		InputUDPConfig:        config.Settings.InputUDPConfig,
+		OutputStdout:           config.Settings.OutputStdout,
+		OutputStdoutConfig:     config.Settings.OutputStdoutConfig,
+		InputTCP:               config.Settings.InputTCP,
+		InputTCPConfig:         config.Settings.InputTCPConfig,
+		OutputTCP:              config.Settings.OutputTCP,
+		OutputTCPConfig:        config.Settings.OutputTCPConfig,
+		InputFile:              config.Settings.InputFile,
+		InputFileLoop:          config.Settings.InputFileLoop,
+		OutputFile:             config.Settings.OutputFile,
+		OutputFileConfig:       config.Settings.OutputFileConfig,
+		OutputPcap:             config.Settings.OutputPcap,
+		OutputPcapConfig:       config.Settings.OutputPcapConfig,
+		InputRAW:               config.Settings.InputRAW,
+		RAWInputConfig:         config.Settings.RAWInputConfig,
+		OutputHTTP:             config.Settings.OutputHTTP,
+		OutputLogReplay:        config.Settings.OutputLogReplay,
+		OutputHTTPConfig:       config.Settings.OutputHTTPConfig,
+		OutputLogReplayConfig:  config.Settings.OutputLogReplayConfig,
+		OutputBinary:           config.Settings.OutputBinary,
+		OutputBinaryConfig:     config.Settings.OutputBinaryConfig,
+		OutputMySQL:            config.Settings.OutputMySQL,
+		OutputMySQLConfig:      config.Settings.OutputMySQLConfig,
+		OutputGRPC:             config.Settings.OutputGRPC,
+		OutputGRPCConfig:       config.Settings.OutputGRPCConfig,
+		OutputComparator:       config.Settings.OutputComparator,
+		OutputComparatorConfig: config.Settings.OutputComparatorConfig,
+		ModifierConfig:         config.Settings.ModifierConfig,
+		InputUDP:               config.Settings.InputUDP,
+		InputUDPConfig:         config.Settings.InputUDPConfig,
+		ProtobufConfig:         config.Settings.ProtobufConfig,
 	}
 
 	return pluginSettings
@@ -152,6 +221,7 @@ func InitPluginSettings() Settings {
 func NewPlugins(settings Settings) *InOutPlugins {
 	plugins := new(InOutPlugins)
 
+	settings.RAWInputConfig.KeepPackets = len(settings.OutputPcap) > 0
 	for _, options := range settings.InputRAW {
 		plugins.registerPlugin(NewRAWInput, options, settings.RAWInputConfig)
 	}
@@ -160,6 +230,15 @@ func NewPlugins(settings Settings) *InOutPlugins {
 		plugins.registerPlugin(NewTCPInput, options, &settings.InputTCPConfig)
 	}
 
+	// 解码 grpc 消息的输出共用 protobuf 描述的配置
+	settings.OutputStdoutConfig.Protobuf = &settings.ProtobufConfig
+	settings.OutputFileConfig.Protobuf = &settings.ProtobufConfig
+	settings.OutputLogReplayConfig.Protobuf = &settings.ProtobufConfig
+
+	if settings.OutputStdout {
+		plugins.registerPlugin(NewStdoutOutput, "", &settings.OutputStdoutConfig)
+	}
+
 	for _, options := range settings.OutputTCP {
 		plugins.registerPlugin(NewTCPOutput, options, &settings.OutputTCPConfig)
 	}
@@ -172,6 +251,10 @@ func NewPlugins(settings Settings) *InOutPlugins {
 		plugins.registerPlugin(NewFileOutput, path, &settings.OutputFileConfig)
 	}
 
+	for _, path := range settings.OutputPcap {
+		plugins.registerPlugin(NewPcapOutput, path, &settings.OutputPcapConfig)
+	}
+
 	// If we explicitly set Host header http output should not rewrite it
 	// Fix: https://github.com/buger/gor/issues/174
 	checkOriginalHost(&settings)
@@ -185,10 +268,27 @@ func NewPlugins(settings Settings) *InOutPlugins {
 		plugins.registerPlugin(NewLogReplayOutput, "", &settings.OutputLogReplayConfig)
 	}
 
+	if settings.OutputBinaryConfig.Protocol == "" {
+		settings.OutputBinaryConfig.Protocol = settings.RAWInputConfig.Protocol
+	}
+
 	for _, options := range settings.OutputBinary {
 		plugins.registerPlugin(NewBinaryOutput, options, &settings.OutputBinaryConfig)
 	}
 
+	for _, options := range settings.OutputMySQL {
+		plugins.registerPlugin(NewMySQLOutput, options, &settings.OutputMySQLConfig)
+	}
+
+	for _, options := range settings.OutputGRPC {
+		plugins.registerPlugin(NewGRPCOutput, options, &settings.OutputGRPCConfig)
+	}
+
+	settings.OutputComparatorConfig.Protocol = settings.RAWInputConfig.Protocol
+	for _, path := range settings.OutputComparator {
+		plugins.registerPlugin(NewComparatorOutput, path, &settings.OutputComparatorConfig)
+	}
+
 	for _, options := range settings.InputUDP {
 		plugins.registerPlugin(NewUDPInput, options, settings.InputUDPConfig)
 	}
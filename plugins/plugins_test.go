@@ -48,3 +48,23 @@ func (s pluginsSuite) TestPluginsRegistrationHost() {
 	}
 
 }
+
+type addressOutput struct{}
+
+func (*addressOutput) PluginWrite(msg *Message) (int, error) {
+	return len(msg.Data), nil
+}
+
+func (s pluginsSuite) TestPluginAddresses() {
+	plugins := NewPlugins(Settings{
+		OutputHTTP: config.MultiOption{"www.example.com|10"},
+		InputFile:  config.MultiOption{"/dev/null"},
+	})
+	plugins.registerPlugin(func(string) *addressOutput { return &addressOutput{} }, "")
+
+	s.Equal([]string{"/dev/null", "www.example.com"}, plugins.InputAddresses)
+	s.Equal([]string{"www.example.com", "address"}, plugins.OutputAddresses)
+	s.Equal("/dev/null", plugins.InputAddress(0))
+	s.Equal("", plugins.InputAddress(2))
+	s.Equal("address", plugins.OutputAddress(1))
+}
@@ -0,0 +1,95 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+
+	"goreplay/client"
+	"goreplay/codec"
+	"goreplay/framer"
+)
+
+const rawReadChunkSize = 64 * 1024
+
+// protocolResponseReader returns a reader of exactly one response to reqData,
+// nil for protocols whose messages we can't frame
+func protocolResponseReader(proto string, reqData []byte) client.ResponseReader {
+	switch proto {
+	case codec.HTTPName:
+		return readHTTPResponse(reqData)
+	case codec.ThriftName:
+		return readThriftResponse(reqData)
+	case codec.RedisName:
+		return readFramedResponse(framer.RESPMessageLen, framer.ErrRESPShort)
+	}
+
+	return nil
+}
+
+// readHTTPResponse reads one http/1.x response, the request is needed to know
+// if the response carries a body (e.g. HEAD)
+func readHTTPResponse(reqData []byte) client.ResponseReader {
+	req, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqData)))
+
+	return func(r *bufio.Reader, _ io.Writer) ([]byte, error) {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		return httputil.DumpResponse(resp, true)
+	}
+}
+
+// readThriftResponse reads one whole thrift message, oneway calls get no response
+func readThriftResponse(reqData []byte) client.ResponseReader {
+	h, err := framer.ParseThriftHeader(reqData)
+	if err == nil && h.Type == framer.ThriftOneway {
+		return func(*bufio.Reader, io.Writer) ([]byte, error) {
+			return nil, nil
+		}
+	}
+
+	return readFramedResponse(framer.ThriftMessageLen, framer.ErrThriftShort)
+}
+
+// readFramedResponse reads until messageLen finds a whole message, errShort is
+// what messageLen returns while more data is needed
+func readFramedResponse(messageLen func([]byte) (int, error), errShort error) client.ResponseReader {
+	return func(r *bufio.Reader, _ io.Writer) ([]byte, error) {
+		var rsp []byte
+		buf := make([]byte, rawReadChunkSize)
+		for {
+			n, err := r.Read(buf)
+			rsp = append(rsp, buf[:n]...)
+
+			l, perr := messageLen(rsp)
+			if perr == nil {
+				return rsp[:l], nil
+			}
+
+			if perr != errShort {
+				return nil, perr
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// readRawResponse is used for protocols we don't know how to frame, it returns what the first read gets
+func readRawResponse(r *bufio.Reader, _ io.Writer) ([]byte, error) {
+	buf := make([]byte, rawReadChunkSize)
+	n, err := r.Read(buf)
+	if n > 0 {
+		return buf[:n], nil
+	}
+
+	return nil, err
+}
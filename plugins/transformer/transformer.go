@@ -0,0 +1,154 @@
+// Package transformer 进程内修改消息的扩展, 不用像 --middleware 一样经过外部进程
+package transformer
+
+import (
+	"fmt"
+	"io"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+
+	"goreplay/plugins"
+	"goreplay/protocol"
+)
+
+var (
+	builders = make(map[string]Builder)
+	lock     sync.RWMutex
+)
+
+// Transformer modifies the messages going from inputs to outputs, in process. Each hook is called with the
+// messages of its payload type and returns the message to pass on, or nil to drop it.
+// Hooks are called concurrently, from one goroutine per input, and the outputs reading replayed
+// responses count as inputs, so a Transformer must be safe for concurrent use.
+type Transformer interface {
+	// Request 录制的请求, 在发往输出之前
+	Request(msg *plugins.Message) *plugins.Message
+	// OriginalResponse 录制的响应, 需要 --input-raw-track-response
+	OriginalResponse(msg *plugins.Message) *plugins.Message
+	// ReplayedResponse 回放的响应, 需要输出的 track-response, 比如 --output-http-track-response
+	ReplayedResponse(msg *plugins.Message) *plugins.Message
+}
+
+// Builder Transformer 的建造者
+type Builder interface {
+	// New 每个 --transformer 调用一次, options 是 --transformer name:options 中 : 之后的部分
+	New(options string) (Transformer, error)
+}
+
+// BuilderFunc 用函数实现 Builder
+type BuilderFunc func(options string) (Transformer, error)
+
+// New calls f
+func (f BuilderFunc) New(options string) (Transformer, error) {
+	return f(options)
+}
+
+// Passthrough 不修改消息, 嵌入后只需要实现用到的 hook
+type Passthrough struct{}
+
+// Request returns msg
+func (Passthrough) Request(msg *plugins.Message) *plugins.Message {
+	return msg
+}
+
+// OriginalResponse returns msg
+func (Passthrough) OriginalResponse(msg *plugins.Message) *plugins.Message {
+	return msg
+}
+
+// ReplayedResponse returns msg
+func (Passthrough) ReplayedResponse(msg *plugins.Message) *plugins.Message {
+	return msg
+}
+
+// Register 注册 transformer, 通常在 init 中调用, 也可以在 --transformer-plugin 加载的插件中调用
+func Register(name string, builder Builder) {
+	lock.Lock()
+	builders[name] = builder
+	lock.Unlock()
+}
+
+// Names 注册的 transformer
+func Names() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	names := make([]string, 0, len(builders))
+	for name := range builders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Open 加载用 go build -buildmode=plugin 编译的插件, 插件在 init 中 Register
+func Open(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return fmt.Errorf("transformer plugin %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Chain 按顺序调用的 transformer, 一个返回 nil 后消息丢弃
+type Chain []Transformer
+
+// NewChain 按 --transformer 的 name[:options] 新建
+func NewChain(specs []string) (Chain, error) {
+	chain := make(Chain, 0, len(specs))
+	for _, spec := range specs {
+		name, options := spec, ""
+		if i := strings.Index(spec, ":"); i >= 0 {
+			name, options = spec[:i], spec[i+1:]
+		}
+
+		lock.RLock()
+		b, ok := builders[name]
+		lock.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q, registered: %s", name, strings.Join(Names(), ", "))
+		}
+		t, err := b.New(options)
+		if err != nil {
+			return nil, fmt.Errorf("transformer %s: %v", name, err)
+		}
+		chain = append(chain, t)
+	}
+
+	return chain, nil
+}
+
+// Transform 按消息的类型调用每个 transformer 的 hook, 没有 meta 的消息不修改
+func (c Chain) Transform(msg *plugins.Message) *plugins.Message {
+	if len(msg.Meta) == 0 {
+		return msg
+	}
+
+	for _, t := range c {
+		switch msg.Meta[0] {
+		case protocol.RequestPayload:
+			msg = t.Request(msg)
+		case protocol.ResponsePayload:
+			msg = t.OriginalResponse(msg)
+		case protocol.ReplayedResponsePayload:
+			msg = t.ReplayedResponse(msg)
+		}
+		if msg == nil {
+			return nil
+		}
+	}
+
+	return msg
+}
+
+// Close 关闭实现了 io.Closer 的 transformer
+func (c Chain) Close() {
+	for _, t := range c {
+		if closer, ok := t.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+}
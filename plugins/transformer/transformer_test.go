@@ -0,0 +1,107 @@
+package transformer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/plugins"
+	"goreplay/protocol"
+)
+
+// TestUnitTransformer transformer unit test execute
+func TestUnitTransformer(t *testing.T) {
+	suite.Run(t, new(transformerSuite))
+}
+
+type transformerSuite struct {
+	suite.Suite
+}
+
+// suffix 在请求和回放的响应后追加 options, 丢弃录制的响应
+type suffix struct {
+	Passthrough
+	options string
+	closed  bool
+}
+
+func (t *suffix) Request(msg *plugins.Message) *plugins.Message {
+	msg.Data = append(msg.Data, t.options...)
+	return msg
+}
+
+func (t *suffix) OriginalResponse(*plugins.Message) *plugins.Message {
+	return nil
+}
+
+func (t *suffix) ReplayedResponse(msg *plugins.Message) *plugins.Message {
+	msg.Data = append(msg.Data, t.options...)
+	return msg
+}
+
+func (t *suffix) Close() error {
+	t.closed = true
+	return nil
+}
+
+func (s *transformerSuite) SetupSuite() {
+	Register("suffix", BuilderFunc(func(options string) (Transformer, error) {
+		if options == "" {
+			return nil, errors.New("need a suffix")
+		}
+		return &suffix{options: options}, nil
+	}))
+	Register("passthrough", BuilderFunc(func(string) (Transformer, error) {
+		return Passthrough{}, nil
+	}))
+}
+
+func (s *transformerSuite) TestChain() {
+	chain, err := NewChain([]string{"suffix:-a", "passthrough", "suffix:-b:c"})
+	s.Require().NoError(err)
+	s.Len(chain, 3)
+
+	message := func(payloadType byte) *plugins.Message {
+		return &plugins.Message{Meta: protocol.PayloadHeader(payloadType, protocol.UUID(), 1, 0), Data: []byte("x")}
+	}
+	for _, tt := range []struct {
+		name        string
+		msg         *plugins.Message
+		want        string
+		wantDropped bool
+	}{
+		{name: "request", msg: message(protocol.RequestPayload), want: "x-a-b:c"},
+		{name: "original response", msg: message(protocol.ResponsePayload), wantDropped: true},
+		{name: "replayed response", msg: message(protocol.ReplayedResponsePayload), want: "x-a-b:c"},
+		{name: "no meta", msg: &plugins.Message{Data: []byte("x")}, want: "x"},
+	} {
+		s.Run(tt.name, func() {
+			got := chain.Transform(tt.msg)
+			if tt.wantDropped {
+				s.Nil(got)
+				return
+			}
+			s.Require().NotNil(got)
+			s.Equal(tt.want, string(got.Data))
+		})
+	}
+
+	chain.Close()
+	s.True(chain[0].(*suffix).closed)
+	s.True(chain[2].(*suffix).closed)
+
+	// 没有 transformer 时不修改
+	var empty Chain
+	msg := message(protocol.RequestPayload)
+	s.Equal(msg, empty.Transform(msg))
+	empty.Close()
+}
+
+func (s *transformerSuite) TestNewChainError() {
+	_, err := NewChain([]string{"missing"})
+	s.EqualError(err, `unknown transformer "missing", registered: passthrough, suffix`)
+	_, err = NewChain([]string{"suffix"})
+	s.EqualError(err, "transformer suffix: need a suffix")
+	s.Error(Open("missing.so"))
+}
@@ -0,0 +1,509 @@
+package protobuf
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// fieldType FieldDescriptorProto.Type
+type fieldType int32
+
+// 字段类型, 取值和 descriptor.proto 一致
+const (
+	typeDouble   fieldType = 1
+	typeFloat    fieldType = 2
+	typeInt64    fieldType = 3
+	typeUint64   fieldType = 4
+	typeInt32    fieldType = 5
+	typeFixed64  fieldType = 6
+	typeFixed32  fieldType = 7
+	typeBool     fieldType = 8
+	typeString   fieldType = 9
+	typeGroup    fieldType = 10
+	typeMessage  fieldType = 11
+	typeBytes    fieldType = 12
+	typeUint32   fieldType = 13
+	typeEnum     fieldType = 14
+	typeSfixed32 fieldType = 15
+	typeSfixed64 fieldType = 16
+	typeSint32   fieldType = 17
+	typeSint64   fieldType = 18
+
+	labelRepeated = 3
+)
+
+// field 消息的一个字段, 类型为 message 或 enum 时 typeName 在 link 时解析
+type field struct {
+	name     string
+	jsonName string
+	number   int32
+	typ      fieldType
+	repeated bool
+	typeName string
+	scope    string // scope typeName 是相对的名字时, 查找的起点
+	message  *message
+	enum     *enum
+}
+
+type message struct {
+	fullName string
+	fields   map[int32]*field
+	mapEntry bool
+}
+
+type enum struct {
+	fullName string
+	values   map[int32]string
+}
+
+type method struct {
+	path            string // path /package.Service/Method
+	input, output   string
+	scope           string
+	in, out         *message
+	clientStreaming bool
+	serverStreaming bool
+}
+
+// file 一个 .proto 文件中的定义, 嵌套的消息和枚举也展开在 messages 和 enums 中
+type file struct {
+	name     string
+	pkg      string
+	deps     []string
+	messages []*message
+	enums    []*enum
+	methods  []*method
+	fields   []*field // fields 所有消息的字段, 用于 link
+}
+
+// Registry holds the messages, enums and grpc methods of loaded files, from FileDescriptorSets,
+// .proto files or server reflection
+type Registry struct {
+	files    map[string]*file
+	messages map[string]*message
+	enums    map[string]*enum
+	methods  map[string]*method
+}
+
+// NewRegistry returns a registry knowing only the well known types
+func NewRegistry() *Registry {
+	r := &Registry{
+		files:    make(map[string]*file),
+		messages: make(map[string]*message),
+		enums:    make(map[string]*enum),
+		methods:  make(map[string]*method),
+	}
+	for name, src := range wellKnownFiles {
+		f, err := parseProto(name, src)
+		if err != nil {
+			panic(err)
+		}
+		r.add(f)
+	}
+	if err := r.link(); err != nil {
+		panic(err)
+	}
+
+	return r
+}
+
+// Methods number of known grpc methods
+func (r *Registry) Methods() int {
+	return len(r.methods)
+}
+
+// AddDescriptorSet adds the files of a serialized FileDescriptorSet, as written by
+// protoc --descriptor_set_out --include_imports
+func (r *Registry) AddDescriptorSet(data []byte) error {
+	var files [][]byte
+	b := buffer(data)
+	for len(b) > 0 {
+		number, wireType, err := b.tag()
+		if err != nil {
+			return err
+		}
+		if number != 1 || wireType != wireBytes {
+			if err = b.skip(number, wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		fd, err := b.bytes()
+		if err != nil {
+			return err
+		}
+		files = append(files, fd)
+	}
+
+	return r.addFileDescriptors(files)
+}
+
+// addFileDescriptors 加入序列化的 FileDescriptorProto
+func (r *Registry) addFileDescriptors(files [][]byte) error {
+	for _, data := range files {
+		f, err := decodeFile(data)
+		if err != nil {
+			return err
+		}
+		r.add(f)
+	}
+
+	return r.link()
+}
+
+func (r *Registry) add(f *file) {
+	if _, ok := r.files[f.name]; ok {
+		return
+	}
+	r.files[f.name] = f
+	for _, m := range f.messages {
+		r.messages[m.fullName] = m
+	}
+	for _, e := range f.enums {
+		r.enums[e.fullName] = e
+	}
+	for _, m := range f.methods {
+		r.methods[m.path] = m
+	}
+}
+
+// link 解析字段和方法引用的类型
+func (r *Registry) link() error {
+	for _, f := range r.files {
+		for _, fd := range f.fields {
+			if fd.message != nil || fd.enum != nil || fd.typeName == "" {
+				continue
+			}
+			name, ok := r.resolve(fd.scope, fd.typeName)
+			if !ok {
+				return fmt.Errorf("protobuf: %s: unknown type %s of field %s", f.name, fd.typeName, fd.name)
+			}
+			if m, ok := r.messages[name]; ok {
+				fd.message = m
+				if fd.typ == 0 {
+					fd.typ = typeMessage
+				}
+			} else {
+				fd.enum = r.enums[name]
+				fd.typ = typeEnum
+			}
+		}
+		for _, m := range f.methods {
+			if m.in != nil {
+				continue
+			}
+			in, ok := r.resolve(m.scope, m.input)
+			out, ok2 := r.resolve(m.scope, m.output)
+			if !ok || !ok2 || r.messages[in] == nil || r.messages[out] == nil {
+				return fmt.Errorf("protobuf: %s: unknown types of method %s", f.name, m.path)
+			}
+			m.in, m.out = r.messages[in], r.messages[out]
+		}
+	}
+
+	return nil
+}
+
+// resolve 按 protobuf 的作用域规则查找类型, 从最内层的作用域向外
+func (r *Registry) resolve(scope, name string) (string, bool) {
+	if strings.HasPrefix(name, ".") {
+		name = name[1:]
+		return name, r.messages[name] != nil || r.enums[name] != nil
+	}
+
+	for {
+		full := name
+		if scope != "" {
+			full = scope + "." + name
+		}
+		if r.messages[full] != nil || r.enums[full] != nil {
+			return full, true
+		}
+		if scope == "" {
+			return "", false
+		}
+		if i := strings.LastIndexByte(scope, '.'); i >= 0 {
+			scope = scope[:i]
+		} else {
+			scope = ""
+		}
+	}
+}
+
+// decodeFile 解码 FileDescriptorProto
+func decodeFile(data []byte) (*file, error) {
+	f := new(file)
+	err := eachField(data, func(number int32, b *buffer, wireType int) error {
+		if wireType != wireBytes {
+			return b.skip(number, wireType)
+		}
+		v, err := b.bytes()
+		if err != nil {
+			return err
+		}
+		switch number {
+		case 1:
+			f.name = string(v)
+		case 2:
+			f.pkg = string(v)
+		case 3:
+			f.deps = append(f.deps, string(v))
+		case 4:
+			return f.decodeMessage(f.pkg, v)
+		case 5:
+			return f.decodeEnum(f.pkg, v)
+		case 6:
+			return f.decodeService(v)
+		}
+		return nil
+	})
+
+	return f, err
+}
+
+// decodeMessage 解码 DescriptorProto, 嵌套的类型在消息的作用域中
+func (f *file) decodeMessage(scope string, data []byte) error {
+	m := &message{fields: make(map[int32]*field)}
+	var nested, enums [][]byte
+	err := eachField(data, func(number int32, b *buffer, wireType int) error {
+		if wireType != wireBytes {
+			return b.skip(number, wireType)
+		}
+		v, err := b.bytes()
+		if err != nil {
+			return err
+		}
+		switch number {
+		case 1:
+			m.fullName = fullName(scope, string(v))
+		case 2:
+			fd, err := decodeField(v)
+			if err != nil {
+				return err
+			}
+			m.fields[fd.number] = fd
+		case 3:
+			nested = append(nested, v)
+		case 4:
+			enums = append(enums, v)
+		case 7:
+			// MessageOptions.map_entry
+			return eachField(v, func(number int32, b *buffer, wireType int) error {
+				if number == 7 && wireType == wireVarint {
+					v, err := b.varint()
+					m.mapEntry = v != 0
+					return err
+				}
+				return b.skip(number, wireType)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f.messages = append(f.messages, m)
+	for _, fd := range m.fields {
+		fd.scope = m.fullName
+		f.fields = append(f.fields, fd)
+	}
+	for _, v := range nested {
+		if err = f.decodeMessage(m.fullName, v); err != nil {
+			return err
+		}
+	}
+	for _, v := range enums {
+		if err = f.decodeEnum(m.fullName, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeField 解码 FieldDescriptorProto
+func decodeField(data []byte) (*field, error) {
+	fd := new(field)
+	err := eachField(data, func(number int32, b *buffer, wireType int) error {
+		switch wireType {
+		case wireVarint:
+			v, err := b.varint()
+			switch number {
+			case 3:
+				fd.number = int32(v)
+			case 4:
+				fd.repeated = v == labelRepeated
+			case 5:
+				fd.typ = fieldType(v)
+			}
+			return err
+		case wireBytes:
+			v, err := b.bytes()
+			switch number {
+			case 1:
+				fd.name = string(v)
+			case 6:
+				fd.typeName = string(v)
+			case 10:
+				fd.jsonName = string(v)
+			}
+			return err
+		}
+		return b.skip(number, wireType)
+	})
+	if fd.jsonName == "" {
+		fd.jsonName = jsonName(fd.name)
+	}
+
+	return fd, err
+}
+
+// decodeEnum 解码 EnumDescriptorProto
+func (f *file) decodeEnum(scope string, data []byte) error {
+	e := &enum{values: make(map[int32]string)}
+	err := eachField(data, func(number int32, b *buffer, wireType int) error {
+		if wireType != wireBytes {
+			return b.skip(number, wireType)
+		}
+		v, err := b.bytes()
+		if err != nil {
+			return err
+		}
+		switch number {
+		case 1:
+			e.fullName = fullName(scope, string(v))
+		case 2:
+			var (
+				name string
+				num  int32
+			)
+			err = eachField(v, func(number int32, b *buffer, wireType int) error {
+				switch {
+				case number == 1 && wireType == wireBytes:
+					v, err := b.bytes()
+					name = string(v)
+					return err
+				case number == 2 && wireType == wireVarint:
+					v, err := b.varint()
+					num = int32(v)
+					return err
+				}
+				return b.skip(number, wireType)
+			})
+			// 别名只保留第一个名字
+			if _, ok := e.values[num]; !ok {
+				e.values[num] = name
+			}
+		}
+		return err
+	})
+	f.enums = append(f.enums, e)
+
+	return err
+}
+
+// decodeService 解码 ServiceDescriptorProto
+func (f *file) decodeService(data []byte) error {
+	var (
+		name    string
+		methods [][]byte
+	)
+	err := eachField(data, func(number int32, b *buffer, wireType int) error {
+		if wireType != wireBytes {
+			return b.skip(number, wireType)
+		}
+		v, err := b.bytes()
+		switch number {
+		case 1:
+			name = string(v)
+		case 2:
+			methods = append(methods, v)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, data := range methods {
+		m := &method{scope: f.pkg}
+		var methodName string
+		err = eachField(data, func(number int32, b *buffer, wireType int) error {
+			if wireType == wireVarint {
+				v, err := b.varint()
+				switch number {
+				case 5:
+					m.clientStreaming = v != 0
+				case 6:
+					m.serverStreaming = v != 0
+				}
+				return err
+			}
+			if wireType != wireBytes {
+				return b.skip(number, wireType)
+			}
+			v, err := b.bytes()
+			switch number {
+			case 1:
+				methodName = string(v)
+			case 2:
+				m.input = string(v)
+			case 3:
+				m.output = string(v)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		m.path = "/" + fullName(f.pkg, name) + "/" + methodName
+		f.methods = append(f.methods, m)
+	}
+
+	return nil
+}
+
+// eachField 依次处理消息的每个字段, fn 负责读出字段的值
+func eachField(data []byte, fn func(number int32, b *buffer, wireType int) error) error {
+	b := buffer(data)
+	for len(b) > 0 {
+		number, wireType, err := b.tag()
+		if err != nil {
+			return err
+		}
+		if err = fn(number, &b, wireType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func fullName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+
+	return scope + "." + name
+}
+
+// jsonName 和 protoc 一样把下划线后面的字母转为大写
+func jsonName(name string) string {
+	var sb strings.Builder
+	upper := false
+	for _, c := range name {
+		switch {
+		case c == '_':
+			upper = true
+		case upper:
+			sb.WriteRune(unicode.ToUpper(c))
+			upper = false
+		default:
+			sb.WriteRune(c)
+		}
+	}
+
+	return sb.String()
+}
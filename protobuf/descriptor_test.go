@@ -0,0 +1,76 @@
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitDescriptor descriptor set unit test execute
+func TestUnitDescriptor(t *testing.T) {
+	suite.Run(t, new(descriptorSuite))
+}
+
+type descriptorSuite struct {
+	suite.Suite
+}
+
+// baseFile base.proto: package base; enum State { ACTIVE = 1; }
+func baseFile() encoder {
+	return encoder{}.str(1, "base.proto").str(2, "base").
+		msg(5, encoder{}.str(1, "State").msg(2, encoder{}.str(1, "ACTIVE").varint(2, 1)))
+}
+
+// shopFile shop.proto, 依赖 base.proto:
+//
+//	message Item { string sku = 1; repeated Item children = 2; map<string, base.State> states = 3; }
+//	service Store { rpc Get(Item) returns (Item); }
+func shopFile() encoder {
+	entry := encoder{}.str(1, "StatesEntry").
+		msg(2, encoder{}.str(1, "key").varint(3, 1).varint(5, uint64(typeString))).
+		msg(2, encoder{}.str(1, "value").varint(3, 2).varint(5, uint64(typeEnum)).str(6, ".base.State")).
+		msg(7, encoder{}.varint(7, 1))
+	item := encoder{}.str(1, "Item").
+		msg(2, encoder{}.str(1, "sku").varint(3, 1).varint(5, uint64(typeString)).str(10, "SKU")).
+		msg(2, encoder{}.str(1, "children").varint(3, 2).varint(4, labelRepeated).varint(5, uint64(typeMessage)).
+			str(6, ".shop.Item")).
+		msg(2, encoder{}.str(1, "states").varint(3, 3).varint(4, labelRepeated).varint(5, uint64(typeMessage)).
+			str(6, ".shop.Item.StatesEntry")).
+		msg(3, entry)
+
+	return encoder{}.str(1, "shop.proto").str(2, "shop").str(3, "base.proto").msg(4, item).
+		msg(6, encoder{}.str(1, "Store").msg(2, encoder{}.str(1, "Get").str(2, ".shop.Item").str(3, ".shop.Item")))
+}
+
+func (s *descriptorSuite) TestAddDescriptorSet() {
+	item := encoder{}.str(1, "a").msg(2, encoder{}.str(1, "b")).msg(3, encoder{}.str(1, "x").varint(2, 1))
+
+	for _, tt := range []struct {
+		name    string
+		set     encoder
+		wantErr bool
+	}{
+		{name: "with imports", set: encoder{}.msg(1, baseFile()).msg(1, shopFile())},
+		{name: "missing import", set: encoder{}.msg(1, shopFile()), wantErr: true},
+		{name: "invalid", set: encoder{}.msg(1, shopFile())[:20], wantErr: true},
+	} {
+		s.Run(tt.name, func() {
+			r := NewRegistry()
+			err := r.AddDescriptorSet(tt.set)
+			if tt.wantErr {
+				s.Error(err)
+				return
+			}
+			s.Require().NoError(err)
+			s.Equal(1, r.Methods())
+
+			got, err := r.Decode("shop.Item", item)
+			s.NoError(err)
+			s.Equal(map[string]interface{}{
+				"SKU":      "a",
+				"children": []interface{}{map[string]interface{}{"SKU": "b"}},
+				"states":   map[string]interface{}{"x": "ACTIVE"},
+			}, got)
+		})
+	}
+}
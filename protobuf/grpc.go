@@ -0,0 +1,156 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/net/http2"
+
+	"goreplay/framer"
+)
+
+const grpcMessagePrefix = 5 // 压缩标志和 4 字节的长度
+
+// ErrUnknownMethod the grpc method of the call isn't in the registry
+var ErrUnknownMethod = errors.New("protobuf: unknown grpc method")
+
+// grpcCall 一个 grpc 请求或响应的 headers 和 body
+type grpcCall struct {
+	path     string
+	encoding string
+	metadata map[string]interface{}
+	body     []byte
+}
+
+// DecodeRequest decodes a grpc request, the http2 frames of one call as grouped by the grpc framer,
+// to its path, metadata and the messages decoded with the input type of the method
+func (r *Registry) DecodeRequest(data []byte) (map[string]interface{}, error) {
+	call, err := readGRPCCall(data)
+	if err != nil {
+		return nil, err
+	}
+	m := r.methods[call.path]
+	if m == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMethod, call.path)
+	}
+
+	messages, err := r.decodeMessages(m.in, call)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"path": call.path, "metadata": call.metadata, "messages": messages}, nil
+}
+
+// DecodeResponse decodes the grpc response of a call to path, its metadata including the trailers and
+// the messages decoded with the output type of the method
+func (r *Registry) DecodeResponse(path string, data []byte) (map[string]interface{}, error) {
+	m := r.methods[path]
+	if m == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMethod, path)
+	}
+	call, err := readGRPCCall(data)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := r.decodeMessages(m.out, call)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"metadata": call.metadata, "messages": messages}, nil
+}
+
+// decodeMessages 解码 body 中的每个消息
+func (r *Registry) decodeMessages(m *message, call *grpcCall) ([]interface{}, error) {
+	data, err := grpcMessages(call)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]interface{}, 0, len(data))
+	for _, d := range data {
+		msg, err := r.decodeMessage(m, d)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// grpcMessages 按 grpc 的长度前缀拆分 body, 解压压缩的消息
+func grpcMessages(call *grpcCall) ([][]byte, error) {
+	var messages [][]byte
+	for body := call.body; len(body) > 0; {
+		if len(body) < grpcMessagePrefix {
+			return nil, ErrInvalid
+		}
+		compressed := body[0] == 1
+		n := binary.BigEndian.Uint32(body[1:grpcMessagePrefix])
+		if uint64(n) > uint64(len(body)-grpcMessagePrefix) {
+			return nil, ErrInvalid
+		}
+		data := body[grpcMessagePrefix : grpcMessagePrefix+n]
+		body = body[grpcMessagePrefix+n:]
+
+		if compressed {
+			if call.encoding != "gzip" {
+				return nil, fmt.Errorf("protobuf: unsupported grpc-encoding %q", call.encoding)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			if data, err = ioutil.ReadAll(zr); err != nil {
+				return nil, err
+			}
+		}
+		messages = append(messages, data)
+	}
+
+	return messages, nil
+}
+
+// readGRPCCall 读取 http2 frame, headers 是独立编码的. logreplay 记录的请求前面可能有 client preface
+func readGRPCCall(data []byte) (*grpcCall, error) {
+	data = bytes.TrimPrefix(data, []byte(http2.ClientPreface))
+	fr := framer.NewHTTP2Framer(data, "", true)
+	fr.SetMaxReadFrameSize(1<<24 - 1)
+
+	call := &grpcCall{metadata: make(map[string]interface{})}
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			break
+		}
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			for _, hf := range f.Fields {
+				switch hf.Name {
+				case ":path":
+					call.path = hf.Value
+				case "grpc-encoding":
+					call.encoding = hf.Value
+				}
+				if !hf.IsPseudo() && hf.Name != framer.LogReplayTraceID {
+					call.metadata[hf.Name] = hf.Value
+				}
+			}
+		case *http2.DataFrame:
+			call.body = append(call.body, f.Data()...)
+		}
+	}
+
+	if len(call.metadata) == 0 && call.path == "" && len(call.body) == 0 {
+		return nil, ErrInvalid
+	}
+
+	return call, nil
+}
@@ -0,0 +1,187 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// TestUnitGRPC grpc message decode unit test execute
+func TestUnitGRPC(t *testing.T) {
+	suite.Run(t, new(grpcSuite))
+}
+
+type grpcSuite struct {
+	suite.Suite
+}
+
+// grpcBody 带长度前缀的 grpc 消息
+func grpcBody(compressed bool, messages ...[]byte) []byte {
+	var body []byte
+	for _, m := range messages {
+		flag := byte(0)
+		if compressed {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			_, _ = zw.Write(m)
+			_ = zw.Close()
+			m, flag = buf.Bytes(), 1
+		}
+		body = append(body, flag, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(body[len(body)-4:], uint32(len(m)))
+		body = append(body, m...)
+	}
+
+	return body
+}
+
+// grpcFrames 一个 grpc 调用的 frame, headers 和 trailers 独立编码
+func grpcFrames(headers []hpack.HeaderField, body []byte, trailers ...hpack.HeaderField) []byte {
+	var buf bytes.Buffer
+	fw := http2.NewFramer(&buf, nil)
+	block := func(fields []hpack.HeaderField) []byte {
+		var hbuf bytes.Buffer
+		enc := hpack.NewEncoder(&hbuf)
+		for _, hf := range fields {
+			_ = enc.WriteField(hf)
+		}
+		return hbuf.Bytes()
+	}
+
+	_ = fw.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block(headers), EndHeaders: true})
+	_ = fw.WriteData(1, len(trailers) == 0, body)
+	if len(trailers) > 0 {
+		_ = fw.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block(trailers), EndHeaders: true,
+			EndStream: true})
+	}
+
+	return buf.Bytes()
+}
+
+func (s *grpcSuite) TestDecodeRequest() {
+	r := NewRegistry()
+	s.Require().NoError(r.AddProtoFile("data/helloworld.proto", []string{"data"}))
+	headers := func(path string, extra ...hpack.HeaderField) []hpack.HeaderField {
+		return append([]hpack.HeaderField{{Name: ":method", Value: "POST"}, {Name: ":path", Value: path},
+			{Name: "content-type", Value: "application/grpc"}, {Name: "_log_replay_trace_id", Value: "1"}}, extra...)
+	}
+	hello := encoder{}.str(1, "alice")
+
+	for _, tt := range []struct {
+		name    string
+		data    []byte
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "unary",
+			data: append([]byte(http2.ClientPreface), grpcFrames(headers("/helloworld.Greeter/SayHello"),
+				grpcBody(false, hello))...),
+			want: map[string]interface{}{"path": "/helloworld.Greeter/SayHello",
+				"metadata": map[string]interface{}{"content-type": "application/grpc"},
+				"messages": []interface{}{map[string]interface{}{"name": "alice"}}},
+		},
+		{
+			name: "gzip stream",
+			data: grpcFrames(headers("/helloworld.Greeter/SayHelloStream",
+				hpack.HeaderField{Name: "grpc-encoding", Value: "gzip"}), grpcBody(true, hello, encoder{})),
+			want: map[string]interface{}{"path": "/helloworld.Greeter/SayHelloStream",
+				"metadata": map[string]interface{}{"content-type": "application/grpc", "grpc-encoding": "gzip"},
+				"messages": []interface{}{map[string]interface{}{"name": "alice"}, map[string]interface{}{}}},
+		},
+		{name: "unknown method", data: grpcFrames(headers("/helloworld.Greeter/Nope"), grpcBody(false, hello)),
+			wantErr: true},
+		{name: "truncated message", data: grpcFrames(headers("/helloworld.Greeter/SayHello"),
+			grpcBody(false, hello)[:6]), wantErr: true},
+		{name: "not http2", data: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true},
+	} {
+		s.Run(tt.name, func() {
+			got, err := r.DecodeRequest(tt.data)
+			if tt.wantErr {
+				s.Error(err)
+				return
+			}
+			s.NoError(err)
+			s.Equal(tt.want, got)
+		})
+	}
+
+	resp, err := r.DecodeResponse("/helloworld.Greeter/SayHello", grpcFrames(
+		[]hpack.HeaderField{{Name: ":status", Value: "200"}}, grpcBody(false, encoder{}.str(1, "hi")),
+		hpack.HeaderField{Name: "grpc-status", Value: "0"}))
+	s.NoError(err)
+	s.Equal(map[string]interface{}{"metadata": map[string]interface{}{"grpc-status": "0"},
+		"messages": []interface{}{map[string]interface{}{"message": "hi"}}}, resp)
+}
+
+// serveReflection v1alpha 的 server reflection, v1 返回 unimplemented
+func (s *grpcSuite) serveReflection() string {
+	files := map[string][]byte{"base.proto": baseFile(), "shop.proto": shopFile()}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/grpc")
+		w.Header().Set("Trailer", "grpc-status")
+		if r.URL.Path != reflectionPaths[1] {
+			w.Header().Set("grpc-status", "12")
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		requests, err := grpcMessages(&grpcCall{body: body})
+		s.Require().NoError(err)
+		for _, req := range requests {
+			var resp encoder
+			_ = eachField(req, func(number int32, b *buffer, wireType int) error {
+				v, _ := b.bytes()
+				switch number {
+				case reflectListServices:
+					resp = encoder{}.msg(6, encoder{}.msg(1, encoder{}.str(1, "shop.Store")).
+						msg(1, encoder{}.str(1, "grpc.reflection.v1alpha.ServerReflection")))
+				case reflectFileContainingSymbol:
+					// 只返回定义服务的文件
+					resp = encoder{}.msg(4, encoder{}.msg(1, files["shop.proto"]))
+				case reflectFileByFilename:
+					resp = encoder{}.msg(4, encoder{}.msg(1, files[string(v)]))
+				}
+				return nil
+			})
+			_, _ = w.Write(grpcBody(false, resp))
+		}
+		w.Header().Set("grpc-status", "0")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	s.T().Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func (s *grpcSuite) TestAddReflection() {
+	r := NewRegistry()
+	s.Require().NoError(r.AddReflection(s.serveReflection(), time.Second))
+	s.Equal(1, r.Methods())
+
+	got, err := r.Decode("shop.Item", encoder{}.msg(3, encoder{}.str(1, "x").varint(2, 1)))
+	s.NoError(err)
+	s.Equal(map[string]interface{}{"states": map[string]interface{}{"x": "ACTIVE"}}, got)
+
+	s.Error(NewRegistry().AddReflection("127.0.0.1:1", 100*time.Millisecond))
+}
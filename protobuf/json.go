@@ -0,0 +1,368 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Decode decodes a serialized message of the named type, for example helloworld.HelloRequest, to the
+// protojson mapping: fields by their json name, 64 bit integers as strings, bytes as base64 and enums
+// by name. Unknown fields are left out
+func (r *Registry) Decode(name string, data []byte) (interface{}, error) {
+	m := r.messages[strings.TrimPrefix(name, ".")]
+	if m == nil {
+		return nil, fmt.Errorf("protobuf: unknown message %s", name)
+	}
+
+	return r.decodeMessage(m, data)
+}
+
+func (r *Registry) decodeMessage(m *message, data []byte) (interface{}, error) {
+	b := buffer(data)
+	fields, err := r.decodeFields(m, &b, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.wellKnown(m, fields), nil
+}
+
+// decodeFields 解码消息的字段, group 不为 0 时读到 group 的 end group 为止
+func (r *Registry) decodeFields(m *message, b *buffer, group int32) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	for len(*b) > 0 {
+		number, wireType, err := b.tag()
+		if err != nil {
+			return nil, err
+		}
+		if wireType == wireEndGroup {
+			if number != group {
+				return nil, ErrInvalid
+			}
+			return out, nil
+		}
+
+		fd := m.fields[number]
+		if fd == nil {
+			if err = b.skip(number, wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err = r.decodeField(fd, b, wireType, out); err != nil {
+			return nil, err
+		}
+	}
+	if group != 0 {
+		return nil, ErrInvalid
+	}
+
+	return out, nil
+}
+
+func (r *Registry) decodeField(fd *field, b *buffer, wireType int, out map[string]interface{}) error {
+	// packed repeated 标量
+	if fd.repeated && wireType == wireBytes && scalarWireType(fd.typ) != wireBytes {
+		v, err := b.bytes()
+		if err != nil {
+			return err
+		}
+		list, _ := out[fd.jsonName].([]interface{})
+		for p := buffer(v); len(p) > 0; {
+			value, err := r.value(fd, &p, scalarWireType(fd.typ))
+			if err != nil {
+				return err
+			}
+			list = append(list, value)
+		}
+		out[fd.jsonName] = list
+		return nil
+	}
+
+	value, err := r.value(fd, b, wireType)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fd.message != nil && fd.message.mapEntry:
+		entries, _ := out[fd.jsonName].(map[string]interface{})
+		if entries == nil {
+			entries = make(map[string]interface{})
+		}
+		entry, _ := value.(map[string]interface{})
+		key, ok := entry["key"]
+		if !ok {
+			key = zero(fd.message.fields[1])
+		}
+		if entries[fmt.Sprint(key)], ok = entry["value"]; !ok {
+			entries[fmt.Sprint(key)] = r.zeroValue(fd.message.fields[2])
+		}
+		out[fd.jsonName] = entries
+	case fd.repeated:
+		list, _ := out[fd.jsonName].([]interface{})
+		out[fd.jsonName] = append(list, value)
+	default:
+		out[fd.jsonName] = value
+	}
+
+	return nil
+}
+
+// value 读取字段的一个值
+func (r *Registry) value(fd *field, b *buffer, wireType int) (interface{}, error) {
+	switch fd.typ {
+	case typeGroup:
+		if wireType != wireStartGroup || fd.message == nil {
+			return nil, ErrInvalid
+		}
+		fields, err := r.decodeFields(fd.message, b, fd.number)
+		if err != nil {
+			return nil, err
+		}
+		return r.wellKnown(fd.message, fields), nil
+	case typeMessage:
+		v, err := b.bytes()
+		if err != nil || wireType != wireBytes || fd.message == nil {
+			return nil, ErrInvalid
+		}
+		return r.decodeMessage(fd.message, v)
+	}
+
+	if wireType != scalarWireType(fd.typ) {
+		return nil, ErrInvalid
+	}
+
+	return scalar(fd, b)
+}
+
+// scalar 标量的值, 数字类型按 protojson 的格式
+func scalar(fd *field, b *buffer) (interface{}, error) {
+	switch fd.typ {
+	case typeString:
+		v, err := b.bytes()
+		return string(v), err
+	case typeBytes:
+		v, err := b.bytes()
+		return base64.StdEncoding.EncodeToString(v), err
+	case typeFixed32, typeSfixed32, typeFloat:
+		v, err := b.fixed32()
+		switch fd.typ {
+		case typeFixed32:
+			return v, err
+		case typeSfixed32:
+			return int32(v), err
+		}
+		return float(float64(math.Float32frombits(v))), err
+	case typeFixed64, typeSfixed64, typeDouble:
+		v, err := b.fixed64()
+		switch fd.typ {
+		case typeFixed64:
+			return strconv.FormatUint(v, 10), err
+		case typeSfixed64:
+			return strconv.FormatInt(int64(v), 10), err
+		}
+		return float(math.Float64frombits(v)), err
+	}
+
+	v, err := b.varint()
+	if err != nil {
+		return nil, err
+	}
+	switch fd.typ {
+	case typeInt32:
+		return int32(v), nil
+	case typeUint32:
+		return uint32(v), nil
+	case typeSint32:
+		return int32(uint32(v)>>1) ^ -int32(v&1), nil
+	case typeInt64:
+		return strconv.FormatInt(int64(v), 10), nil
+	case typeUint64:
+		return strconv.FormatUint(v, 10), nil
+	case typeSint64:
+		return strconv.FormatInt(int64(v>>1)^-int64(v&1), 10), nil
+	case typeBool:
+		return v != 0, nil
+	case typeEnum:
+		if fd.enum != nil {
+			if name, ok := fd.enum.values[int32(v)]; ok {
+				return name, nil
+			}
+		}
+		return int32(v), nil
+	}
+
+	return nil, ErrInvalid
+}
+
+func scalarWireType(typ fieldType) int {
+	switch typ {
+	case typeFixed32, typeSfixed32, typeFloat:
+		return wireFixed32
+	case typeFixed64, typeSfixed64, typeDouble:
+		return wireFixed64
+	case typeString, typeBytes, typeMessage:
+		return wireBytes
+	case typeGroup:
+		return wireStartGroup
+	}
+
+	return wireVarint
+}
+
+// float NaN 和 Infinity 在 JSON 中是字符串
+func float(v float64) interface{} {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+
+	return v
+}
+
+// zero 没有编码的标量的默认值
+func zero(fd *field) interface{} {
+	switch fd.typ {
+	case typeString, typeBytes:
+		return ""
+	case typeBool:
+		return false
+	case typeInt64, typeUint64, typeSint64, typeFixed64, typeSfixed64:
+		return "0"
+	case typeEnum:
+		if fd.enum != nil && fd.enum.values[0] != "" {
+			return fd.enum.values[0]
+		}
+	}
+
+	return 0
+}
+
+func (r *Registry) zeroValue(fd *field) interface{} {
+	if fd.message != nil {
+		return r.wellKnown(fd.message, map[string]interface{}{})
+	}
+
+	return zero(fd)
+}
+
+// wellKnown google.protobuf 中的类型按 protojson 的特殊格式
+func (r *Registry) wellKnown(m *message, fields map[string]interface{}) interface{} {
+	if !strings.HasPrefix(m.fullName, "google.protobuf.") {
+		return fields
+	}
+
+	name := strings.TrimPrefix(m.fullName, "google.protobuf.")
+	switch name {
+	case "Timestamp":
+		seconds, nanos := secondsNanos(fields)
+		return time.Unix(seconds, int64(nanos)).UTC().Format(time.RFC3339Nano)
+	case "Duration":
+		return duration(secondsNanos(fields))
+	case "DoubleValue", "FloatValue", "Int64Value", "UInt64Value", "Int32Value", "UInt32Value", "BoolValue",
+		"StringValue", "BytesValue":
+		if v, ok := fields["value"]; ok {
+			return v
+		}
+		return zero(m.fields[1])
+	case "Struct":
+		if v, ok := fields["fields"]; ok {
+			return v
+		}
+		return map[string]interface{}{}
+	case "ListValue":
+		if v, ok := fields["values"]; ok {
+			return v
+		}
+		return []interface{}{}
+	case "Value":
+		for k, v := range fields {
+			if k == "nullValue" {
+				return nil
+			}
+			return v
+		}
+		return nil
+	case "FieldMask":
+		paths, _ := fields["paths"].([]interface{})
+		s := make([]string, 0, len(paths))
+		for _, p := range paths {
+			s = append(s, jsonName(fmt.Sprint(p)))
+		}
+		return strings.Join(s, ",")
+	case "Any":
+		return r.any(fields)
+	}
+
+	return fields
+}
+
+// any 已知的类型解码为 @type 加上消息的字段
+func (r *Registry) any(fields map[string]interface{}) interface{} {
+	typeURL, _ := fields["typeUrl"].(string)
+	value, _ := fields["value"].(string)
+	out := map[string]interface{}{"@type": typeURL}
+
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		out["value"] = value
+		return out
+	}
+	decoded, err := r.Decode(typeURL[strings.LastIndexByte(typeURL, '/')+1:], data)
+	if err != nil {
+		out["value"] = value
+		return out
+	}
+	if msg, ok := decoded.(map[string]interface{}); ok {
+		for k, v := range msg {
+			out[k] = v
+		}
+		return out
+	}
+	out["value"] = decoded
+
+	return out
+}
+
+func secondsNanos(fields map[string]interface{}) (int64, int32) {
+	seconds, _ := fields["seconds"].(string)
+	s, _ := strconv.ParseInt(seconds, 10, 64)
+	nanos, _ := fields["nanos"].(int32)
+
+	return s, nanos
+}
+
+// duration 格式为 1.5s, 小数部分为 0, 3, 6 或 9 位
+func duration(seconds int64, nanos int32) string {
+	sign := ""
+	if seconds < 0 || nanos < 0 {
+		sign = "-"
+	}
+	if seconds < 0 {
+		seconds = -seconds
+	}
+	if nanos < 0 {
+		nanos = -nanos
+	}
+
+	s := sign + strconv.FormatInt(seconds, 10)
+	if nanos == 0 {
+		return s + "s"
+	}
+	frac := fmt.Sprintf("%09d", nanos)
+	for strings.HasSuffix(frac, "000") {
+		frac = frac[:len(frac)-3]
+	}
+
+	return s + "." + frac + "s"
+}
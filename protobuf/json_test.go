@@ -0,0 +1,146 @@
+package protobuf
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitDecode protobuf decode unit test execute
+func TestUnitDecode(t *testing.T) {
+	suite.Run(t, new(decodeSuite))
+}
+
+type decodeSuite struct {
+	suite.Suite
+	r *Registry
+}
+
+func (s *decodeSuite) SetupTest() {
+	s.r = NewRegistry()
+	s.Require().NoError(s.r.AddProtoFile("data/helloworld.proto", []string{"data"}))
+}
+
+// helloRequest 编码 helloworld.HelloRequest
+func helloRequest() encoder {
+	return encoder{}.
+		str(1, "alice").
+		varint(2, 42).
+		msg(3, appendVarint(appendVarint(nil, 1), 2)).
+		msg(4, encoder{}.str(1, "env").msg(2, encoder{}.str(1, "prod"))).
+		varint(5, 1).
+		str(6, "alice@example.com").
+		msg(8, encoder{}.varint(1, 1)).
+		msg(9, encoder{}.varint(1, 1609556645).varint(2, 500000000)).
+		str(10, "\x01\x02").
+		varint(11, 5).
+		fixed64(12, math.Float64bits(0.5)).
+		varint(99, 1)
+}
+
+func (s *decodeSuite) TestDecode() {
+	for _, tt := range []struct {
+		name    string
+		typ     string
+		data    encoder
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name: "request",
+			typ:  "helloworld.HelloRequest",
+			data: helloRequest(),
+			want: map[string]interface{}{
+				"name":      "alice",
+				"userId":    "42",
+				"scores":    []interface{}{int32(1), int32(2)},
+				"labels":    map[string]interface{}{"env": map[string]interface{}{"value": "prod"}},
+				"kind":      "KIND_USER",
+				"email":     "alice@example.com",
+				"inner":     map[string]interface{}{"ok": true},
+				"createdAt": "2021-01-02T03:04:05.5Z",
+				"token":     "AQI=",
+				"delta":     int32(-3),
+				"ratio":     0.5,
+			},
+		},
+		{
+			name: "unpacked repeated and nested type",
+			typ:  ".helloworld.HelloReply",
+			data: encoder{}.str(1, "hi").msg(2, encoder{}.varint(1, 1)).msg(2, encoder{}),
+			want: map[string]interface{}{
+				"message": "hi",
+				"items":   []interface{}{map[string]interface{}{"ok": true}, map[string]interface{}{}},
+			},
+		},
+		{name: "empty", typ: "helloworld.HelloReply", want: map[string]interface{}{}},
+		{name: "unknown type", typ: "helloworld.Nope", wantErr: true},
+		{name: "wrong wire type", typ: "helloworld.HelloReply", data: encoder{}.varint(1, 1), wantErr: true},
+		{name: "truncated", typ: "helloworld.HelloRequest", data: helloRequest()[:10], wantErr: true},
+	} {
+		s.Run(tt.name, func() {
+			got, err := s.r.Decode(tt.typ, tt.data)
+			if tt.wantErr {
+				s.Error(err)
+				return
+			}
+			s.NoError(err)
+			s.Equal(tt.want, got)
+		})
+	}
+}
+
+func (s *decodeSuite) TestWellKnown() {
+	timestamp := encoder{}.str(1, "type.googleapis.com/google.protobuf.Timestamp").
+		msg(2, encoder{}.varint(1, 1609556645))
+	value := encoder{}.msg(5, encoder{}.msg(1, encoder{}.str(1, "a").msg(2, encoder{}.varint(4, 1))))
+
+	for _, tt := range []struct {
+		typ  string
+		data encoder
+		want interface{}
+	}{
+		{typ: "google.protobuf.Duration", data: encoder{}.varint(1, 1).varint(2, 500000000), want: "1.500s"},
+		{typ: "google.protobuf.Duration", data: encoder{}.varint(1, 3), want: "3s"},
+		{typ: "google.protobuf.Int64Value", data: encoder{}.varint(1, 7), want: "7"},
+		{typ: "google.protobuf.BoolValue", want: false},
+		{typ: "google.protobuf.FieldMask", data: encoder{}.str(1, "user_id").str(1, "name"), want: "userId,name"},
+		{typ: "google.protobuf.Any", data: timestamp,
+			want: map[string]interface{}{"@type": "type.googleapis.com/google.protobuf.Timestamp",
+				"value": "2021-01-02T03:04:05Z"}},
+		{typ: "google.protobuf.Any", data: encoder{}.str(1, "type.googleapis.com/common.Label").
+			msg(2, encoder{}.str(1, "prod")), want: map[string]interface{}{"@type": "type.googleapis.com/common.Label",
+			"value": "prod"}},
+		{typ: "google.protobuf.Value", data: value, want: map[string]interface{}{"a": true}},
+		{typ: "google.protobuf.Value", data: encoder{}.varint(1, 0), want: nil},
+	} {
+		s.Run(tt.typ, func() {
+			got, err := s.r.Decode(tt.typ, tt.data)
+			s.NoError(err)
+			s.Equal(tt.want, got)
+		})
+	}
+}
+
+func (s *decodeSuite) TestAddProtoFile() {
+	for _, tt := range []struct {
+		name string
+		src  string
+	}{
+		{name: "unknown type", src: `syntax = "proto3"; message A { B b = 1; }`},
+		{name: "unknown import", src: `syntax = "proto3"; import "nope.proto";`},
+		{name: "syntax error", src: `syntax = "proto3"; message A { string a = ; }`},
+		{name: "unterminated", src: `syntax = "proto3"; message A { string a = 1;`},
+	} {
+		s.Run(tt.name, func() {
+			dir := s.T().TempDir()
+			s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "a.proto"), []byte(tt.src), 0600))
+			s.Error(NewRegistry().AddProtoFile(filepath.Join(dir, "a.proto"), []string{dir}))
+		})
+	}
+
+	s.Equal(2, s.r.Methods())
+}
@@ -0,0 +1,99 @@
+package protobuf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"goreplay/config"
+)
+
+// Load builds a registry from the descriptor sets, .proto files and server reflection of conf
+func Load(conf *config.ProtobufConfig) (*Registry, error) {
+	r := NewRegistry()
+	for _, path := range conf.DescriptorSets {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.AddDescriptorSet(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	for _, path := range conf.Files {
+		if err := r.AddProtoFile(path, conf.ImportPaths); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Reflection != "" {
+		if err := r.AddReflection(conf.Reflection, conf.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// AddProtoFile parses a .proto file and the files it imports, which are searched in importPaths and
+// then relative to the working directory
+func (r *Registry) AddProtoFile(path string, importPaths []string) error {
+	name := path
+	for _, dir := range importPaths {
+		if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = filepath.ToSlash(rel)
+			break
+		}
+	}
+
+	if err := r.addProtoFile(name, importPaths, make(map[string]bool)); err != nil {
+		return err
+	}
+
+	return r.link()
+}
+
+// addProtoFile 先加入 import 的文件, loading 用于发现循环 import
+func (r *Registry) addProtoFile(name string, importPaths []string, loading map[string]bool) error {
+	if r.files[name] != nil {
+		return nil
+	}
+	if loading[name] {
+		return fmt.Errorf("protobuf: import cycle through %s", name)
+	}
+	loading[name] = true
+
+	src, err := readImport(name, importPaths)
+	if err != nil {
+		return err
+	}
+	f, err := parseProto(name, string(src))
+	if err != nil {
+		return err
+	}
+	for _, dep := range f.deps {
+		if err = r.addProtoFile(dep, importPaths, loading); err != nil {
+			return err
+		}
+	}
+	r.add(f)
+
+	return nil
+}
+
+func readImport(name string, importPaths []string) ([]byte, error) {
+	for _, dir := range importPaths {
+		src, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err == nil {
+			return src, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return ioutil.ReadFile(filepath.FromSlash(name))
+}
@@ -0,0 +1,492 @@
+package protobuf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scalarTypes .proto 中的标量类型
+var scalarTypes = map[string]fieldType{
+	"double": typeDouble, "float": typeFloat, "int64": typeInt64, "uint64": typeUint64,
+	"int32": typeInt32, "fixed64": typeFixed64, "fixed32": typeFixed32, "bool": typeBool,
+	"string": typeString, "bytes": typeBytes, "uint32": typeUint32, "sfixed32": typeSfixed32,
+	"sfixed64": typeSfixed64, "sint32": typeSint32, "sint64": typeSint64,
+}
+
+// parser 解析 .proto 文件中解码需要的定义: 消息, 枚举和服务. 选项, 扩展和 group 被跳过
+type parser struct {
+	name   string
+	src    string
+	pos    int
+	line   int
+	peeked string
+	f      *file
+}
+
+// parseProto 解析 .proto 文件, name 是 import 时使用的名字
+func parseProto(name, src string) (*file, error) {
+	p := &parser{name: name, src: src, line: 1, f: &file{name: name}}
+	for {
+		tok := p.next()
+		var err error
+		switch tok {
+		case "":
+			return p.f, nil
+		case ";":
+		case "syntax", "edition", "option":
+			err = p.skipStatement()
+		case "package":
+			p.f.pkg = p.next()
+			err = p.expect(";")
+		case "import":
+			err = p.parseImport()
+		case "message":
+			err = p.parseMessage(p.f.pkg)
+		case "enum":
+			err = p.parseEnum(p.f.pkg)
+		case "service":
+			err = p.parseService()
+		case "extend":
+			err = p.skipBlock()
+		default:
+			err = p.errorf("unexpected %q", tok)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseImport() error {
+	tok := p.next()
+	if tok == "public" || tok == "weak" {
+		tok = p.next()
+	}
+	dep, err := p.unquote(tok)
+	if err != nil {
+		return err
+	}
+	p.f.deps = append(p.f.deps, dep)
+
+	return p.expect(";")
+}
+
+func (p *parser) parseMessage(scope string) error {
+	m := &message{fullName: fullName(scope, p.next()), fields: make(map[int32]*field)}
+	p.f.messages = append(p.f.messages, m)
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+
+	return p.parseMessageBody(m, "}")
+}
+
+// parseMessageBody 解析消息或 oneof 的内容, 直到 end
+func (p *parser) parseMessageBody(m *message, end string) error {
+	for {
+		tok := p.next()
+		var err error
+		switch tok {
+		case end:
+			return nil
+		case "":
+			return p.errorf("unexpected end of file")
+		case ";":
+		case "message":
+			err = p.parseMessage(m.fullName)
+		case "enum":
+			err = p.parseEnum(m.fullName)
+		case "option", "reserved", "extensions":
+			err = p.skipStatement()
+		case "extend":
+			err = p.skipBlock()
+		case "oneof":
+			p.next()
+			if err = p.expect("{"); err == nil {
+				err = p.parseMessageBody(m, "}")
+			}
+		case "map":
+			err = p.parseMap(m)
+		default:
+			err = p.parseField(m, tok)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseField 解析 [label] type name = number [options];
+func (p *parser) parseField(m *message, tok string) error {
+	fd := &field{scope: m.fullName}
+	if tok == "repeated" || tok == "optional" || tok == "required" {
+		fd.repeated = tok == "repeated"
+		tok = p.next()
+	}
+	if tok == "group" {
+		// proto2 的 group 不解码
+		return p.skipBlock()
+	}
+	p.setType(fd, tok)
+
+	fd.name = p.next()
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	number, err := p.number()
+	if err != nil {
+		return err
+	}
+	fd.number = number
+	if fd.jsonName, err = p.fieldOptions(); err != nil {
+		return err
+	}
+	if fd.jsonName == "" {
+		fd.jsonName = jsonName(fd.name)
+	}
+	m.fields[fd.number] = fd
+	p.f.fields = append(p.f.fields, fd)
+
+	return nil
+}
+
+// parseMap map<key, value> name = number; 和 protoc 一样生成 NameEntry 消息
+func (p *parser) parseMap(m *message) error {
+	if err := p.expect("<"); err != nil {
+		return err
+	}
+	key := p.next()
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	value := p.next()
+	if err := p.expect(">"); err != nil {
+		return err
+	}
+
+	fd := &field{name: p.next(), typ: typeMessage, repeated: true}
+	entryName := jsonName(fd.name)
+	entry := &message{fullName: m.fullName + "." + strings.ToUpper(entryName[:1]) + entryName[1:] + "Entry",
+		fields: make(map[int32]*field), mapEntry: true}
+	entry.fields[1] = &field{name: "key", jsonName: "key", number: 1}
+	entry.fields[2] = &field{name: "value", jsonName: "value", number: 2, scope: m.fullName}
+	p.setType(entry.fields[1], key)
+	p.setType(entry.fields[2], value)
+	p.f.messages = append(p.f.messages, entry)
+	p.f.fields = append(p.f.fields, entry.fields[2])
+	fd.message = entry
+
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	number, err := p.number()
+	if err != nil {
+		return err
+	}
+	fd.number = number
+	if fd.jsonName, err = p.fieldOptions(); err != nil {
+		return err
+	}
+	if fd.jsonName == "" {
+		fd.jsonName = jsonName(fd.name)
+	}
+	m.fields[fd.number] = fd
+
+	return nil
+}
+
+func (p *parser) setType(fd *field, name string) {
+	if typ, ok := scalarTypes[name]; ok {
+		fd.typ = typ
+		return
+	}
+	fd.typeName = name
+}
+
+// fieldOptions 解析字段的 [options], 返回 json_name
+func (p *parser) fieldOptions() (string, error) {
+	tok := p.next()
+	if tok == ";" {
+		return "", nil
+	}
+	if tok != "[" {
+		return "", p.errorf("expected ; got %q", tok)
+	}
+
+	var (
+		name  string
+		value []string
+		depth int
+	)
+	for {
+		tok = p.next()
+		switch {
+		case tok == "":
+			return "", p.errorf("unexpected end of file")
+		case tok == "{":
+			depth++
+		case tok == "}":
+			depth--
+		case depth == 0 && (tok == "," || tok == "]"):
+			if len(value) == 3 && value[0] == "json_name" && value[1] == "=" {
+				name, _ = p.unquote(value[2])
+			}
+			value = value[:0]
+			if tok == "]" {
+				return name, p.expect(";")
+			}
+			continue
+		}
+		value = append(value, tok)
+	}
+}
+
+func (p *parser) parseEnum(scope string) error {
+	e := &enum{fullName: fullName(scope, p.next()), values: make(map[int32]string)}
+	p.f.enums = append(p.f.enums, e)
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+
+	for {
+		tok := p.next()
+		switch tok {
+		case "}":
+			return nil
+		case "":
+			return p.errorf("unexpected end of file")
+		case ";":
+			continue
+		case "option", "reserved":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := p.expect("="); err != nil {
+			return err
+		}
+		number, err := p.number()
+		if err != nil {
+			return err
+		}
+		if _, ok := e.values[number]; !ok {
+			e.values[number] = tok
+		}
+		if _, err = p.fieldOptions(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *parser) parseService() error {
+	service := fullName(p.f.pkg, p.next())
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+
+	for {
+		tok := p.next()
+		switch tok {
+		case "}":
+			return nil
+		case "":
+			return p.errorf("unexpected end of file")
+		case ";":
+		case "option":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case "rpc":
+			if err := p.parseRPC(service); err != nil {
+				return err
+			}
+		default:
+			return p.errorf("unexpected %q", tok)
+		}
+	}
+}
+
+// parseRPC rpc Name (stream In) returns (stream Out) {...} 或者 ;
+func (p *parser) parseRPC(service string) error {
+	m := &method{path: "/" + service + "/" + p.next(), scope: p.f.pkg}
+	var err error
+	if m.input, m.clientStreaming, err = p.rpcType(); err != nil {
+		return err
+	}
+	if err = p.expect("returns"); err != nil {
+		return err
+	}
+	if m.output, m.serverStreaming, err = p.rpcType(); err != nil {
+		return err
+	}
+	p.f.methods = append(p.f.methods, m)
+
+	if tok := p.next(); tok == "{" {
+		p.peeked = tok
+		return p.skipBlock()
+	} else if tok != ";" {
+		return p.errorf("expected ; got %q", tok)
+	}
+
+	return nil
+}
+
+func (p *parser) rpcType() (string, bool, error) {
+	if err := p.expect("("); err != nil {
+		return "", false, err
+	}
+	name := p.next()
+	stream := name == "stream"
+	if stream {
+		name = p.next()
+	}
+
+	return name, stream, p.expect(")")
+}
+
+// skipStatement 跳过到 ; 为止, 包括聚合选项中的 {}
+func (p *parser) skipStatement() error {
+	depth := 0
+	for {
+		switch p.next() {
+		case "":
+			return p.errorf("unexpected end of file")
+		case "{":
+			depth++
+		case "}":
+			depth--
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// skipBlock 跳过到下一个 {} 的结束
+func (p *parser) skipBlock() error {
+	depth := 0
+	for {
+		switch p.next() {
+		case "":
+			return p.errorf("unexpected end of file")
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *parser) expect(want string) error {
+	if tok := p.next(); tok != want {
+		return p.errorf("expected %q got %q", want, tok)
+	}
+
+	return nil
+}
+
+func (p *parser) number() (int32, error) {
+	tok := p.next()
+	v, err := strconv.ParseInt(tok, 0, 32)
+	if err != nil {
+		return 0, p.errorf("invalid number %q", tok)
+	}
+
+	return int32(v), nil
+}
+
+func (p *parser) unquote(tok string) (string, error) {
+	if len(tok) < 2 || (tok[0] != '"' && tok[0] != '\'') {
+		return "", p.errorf("expected string got %q", tok)
+	}
+	if tok[0] == '\'' {
+		tok = `"` + strings.ReplaceAll(tok[1:len(tok)-1], `"`, `\"`) + `"`
+	}
+	s, err := strconv.Unquote(tok)
+	if err != nil {
+		return "", p.errorf("invalid string %s", tok)
+	}
+
+	return s, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("protobuf: %s:%d: %s", p.name, p.line, fmt.Sprintf(format, args...))
+}
+
+// next 下一个 token, 文件结束时返回空
+func (p *parser) next() string {
+	if p.peeked != "" {
+		tok := p.peeked
+		p.peeked = ""
+		return tok
+	}
+
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return ""
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != c; p.pos++ {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+		}
+		p.pos++
+		if p.pos > len(p.src) {
+			p.pos = len(p.src)
+		}
+	case isWordByte(c):
+		for p.pos < len(p.src) && isWordByte(p.src[p.pos]) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+
+	return p.src[start:p.pos]
+}
+
+// skipSpace 跳过空白和注释
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == '\n':
+			p.line++
+			p.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			end := strings.Index(p.src[p.pos+2:], "*/")
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.line += strings.Count(p.src[p.pos:p.pos+2+end], "\n")
+			p.pos += end + 4
+		default:
+			return
+		}
+	}
+}
+
+// isWordByte 标识符, 带包名的类型名和数字
+func isWordByte(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || c == '+' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z'
+}
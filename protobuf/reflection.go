@@ -0,0 +1,235 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"goreplay/client"
+)
+
+// server reflection 的服务, 先尝试 v1, 旧的服务端只有 v1alpha
+var reflectionPaths = []string{
+	"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+}
+
+// ServerReflectionRequest 的字段
+const (
+	reflectFileByFilename       = 3
+	reflectFileContainingSymbol = 4
+	reflectListServices         = 7
+)
+
+// maxReflectionRounds 获取依赖的文件的最大轮数
+const maxReflectionRounds = 16
+
+type reflectionClient struct {
+	c         *client.GRPCClient
+	authority string
+	path      string
+}
+
+// AddReflection loads the files defining the services of a grpc server with server reflection. addr is
+// host:port for h2c, or https://host:port for h2 over tls without certificate verification
+func (r *Registry) AddReflection(addr string, timeout time.Duration) error {
+	secure := strings.HasPrefix(addr, "https://")
+	addr = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(addr, "https://"), "http://"), "/")
+	rc := &reflectionClient{
+		c:         client.NewGRPCClient(addr, &client.GRPCClientConfig{Timeout: timeout, Secure: secure, SkipVerify: true}),
+		authority: addr,
+	}
+	defer rc.c.Disconnect()
+
+	var (
+		services []string
+		err      error
+	)
+	for _, rc.path = range reflectionPaths {
+		if services, err = rc.listServices(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	files, err := rc.files(reflectFileContainingSymbol, services)
+	if err != nil {
+		return err
+	}
+	// 服务端可能只返回定义服务的文件, 依赖的文件按名字再获取
+	for i := 0; i < maxReflectionRounds; i++ {
+		missing := r.missingDeps(files)
+		if len(missing) == 0 {
+			break
+		}
+		more, err := rc.files(reflectFileByFilename, missing)
+		if err != nil {
+			return err
+		}
+		if len(more) == 0 {
+			return fmt.Errorf("protobuf: server reflection: files not found: %s", strings.Join(missing, ", "))
+		}
+		for name, fd := range more {
+			files[name] = fd
+		}
+	}
+
+	data := make([][]byte, 0, len(files))
+	for _, fd := range files {
+		data = append(data, fd)
+	}
+
+	return r.addFileDescriptors(data)
+}
+
+// missingDeps 依赖的文件中 registry 和 files 都没有的
+func (r *Registry) missingDeps(files map[string][]byte) []string {
+	var missing []string
+	for _, data := range files {
+		f, err := decodeFile(data)
+		if err != nil {
+			continue
+		}
+		for _, dep := range f.deps {
+			if _, ok := files[dep]; !ok && r.files[dep] == nil {
+				missing = append(missing, dep)
+			}
+		}
+	}
+
+	return missing
+}
+
+func (rc *reflectionClient) listServices() ([]string, error) {
+	responses, err := rc.call(reflectListServices, []string{"*"})
+	if err != nil {
+		return nil, err
+	}
+
+	var services []string
+	for _, resp := range responses {
+		err = eachField(resp, func(number int32, b *buffer, wireType int) error {
+			if number != 6 || wireType != wireBytes {
+				return b.skip(number, wireType)
+			}
+			// ListServiceResponse.service.name
+			v, err := b.bytes()
+			if err != nil {
+				return err
+			}
+			return eachField(v, func(number int32, b *buffer, wireType int) error {
+				if number != 1 || wireType != wireBytes {
+					return b.skip(number, wireType)
+				}
+				service, err := b.bytes()
+				if err == nil && !strings.HasPrefix(string(service), "grpc.reflection.") {
+					services = append(services, string(service))
+				}
+				return err
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return services, nil
+}
+
+// files 获取文件, 返回文件名到序列化的 FileDescriptorProto
+func (rc *reflectionClient) files(kind int32, names []string) (map[string][]byte, error) {
+	responses, err := rc.call(kind, names)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	for _, resp := range responses {
+		err = eachField(resp, func(number int32, b *buffer, wireType int) error {
+			if number != 4 || wireType != wireBytes {
+				return b.skip(number, wireType)
+			}
+			// FileDescriptorResponse.file_descriptor_proto
+			v, err := b.bytes()
+			if err != nil {
+				return err
+			}
+			return eachField(v, func(number int32, b *buffer, wireType int) error {
+				if number != 1 || wireType != wireBytes {
+					return b.skip(number, wireType)
+				}
+				fd, err := b.bytes()
+				if err != nil {
+					return err
+				}
+				f, err := decodeFile(fd)
+				if err != nil {
+					return err
+				}
+				files[f.name] = fd
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// call 在一个 stream 上为每个参数发送一个 ServerReflectionRequest, 返回所有的响应
+func (rc *reflectionClient) call(kind int32, args []string) ([][]byte, error) {
+	var hbuf, buf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	for _, hf := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: rc.path},
+		{Name: ":authority", Value: rc.authority},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "te", Value: "trailers"},
+	} {
+		if err := enc.WriteField(hf); err != nil {
+			return nil, err
+		}
+	}
+
+	var body []byte
+	for _, arg := range args {
+		req := appendBytes(nil, kind, []byte(arg))
+		body = append(body, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(body[len(body)-4:], uint32(len(req)))
+		body = append(body, req...)
+	}
+
+	fw := http2.NewFramer(&buf, nil)
+	if err := fw.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: hbuf.Bytes(),
+		EndHeaders: true}); err != nil {
+		return nil, err
+	}
+	if err := fw.WriteData(1, true, body); err != nil {
+		return nil, err
+	}
+
+	resp, err := rc.c.RoundTrip(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	call, err := readGRPCCall(resp)
+	if err != nil {
+		return nil, err
+	}
+	if status, _ := call.metadata["grpc-status"].(string); status != "" && status != "0" {
+		return nil, fmt.Errorf("protobuf: server reflection: grpc-status %s %v", status, call.metadata["grpc-message"])
+	}
+
+	return grpcMessages(call)
+}
@@ -0,0 +1,131 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// protobuf wire types
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+// ErrInvalid the data is not a valid protobuf message
+var ErrInvalid = errors.New("protobuf: invalid wire format")
+
+// buffer 按 wire format 读取的数据
+type buffer []byte
+
+func (b *buffer) varint() (uint64, error) {
+	var v uint64
+	for i := 0; i < len(*b) && i < 10; i++ {
+		c := (*b)[i]
+		v |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			*b = (*b)[i+1:]
+			return v, nil
+		}
+	}
+
+	return 0, ErrInvalid
+}
+
+func (b *buffer) fixed32() (uint32, error) {
+	if len(*b) < 4 {
+		return 0, ErrInvalid
+	}
+	v := binary.LittleEndian.Uint32(*b)
+	*b = (*b)[4:]
+
+	return v, nil
+}
+
+func (b *buffer) fixed64() (uint64, error) {
+	if len(*b) < 8 {
+		return 0, ErrInvalid
+	}
+	v := binary.LittleEndian.Uint64(*b)
+	*b = (*b)[8:]
+
+	return v, nil
+}
+
+func (b *buffer) bytes() ([]byte, error) {
+	n, err := b.varint()
+	if err != nil || n > uint64(len(*b)) {
+		return nil, ErrInvalid
+	}
+	v := (*b)[:n]
+	*b = (*b)[n:]
+
+	return v, nil
+}
+
+// tag 字段号和 wire type
+func (b *buffer) tag() (int32, int, error) {
+	v, err := b.varint()
+	if err != nil || v>>3 == 0 || v>>3 > math.MaxInt32 {
+		return 0, 0, ErrInvalid
+	}
+
+	return int32(v >> 3), int(v & 7), nil
+}
+
+// skip 跳过一个字段的值, group 跳到对应的 end group
+func (b *buffer) skip(number int32, wireType int) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = b.varint()
+	case wireFixed64:
+		_, err = b.fixed64()
+	case wireBytes:
+		_, err = b.bytes()
+	case wireFixed32:
+		_, err = b.fixed32()
+	case wireStartGroup:
+		for {
+			n, t, err := b.tag()
+			if err != nil {
+				return err
+			}
+			if t == wireEndGroup {
+				if n != number {
+					return ErrInvalid
+				}
+				return nil
+			}
+			if err = b.skip(n, t); err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrInvalid
+	}
+
+	return err
+}
+
+// appendVarint 编码 varint, 用于 server reflection 的请求
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
+
+// appendBytes 编码一个 length delimited 字段
+func appendBytes(b []byte, number int32, v []byte) []byte {
+	b = appendVarint(b, uint64(number)<<3|wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+
+	return append(b, v...)
+}
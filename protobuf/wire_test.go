@@ -0,0 +1,70 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// encoder 测试中按 wire format 编码消息
+type encoder []byte
+
+func (e encoder) varint(number int32, v uint64) encoder {
+	return appendVarint(appendVarint(e, uint64(number)<<3|wireVarint), v)
+}
+
+func (e encoder) str(number int32, v string) encoder {
+	return appendBytes(e, number, []byte(v))
+}
+
+func (e encoder) msg(number int32, v encoder) encoder {
+	return appendBytes(e, number, v)
+}
+
+func (e encoder) fixed64(number int32, v uint64) encoder {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+
+	return append(appendVarint(e, uint64(number)<<3|wireFixed64), b[:]...)
+}
+
+// TestUnitWire wire format unit test execute
+func TestUnitWire(t *testing.T) {
+	suite.Run(t, new(wireSuite))
+}
+
+type wireSuite struct {
+	suite.Suite
+}
+
+func (s *wireSuite) TestSkip() {
+	group := encoder(appendVarint(nil, 5<<3|wireStartGroup)).varint(1, 1).str(2, "x")
+	group = appendVarint(group, 5<<3|wireEndGroup)
+
+	for _, tt := range []struct {
+		name    string
+		data    encoder
+		wantErr bool
+	}{
+		{name: "varint", data: encoder{}.varint(1, 300)},
+		{name: "bytes", data: encoder{}.str(1, "hello")},
+		{name: "fixed64", data: encoder{}.fixed64(1, 7)},
+		{name: "group", data: group},
+		{name: "truncated", data: encoder{}.str(1, "hello")[:4], wantErr: true},
+		{name: "unterminated group", data: group[:len(group)-1], wantErr: true},
+	} {
+		s.Run(tt.name, func() {
+			b := buffer(tt.data)
+			number, wireType, err := b.tag()
+			s.Require().NoError(err)
+			err = b.skip(number, wireType)
+			if tt.wantErr {
+				s.Error(err)
+				return
+			}
+			s.NoError(err)
+			s.Empty(b)
+		})
+	}
+}
@@ -0,0 +1,394 @@
+// Package spool 磁盘上的先进先出队列, 进程重启后继续读取没有提交的记录
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	headerSize         = 8       // 记录头: 4 字节长度 + 4 字节 crc32
+	defaultSegmentSize = 4 << 20 // 段文件的最大大小
+	segmentExt         = ".seg"
+	offsetFile         = "offset" // 已提交的位置: 段序号 偏移
+)
+
+// ErrFull 超过大小上限, 记录没有写入
+var ErrFull = errors.New("spool: full")
+
+// Spool 记录追加写入段文件, 从最早的段开始读, 提交后删除读完的段
+type Spool struct {
+	mu          sync.Mutex
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	segments    []int64 // 段序号, 第一个是读的段, 最后一个是写的段
+	readOffset  int64   // 第一个段中已经提交的位置
+	pending     []int64 // 上次 Peek 的每条记录在第一个段中的结束位置
+	diskSize    int64   // 所有段文件的大小
+	unread      int64   // 没有提交的记录的大小
+	records     int     // 没有提交的记录数
+	writer      *os.File
+	writeSize   int64
+}
+
+// Open 打开或新建 dir 下的队列, 段文件总大小不超过 maxSize.
+// 段文件中校验失败的记录和之后的内容会被截掉
+func Open(dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= headerSize {
+		return nil, fmt.Errorf("spool: size %d is too small", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxSize: maxSize, segmentSize: defaultSegmentSize}
+	if s.segmentSize > maxSize/4 {
+		s.segmentSize = maxSize / 4
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load 找到段文件, 读取提交的位置, 统计没有提交的记录
+func (s *Spool) load() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		id, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), segmentExt), 10, 64)
+		if err == nil {
+			s.segments = append(s.segments, id)
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	readSegment, readOffset := s.loadOffset()
+	for len(s.segments) > 0 && s.segments[0] < readSegment {
+		_ = os.Remove(s.path(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) > 0 && s.segments[0] == readSegment {
+		s.readOffset = readOffset
+	}
+
+	for i, id := range s.segments {
+		from := int64(0)
+		if i == 0 {
+			from = s.readOffset
+		}
+		size, records, err := s.repair(id, from)
+		if err != nil {
+			return err
+		}
+		s.diskSize += size
+		s.unread += size - from
+		s.records += records
+	}
+
+	if len(s.segments) == 0 {
+		s.segments = []int64{readSegment}
+		s.readOffset = 0
+	}
+
+	return s.openWriter(s.segments[len(s.segments)-1])
+}
+
+func (s *Spool) loadOffset() (int64, int64) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, offsetFile))
+	if err != nil {
+		return 0, 0
+	}
+
+	var segment, offset int64
+	if _, err = fmt.Sscan(string(data), &segment, &offset); err != nil {
+		return 0, 0
+	}
+
+	return segment, offset
+}
+
+// repair 统计段文件中 from 之后的记录, 截掉第一条损坏的记录之后的内容
+func (s *Spool) repair(id, from int64) (int64, int, error) {
+	f, err := os.OpenFile(s.path(id), os.O_RDWR, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > info.Size() {
+		from = info.Size()
+	}
+	if _, err = f.Seek(from, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	end, records := from, 0
+	for {
+		data, err := readRecord(f, s.maxSize)
+		if err != nil {
+			break
+		}
+		end += int64(headerSize + len(data))
+		records++
+	}
+
+	if end < info.Size() {
+		if err = f.Truncate(end); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return end, records, nil
+}
+
+func (s *Spool) path(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func (s *Spool) openWriter(id int64) error {
+	f, err := os.OpenFile(s.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	s.writer, s.writeSize = f, info.Size()
+
+	return nil
+}
+
+// Put 在末尾追加一条记录, 超过大小上限时返回 ErrFull
+func (s *Spool) Put(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == nil {
+		return os.ErrClosed
+	}
+
+	size := int64(headerSize + len(data))
+	if s.diskSize+size > s.maxSize {
+		return ErrFull
+	}
+
+	if s.writeSize > 0 && s.writeSize+size > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[headerSize:], data)
+	if _, err := s.writer.Write(buf); err != nil {
+		return err
+	}
+
+	s.writeSize += size
+	s.diskSize += size
+	s.unread += size
+	s.records++
+
+	return nil
+}
+
+// rotate 写入新的段文件
+func (s *Spool) rotate() error {
+	if err := s.writer.Close(); err != nil {
+		return err
+	}
+
+	id := s.segments[len(s.segments)-1] + 1
+	if err := s.openWriter(id); err != nil {
+		return err
+	}
+	s.segments = append(s.segments, id)
+
+	return nil
+}
+
+// Peek 返回最早的至多 n 条没有提交的记录, 不会跨越段文件
+func (s *Spool) Peek(n int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = s.pending[:0]
+	if s.records == 0 {
+		return nil, nil
+	}
+
+	// 读完的写入段在 Commit 时不能删除, 轮换之后在这里删除
+	for s.readOffset >= s.segmentLen(0) && len(s.segments) > 1 {
+		s.removeHead()
+	}
+
+	f, err := os.Open(s.path(s.segments[0]))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(s.readOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var records [][]byte
+	end := s.readOffset
+	for len(records) < n {
+		data, err := readRecord(f, s.maxSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		end += int64(headerSize + len(data))
+		records = append(records, data)
+		s.pending = append(s.pending, end)
+	}
+
+	return records, nil
+}
+
+// segmentLen 第 i 个段文件的大小, 写入段使用记录的大小
+func (s *Spool) segmentLen(i int) int64 {
+	if i == len(s.segments)-1 {
+		return s.writeSize
+	}
+
+	info, err := os.Stat(s.path(s.segments[i]))
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+func (s *Spool) removeHead() {
+	s.diskSize -= s.segmentLen(0)
+	_ = os.Remove(s.path(s.segments[0]))
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+}
+
+// Commit 提交上次 Peek 返回的前 n 条记录, 之后不会再读到
+func (s *Spool) Commit(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(s.pending) {
+		return fmt.Errorf("spool: commit %d records, only %d peeked", n, len(s.pending))
+	}
+	if n == 0 {
+		return nil
+	}
+
+	end := s.pending[n-1]
+	s.unread -= end - s.readOffset
+	s.readOffset = end
+	s.records -= n
+	s.pending = s.pending[:0]
+
+	if len(s.segments) > 1 && s.readOffset >= s.segmentLen(0) {
+		s.removeHead()
+	}
+
+	return s.saveOffset()
+}
+
+// saveOffset 先写临时文件再改名, 避免写了一半的位置
+func (s *Spool) saveOffset() error {
+	tmp := filepath.Join(s.dir, offsetFile+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.segments[0], s.readOffset)), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(s.dir, offsetFile))
+}
+
+// Len 没有提交的记录数
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.records
+}
+
+// Size 没有提交的记录的大小
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.unread
+}
+
+// Close 写入磁盘并关闭, 之后 Put 返回错误
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == nil {
+		return nil
+	}
+
+	err := s.writer.Sync()
+	if cerr := s.writer.Close(); err == nil {
+		err = cerr
+	}
+	s.writer = nil
+
+	return err
+}
+
+// readRecord 读一条记录, 不完整, 超过 limit 或者校验失败时返回错误, 正好读完时返回 io.EOF
+func readRecord(r io.Reader, limit int64) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("spool: truncated record header")
+		}
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if int64(size) > limit {
+		return nil, fmt.Errorf("spool: record size %d over %d", size, limit)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("spool: truncated record: %v", err)
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("spool: checksum mismatch")
+	}
+
+	return data, nil
+}
@@ -0,0 +1,159 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitSpool spool test execute
+func TestUnitSpool(t *testing.T) {
+	suite.Run(t, new(spoolSuite))
+}
+
+type spoolSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *spoolSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+}
+
+func (s *spoolSuite) open(maxSize int64) *Spool {
+	sp, err := Open(s.dir, maxSize)
+	s.Require().NoError(err)
+
+	return sp
+}
+
+func (s *spoolSuite) put(sp *Spool, from, to int) {
+	for i := from; i < to; i++ {
+		s.Require().NoError(sp.Put([]byte(fmt.Sprintf("record-%02d", i))))
+	}
+}
+
+// drain 读出并提交所有记录
+func (s *spoolSuite) drain(sp *Spool) []string {
+	var got []string
+	for {
+		records, err := sp.Peek(3)
+		s.Require().NoError(err)
+		if len(records) == 0 {
+			return got
+		}
+		for _, r := range records {
+			got = append(got, string(r))
+		}
+		s.Require().NoError(sp.Commit(len(records)))
+	}
+}
+
+func (s *spoolSuite) TestPeekCommit() {
+	sp := s.open(1 << 20)
+	s.put(sp, 0, 5)
+	s.Equal(5, sp.Len())
+	s.Equal(int64(5*(headerSize+9)), sp.Size())
+
+	records, err := sp.Peek(2)
+	s.Require().NoError(err)
+	s.Equal([][]byte{[]byte("record-00"), []byte("record-01")}, records)
+
+	// 没有提交时再次读到同样的记录
+	records, err = sp.Peek(10)
+	s.Require().NoError(err)
+	s.Len(records, 5)
+	s.Require().NoError(sp.Commit(1))
+	s.Error(sp.Commit(1), "commit without peek")
+
+	s.Equal([]string{"record-01", "record-02", "record-03", "record-04"}, s.drain(sp))
+	s.Equal(0, sp.Len())
+	s.Equal(int64(0), sp.Size())
+	s.Require().NoError(sp.Close())
+	s.Equal(os.ErrClosed, sp.Put([]byte("a")))
+}
+
+func (s *spoolSuite) TestReopen() {
+	sp := s.open(1 << 20)
+	s.put(sp, 0, 4)
+	_, err := sp.Peek(2)
+	s.Require().NoError(err)
+	s.Require().NoError(sp.Commit(2))
+	s.Require().NoError(sp.Close())
+
+	sp = s.open(1 << 20)
+	s.Equal(2, sp.Len())
+	s.put(sp, 4, 5)
+	s.Equal([]string{"record-02", "record-03", "record-04"}, s.drain(sp))
+	s.Require().NoError(sp.Close())
+}
+
+func (s *spoolSuite) TestSegments() {
+	// 每条记录 17 字节, 段文件最大为上限的 1/4 即 34 字节, 两条记录一个段
+	sp := s.open(136)
+	s.put(sp, 0, 8)
+	segments, _ := filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	s.Len(segments, 4)
+	s.Equal(ErrFull, sp.Put([]byte("record-08")))
+
+	s.Len(s.drain(sp), 8)
+	segments, _ = filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	s.Len(segments, 1)
+	s.NoError(sp.Put([]byte("record-08")))
+	s.Require().NoError(sp.Close())
+
+	sp = s.open(136)
+	s.Equal([]string{"record-08"}, s.drain(sp))
+	s.Require().NoError(sp.Close())
+}
+
+func (s *spoolSuite) TestRepair() {
+	for _, tt := range []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		want    []string
+	}{
+		{name: "truncated", corrupt: func(data []byte) []byte { return data[:len(data)-3] },
+			want: []string{"record-00", "record-01"}},
+		{name: "checksum", corrupt: func(data []byte) []byte {
+			data[headerSize+21] ^= 0xff
+			return data
+		}, want: []string{"record-00"}},
+		{name: "size", corrupt: func(data []byte) []byte {
+			data[0] = 0xff
+			return data
+		}},
+	} {
+		s.Run(tt.name, func() {
+			s.dir = s.T().TempDir()
+			sp := s.open(1 << 20)
+			s.put(sp, 0, 3)
+			s.Require().NoError(sp.Close())
+
+			path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", 0, segmentExt))
+			data, err := ioutil.ReadFile(path)
+			s.Require().NoError(err)
+			s.Require().NoError(ioutil.WriteFile(path, tt.corrupt(data), 0644))
+
+			sp = s.open(1 << 20)
+			s.Equal(len(tt.want), sp.Len())
+			s.put(sp, 3, 4)
+			s.Equal(append(tt.want, "record-03"), s.drain(sp))
+			s.Require().NoError(sp.Close())
+		})
+	}
+}
+
+func (s *spoolSuite) TestOpenErrors() {
+	_, err := Open(s.dir, headerSize)
+	s.Error(err)
+
+	file := filepath.Join(s.dir, "file")
+	s.Require().NoError(ioutil.WriteFile(file, nil, 0644))
+	_, err = Open(file, 1<<20)
+	s.Error(err)
+}
@@ -0,0 +1,433 @@
+package decrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"strings"
+)
+
+// record 和握手消息的类型
+const (
+	recordChangeCipherSpec = 20
+	recordHandshake        = 22
+	recordApplicationData  = 23
+
+	handshakeClientHello = 1
+	handshakeServerHello = 2
+	handshakeFinished    = 20
+	handshakeKeyUpdate   = 24
+
+	extSupportedVersions = 43
+	versionTLS13         = 0x0304
+)
+
+const (
+	maxRecordLen = 1<<14 + 2048 // TLS 1.2 密文的最大长度
+	maxPending   = 1 << 20      // 每个方向等待 key 时最多缓存的字节数
+	maxSegments  = 256          // 每个方向最多缓存的乱序 segment
+)
+
+// helloRetryRandom HelloRetryRequest 的 ServerHello random
+var helloRetryRandom = []byte{0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65,
+	0xb8, 0x91, 0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c}
+
+// 一个方向用的 key
+const (
+	stagePlain     = iota
+	stageHandshake // TLS 1.3 的 handshake traffic secret
+	stageTraffic   // TLS 1.2 的 key block, TLS 1.3 的 application traffic secret
+)
+
+// decryptError 连接不能解密的原因, 也是 gor_tls_connections_total 的 result
+type decryptError string
+
+func (e decryptError) Error() string {
+	return "tls: " + strings.ReplaceAll(string(e), "_", " ")
+}
+
+const (
+	errNoHandshake       decryptError = "no_handshake"
+	errMissingKey        decryptError = "missing_key"
+	errUnsupportedCipher decryptError = "unsupported_cipher"
+	errDecrypt           decryptError = "decrypt_error"
+	errInvalid           decryptError = "invalid"
+	errLost              decryptError = "lost"
+)
+
+// stream 连接一个方向的数据
+type stream struct {
+	started  bool
+	next     uint32            // 下一个 segment 的 tcp seq
+	plain    uint32            // 下一个明文字节的 seq, 明文从连接的第一个 seq 开始连续编号
+	segments map[uint32][]byte // 乱序到达的 segment
+	buf      []byte            // 还没有处理的 record
+	hs       []byte            // 还不完整的握手消息
+	stage    int
+	aead     cipher.AEAD
+	iv       []byte
+	seq      uint64 // record 的 sequence number
+	secret   []byte // TLS 1.3 当前的 traffic secret
+	skipped  int    // 跳过的 0-RTT 数据
+	fin      bool
+}
+
+// start 从 seq 开始接收数据
+func (s *stream) start(seq uint32) {
+	s.started, s.next, s.plain = true, seq, seq
+}
+
+// reassemble 按 tcp seq 把 payload 接到 buf 后面, 去掉重传的部分, 乱序的 segment 先存起来
+func (s *stream) reassemble(seq uint32, payload []byte) error {
+	if !s.started {
+		s.start(seq)
+	}
+	if int32(seq-s.next) > 0 {
+		if len(s.segments) >= maxSegments {
+			return errLost
+		}
+		if s.segments == nil {
+			s.segments = make(map[uint32][]byte)
+		}
+		s.segments[seq] = append([]byte(nil), payload...)
+		return nil
+	}
+
+	s.append(seq, payload)
+	for progress := true; progress; {
+		progress = false
+		for seq, data := range s.segments {
+			if int32(seq-s.next) <= 0 {
+				delete(s.segments, seq)
+				s.append(seq, data)
+				progress = true
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *stream) append(seq uint32, payload []byte) {
+	if skip := int(s.next - seq); skip < len(payload) {
+		s.buf = append(s.buf, payload[skip:]...)
+		s.next += uint32(len(payload) - skip)
+	}
+}
+
+// setAEAD 换 key, sequence number 从 0 开始
+func (s *stream) setAEAD(key, iv []byte) error {
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	s.aead, s.iv, s.seq = aead, iv, 0
+
+	return nil
+}
+
+// setSecret 用 TLS 1.3 的 traffic secret 换 key
+func (s *stream) setSecret(suite *cipherSuite, secret []byte) error {
+	s.secret = secret
+
+	return s.setAEAD(expandLabel(suite.hash, secret, "key", suite.keyLen), expandLabel(suite.hash, secret, "iv", 12))
+}
+
+// open 解密一个 record, 返回真正的 content type 和明文, 明文复用 body
+func (s *stream) open(hdr, body []byte, tls13 bool) (byte, []byte, error) {
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], s.seq)
+
+	if !tls13 {
+		// explicit nonce + 密文 + tag
+		if len(body) < 8+s.aead.Overhead() {
+			return 0, nil, errDecrypt
+		}
+		nonce := append(append([]byte(nil), s.iv...), body[:8]...)
+		ad := append(seq[:], hdr[0], hdr[1], hdr[2], 0, 0)
+		binary.BigEndian.PutUint16(ad[11:], uint16(len(body)-8-s.aead.Overhead()))
+		plain, err := s.aead.Open(body[8:8], nonce, body[8:], ad)
+		if err != nil {
+			return 0, nil, errDecrypt
+		}
+		s.seq++
+		return hdr[0], plain, nil
+	}
+
+	nonce := append([]byte(nil), s.iv...)
+	for i, b := range seq {
+		nonce[len(nonce)-8+i] ^= b
+	}
+	plain, err := s.aead.Open(body[:0], nonce, body, hdr)
+	if err != nil {
+		return 0, nil, errDecrypt
+	}
+	s.seq++
+	// 去掉 padding, 最后一个非 0 字节是真正的 content type
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, errDecrypt
+	}
+
+	return plain[i], plain[:i], nil
+}
+
+// conn 一个 TLS 连接的解密状态
+type conn struct {
+	keys         *KeyLog
+	streams      [2]stream // 0 是 client -> server, 1 是 server -> client
+	clientRandom []byte
+	serverRandom []byte
+	suite        *cipherSuite
+	seen         bool // 收到过数据
+	plaintext    bool // 不是 TLS 连接, 数据原样保留
+	waiting      bool // 在等 key log 写入 key
+	err          error
+	result       string
+}
+
+// report 记录连接的结果, 只记一次
+func (c *conn) report(result string) {
+	if c.result == "" {
+		c.result = result
+		connectionsMetric.With(result).Inc()
+	}
+}
+
+// fail 连接不能再解密
+func (c *conn) fail(err error) {
+	c.err = err
+	result := string(errInvalid)
+	if e, ok := err.(decryptError); ok {
+		result = string(e)
+	}
+	c.report(result)
+	for i := range c.streams {
+		c.streams[i].buf, c.streams[i].segments, c.streams[i].hs = nil, nil, nil
+	}
+}
+
+// decrypt 接收一个 segment, 返回解密出的应用数据和它的第一个字节在明文中的 seq
+func (c *conn) decrypt(dir int, seq uint32, payload []byte) (uint32, []byte, error) {
+	s := &c.streams[dir]
+	if err := s.reassemble(seq, payload); err != nil {
+		return s.plain, nil, err
+	}
+	if !c.seen && len(s.buf) > 0 {
+		c.seen = true
+		// TLS 连接总是客户端先发 ClientHello
+		if dir == 1 || s.buf[0] != recordHandshake {
+			c.plaintext = true
+			c.report("plaintext")
+			start, out := s.plain, s.buf
+			c.streams = [2]stream{}
+			return start, out, nil
+		}
+	}
+
+	start := s.plain
+	out, err := c.records(dir)
+	if len(out) > 0 {
+		s.plain += uint32(len(out))
+		c.report("decrypted")
+	}
+
+	return start, out, err
+}
+
+// records 处理 buf 中完整的 record. 缺少 key 时停下, 等 key log 追加后再处理
+func (c *conn) records(dir int) ([]byte, error) {
+	s := &c.streams[dir]
+	var out []byte
+	off := 0
+	for len(s.buf)-off >= 5 {
+		hdr := s.buf[off : off+5]
+		n := int(binary.BigEndian.Uint16(hdr[3:]))
+		if hdr[0] < recordChangeCipherSpec || hdr[0] > recordApplicationData || hdr[1] != 3 || n > maxRecordLen {
+			return out, errInvalid
+		}
+		if len(s.buf)-off < 5+n {
+			break
+		}
+		data, ok, err := c.record(dir, hdr, s.buf[off+5:off+5+n])
+		if err != nil {
+			return out, err
+		}
+		if !ok {
+			break
+		}
+		out = append(out, data...)
+		off += 5 + n
+	}
+
+	s.buf = append(s.buf[:0], s.buf[off:]...)
+	if len(s.buf) > maxPending {
+		return out, errMissingKey
+	}
+
+	return out, nil
+}
+
+// record 处理一个 record, 返回其中的应用数据. 缺少 key 时返回 false
+func (c *conn) record(dir int, hdr, body []byte) ([]byte, bool, error) {
+	s := &c.streams[dir]
+	if s.stage == stagePlain {
+		switch hdr[0] {
+		case recordHandshake:
+			return nil, true, c.handshake(dir, body)
+		case recordChangeCipherSpec:
+			if c.suite == nil {
+				return nil, false, errNoHandshake
+			}
+			if !c.suite.tls13 {
+				s.stage = stageTraffic
+			}
+		}
+		// alert, TLS 1.3 ServerHello 之前的 0-RTT 数据忽略
+		return nil, true, nil
+	}
+	if hdr[0] == recordChangeCipherSpec {
+		// TLS 1.3 兼容模式的 ChangeCipherSpec
+		return nil, true, nil
+	}
+
+	if s.aead == nil {
+		ok, err := c.setKeys(dir)
+		if !ok || err != nil {
+			c.waiting = err == nil
+			return nil, false, err
+		}
+		c.waiting = false
+	}
+
+	typ, plain, err := s.open(hdr, body, c.suite.tls13)
+	if err != nil {
+		// 客户端的 0-RTT 数据用 early traffic secret 加密, 跳过
+		if c.suite.tls13 && dir == 0 && s.stage == stageHandshake && s.seq == 0 && s.skipped < maxPending {
+			s.skipped += len(body)
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	switch {
+	case typ == recordApplicationData:
+		return plain, true, nil
+	case typ == recordHandshake && c.suite.tls13:
+		return nil, true, c.handshake(dir, plain)
+	}
+
+	return nil, true, nil
+}
+
+// setKeys 按 stage 从 key log 取 key, 还没有时返回 false
+func (c *conn) setKeys(dir int) (bool, error) {
+	s := &c.streams[dir]
+	if !c.suite.tls13 {
+		master := c.keys.Secret(labelMasterSecret, c.clientRandom)
+		if master == nil {
+			return false, nil
+		}
+		// key block: client write key, server write key, client write iv, server write iv
+		n := c.suite.keyLen
+		seed := append(append([]byte(nil), c.serverRandom...), c.clientRandom...)
+		block := prf12(c.suite.hash, master, "key expansion", seed, 2*n+8)
+		return true, s.setAEAD(block[dir*n:(dir+1)*n], block[2*n+dir*4:2*n+(dir+1)*4])
+	}
+
+	labels := [2][2]string{{labelClientHandshake, labelServerHandshake}, {labelClientTraffic, labelServerTraffic}}
+	secret := c.keys.Secret(labels[s.stage-stageHandshake][dir], c.clientRandom)
+	if secret == nil {
+		return false, nil
+	}
+
+	return true, s.setSecret(c.suite, secret)
+}
+
+// handshake 处理握手消息, 一个消息可能跨多个 record
+func (c *conn) handshake(dir int, data []byte) error {
+	s := &c.streams[dir]
+	s.hs = append(s.hs, data...)
+	for len(s.hs) >= 4 {
+		n := int(s.hs[1])<<16 | int(s.hs[2])<<8 | int(s.hs[3])
+		if n > maxPending {
+			return errInvalid
+		}
+		if len(s.hs) < 4+n {
+			break
+		}
+		if err := c.handshakeMessage(dir, s.hs[0], s.hs[4:4+n]); err != nil {
+			return err
+		}
+		s.hs = s.hs[4+n:]
+	}
+	if len(s.hs) == 0 {
+		s.hs = nil
+	}
+
+	return nil
+}
+
+func (c *conn) handshakeMessage(dir int, typ byte, msg []byte) error {
+	s := &c.streams[dir]
+	switch {
+	case typ == handshakeClientHello && dir == 0:
+		if len(msg) < 34 {
+			return errInvalid
+		}
+		c.clientRandom = append([]byte(nil), msg[2:34]...)
+	case typ == handshakeServerHello && dir == 1:
+		return c.serverHello(msg)
+	case typ == handshakeFinished && s.stage == stageHandshake:
+		s.stage, s.aead = stageTraffic, nil
+	case typ == handshakeKeyUpdate && s.stage == stageTraffic && s.secret != nil:
+		h := c.suite.hash
+		return s.setSecret(c.suite, expandLabel(h, s.secret, "traffic upd", h().Size()))
+	}
+
+	return nil
+}
+
+// serverHello 取 server random, cipher suite 和协商的版本
+func (c *conn) serverHello(msg []byte) error {
+	if len(msg) < 35 || len(msg) < 35+int(msg[34])+3 {
+		return errInvalid
+	}
+	if bytes.Equal(msg[2:34], helloRetryRandom) {
+		// 客户端会再发一次 ClientHello
+		return nil
+	}
+	if c.clientRandom == nil {
+		return errNoHandshake
+	}
+
+	random := msg[2:34]
+	b := msg[35+int(msg[34]):]
+	id, version := binary.BigEndian.Uint16(b), uint16(0)
+	if b = b[3:]; len(b) >= 2 {
+		exts := b[2:]
+		for len(exts) >= 4 {
+			typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+			if len(exts) < 4+n {
+				return errInvalid
+			}
+			if typ == extSupportedVersions && n == 2 {
+				version = binary.BigEndian.Uint16(exts[4:])
+			}
+			exts = exts[4+n:]
+		}
+	}
+
+	suite, ok := cipherSuites[id]
+	if !ok || suite.tls13 != (version == versionTLS13) {
+		return errUnsupportedCipher
+	}
+	c.serverRandom, c.suite = append([]byte(nil), random...), &suite
+	if suite.tls13 {
+		c.streams[0].stage, c.streams[1].stage = stageHandshake, stageHandshake
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package decrypt
+
+import (
+	"github.com/golang/groupcache/lru"
+
+	"goreplay/logger"
+	"goreplay/metrics"
+	"goreplay/tcp"
+)
+
+// connectionsMetric 按结果统计的连接数
+var connectionsMetric = metrics.NewCounterVec("gor_tls_connections_total",
+	"Connections seen by --input-raw-tls-keylog, by result decrypted, plaintext, no_handshake, missing_key, "+
+		"unsupported_cipher, decrypt_error, invalid or lost.", "result")
+
+// Decrypter decrypts the TLS 1.2 and 1.3 connections to a listen address with the secrets of a key log.
+// The bytes of each direction are reassembled by tcp sequence, and the plaintext of the records replaces
+// the payload of the packet completing them. The seq of the packet is then the offset of that plaintext,
+// counted from the first seq of the direction, so the plaintext of a direction has contiguous seqs.
+// Connections which do not start with a TLS handshake are left as they are.
+type Decrypter struct {
+	keys    *KeyLog
+	address string
+	conns   *lru.Cache // *conn, 按连接的客户端一侧索引
+}
+
+// New returns a decrypter of the connections to address
+func New(keys *KeyLog, address string) *Decrypter {
+	return &Decrypter{keys: keys, address: address, conns: lru.New(65535)}
+}
+
+// Decrypt replaces the payload and the seq of pckt with the application data it completes. Packets without
+// any are dropped, unless they have a SYN, FIN or RST flag.
+func (d *Decrypter) Decrypt(pckt *tcp.Packet) bool {
+	isIn, isOut := tcp.IsRequest(pckt, d.address), tcp.IsResponse(pckt, d.address)
+	if !(isIn || isOut) {
+		return true
+	}
+	dir := 0
+	if isOut {
+		dir = 1
+	}
+
+	key := tcp.DefaultMessageKey(pckt, isOut).String()
+	c := d.conn(key, pckt, dir)
+	if c == nil {
+		return true
+	}
+	defer d.close(key, c, pckt, dir)
+
+	if c.plaintext {
+		return true
+	}
+	s := &c.streams[dir]
+	if len(pckt.Payload) == 0 {
+		if s.started && !pckt.SYN {
+			pckt.Seq = s.plain
+		}
+		return true
+	}
+	var out []byte
+	if c.err == nil {
+		var err error
+		if pckt.Seq, out, err = c.decrypt(dir, pckt.Seq, pckt.Payload); err != nil {
+			logger.Debug("[TLS] can not decrypt", pckt.Src(), "->", pckt.Dst(), err)
+			c.fail(err)
+		}
+	}
+	if len(out) == 0 {
+		pckt.Payload = nil
+		return pckt.SYN || pckt.FIN || pckt.RST
+	}
+	pckt.Payload = out
+
+	return true
+}
+
+// conn 包所在的连接, 连接开始时新建. 只有 ack 的包不在已知连接中时返回 nil
+func (d *Decrypter) conn(key string, pckt *tcp.Packet, dir int) *conn {
+	if pckt.SYN && !pckt.ACK {
+		c := &conn{keys: d.keys}
+		c.streams[0].start(pckt.Seq + 1)
+		d.conns.Add(key, c)
+		return c
+	}
+	if v, ok := d.conns.Get(key); ok {
+		c := v.(*conn)
+		if pckt.SYN {
+			c.streams[1].start(pckt.Seq + 1)
+		}
+		return c
+	}
+
+	c := &conn{keys: d.keys}
+	switch {
+	case pckt.SYN:
+		c.streams[1].start(pckt.Seq + 1)
+	case len(pckt.Payload) == 0:
+		return nil
+	case dir != 0 || !isClientHello(pckt.Payload):
+		// 抓包开始前建立的连接
+		c.fail(errNoHandshake)
+	}
+	d.conns.Add(key, c)
+
+	return c
+}
+
+// close 两个方向都 FIN 或者 RST 后删除连接
+func (d *Decrypter) close(key string, c *conn, pckt *tcp.Packet, dir int) {
+	c.streams[dir].fin = c.streams[dir].fin || pckt.FIN
+	if !pckt.RST && !(c.streams[0].fin && c.streams[1].fin) {
+		return
+	}
+	if c.waiting {
+		c.report(string(errMissingKey))
+	}
+	d.conns.Remove(key)
+}
+
+// isClientHello payload 以 ClientHello 的 record 开始
+func isClientHello(payload []byte) bool {
+	return len(payload) > 5 && payload[0] == recordHandshake && payload[1] == 3 && payload[5] == handshakeClientHello
+}
@@ -0,0 +1,384 @@
+package decrypt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"goreplay/framer"
+	"goreplay/tcp"
+	_ "goreplay/tcp/protocol" // grpc framer
+)
+
+// TestUnitDecrypter tls decrypt unit test execute
+func TestUnitDecrypter(t *testing.T) {
+	suite.Run(t, new(decrypterSuite))
+}
+
+type decrypterSuite struct {
+	suite.Suite
+	cert tls.Certificate
+}
+
+const (
+	testRequest  = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	testAddress  = "10.0.0.2:443"
+	clientISN    = 1000
+	serverISN    = 0xfffffff0 // seq 会回绕
+	testResponse = "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+)
+
+func (s *decrypterSuite) SetupSuite() {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "example.com"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	s.Require().NoError(err)
+	s.cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// chunk 一次 Write 写出的数据, dir 0 是客户端写的
+type chunk struct {
+	dir  int
+	data []byte
+}
+
+// recorder 按顺序记录两端写出的数据
+type recorder struct {
+	net.Conn
+	dir    int
+	mu     *sync.Mutex
+	chunks *[]chunk
+}
+
+func (r recorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	*r.chunks = append(*r.chunks, chunk{dir: r.dir, data: append([]byte(nil), b...)})
+	r.mu.Unlock()
+
+	return r.Conn.Write(b)
+}
+
+// session 用 crypto/tls 完成一次 testRequest 和 testResponse, 返回两端写出的数据, key log 写到 keys
+func (s *decrypterSuite) session(version uint16, cipherSuite uint16, keys io.Writer) ([]chunk, uint16) {
+	return s.exchange(version, cipherSuite, keys, []string{testRequest}, testResponse)
+}
+
+// exchange 客户端分几次写出 requests, 服务端收完后写出 response
+func (s *decrypterSuite) exchange(version uint16, cipherSuite uint16, keys io.Writer, requests []string,
+	response string) ([]chunk, uint16) {
+	var (
+		mu     sync.Mutex
+		chunks []chunk
+	)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		server := tls.Server(recorder{Conn: conn, dir: 1, mu: &mu, chunks: &chunks},
+			&tls.Config{Certificates: []tls.Certificate{s.cert}})
+		defer server.Close()
+		req := make([]byte, len(strings.Join(requests, "")))
+		if _, err = io.ReadFull(server, req); err == nil {
+			_, _ = server.Write([]byte(response))
+		}
+	}()
+
+	conf := &tls.Config{InsecureSkipVerify: true, KeyLogWriter: keys, MinVersion: version, MaxVersion: version}
+	if cipherSuite != 0 {
+		conf.CipherSuites = []uint16{cipherSuite}
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	s.Require().NoError(err)
+	client := tls.Client(recorder{Conn: conn, dir: 0, mu: &mu, chunks: &chunks}, conf)
+	for _, req := range requests {
+		_, err = client.Write([]byte(req))
+		s.Require().NoError(err)
+	}
+	resp := make([]byte, len(response))
+	_, err = io.ReadFull(client, resp)
+	s.Require().NoError(err)
+	s.Require().NoError(client.Close())
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return chunks, client.ConnectionState().CipherSuite
+}
+
+// packet 10.0.0.1:40000 和 testAddress 之间的包
+func packet(dir int, seq uint32, payload []byte) *tcp.Packet {
+	pckt := &tcp.Packet{SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2},
+		TCP: &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: seq, ACK: true}}
+	if dir == 1 {
+		pckt.SrcIP, pckt.DstIP = pckt.DstIP, pckt.SrcIP
+		pckt.SrcPort, pckt.DstPort = pckt.DstPort, pckt.SrcPort
+	}
+	pckt.Payload = payload
+
+	return pckt
+}
+
+// packets 连接的三次握手和按 size 切分的数据, 最后两端 FIN
+func packets(chunks []chunk, size int) []*tcp.Packet {
+	syn, synAck := packet(0, clientISN, nil), packet(1, serverISN, nil)
+	syn.SYN, syn.ACK, synAck.SYN = true, false, true
+	pckts := []*tcp.Packet{syn, synAck}
+
+	seq := [2]uint32{clientISN + 1, serverISN + 1}
+	for _, c := range chunks {
+		for data := c.data; len(data) > 0; {
+			n := size
+			if n > len(data) {
+				n = len(data)
+			}
+			pckts = append(pckts, packet(c.dir, seq[c.dir], data[:n]))
+			seq[c.dir] += uint32(n)
+			data = data[n:]
+		}
+	}
+
+	for dir := range seq {
+		fin := packet(dir, seq[dir], nil)
+		fin.FIN = true
+		pckts = append(pckts, fin)
+	}
+
+	return pckts
+}
+
+// feed 把包交给 d, 返回两个方向得到的数据
+func feed(d *Decrypter, pckts []*tcp.Packet) [2]string {
+	var out [2]bytes.Buffer
+	for _, p := range pckts {
+		if d.Decrypt(p) {
+			dir := 0
+			if tcp.IsResponse(p, testAddress) {
+				dir = 1
+			}
+			out[dir].Write(p.Payload)
+		}
+	}
+
+	return [2]string{out[0].String(), out[1].String()}
+}
+
+func (s *decrypterSuite) TestDecrypt() {
+	for _, tt := range []struct {
+		name        string
+		version     uint16
+		cipherSuite uint16
+		// reorder 打乱顺序并重传一些包
+		reorder bool
+		// lateKeys 前几个包之后才写 key log
+		lateKeys bool
+	}{
+		{name: "tls 1.2 aes128", version: tls.VersionTLS12, cipherSuite: tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{name: "tls 1.2 aes256", version: tls.VersionTLS12, cipherSuite: tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			reorder: true},
+		{name: "tls 1.3", version: tls.VersionTLS13},
+		{name: "tls 1.3 reordered", version: tls.VersionTLS13, reorder: true},
+		{name: "tls 1.3 late keys", version: tls.VersionTLS13, lateKeys: true},
+	} {
+		s.Run(tt.name, func() {
+			var keys bytes.Buffer
+			chunks, cipherSuite := s.session(tt.version, tt.cipherSuite, &keys)
+			if _, ok := cipherSuites[cipherSuite]; !ok {
+				s.T().Skipf("cipher suite %s is not supported", tls.CipherSuiteName(cipherSuite))
+			}
+
+			path := filepath.Join(s.T().TempDir(), "keys.log")
+			written := keys.Bytes()
+			if tt.lateKeys {
+				written = nil
+			}
+			s.Require().NoError(ioutil.WriteFile(path, written, 0600))
+			keyLog, err := OpenKeyLog(path)
+			s.Require().NoError(err)
+			d := New(keyLog, testAddress)
+
+			pckts := packets(chunks, 700)
+			if tt.reorder {
+				// 同一个方向相邻的包交换, 每隔几个包重传前一个包
+				pckts = packets(chunks, 40)
+				for i := 2; i+3 < len(pckts); i += 2 {
+					if pckts[i].SrcPort == pckts[i+1].SrcPort {
+						pckts[i], pckts[i+1] = pckts[i+1], pckts[i]
+					}
+				}
+				for i := 4; i+2 < len(pckts); i += 5 {
+					pckts = append(pckts[:i+1], append([]*tcp.Packet{pckts[i-1]}, pckts[i+1:]...)...)
+				}
+			}
+			var got [2]string
+			if tt.lateKeys {
+				first := feed(d, pckts[:6])
+				s.Require().NoError(ioutil.WriteFile(path, keys.Bytes(), 0600))
+				got = feed(d, pckts[6:])
+				got[0], got[1] = first[0]+got[0], first[1]+got[1]
+			} else {
+				got = feed(d, pckts)
+			}
+
+			s.Equal([2]string{testRequest, testResponse}, got)
+			// 两端 FIN 后连接删除
+			s.Zero(d.conns.Len())
+		})
+	}
+}
+
+func (s *decrypterSuite) TestUndecryptable() {
+	var keys bytes.Buffer
+	chunks, _ := s.session(tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, &keys)
+	plain := []chunk{{dir: 0, data: []byte(testRequest)}, {dir: 1, data: []byte(testResponse)}}
+	// 改掉 master secret 的最后一位
+	wrong := append([]byte(nil), keys.Bytes()...)
+	if wrong[len(wrong)-2] == '0' {
+		wrong[len(wrong)-2] = '1'
+	} else {
+		wrong[len(wrong)-2] = '0'
+	}
+
+	for _, tt := range []struct {
+		name    string
+		pckts   []*tcp.Packet
+		keys    []byte
+		want    [2]string
+		waiting bool
+		wantErr error
+	}{
+		{name: "missing key", pckts: packets(chunks, 700), waiting: true},
+		{name: "wrong key", pckts: packets(chunks, 700), keys: wrong, wantErr: errDecrypt},
+		{name: "not tls", pckts: packets(plain, 700), want: [2]string{testRequest, testResponse}},
+		// 没有 SYN 和 ClientHello
+		{name: "no handshake", pckts: packets(chunks, 700)[5:], keys: keys.Bytes(), wantErr: errNoHandshake},
+	} {
+		s.Run(tt.name, func() {
+			path := filepath.Join(s.T().TempDir(), "keys.log")
+			s.Require().NoError(ioutil.WriteFile(path, tt.keys, 0600))
+			keyLog, err := OpenKeyLog(path)
+			s.Require().NoError(err)
+			d := New(keyLog, testAddress)
+
+			// 最后的 FIN 会删除连接, 先留着
+			pckts := tt.pckts[:len(tt.pckts)-1]
+			s.Equal(tt.want, feed(d, pckts))
+			v, ok := d.conns.Get(tcp.DefaultMessageKey(pckts[len(pckts)-1], false).String())
+			s.Require().True(ok)
+			c := v.(*conn)
+			s.Equal(tt.want[0] != "", c.plaintext)
+			s.Equal(tt.waiting, c.waiting)
+			s.Equal(tt.wantErr, c.err)
+		})
+	}
+}
+
+// grpcRequests 一个连接上的两个 grpc 请求, 第二个的 header block 引用第一个加入动态表的表项
+func (s *decrypterSuite) grpcRequests() []string {
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	var requests []string
+	for i, path := range []string{"/helloworld.Greeter/SayHello", "/helloworld.Greeter/SayBye"} {
+		var buf bytes.Buffer
+		fw := http2.NewFramer(&buf, nil)
+		if i == 0 {
+			buf.WriteString(http2.ClientPreface)
+			s.Require().NoError(fw.WriteSettings())
+		}
+		hbuf.Reset()
+		for _, hf := range []hpack.HeaderField{
+			{Name: ":method", Value: "POST"},
+			{Name: ":path", Value: path},
+			{Name: "content-type", Value: "application/grpc"},
+			{Name: "x-user", Value: "alice"},
+		} {
+			s.Require().NoError(enc.WriteField(hf))
+		}
+		id := uint32(2*i + 1)
+		s.Require().NoError(fw.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: hbuf.Bytes(),
+			EndHeaders: true}))
+		s.Require().NoError(fw.WriteData(id, true, []byte{0, 0, 0, 0, 1, 'x'}))
+		requests = append(requests, buf.String())
+	}
+
+	return requests
+}
+
+// wire 把包编码成以太网帧, 交给 MessagePool
+func wire(p *tcp.Packet) gopacket.Packet {
+	mac := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: p.SrcIP, DstIP: p.DstIP}
+	t := *p.TCP
+	_ = t.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	_ = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4}, ip, &t, gopacket.Payload(p.Payload))
+
+	return gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+}
+
+// TestMessagePool grpc over TLS, 每个 record 的明文接着上一个 record 的 seq, 动态表一直同步
+func (s *decrypterSuite) TestMessagePool() {
+	var keys bytes.Buffer
+	chunks, _ := s.exchange(tls.VersionTLS13, 0, &keys, s.grpcRequests(), "")
+	path := filepath.Join(s.T().TempDir(), "keys.log")
+	s.Require().NoError(ioutil.WriteFile(path, keys.Bytes(), 0600))
+	keyLog, err := OpenKeyLog(path)
+	s.Require().NoError(err)
+
+	got := make(map[uint32]map[string]string)
+	pool := tcp.NewMessagePool(0, time.Second, func(m *tcp.Message) {
+		fr := framer.NewHTTP2Framer(m.Data(), "", true)
+		for {
+			frame, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if hf, ok := frame.(*http2.MetaHeadersFrame); ok && m.IsIncoming {
+				got[hf.StreamID] = make(map[string]string)
+				for _, field := range hf.Fields {
+					got[hf.StreamID][field.Name] = field.Value
+				}
+			}
+		}
+	})
+	pool.Address(testAddress)
+	pool.Protocol("grpc")
+	pool.Decrypter(New(keyLog, testAddress))
+	for _, p := range packets(chunks, 40) {
+		pool.Handler(wire(p))
+	}
+
+	s.Require().Len(got, 2)
+	s.Equal("/helloworld.Greeter/SayHello", got[1][":path"])
+	s.Equal("/helloworld.Greeter/SayBye", got[3][":path"])
+	s.Equal("alice", got[3]["x-user"])
+}
@@ -0,0 +1,84 @@
+package decrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+)
+
+// cipherSuite 支持的 AES-GCM cipher suite
+type cipherSuite struct {
+	keyLen int
+	hash   func() hash.Hash
+	tls13  bool
+}
+
+// cipherSuites 按 id 索引, ChaCha20-Poly1305 和 CBC 的 suite 不支持
+var cipherSuites = map[uint16]cipherSuite{
+	0x009c: {keyLen: 16, hash: sha256.New}, // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {keyLen: 32, hash: sha512.New384},
+	0x009e: {keyLen: 16, hash: sha256.New}, // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009f: {keyLen: 32, hash: sha512.New384},
+	0xc02b: {keyLen: 16, hash: sha256.New}, // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {keyLen: 32, hash: sha512.New384},
+	0xc02f: {keyLen: 16, hash: sha256.New}, // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {keyLen: 32, hash: sha512.New384},
+	0x1301: {keyLen: 16, hash: sha256.New, tls13: true}, // TLS_AES_128_GCM_SHA256
+	0x1302: {keyLen: 32, hash: sha512.New384, tls13: true},
+}
+
+// prf12 TLS 1.2 的 PRF: P_hash(secret, label + seed)
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(labelSeed)
+	a := mac.Sum(nil)
+
+	out := make([]byte, 0, n+mac.Size())
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+
+	return out[:n]
+}
+
+// expandLabel TLS 1.3 的 HKDF-Expand-Label, context 为空
+func expandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	info := []byte{byte(n >> 8), byte(n), byte(len("tls13 ") + len(label))}
+	info = append(info, "tls13 "...)
+	info = append(info, label...)
+	info = append(info, 0)
+
+	mac := hmac.New(h, secret)
+	var t, out []byte
+	for i := byte(1); len(out) < n; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+
+	return out[:n]
+}
+
+// newGCM AES-GCM 的 AEAD
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
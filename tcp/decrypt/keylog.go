@@ -0,0 +1,117 @@
+package decrypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// key log 中用到的 label, 见 https://firefox-source-docs.mozilla.org/security/nss/legacy/key_log_format/
+const (
+	labelMasterSecret    = "CLIENT_RANDOM"
+	labelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	labelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	labelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	labelServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// keyLogCacheSize 最多保留的 secret 数, 一个 TLS 1.3 连接有 4 个
+const keyLogCacheSize = 1 << 18
+
+// KeyLog secrets of a NSS key log file, as written by SSLKEYLOGFILE. Lines appended to the file
+// are read when a secret is looked up and can not be found.
+type KeyLog struct {
+	mu      sync.Mutex
+	path    string
+	offset  int64  // 已经读到的位置
+	partial []byte // 还没有换行的最后一行
+	secrets *lru.Cache
+}
+
+// OpenKeyLog reads the key log at path. The file does not have to exist yet.
+func OpenKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{path: path, secrets: lru.New(keyLogCacheSize)}
+	if err := k.load(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Secret the secret with label of the connection whose ClientHello has clientRandom, nil if unknown
+func (k *KeyLog) Secret(label string, clientRandom []byte) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := label + " " + hex.EncodeToString(clientRandom)
+	if v, ok := k.secrets.Get(key); ok {
+		return v.([]byte)
+	}
+	if err := k.load(); err != nil {
+		return nil
+	}
+	if v, ok := k.secrets.Get(key); ok {
+		return v.([]byte)
+	}
+
+	return nil
+}
+
+// load 读取文件新追加的行, 文件变短时从头读
+func (k *KeyLog) load() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == k.offset {
+		return nil
+	}
+	if info.Size() < k.offset {
+		k.offset, k.partial = 0, nil
+	}
+	if _, err = f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	k.offset += int64(len(data))
+
+	data = append(k.partial, data...)
+	end := bytes.LastIndexByte(data, '\n')
+	k.partial = append([]byte(nil), data[end+1:]...)
+	for _, line := range strings.Split(string(data[:end+1]), "\n") {
+		k.add(line)
+	}
+
+	return nil
+}
+
+// add 解析一行 "<label> <client random> <secret>", 注释和不认识的行忽略
+func (k *KeyLog) add(line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+	random, err := hex.DecodeString(fields[1])
+	if err != nil || len(random) != 32 {
+		return
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil || len(secret) == 0 {
+		return
+	}
+	k.secrets.Add(fields[0]+" "+hex.EncodeToString(random), secret)
+}
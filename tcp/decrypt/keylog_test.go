@@ -0,0 +1,55 @@
+package decrypt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestUnitKeyLog key log unit test execute
+func TestUnitKeyLog(t *testing.T) {
+	suite.Run(t, new(keyLogSuite))
+}
+
+type keyLogSuite struct {
+	suite.Suite
+}
+
+func (s *keyLogSuite) TestSecret() {
+	random := bytes.Repeat([]byte{0xab}, 32)
+	hexRandom := "ABABABABABABABABABABABABABABABABABABABABABABABABABABABABABABABAB"
+	path := filepath.Join(s.T().TempDir(), "keys.log")
+	s.Require().NoError(os.WriteFile(path, []byte("# SSL/TLS secrets log file\n"+
+		"CLIENT_RANDOM "+hexRandom+" 0102\n"+
+		"CLIENT_HANDSHAKE_TRAFFIC_SECRET "+hexRandom+" zz\n"+
+		"CLIENT_TRAFFIC_SECRET_0 abab 0304\n"+
+		"SERVER_TRAFFIC_SECRET_0 "+hexRandom), 0600))
+
+	k, err := OpenKeyLog(path)
+	s.Require().NoError(err)
+	s.Equal([]byte{1, 2}, k.Secret(labelMasterSecret, random))
+	s.Nil(k.Secret(labelClientHandshake, random))
+	s.Nil(k.Secret(labelServerTraffic, random), "line without secret and newline")
+
+	// 追加的行, 包括之前没有写完的那行
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	s.Require().NoError(err)
+	_, err = f.WriteString(" 0506\nSERVER_HANDSHAKE_TRAFFIC_SECRET " + hexRandom + " 0708\n")
+	s.Require().NoError(err)
+	s.Require().NoError(f.Close())
+	s.Equal([]byte{5, 6}, k.Secret(labelServerTraffic, random))
+	s.Equal([]byte{7, 8}, k.Secret(labelServerHandshake, random))
+
+	// 文件被重新写过
+	s.Require().NoError(os.WriteFile(path, []byte("CLIENT_TRAFFIC_SECRET_0 "+hexRandom+" 09\n"), 0600))
+	s.Equal([]byte{9}, k.Secret(labelClientTraffic, random))
+	s.Equal([]byte{1, 2}, k.Secret(labelMasterSecret, random))
+
+	_, err = OpenKeyLog(filepath.Join(s.T().TempDir(), "missing.log"))
+	s.NoError(err)
+	_, err = OpenKeyLog(s.T().TempDir())
+	s.Error(err)
+}
@@ -14,6 +14,7 @@ import (
 	"golang.org/x/net/http2"
 
 	"goreplay/framer"
+	"goreplay/metrics"
 	"goreplay/tcp"
 )
 
@@ -27,14 +28,31 @@ type grpcFramerBuilder struct{}
 type grpcFramer struct {
 	clientStreamCache *lru.Cache
 	serverStreamCache *lru.Cache
+	// streams *grpcStream of each connection direction
+	streams *lru.Cache
 	tcp.CommonFramer
 }
 
+// grpcStream 一个连接一个方向的 hpack 动态表, 和跨包的 frame, header block
+type grpcStream struct {
+	decoder *framer.HPACKDecoder
+	pending []byte              // pending 没有收完的 frame
+	headers *http2.HeadersFrame // headers 等待 CONTINUATION 的 HEADERS
+	block   []byte              // block headers 已经收到的 header block
+	next    uint32              // next 下一个包的 TCP 序号, 用来丢掉重传
+	seen    bool                // seen 收到过数据, next 有效
+}
+
+// hpackErrorsMetric header block 解码失败的次数
+var hpackErrorsMetric = metrics.NewCounterVec("gor_grpc_hpack_errors_total",
+	"gRPC header blocks which could not be fully decoded, by reason missing_entry, invalid or lost.", "reason")
+
 // New 新建 grpc framer
 func (fb *grpcFramerBuilder) New(listenAddr string) tcp.Framer {
 	return &grpcFramer{
 		clientStreamCache: lru.New(65535),
 		serverStreamCache: lru.New(65535),
+		streams:           lru.New(65535),
 		CommonFramer:      tcp.CommonFramer{ListenAddr: listenAddr},
 	}
 }
@@ -43,27 +61,68 @@ func (fb *grpcFramerBuilder) New(listenAddr string) tcp.Framer {
 func (g *grpcFramer) MessageGroupBy(pckt *tcp.Packet) map[string]*tcp.Packet {
 	groupMap := make(map[string]*tcp.Packet)
 
-	if pckt == nil || len(pckt.Payload) == 0 {
+	if pckt == nil {
 		return groupMap
 	}
 
-	payload := bytes.Replace(pckt.Payload, []byte(http2.ClientPreface), []byte{}, 1)
 	srcKey := tcp.DefaultMessageKey(pckt, false)
-	fr := framer.NewHTTP2Framer(payload, srcKey.String(), false)
+	if pckt.FIN || pckt.RST {
+		defer g.streams.Remove(srcKey.String())
+	}
 
-	for {
+	if len(pckt.Payload) == 0 {
+		return groupMap
+	}
+
+	st, payload := g.inOrder(srcKey.String(), pckt)
+	if len(payload) == 0 {
+		return groupMap
+	}
+
+	data := append(st.pending, payload...)
+	// pendingLen data 比 pckt.Payload 多出的长度, 用来计算每组在包中的偏移
+	pendingLen := len(st.pending) - (len(pckt.Payload) - len(payload))
+	st.pending = nil
+	if bytes.HasPrefix(data, []byte(http2.ClientPreface)) {
+		// 新的连接, 两个方向的动态表都从头开始
+		data = data[len(http2.ClientPreface):]
+		pendingLen -= len(http2.ClientPreface)
+		next := st.next
+		st = g.newStream(srcKey.String(), true)
+		st.next, st.seen = next, true
+		g.newStream(tcp.DefaultMessageKey(pckt, true).String(), true)
+	}
+
+	fr := framer.NewHTTP2Framer(data, "", false)
+	fr.AllowIllegalReads = true
+	for pos := 0; pos < len(data); {
+		start := pos
 		framePayload, frame, err := fr.ReadFrameAndBytes()
 		if err != nil {
-			if err != io.EOF {
+			if http2FrameIncomplete(data[pos:]) {
+				st.pending = append([]byte{}, data[pos:]...)
+			} else if err != io.EOF {
 				logger.Debug3("grpcFramer read frame err: ", hex.EncodeToString(pckt.Payload), err)
 			}
 
 			break
 		}
+		pos += len(framePayload)
 
-		if hf, ok := frame.(*http2.MetaHeadersFrame); ok {
-			framePayload, err = framer.ReEncodeMetaHeadersFrame(hf)
-			if err != nil {
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			// 对端的 encoder 按这个大小调整动态表
+			if v, ok := f.Value(http2.SettingHeaderTableSize); ok && !f.IsAck() {
+				g.stream(tcp.DefaultMessageKey(pckt, true).String()).decoder.SetAllowedMaxDynamicTableSize(v)
+			}
+			continue
+		case *http2.HeadersFrame, *http2.ContinuationFrame:
+			if framePayload = st.headerBlock(frame); framePayload == nil {
+				continue
+			}
+		case *http2.MetaHeadersFrame:
+			// 已经被解码的 header block
+			if framePayload, err = framer.ReEncodeMetaHeadersFrame(f); err != nil {
 				logger.Debug("reEncodeMetaHeadersFrame err: ", err)
 				return map[string]*tcp.Packet{}
 			}
@@ -76,12 +135,10 @@ func (g *grpcFramer) MessageGroupBy(pckt *tcp.Packet) map[string]*tcp.Packet {
 			cachePack, ok := groupMap[newKey.String()]
 
 			if ok {
-				// fixme cachePack Length是否要改
 				cachePack.Payload = append(cachePack.Payload, framePayload...)
 			} else {
-				cp := pckt.Copy()
-				cp.Payload = framePayload
-				groupMap[newKey.String()] = cp
+				// 每组有自己的 payload, 不能与 data 和其他组共用
+				groupMap[newKey.String()] = subPacket(pckt, start-pendingLen, append([]byte{}, framePayload...))
 			}
 		}
 	}
@@ -89,6 +146,105 @@ func (g *grpcFramer) MessageGroupBy(pckt *tcp.Packet) map[string]*tcp.Packet {
 	return groupMap
 }
 
+// inOrder 按 TCP 序号去掉重传的数据, 重传的 header block 再解码一次会弄乱动态表.
+// 中间有包丢失时之前的动态表和没有收完的 frame 都不能再用, 换成没有同步的 stream
+func (g *grpcFramer) inOrder(key string, pckt *tcp.Packet) (*grpcStream, []byte) {
+	st := g.stream(key)
+	payload := pckt.Payload
+	end := pckt.Seq + uint32(len(payload))
+	if st.seen {
+		switch ahead := int32(pckt.Seq - st.next); {
+		case ahead > 0:
+			logger.Debug3("grpcFramer lost bytes: ", ahead, key)
+			st = g.newStream(key, false)
+		case int32(end-st.next) <= 0:
+			return st, nil
+		case ahead < 0:
+			payload = payload[-ahead:]
+		}
+	}
+	st.next, st.seen = end, true
+
+	return st, payload
+}
+
+func (g *grpcFramer) stream(key string) *grpcStream {
+	if st, ok := g.streams.Get(key); ok {
+		return st.(*grpcStream)
+	}
+
+	// 从连接中间开始, 动态表中可能有没有见过的表项
+	return g.newStream(key, false)
+}
+
+func (g *grpcFramer) newStream(key string, synced bool) *grpcStream {
+	st := &grpcStream{decoder: framer.NewHPACKDecoder(synced)}
+	g.streams.Add(key, st)
+
+	return st
+}
+
+// headerBlock 收集 HEADERS 和 CONTINUATION 中的 header block, 收完时用连接的动态表解码,
+// 返回独立编码的 HEADERS frame, 没有收完时返回 nil
+func (st *grpcStream) headerBlock(frame http2.Frame) []byte {
+	switch f := frame.(type) {
+	case *http2.HeadersFrame:
+		if st.headers != nil {
+			st.lost()
+		}
+		hf := *f
+		st.headers, st.block = &hf, append([]byte{}, f.HeaderBlockFragment()...)
+	case *http2.ContinuationFrame:
+		if st.headers == nil || st.headers.StreamID != f.StreamID {
+			st.lost()
+			return nil
+		}
+		st.block = append(st.block, f.HeaderBlockFragment()...)
+	}
+
+	if !frame.Header().Flags.Has(http2.FlagHeadersEndHeaders) {
+		return nil
+	}
+
+	fields, missing, err := st.decoder.Decode(st.block)
+	switch {
+	case err != nil:
+		hpackErrorsMetric.With("invalid").Inc()
+		logger.Debug3("grpcFramer decode header block err: ", hex.EncodeToString(st.block), err)
+	case missing > 0:
+		hpackErrorsMetric.With("missing_entry").Inc()
+		logger.Debug3("grpcFramer header block refers to unknown entries: ", missing)
+	}
+
+	hf := st.headers
+	hf.Flags |= http2.FlagHeadersEndHeaders
+	st.headers, st.block = nil, nil
+
+	payload, err := framer.ReEncodeMetaHeadersFrame(&http2.MetaHeadersFrame{HeadersFrame: hf, Fields: fields})
+	if err != nil {
+		logger.Debug("reEncodeMetaHeadersFrame err: ", err)
+		return nil
+	}
+
+	return payload
+}
+
+// lost 漏掉了 header block 的一部分, 不知道它在动态表中加入了什么
+func (st *grpcStream) lost() {
+	hpackErrorsMetric.With("lost").Inc()
+	st.decoder.Reset()
+	st.headers, st.block = nil, nil
+}
+
+// http2FrameIncomplete data 开头的 frame 还没有收完
+func http2FrameIncomplete(data []byte) bool {
+	if len(data) < 9 {
+		return true
+	}
+
+	return len(data) < 9+int(uint32(data[0])<<16|uint32(data[1])<<8|uint32(data[2]))
+}
+
 // ReqRspKey key for both req and rsp
 func (g *grpcFramer) ReqRspKey(pckt *tcp.Packet) string {
 	isOut := pckt.Src() == g.ListenAddr
@@ -1,15 +1,18 @@
 package protocol
 
 import (
+	"bytes"
 	"fmt"
 	"math/big"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/google/gopacket/layers"
 	"github.com/stretchr/testify/suite"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 
 	"goreplay/framer"
 	"goreplay/tcp"
@@ -252,3 +255,164 @@ func (s *GrpcSuite) TestEnd() {
 	}
 
 }
+
+func TestUnitGrpcHPACKSuite(t *testing.T) {
+	suite.Run(t, new(GrpcHPACKSuite))
+}
+
+// GrpcHPACKSuite 一个连接上的 header block 用同一个 hpack encoder 编码
+type GrpcHPACKSuite struct {
+	suite.Suite
+	hbuf bytes.Buffer
+	enc  *hpack.Encoder
+	seq  uint32 // seq 下一个包的 TCP 序号
+}
+
+func (s *GrpcHPACKSuite) SetupTest() {
+	s.hbuf.Reset()
+	s.enc = hpack.NewEncoder(&s.hbuf)
+	s.seq = 1
+}
+
+// headers HEADERS frame, fragment 大于 0 时 header block 拆成 HEADERS 和 CONTINUATION
+func (s *GrpcHPACKSuite) headers(streamID uint32, path string, fragment int) []byte {
+	s.hbuf.Reset()
+	for _, hf := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":path", Value: path},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "x-user", Value: "alice"},
+	} {
+		s.Require().NoError(s.enc.WriteField(hf))
+	}
+	block := s.hbuf.Bytes()
+
+	var buf bytes.Buffer
+	fw := http2.NewFramer(&buf, nil)
+	if fragment == 0 {
+		s.Require().NoError(fw.WriteHeaders(http2.HeadersFrameParam{StreamID: streamID, BlockFragment: block,
+			EndHeaders: true}))
+		return buf.Bytes()
+	}
+	s.Require().NoError(fw.WriteHeaders(http2.HeadersFrameParam{StreamID: streamID, BlockFragment: block[:fragment]}))
+	s.Require().NoError(fw.WriteContinuation(streamID, true, block[fragment:]))
+
+	return buf.Bytes()
+}
+
+func (s *GrpcHPACKSuite) data(streamID uint32) []byte {
+	var buf bytes.Buffer
+	s.Require().NoError(http2.NewFramer(&buf, nil).WriteData(streamID, true, []byte{0, 0, 0, 0, 1, 'x'}))
+
+	return buf.Bytes()
+}
+
+// groups 按 stream id 返回每组的 headers, 包的序号接着上一个包
+func (s *GrpcHPACKSuite) groups(f tcp.Framer, payload []byte) map[uint32]map[string]string {
+	got := s.groupsAt(f, s.seq, payload)
+	s.seq += uint32(len(payload))
+
+	return got
+}
+
+// groupsAt 与 groups 相同, 使用指定的序号
+func (s *GrpcHPACKSuite) groupsAt(f tcp.Framer, seq uint32, payload []byte) map[uint32]map[string]string {
+	pckt, err := tcp.NewMessagePool(0, time.Second, nil).ParsePacket(testPacket(&s.Suite, seq, payload, false))
+	s.Require().NoError(err)
+
+	got := make(map[uint32]map[string]string)
+	for _, p := range f.MessageGroupBy(pckt) {
+		// 每组的 headers 都是独立编码的
+		fr := framer.NewHTTP2Framer(p.Payload, "", true)
+		for {
+			frame, err := fr.ReadFrame()
+			if err != nil {
+				break
+			}
+			if got[frame.Header().StreamID] == nil {
+				got[frame.Header().StreamID] = make(map[string]string)
+			}
+			if hf, ok := frame.(*http2.MetaHeadersFrame); ok {
+				for _, field := range hf.Fields {
+					got[hf.StreamID][field.Name] = field.Value
+				}
+			}
+		}
+	}
+
+	return got
+}
+
+func (s *GrpcHPACKSuite) TestMessageGroupBy() {
+	f := (&grpcFramerBuilder{}).New(testServerAddr)
+	var settings bytes.Buffer
+	s.Require().NoError(http2.NewFramer(&settings, nil).WriteSettings())
+
+	hello := s.headers(1, "/helloworld.Greeter/SayHello", 0)
+	// 之后的 header block 引用前面加入动态表的表项
+	split := s.headers(3, "/helloworld.Greeter/SayBye", 0)
+	continued := s.headers(5, "/helloworld.Greeter/SayAgain", 3)
+	two := append(s.headers(7, "/a", 0), s.headers(9, "/b", 0)...)
+
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		want    map[uint32]string // stream id -> :path
+	}{
+		{name: "preface", payload: bytes.Join([][]byte{[]byte(http2.ClientPreface), settings.Bytes(), hello,
+			s.data(1)}, nil), want: map[uint32]string{1: "/helloworld.Greeter/SayHello"}},
+		{name: "frame split", payload: split[:12], want: map[uint32]string{}},
+		{name: "rest of the frame", payload: split[12:], want: map[uint32]string{3: "/helloworld.Greeter/SayBye"}},
+		{name: "headers", payload: continued[:20], want: map[uint32]string{}},
+		{name: "continuation", payload: continued[20:], want: map[uint32]string{5: "/helloworld.Greeter/SayAgain"}},
+		{name: "two streams", payload: two, want: map[uint32]string{7: "/a", 9: "/b"}},
+	} {
+		s.Run(tt.name, func() {
+			got := s.groups(f, tt.payload)
+			s.Len(got, len(tt.want))
+			for id, path := range tt.want {
+				s.Equal(path, got[id][":path"])
+				s.Equal("alice", got[id]["x-user"])
+			}
+		})
+	}
+}
+
+func (s *GrpcHPACKSuite) TestMiddleOfConnection() {
+	s.headers(1, "/helloworld.Greeter/SayHello", 0)
+	missing := hpackErrorsMetric.With("missing_entry").Value()
+
+	// 第一个 header block 没有抓到, :path 是新的值, 仍然可以解码
+	got := s.groups((&grpcFramerBuilder{}).New(testServerAddr), s.headers(3, "/helloworld.Greeter/SayBye", 0))
+	s.Equal("/helloworld.Greeter/SayBye", got[3][":path"])
+	s.Empty(got[3]["x-user"])
+	s.Equal(missing+1, hpackErrorsMetric.With("missing_entry").Value())
+}
+
+func (s *GrpcHPACKSuite) TestRetransmission() {
+	f := (&grpcFramerBuilder{}).New(testServerAddr)
+	hello := s.headers(1, "/helloworld.Greeter/SayHello", 0)
+	s.Equal("/helloworld.Greeter/SayHello", s.groups(f, hello)[1][":path"])
+
+	// 重传的包不再解码, 动态表不变
+	s.Empty(s.groupsAt(f, s.seq-uint32(len(hello)), hello))
+	bye := s.headers(3, "/helloworld.Greeter/SayBye", 0)
+	got := s.groups(f, bye)
+	s.Equal("/helloworld.Greeter/SayBye", got[3][":path"])
+	s.Equal("alice", got[3]["x-user"])
+
+	// 与收到过的数据部分重叠, 只解码新的部分
+	again := s.headers(5, "/helloworld.Greeter/SayAgain", 0)
+	got = s.groupsAt(f, s.seq-uint32(len(bye)), append(append([]byte{}, bye...), again...))
+	s.seq += uint32(len(again))
+	s.Len(got, 1)
+	s.Equal("alice", got[5]["x-user"])
+
+	// 丢了一个包, 之后的 header block 引用的表项不知道, 不能用旧的动态表解码
+	s.headers(7, "/lost", 0)
+	missing := hpackErrorsMetric.With("missing_entry").Value()
+	got = s.groupsAt(f, s.seq+100, s.headers(9, "/b", 0))
+	s.Equal("/b", got[9][":path"])
+	s.Empty(got[9]["x-user"])
+	s.Equal(missing+1, hpackErrorsMetric.With("missing_entry").Value())
+}
@@ -0,0 +1,290 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+
+	"github.com/golang/groupcache/lru"
+
+	"goreplay/framer"
+	"goreplay/logger"
+	"goreplay/tcp"
+)
+
+func init() {
+	tcp.RegisterFramerBuilder("mysql", &mysqlFramerBuilder{})
+}
+
+// mysqlFramerBuilder mysql framer builder
+type mysqlFramerBuilder struct{}
+
+// New 新建 mysql framer
+func (fb *mysqlFramerBuilder) New(listenAddr string) tcp.Framer {
+	return &mysqlFramer{
+		conns:        lru.New(65535),
+		CommonFramer: tcp.CommonFramer{ListenAddr: listenAddr},
+	}
+}
+
+// mysqlFramer frames mysql commands and their responses. The handshake is followed to learn
+// the capabilities but makes no message, each command with a response is one message and
+// so is its response. A response ends with the packet which completes it, or when packet
+// sequence ids start over for the next command.
+type mysqlFramer struct {
+	// conns *mysqlConn of each connection, keyed by its client side
+	conns *lru.Cache
+	// starts packets of the last MessageGroupBy starting a message, with their request response key
+	starts map[*tcp.Packet]string
+	// ends packets of the last MessageGroupBy ending a message
+	ends map[*tcp.Packet]bool
+	tcp.CommonFramer
+}
+
+// mysqlConn parsing state of a connection
+type mysqlConn struct {
+	handshake    bool   // the connection phase is going on
+	serverCaps   uint32 // capabilities of the server greeting
+	deprecateEOF bool
+	index        uint64 // index of the last command
+	cmd          byte   // last command
+	waiting      bool   // the last command has not been answered
+	sql          string // statement of the last COM_STMT_PREPARE
+	seq          byte   // sequence id of the last response packet
+	resp         *framer.MySQLResponse
+	respKey      string    // message key of resp
+	pending      [2][]byte // bytes of an incomplete packet, from the client and from the server
+}
+
+// mysqlGroups groups made of the mysql packets in data, the pending bytes followed by the
+// payload of pckt
+type mysqlGroups struct {
+	f          *mysqlFramer
+	pckt       *tcp.Packet
+	data       []byte
+	pendingLen int
+	groupMap   map[string]*tcp.Packet
+	from       map[string]int
+}
+
+// add groups data[start:end] with the bytes key already has in this packet
+func (g *mysqlGroups) add(key string, start, end int, reqRspKey string, isEnd bool) {
+	if prev, ok := g.groupMap[key]; ok {
+		start = g.from[key]
+		reqRspKey = g.f.starts[prev]
+		delete(g.f.starts, prev)
+		delete(g.f.ends, prev)
+	}
+
+	cp := subPacket(g.pckt, start-g.pendingLen, g.data[start:end])
+	g.groupMap[key] = cp
+	g.from[key] = start
+	if reqRspKey != "" {
+		g.f.starts[cp] = reqRspKey
+	}
+	if isEnd {
+		g.f.ends[cp] = true
+	}
+}
+
+// MessageGroupBy groups the mysql packets carried by the packet by the message they belong to
+func (f *mysqlFramer) MessageGroupBy(pckt *tcp.Packet) map[string]*tcp.Packet {
+	groupMap := make(map[string]*tcp.Packet)
+	f.starts = make(map[*tcp.Packet]string)
+	f.ends = make(map[*tcp.Packet]bool)
+
+	if pckt == nil {
+		return groupMap
+	}
+
+	isIn, isOut := f.InOut(pckt)
+	if !(isIn || isOut) {
+		return groupMap
+	}
+
+	clientKey := tcp.DefaultMessageKey(pckt, isOut)
+	if pckt.RST {
+		defer f.conns.Remove(clientKey.String())
+	}
+
+	if len(pckt.Payload) == 0 {
+		return groupMap
+	}
+
+	c := f.conn(clientKey.String())
+	dir := 0
+	if isOut {
+		dir = 1
+	}
+
+	g := &mysqlGroups{
+		f:          f,
+		pckt:       pckt,
+		data:       append(c.pending[dir], pckt.Payload...),
+		pendingLen: len(c.pending[dir]),
+		groupMap:   groupMap,
+		from:       make(map[string]int),
+	}
+	c.pending[dir] = nil
+
+	for pos := 0; pos < len(g.data); {
+		p, err := framer.ReadMySQLPacket(g.data[pos:])
+		if err != nil {
+			// no group refers to data before the first complete packet, it can keep growing
+			c.pending[dir] = g.data
+			if pos > 0 {
+				c.pending[dir] = append([]byte{}, g.data[pos:]...)
+			}
+			break
+		}
+
+		if isIn {
+			f.clientPacket(g, c, clientKey, pos, p)
+		} else {
+			f.serverPacket(g, c, clientKey, tcp.DefaultMessageKey(pckt, false), pos, p)
+		}
+		pos += p.Len
+	}
+
+	return groupMap
+}
+
+// clientPacket a command starts a request message, which it ends
+func (f *mysqlFramer) clientPacket(g *mysqlGroups, c *mysqlConn, clientKey *big.Int, pos int,
+	p framer.MySQLPacket) {
+	if c.handshake {
+		// handshake response, result sets end the way both sides are capable of
+		caps, err := framer.MySQLHandshakeCapabilities(p.Payload)
+		if err == nil && p.SeqID == 1 {
+			c.deprecateEOF = caps&c.serverCaps&framer.MySQLClientDeprecateEOF != 0
+		}
+		return
+	}
+
+	// commands start over at sequence id 0, LOCAL INFILE data goes on
+	if p.SeqID != 0 || len(p.Payload) == 0 {
+		return
+	}
+
+	// the response to the previous command is over whatever it looked like
+	if c.resp != nil {
+		g.add(c.respKey, pos, pos, "", true)
+		c.resp = nil
+	}
+	c.waiting = false
+
+	cmd, args := p.Payload[0], p.Payload[1:]
+	switch {
+	case cmd == framer.MySQLComStmtPrepare:
+		c.sql = string(args)
+	case cmd == framer.MySQLComStmtClose && len(args) >= 4:
+		framer.DelMySQLStatement(clientKey.String(), binary.LittleEndian.Uint32(args))
+	}
+
+	if !framer.MySQLHasResponse(cmd) {
+		return
+	}
+
+	c.index++
+	c.cmd = cmd
+	c.waiting = true
+
+	key := indexKey(clientKey, c.index)
+	g.add(key, pos, pos+p.Len, key, true)
+}
+
+// serverPacket response packets make the response message of the command they answer
+func (f *mysqlFramer) serverPacket(g *mysqlGroups, c *mysqlConn, clientKey, serverKey *big.Int, pos int,
+	p framer.MySQLPacket) {
+	// responses start at sequence id 1, 0 is the greeting of a new connection
+	if c.resp == nil && p.SeqID == 0 {
+		c.handshake = true
+		c.waiting = false
+		if greeting, err := framer.ParseMySQLGreeting(p.Payload); err == nil {
+			c.serverCaps = greeting.Capabilities
+		}
+		return
+	}
+
+	if c.handshake {
+		// auth switch and auth more data go on until the server says OK or ERR
+		if len(p.Payload) > 0 && (p.Payload[0] == framer.MySQLOK || p.Payload[0] == framer.MySQLErr) {
+			c.handshake = false
+		}
+		return
+	}
+
+	// a new response while we still wait for the end of the last one
+	if c.resp != nil && p.SeqID == 1 && p.SeqID != c.seq+1 {
+		logger.Debug3("mysqlFramer response out of sequence: ", hex.EncodeToString(p.Payload))
+		g.add(c.respKey, pos, pos, "", true)
+		c.resp = nil
+		c.waiting = false
+	}
+
+	if !c.waiting {
+		return
+	}
+
+	reqRspKey := ""
+	if c.resp == nil {
+		c.resp = framer.NewMySQLResponse(c.cmd, c.deprecateEOF)
+		c.respKey = indexKey(serverKey, c.index)
+		reqRspKey = indexKey(clientKey, c.index)
+	}
+	c.seq = p.SeqID
+
+	done, err := c.resp.Next(p.Payload)
+	if err != nil {
+		logger.Debug3("mysqlFramer read response err: ", hex.EncodeToString(p.Payload), err)
+		done = true
+	}
+
+	g.add(c.respKey, pos, pos+p.Len, reqRspKey, done)
+	if !done {
+		return
+	}
+
+	if c.cmd == framer.MySQLComStmtPrepare && c.resp.StmtID != 0 {
+		framer.PutMySQLStatement(clientKey.String(), c.resp.StmtID, c.sql)
+	}
+	c.deprecateEOF = c.resp.DeprecateEOF
+	c.resp = nil
+	c.waiting = false
+}
+
+func (f *mysqlFramer) conn(key string) *mysqlConn {
+	if c, ok := f.conns.Get(key); ok {
+		return c.(*mysqlConn)
+	}
+
+	c := &mysqlConn{}
+	f.conns.Add(key, c)
+
+	return c
+}
+
+// ReqRspKey key for both req and rsp, the index of the command on its connection
+func (f *mysqlFramer) ReqRspKey(pckt *tcp.Packet) string {
+	if key, ok := f.starts[pckt]; ok {
+		return key
+	}
+
+	return f.CommonFramer.ReqRspKey(pckt)
+}
+
+// Start hints message pool to start the reassembling the message
+func (f *mysqlFramer) Start(pckt *tcp.Packet) (isIncoming, isOutgoing bool) {
+	if _, ok := f.starts[pckt]; !ok {
+		return false, false
+	}
+
+	return f.InOut(pckt)
+}
+
+// End hints message pool to stop the session
+func (f *mysqlFramer) End(msg *tcp.Message) bool {
+	packets := msg.Packets()
+
+	return len(packets) > 0 && f.ends[packets[len(packets)-1]]
+}
@@ -0,0 +1,180 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/framer"
+	"goreplay/tcp"
+)
+
+func TestUnitMySQLSuite(t *testing.T) {
+	suite.Run(t, new(MySQLSuite))
+}
+
+type MySQLSuite struct {
+	suite.Suite
+}
+
+func mysqlPacket(seq byte, payload string) string {
+	n := len(payload)
+	return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}) + payload
+}
+
+func mysqlGreeting(caps uint32) string {
+	var b []byte
+	b = append(b, framer.MySQLHandshakeV10)
+	b = append(b, "8.0.30\x00\x01\x00\x00\x00abcdefgh\x00"...)
+	b = append(b, byte(caps), byte(caps>>8), 45, 2, 0, byte(caps>>16), byte(caps>>24), 21)
+	b = append(b, make([]byte, 10)...)
+	b = append(b, "ijklmnopqrst\x00mysql_native_password\x00"...)
+
+	return mysqlPacket(0, string(b))
+}
+
+func mysqlHandshakeResponse(caps uint32) string {
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint32(b, caps)
+	b = append(b, "root\x00\x00mysql_native_password\x00"...)
+
+	return mysqlPacket(1, string(b))
+}
+
+const (
+	mysqlTestOK     = "\x00\x00\x00\x02\x00\x00\x00"
+	mysqlTestEOF    = "\xfe\x00\x00\x02\x00"
+	mysqlTestColumn = "\x03def\x00\x01t\x01t\x01a\x01a\x0c\x21\x00\x0b\x00\x00\x00\x03\x00\x00\x00\x00\x00"
+)
+
+func (s *MySQLSuite) TestMessageGroupBy() {
+	builder := mysqlFramerBuilder{}
+	f := builder.New(testServerAddr)
+	pool := tcp.NewMessagePool(0, time.Second, nil)
+
+	query := mysqlPacket(0, "\x03SELECT a FROM t")
+	tests := []struct {
+		name       string
+		payload    string
+		isResponse bool
+		wantGroups int
+		wantStarts int
+		wantEnds   int
+	}{
+		{name: "greeting", payload: mysqlGreeting(framer.MySQLClientProtocol41), isResponse: true},
+		{name: "handshake response", payload: mysqlHandshakeResponse(framer.MySQLClientProtocol41)},
+		{name: "auth ok", payload: mysqlPacket(2, mysqlTestOK), isResponse: true},
+		{name: "ping", payload: mysqlPacket(0, "\x0e"), wantGroups: 1, wantStarts: 1, wantEnds: 1},
+		{name: "ping response", payload: mysqlPacket(1, mysqlTestOK), isResponse: true,
+			wantGroups: 1, wantStarts: 1, wantEnds: 1},
+		{name: "partial query", payload: query[:6]},
+		{name: "rest of the query", payload: query[6:], wantGroups: 1, wantStarts: 1, wantEnds: 1},
+		{name: "result set start", payload: mysqlPacket(1, "\x01") + mysqlPacket(2, mysqlTestColumn),
+			isResponse: true, wantGroups: 1, wantStarts: 1},
+		{name: "result set end", payload: mysqlPacket(3, mysqlTestEOF) + mysqlPacket(4, "\x011") +
+			mysqlPacket(5, mysqlTestEOF), isResponse: true, wantGroups: 1, wantEnds: 1},
+		{name: "statement close", payload: mysqlPacket(0, "\x19\x01\x00\x00\x00")},
+		{name: "unexpected response", payload: mysqlPacket(1, mysqlTestOK), isResponse: true},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			pckt, err := pool.ParsePacket(testPacket(&s.Suite, 1, []byte(tt.payload), tt.isResponse))
+			s.Require().NoError(err)
+
+			groups := f.MessageGroupBy(pckt)
+			s.Len(groups, tt.wantGroups)
+
+			starts, ends := 0, 0
+			for _, p := range groups {
+				if in, out := f.Start(p); in || out {
+					s.Equal(!tt.isResponse, in)
+					starts++
+				}
+				if f.(*mysqlFramer).ends[p] {
+					ends++
+				}
+			}
+			s.Equal(tt.wantStarts, starts)
+			s.Equal(tt.wantEnds, ends)
+		})
+	}
+}
+
+func (s *MySQLSuite) TestMessagePool() {
+	msgs := make(chan *tcp.Message, 16)
+	uuids := make(map[string]string)
+	connIDs := make(map[string]string)
+	pool := tcp.NewMessagePool(0, time.Second, func(m *tcp.Message) {
+		uuids[string(m.Data())] = string(m.UUID())
+		connIDs[string(m.Data())] = m.ConnectionID()
+		msgs <- m
+	})
+	pool.MatchUUID(true)
+	pool.Address(testServerAddr)
+	pool.Protocol("mysql")
+
+	caps := framer.MySQLClientProtocol41 | framer.MySQLClientDeprecateEOF
+	query := mysqlPacket(0, "\x03SELECT a FROM t")
+	resultSet := mysqlPacket(1, "\x01") + mysqlPacket(2, mysqlTestColumn) + mysqlPacket(3, "\x011") +
+		mysqlPacket(4, "\xfe\x00\x00\x02\x00\x00\x00")
+	prepare := mysqlPacket(0, "\x16SELECT a FROM t WHERE b = ?")
+	prepareOK := mysqlPacket(1, "\x00\x07\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00") +
+		mysqlPacket(2, mysqlTestColumn) + mysqlPacket(3, mysqlTestColumn)
+	execute := mysqlPacket(0, "\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00\x01\x03\x00\x01\x00\x00\x00")
+	executeResult := mysqlPacket(1, "\x01") + mysqlPacket(2, mysqlTestColumn) + mysqlPacket(3, "\x00\x00\x012") +
+		mysqlPacket(4, "\xfe\x00\x00\x02\x00\x00\x00")
+	// the result set stops short, the next command ends it
+	aborted := mysqlPacket(0, "\x03SELECT b FROM t")
+	abortedResp := mysqlPacket(1, "\x01") + mysqlPacket(2, mysqlTestColumn)
+	ping, pong := mysqlPacket(0, "\x0e"), mysqlPacket(1, mysqlTestOK)
+
+	clientSeq, serverSeq := uint32(100), uint32(500)
+	send := func(payload string, isResponse bool) {
+		if isResponse {
+			pool.Handler(testPacket(&s.Suite, serverSeq, []byte(payload), true))
+			serverSeq += uint32(len(payload))
+			return
+		}
+		pool.Handler(testPacket(&s.Suite, clientSeq, []byte(payload), false))
+		clientSeq += uint32(len(payload))
+	}
+
+	send(mysqlGreeting(caps), true)
+	send(mysqlHandshakeResponse(caps), false)
+	send(mysqlPacket(2, mysqlTestOK), true)
+	send(query, false)
+	// a packet of the result set is split between tcp packets
+	send(resultSet[:20], true)
+	send(resultSet[20:], true)
+	send(prepare, false)
+	send(prepareOK, true)
+	send(execute, false)
+	send(executeResult, true)
+	send(aborted, false)
+	send(abortedResp, true)
+	send(ping, false)
+	send(pong, true)
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-msgs:
+		case <-time.After(time.Second):
+			s.FailNow("mysql messages are not dispatched")
+		}
+	}
+
+	s.Equal(uuids[query], uuids[resultSet])
+	s.Equal(uuids[prepare], uuids[prepareOK])
+	s.Equal(uuids[execute], uuids[executeResult])
+	s.Equal(uuids[aborted], uuids[abortedResp])
+	s.Equal(uuids[ping], uuids[pong])
+	s.NotEqual(uuids[query], uuids[prepare])
+
+	// the connection id of recorded messages finds the prepared statement
+	sql, ok := framer.MySQLStatement(connIDs[execute], 7)
+	s.True(ok)
+	s.Equal("SELECT a FROM t WHERE b = ?", sql)
+}
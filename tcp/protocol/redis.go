@@ -0,0 +1,240 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"math/big"
+
+	"github.com/golang/groupcache/lru"
+
+	"goreplay/framer"
+	"goreplay/logger"
+	"goreplay/tcp"
+)
+
+func init() {
+	tcp.RegisterFramerBuilder("redis", &redisFramerBuilder{})
+}
+
+// redisFramerBuilder redis framer builder
+type redisFramerBuilder struct{}
+
+// New 新建 redis framer
+func (fb *redisFramerBuilder) New(listenAddr string) tcp.Framer {
+	return &redisFramer{
+		streams:      lru.New(65535),
+		CommonFramer: tcp.CommonFramer{ListenAddr: listenAddr},
+	}
+}
+
+// redisFramer frames RESP2/RESP3 commands and replies. Pipelined values are split into
+// one message each, the n-th reply of a connection answers its n-th command. Retransmitted bytes
+// are dropped, after lost bytes or an invalid value the counting starts over from the next command.
+type redisFramer struct {
+	// streams *redisStream of each connection direction
+	streams *lru.Cache
+	// starts packets of the last MessageGroupBy starting a message, with their request response key
+	starts map[*tcp.Packet]string
+	tcp.CommonFramer
+}
+
+// redisStream parsing state of one direction of a connection
+type redisStream struct {
+	index   uint64 // index of the value being received
+	pending []byte // received bytes of that value
+	next    uint32 // next TCP seq
+	seen    bool
+	// waiting replies acking no byte from seq ackAfter on answer commands before the last resync
+	waiting  bool
+	ackAfter uint32
+}
+
+// MessageGroupBy splits the packet into its RESP values
+func (f *redisFramer) MessageGroupBy(pckt *tcp.Packet) map[string]*tcp.Packet {
+	groupMap := make(map[string]*tcp.Packet)
+	f.starts = make(map[*tcp.Packet]string)
+
+	if pckt == nil {
+		return groupMap
+	}
+
+	connKey := tcp.DefaultMessageKey(pckt, false)
+	if pckt.FIN || pckt.RST {
+		defer f.streams.Remove(connKey.String())
+	}
+
+	isIn, isOut := f.InOut(pckt)
+	if len(pckt.Payload) == 0 || !(isIn || isOut) {
+		return groupMap
+	}
+
+	// replies are keyed by the request direction of the connection
+	reqKey := tcp.DefaultMessageKey(pckt, isOut)
+	st, peer := f.stream(connKey.String()), f.stream(tcp.DefaultMessageKey(pckt, true).String())
+	cmd, reply := st, peer
+	if isOut {
+		cmd, reply = peer, st
+	}
+	if pckt = inOrder(st, cmd, reply, pckt); pckt == nil {
+		return groupMap
+	}
+	pendingLen := len(st.pending)
+	data := append(st.pending, pckt.Payload...)
+	st.pending = nil
+
+	valueLen := framer.RESPCommandLen
+	if isOut {
+		valueLen = framer.RESPMessageLen
+	}
+
+	start := 0
+	for start < len(data) {
+		n, err := valueLen(data[start:])
+		if err == framer.ErrRESPShort {
+			st.pending = append([]byte{}, data[start:]...)
+			break
+		}
+
+		if err != nil {
+			logger.Debug3("redisFramer read value err: ", hex.EncodeToString(pckt.Payload), err)
+			resync(cmd, reply, cmd.next)
+			return groupMap
+		}
+
+		// push messages don't answer any command
+		if isOut && data[start] == framer.RESPPush {
+			start += n
+			continue
+		}
+
+		f.group(groupMap, pckt, data, start, start+n, pendingLen, connKey, reqKey, st.index)
+		st.index++
+		start += n
+	}
+
+	if len(st.pending) > 0 && !(isOut && st.pending[0] == framer.RESPPush) {
+		f.group(groupMap, pckt, data, start, len(data), pendingLen, connKey, reqKey, st.index)
+	}
+
+	return groupMap
+}
+
+// inOrder drops retransmitted bytes of pckt, returning nil when nothing is new. Replies only answer
+// commands by order, so the first command seen and lost bytes make both directions start over.
+func inOrder(st, cmd, reply *redisStream, pckt *tcp.Packet) *tcp.Packet {
+	end := pckt.Seq + uint32(len(pckt.Payload))
+	switch ahead := int32(pckt.Seq - st.next); {
+	case !st.seen:
+		if st == cmd {
+			// 可能从连接中间开始, 之前的命令没有收到
+			resync(cmd, reply, pckt.Seq)
+		}
+	case ahead > 0:
+		logger.Debug3("redisFramer lost bytes: ", ahead, pckt.Src(), "->", pckt.Dst())
+		from := cmd.next
+		if st == cmd {
+			from = pckt.Seq
+		}
+		resync(cmd, reply, from)
+	case int32(end-st.next) <= 0:
+		return nil
+	case ahead < 0:
+		pckt = subPacket(pckt, int(-ahead), pckt.Payload[-ahead:])
+	}
+	st.next, st.seen = end, true
+
+	if st == reply {
+		if !cmd.seen || reply.waiting && int32(pckt.Ack-reply.ackAfter) <= 0 {
+			// 回复的是 resync 之前的命令
+			return nil
+		}
+		reply.waiting = false
+	}
+
+	return pckt
+}
+
+// resync drops the values being received in both directions, the next command and reply get the
+// same index, newer than any before. Replies are dropped until one acks the command bytes from seq from.
+func resync(cmd, reply *redisStream, from uint32) {
+	index := cmd.index
+	if reply.index > index {
+		index = reply.index
+	}
+	cmd.index, cmd.pending = index+1, nil
+	reply.index, reply.pending = index+1, nil
+	reply.waiting, reply.ackAfter = true, from
+}
+
+// group adds the part of data[start:end] carried by pckt to groupMap
+func (f *redisFramer) group(groupMap map[string]*tcp.Packet, pckt *tcp.Packet, data []byte,
+	start, end, pendingLen int, connKey, reqKey *big.Int, index uint64) {
+	// bytes before pendingLen came with previous packets
+	off := start - pendingLen
+	if off < 0 {
+		off = 0
+	}
+
+	cp := subPacket(pckt, off, data[pendingLen+off:end])
+	groupMap[indexKey(connKey, index)] = cp
+	if start >= pendingLen {
+		f.starts[cp] = indexKey(reqKey, index)
+	}
+}
+
+// subPacket copy of pckt carrying payload, which starts off bytes after the payload of pckt
+func subPacket(pckt *tcp.Packet, off int, payload []byte) *tcp.Packet {
+	cp := *pckt
+	t := *pckt.TCP
+	t.Seq = pckt.Seq + uint32(off)
+	t.Payload = payload
+	cp.TCP = &t
+
+	return &cp
+}
+
+func (f *redisFramer) stream(key string) *redisStream {
+	if st, ok := f.streams.Get(key); ok {
+		return st.(*redisStream)
+	}
+
+	st := &redisStream{}
+	f.streams.Add(key, st)
+
+	return st
+}
+
+func indexKey(key *big.Int, index uint64) string {
+	newKey := new(big.Int).Lsh(key, 64)
+	newKey.Or(newKey, new(big.Int).SetUint64(index))
+
+	return newKey.String()
+}
+
+// ReqRspKey key for both req and rsp, the index of the value on its connection
+func (f *redisFramer) ReqRspKey(pckt *tcp.Packet) string {
+	if key, ok := f.starts[pckt]; ok {
+		return key
+	}
+
+	return f.CommonFramer.ReqRspKey(pckt)
+}
+
+// Start hints message pool to start the reassembling the message
+func (f *redisFramer) Start(pckt *tcp.Packet) (isIncoming, isOutgoing bool) {
+	if _, ok := f.starts[pckt]; !ok {
+		return false, false
+	}
+
+	return f.InOut(pckt)
+}
+
+// End hints message pool to stop the session
+func (f *redisFramer) End(msg *tcp.Message) bool {
+	valueLen := framer.RESPMessageLen
+	if msg.IsIncoming {
+		valueLen = framer.RESPCommandLen
+	}
+	_, err := valueLen(msg.Data())
+
+	return err == nil
+}
@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/tcp"
+)
+
+func TestUnitRedisSuite(t *testing.T) {
+	suite.Run(t, new(RedisSuite))
+}
+
+type RedisSuite struct {
+	suite.Suite
+}
+
+func (s *RedisSuite) TestMessageGroupBy() {
+	builder := redisFramerBuilder{}
+	f := builder.New(testServerAddr)
+	pool := tcp.NewMessagePool(0, time.Second, nil)
+
+	tests := []struct {
+		name       string
+		payload    string
+		isResponse bool
+		wantGroups int
+		wantStarts int
+	}{
+		{name: "pipelined commands", payload: "*1\r\n$4\r\nPING\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n",
+			wantGroups: 3, wantStarts: 3},
+		{name: "partial command", payload: "*2\r\n$3\r\nGET\r\n$1", wantGroups: 1, wantStarts: 1},
+		{name: "rest of the command", payload: "\r\nk\r\n*1\r\n$4\r\nQU", wantGroups: 2, wantStarts: 1},
+		{name: "replies and push", payload: "+PONG\r\n>2\r\n+a\r\n+b\r\n$-1\r\n", isResponse: true,
+			wantGroups: 2, wantStarts: 2},
+		{name: "invalid reply", payload: "?\r\n", isResponse: true},
+	}
+
+	// 每个方向的包接着上一个包的序号, ack 对端收到的数据
+	seq := map[bool]uint32{false: 1, true: 1}
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			pckt, err := pool.ParsePacket(testPacketAck(&s.Suite, seq[tt.isResponse], seq[!tt.isResponse],
+				[]byte(tt.payload), tt.isResponse))
+			s.Require().NoError(err)
+			seq[tt.isResponse] += uint32(len(tt.payload))
+
+			groups := f.MessageGroupBy(pckt)
+			s.Len(groups, tt.wantGroups)
+
+			starts := 0
+			for _, p := range groups {
+				if in, out := f.Start(p); in || out {
+					s.Equal(!tt.isResponse, in)
+					starts++
+				}
+			}
+			s.Equal(tt.wantStarts, starts)
+		})
+	}
+}
+
+func (s *RedisSuite) TestMessagePool() {
+	msgs := make(chan *tcp.Message, 8)
+	uuids := make(map[string]string)
+	pool := tcp.NewMessagePool(0, time.Second, func(m *tcp.Message) {
+		uuids[string(m.Data())] = string(m.UUID())
+		msgs <- m
+	})
+	pool.MatchUUID(true)
+	pool.Address(testServerAddr)
+	pool.Protocol("redis")
+
+	set := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	get := "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"
+	ping := "PING\r\n"
+	ok, value, pong := "+OK\r\n", "$1\r\nv\r\n", "+PONG\r\n"
+
+	// three pipelined commands, the replies come back split at other boundaries
+	pool.Handler(testPacket(&s.Suite, 100, []byte(set+get[:5]), false))
+	pool.Handler(testPacket(&s.Suite, 100+uint32(len(set)+5), []byte(get[5:]+ping), false))
+	acked := 100 + uint32(len(set+get+ping))
+	pool.Handler(testPacketAck(&s.Suite, 500, acked, []byte(ok+value[:2]), true))
+	pool.Handler(testPacketAck(&s.Suite, 507, acked, []byte(value[2:]+pong), true))
+
+	for i := 0; i < 6; i++ {
+		select {
+		case <-msgs:
+		case <-time.After(time.Second):
+			s.FailNow("redis messages are not dispatched")
+		}
+	}
+
+	s.Equal(uuids[set], uuids[ok])
+	s.Equal(uuids[get], uuids[value])
+	s.Equal(uuids[ping], uuids[pong])
+	s.NotEqual(uuids[set], uuids[get])
+	s.NotEqual(uuids[get], uuids[ping])
+}
+
+// redisConn 一个连接上的命令和回复, 按 MessagePool 分发的消息记录每个命令和回复的 UUID
+type redisConn struct {
+	s        *RedisSuite
+	pool     *tcp.MessagePool
+	uuids    map[string]string
+	cmd, rsp uint32 // 两个方向下一个包的序号
+}
+
+func (s *RedisSuite) conn() *redisConn {
+	c := &redisConn{s: s, uuids: make(map[string]string), cmd: 100, rsp: 500}
+	c.pool = tcp.NewMessagePool(0, time.Second, func(m *tcp.Message) {
+		c.uuids[string(m.Data())] = string(m.UUID())
+	})
+	c.pool.MatchUUID(true)
+	c.pool.Address(testServerAddr)
+	c.pool.Protocol("redis")
+
+	return c
+}
+
+func (c *redisConn) send(payload string) {
+	c.pool.Handler(testPacketAck(&c.s.Suite, c.cmd, c.rsp, []byte(payload), false))
+	c.cmd += uint32(len(payload))
+}
+
+func (c *redisConn) reply(payload string) {
+	c.pool.Handler(testPacketAck(&c.s.Suite, c.rsp, c.cmd, []byte(payload), true))
+	c.rsp += uint32(len(payload))
+}
+
+func echo(v string) string {
+	return "*2\r\n$4\r\nECHO\r\n$1\r\n" + v + "\r\n"
+}
+
+func (s *RedisSuite) TestOutOfOrder() {
+	c := s.conn()
+
+	// 重传的命令和回复, 以及与收到过的数据重叠的包只算一次
+	c.send(echo("a"))
+	c.pool.Handler(testPacketAck(&s.Suite, 100, c.rsp, []byte(echo("a")), false))
+	c.pool.Handler(testPacketAck(&s.Suite, 100, c.rsp, []byte(echo("a")+echo("b")), false))
+	c.cmd += uint32(len(echo("b")))
+	c.reply("+a\r\n")
+	c.pool.Handler(testPacketAck(&s.Suite, 500, c.cmd, []byte("+a\r\n"), true))
+	c.reply("+b\r\n")
+	s.Equal(c.uuids[echo("a")], c.uuids["+a\r\n"])
+	s.Equal(c.uuids[echo("b")], c.uuids["+b\r\n"])
+
+	// 丢了一个回复, 在这之前发出的命令的回复都不知道对应哪个命令
+	c.send(echo("c"))
+	c.rsp += uint32(len("+c\r\n"))
+	c.send(echo("d"))
+	c.reply("+d\r\n")
+	c.send(echo("e"))
+	c.reply("+e\r\n")
+	s.NotContains(c.uuids, "+d\r\n")
+	s.Equal(c.uuids[echo("e")], c.uuids["+e\r\n"])
+
+	// 丢了一个命令
+	c.cmd += uint32(len(echo("f")))
+	c.reply("+f\r\n")
+	c.send(echo("g"))
+	c.reply("+g\r\n")
+	s.Equal(c.uuids[echo("g")], c.uuids["+g\r\n"])
+
+	// 回复不能解析
+	c.send(echo("h"))
+	c.reply("?\r\n")
+	c.send(echo("i"))
+	c.reply("+i\r\n")
+	s.Equal(c.uuids[echo("i")], c.uuids["+i\r\n"])
+}
+
+func (s *RedisSuite) TestMiddleOfConnection() {
+	c := s.conn()
+
+	// 没有见过的命令的回复
+	c.reply("+x\r\n")
+	c.send(echo("y"))
+	c.pool.Handler(testPacketAck(&s.Suite, c.rsp, 100, []byte("+z\r\n"), true))
+	c.rsp += uint32(len("+z\r\n"))
+	c.reply("+y\r\n")
+
+	s.NotContains(c.uuids, "+x\r\n")
+	s.NotContains(c.uuids, "+z\r\n")
+	s.Equal(c.uuids[echo("y")], c.uuids["+y\r\n"])
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"math/big"
+
+	"goreplay/framer"
+	"goreplay/tcp"
+)
+
+func init() {
+	tcp.RegisterFramerBuilder("thrift", &thriftFramerBuilder{})
+}
+
+// thriftFramerBuilder thrift framer builder
+type thriftFramerBuilder struct{}
+
+// New 新建 thrift framer
+func (fb *thriftFramerBuilder) New(listenAddr string) tcp.Framer {
+	return &thriftFramer{CommonFramer: tcp.CommonFramer{ListenAddr: listenAddr}}
+}
+
+// thriftFramer frames thrift messages of framed or buffered transport, binary or compact protocol
+type thriftFramer struct {
+	tcp.CommonFramer
+}
+
+// Start hints message pool to start the reassembling the message
+func (f *thriftFramer) Start(pckt *tcp.Packet) (isIncoming, isOutgoing bool) {
+	// 一些握手包或者保活包
+	if len(pckt.Payload) == 0 {
+		return false, false
+	}
+
+	h, err := framer.ParseThriftHeader(pckt.Payload)
+	if err != nil {
+		return false, false
+	}
+
+	switch h.Type {
+	case framer.ThriftCall, framer.ThriftOneway:
+		return true, false
+	case framer.ThriftReply, framer.ThriftException:
+		return false, true
+	}
+
+	return false, false
+}
+
+// End hints message pool to stop the session
+func (f *thriftFramer) End(msg *tcp.Message) bool {
+	_, err := framer.ThriftMessageLen(msg.Data())
+
+	return err == nil
+}
+
+// ReqRspKey key for both req and rsp, the seqid is part of it
+// so that pipelined calls on one connection are paired correctly
+func (f *thriftFramer) ReqRspKey(pckt *tcp.Packet) string {
+	isOut := pckt.Src() == f.ListenAddr
+	// if response get peer key, keep it is the same of request key
+	key := f.MessageKey(pckt, isOut)
+
+	h, err := framer.ParseThriftHeader(pckt.Payload)
+	if err != nil {
+		return key.String()
+	}
+
+	newKey := new(big.Int).Lsh(key, 32)
+	newKey.Or(newKey, big.NewInt(int64(uint32(h.SeqID))))
+
+	return newKey.String()
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/suite"
+
+	"goreplay/framer"
+	"goreplay/tcp"
+)
+
+const testServerAddr = "192.168.1.3:9090"
+
+func TestUnitThriftSuite(t *testing.T) {
+	suite.Run(t, new(ThriftSuite))
+}
+
+type ThriftSuite struct {
+	suite.Suite
+	framer tcp.Framer
+}
+
+func (s *ThriftSuite) SetupTest() {
+	builder := thriftFramerBuilder{}
+	s.framer = builder.New(testServerAddr)
+}
+
+// thriftMessage strict binary protocol message with an empty struct, framed if asked
+func thriftMessage(name string, typ byte, seqID uint32, isFramed bool) []byte {
+	b := make([]byte, 12+len(name)+1)
+	binary.BigEndian.PutUint32(b, 0x80010000|uint32(typ))
+	binary.BigEndian.PutUint32(b[4:], uint32(len(name)))
+	copy(b[8:], name)
+	binary.BigEndian.PutUint32(b[8+len(name):], seqID)
+
+	if !isFramed {
+		return b
+	}
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(b)))
+
+	return append(size, b...)
+}
+
+// testPacket builds a packet from client 192.168.1.2:45678 to testServerAddr, or back if isResponse
+func testPacket(s *suite.Suite, seq uint32, payload []byte, isResponse bool) gopacket.Packet {
+	return testPacketAck(s, seq, 0, payload, isResponse)
+}
+
+// testPacketAck is testPacket with the ack number set
+func testPacketAck(s *suite.Suite, seq, ack uint32, payload []byte, isResponse bool) gopacket.Packet {
+	client, server := net.IPv4(192, 168, 1, 2), net.IPv4(192, 168, 1, 3)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+	t := &layers.TCP{SrcPort: 45678, DstPort: 9090, Seq: seq, Ack: ack, ACK: true, PSH: true, Window: 1024}
+	if isResponse {
+		ip.SrcIP, ip.DstIP = server, client
+		t.SrcPort, t.DstPort = 9090, 45678
+	}
+	s.Require().NoError(t.SetNetworkLayerForChecksum(ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	s.Require().NoError(gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6),
+			EthernetType: layers.EthernetTypeIPv4}, ip, t, gopacket.Payload(payload)))
+
+	return gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+}
+
+func (s *ThriftSuite) TestStart() {
+	tests := []struct {
+		name    string
+		payload []byte
+		wantIn  bool
+		wantOut bool
+	}{
+		{name: "call", payload: thriftMessage("add", framer.ThriftCall, 1, true), wantIn: true},
+		{name: "oneway", payload: thriftMessage("add", framer.ThriftOneway, 1, false), wantIn: true},
+		{name: "reply", payload: thriftMessage("add", framer.ThriftReply, 1, false), wantOut: true},
+		{name: "exception", payload: thriftMessage("add", framer.ThriftException, 1, true), wantOut: true},
+		{name: "not thrift", payload: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{name: "empty payload"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			pckt := &tcp.Packet{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: tt.payload}}}
+			in, out := s.framer.Start(pckt)
+			s.Equal(tt.wantIn, in)
+			s.Equal(tt.wantOut, out)
+		})
+	}
+}
+
+func (s *ThriftSuite) TestReqRspKey() {
+	pool := tcp.NewMessagePool(0, time.Second, nil)
+	key := func(seqID uint32, isResponse bool) string {
+		typ := framer.ThriftCall
+		if isResponse {
+			typ = framer.ThriftReply
+		}
+
+		pckt, err := pool.ParsePacket(testPacket(&s.Suite, 1, thriftMessage("add", typ, seqID, true), isResponse))
+		s.Require().NoError(err)
+
+		return s.framer.ReqRspKey(pckt)
+	}
+
+	s.Equal(key(1, false), key(1, true))
+	s.Equal(key(2, false), key(2, true))
+	s.NotEqual(key(1, false), key(2, false))
+}
+
+func (s *ThriftSuite) TestMessagePool() {
+	msgs := make(chan *tcp.Message, 4)
+	uuids := make(map[string]string)
+	pool := tcp.NewMessagePool(0, time.Second, func(m *tcp.Message) {
+		uuids[string(m.Data())] = string(m.UUID())
+		msgs <- m
+	})
+	pool.MatchUUID(true)
+	pool.Address(testServerAddr)
+	pool.Protocol("thrift")
+
+	req1 := thriftMessage("add", framer.ThriftCall, 1, true)
+	req2 := thriftMessage("sub", framer.ThriftCall, 2, false)
+	rsp1 := thriftMessage("add", framer.ThriftReply, 1, true)
+	rsp2 := thriftMessage("sub", framer.ThriftReply, 2, false)
+
+	// the first request spans two packets, responses come back out of order
+	pool.Handler(testPacket(&s.Suite, 100, req1[:19], false))
+	pool.Handler(testPacket(&s.Suite, 119, req1[19:], false))
+	pool.Handler(testPacket(&s.Suite, 100+uint32(len(req1)), req2, false))
+	pool.Handler(testPacket(&s.Suite, 500, rsp2, true))
+	pool.Handler(testPacket(&s.Suite, 500+uint32(len(rsp2)), rsp1, true))
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-msgs:
+		case <-time.After(time.Second):
+			s.FailNow("thrift messages are not dispatched")
+		}
+	}
+
+	s.Equal(uuids[string(req1)], uuids[string(rsp1)])
+	s.Equal(uuids[string(req2)], uuids[string(rsp2)])
+	s.NotEqual(uuids[string(req1)], uuids[string(req2)])
+}
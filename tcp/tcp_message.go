@@ -9,6 +9,7 @@ import (
 	"math/big"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coocood/freecache"
@@ -41,6 +42,7 @@ type Stats struct {
 // Message is the representation of a tcp message
 type Message struct {
 	reqRspKey string // reqRspKey message request and response match key
+	connID    string // 连接关闭的消息所在连接, 见 MessagePool.OnClose
 	packets   []*Packet
 	pool      *MessagePool
 	buf       *bytes.Buffer
@@ -105,9 +107,17 @@ func (m *Message) UUID() []byte {
 
 // ConnectionID returns the ID of a TCP connection.
 func (m *Message) ConnectionID() string {
+	if m.connID != "" {
+		return m.connID
+	}
 	return DefaultMessageKey(m.packets[0], false).String()
 }
 
+// Closed reports whether m only marks that its connection saw FIN or RST, such a message has no data
+func (m *Message) Closed() bool {
+	return m.connID != ""
+}
+
 func (m *Message) add(pckt *Packet) {
 	m.Length += len(pckt.Payload)
 	m.LostData += int(pckt.Lost)
@@ -171,6 +181,17 @@ type MessagePool struct {
 	protocol       string
 	framer         Framer
 	longConnection bool
+	timeouts       uint64    // 等待超时后分发的消息数
+	decrypter      Decrypter // 分组前还原 payload, 比如解密 TLS
+	closeHandler   Handler   // 连接 FIN 或 RST 时调用
+	keepRaw        bool      // 包带上原始数据包, 用于 --output-pcap
+}
+
+// Decrypter turns the payload of a packet into the data the framer should see, before the packet is
+// grouped into messages. Decrypt replaces pckt.Payload, and pckt.Seq so the payloads of a direction stay
+// contiguous for framers tracking tcp sequence, and returns false if the packet must be dropped.
+type Decrypter interface {
+	Decrypt(pckt *Packet) bool
 }
 
 // NewMessagePool returns a new instance of message pool
@@ -247,9 +268,17 @@ func (pool *MessagePool) Handler(packet gopacket.Packet) {
 	pool.Lock()
 	defer pool.Unlock()
 
+	if pool.decrypter != nil && !pool.decrypter.Decrypt(pckt) {
+		return
+	}
+
 	defer func(p *Packet) {
 		pool.afterHandler(p)
 	}(pckt)
+	if pckt.FIN || pckt.RST {
+		// 在这个包分发的消息之后
+		defer pool.closed(pckt)
+	}
 
 	packsMap := pool.MessageGroupBy(pckt)
 	if packsMap == nil {
@@ -298,7 +327,7 @@ func (pool *MessagePool) Handler(packet gopacket.Packet) {
 			// response get peer's key(request key)
 			m.reqRspKey = DefaultMessageKey(pckt, !in).String()
 		} else {
-			m.reqRspKey = pool.framer.ReqRspKey(pckt)
+			m.reqRspKey = pool.framer.ReqRspKey(itemPckt)
 		}
 
 		logger.Debug3("first addPacket message:", key, itemPckt.Src(), itemPckt.Dst(), itemPckt.Flag(), m.reqRspKey)
@@ -327,6 +356,20 @@ func (pool *MessagePool) dispatch(key string, m *Message) {
 	pool.handler(m)
 }
 
+// closed 通知连接关闭, 连接用请求的 ConnectionID 标识
+func (pool *MessagePool) closed(pckt *Packet) {
+	if pool.closeHandler == nil {
+		return
+	}
+
+	isOut := IsResponse(pckt, pool.address)
+	m := NewMessage(pckt.Src(), pckt.Dst(), pckt.Version, 1)
+	m.IsIncoming = !isOut
+	m.Start, m.End = pckt.Timestamp, pckt.Timestamp
+	m.connID = DefaultMessageKey(pckt, isOut).String()
+	pool.closeHandler(m)
+}
+
 func (pool *MessagePool) shouldDispatch(m *Message) bool {
 	if m == nil {
 		return false
@@ -366,6 +409,7 @@ func (pool *MessagePool) addPacket(key string, m *Message, pckt *Packet) {
 			return
 		}
 		m.TimedOut = true
+		atomic.AddUint64(&pool.timeouts, 1)
 	default:
 		// continue to receive packets
 		logger.Debug3(fmt.Sprintf("default continue to receive packets, key %s m.packets length: %d",
@@ -379,11 +423,43 @@ func (pool *MessagePool) addPacket(key string, m *Message, pckt *Packet) {
 	pool.dispatch(key, m)
 }
 
+// Size 正在组装的消息数
+func (pool *MessagePool) Size() int {
+	pool.Lock()
+	defer pool.Unlock()
+
+	return len(pool.pool)
+}
+
+// Timeouts 等待超时后分发的消息总数
+func (pool *MessagePool) Timeouts() uint64 {
+	return atomic.LoadUint64(&pool.timeouts)
+}
+
 // Address listen destination address
 func (pool *MessagePool) Address(address string) {
 	pool.address = address
 }
 
+// KeepRaw makes the packets of the messages keep the gopacket.Packet they are parsed from in Raw,
+// which holds the whole captured packet until the message is handled. This function should be called
+// at initial stage of the pool
+func (pool *MessagePool) KeepRaw(keep bool) {
+	pool.keepRaw = keep
+}
+
+// Decrypter set the decrypter of the packets, this function should be called at initial stage of the pool
+func (pool *MessagePool) Decrypter(d Decrypter) {
+	pool.decrypter = d
+}
+
+// OnClose sets the handler called with a message without data when a connection sees FIN or RST, after the
+// messages dispatched by that packet. The message has the ConnectionID of the requests on the connection.
+// This function should be called at initial stage of the pool
+func (pool *MessagePool) OnClose(handler Handler) {
+	pool.closeHandler = handler
+}
+
 // Protocol record business protocol
 func (pool *MessagePool) Protocol(protocol string) {
 	if protocol == "" {
@@ -33,6 +33,9 @@ type Packet struct {
 	// Data info
 	Lost      uint16
 	Timestamp time.Time
+
+	// Raw 解析出这个包的原始数据包, 用于 --output-pcap, 只有 MessagePool.KeepRaw 时设置
+	Raw gopacket.Packet
 }
 
 // Copy copys a packet
@@ -47,6 +50,7 @@ func (pckt *Packet) Copy() *Packet {
 	cp.TCP = pckt.TCP
 	cp.Lost = pckt.Lost
 	cp.Timestamp = pckt.Timestamp
+	cp.Raw = pckt.Raw
 
 	cp.Payload = []byte{}
 
@@ -68,6 +72,9 @@ func (pool *MessagePool) ParsePacket(packet gopacket.Packet) (pckt *Packet, err
 
 	// initialization
 	pckt = new(Packet)
+	if pool.keepRaw {
+		pckt.Raw = packet
+	}
 	pckt.Timestamp = packet.Metadata().Timestamp
 	if pckt.Timestamp.IsZero() {
 		pckt.Timestamp = time.Now()
@@ -285,3 +285,65 @@ func (s *tcpSuite) TestMessageUUID() {
 	})
 
 }
+
+// decrypterFunc 测试用的 Decrypter
+type decrypterFunc func(pckt *Packet) bool
+
+func (f decrypterFunc) Decrypt(pckt *Packet) bool {
+	return f(pckt)
+}
+
+func (s *tcpSuite) TestMessageDecrypter() {
+	var mssg = make(chan *Message, 1)
+	packets := GetPackets(1, 10, []byte("ciphertext"))
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	packets[9].Data()[14:][20:][13] = 1 // FIN flag
+	p := NewMessagePool(poolSize, time.Second, func(m *Message) { mssg <- m })
+
+	n := 0
+	p.Decrypter(decrypterFunc(func(pckt *Packet) bool {
+		// 第 3, 4 个包没有明文
+		n++
+		pckt.Payload = []byte("x")
+		return n != 3 && n != 4
+	}))
+	for _, v := range packets {
+		p.Handler(v)
+	}
+
+	select {
+	case <-time.After(time.Second):
+		s.Fail("can't parse packets fast enough")
+	case m := <-mssg:
+		s.Equal("xxxxxxxx", string(m.Data()))
+	}
+}
+
+func (s *tcpSuite) TestMessageOnClose() {
+	var mssg = make(chan *Message, 3)
+	packets := GetPackets(1, 5, []byte("data"))
+	packets[0].Data()[14:][20:][13] = 2 // SYN flag
+	packets[4].Data()[14:][20:][13] = 1 // FIN flag
+	rst := exchangeIP(GetPackets(10, 1, nil))[0]
+	rst.Data()[14:][20:][13] = 4 // RST flag
+	p := NewMessagePool(poolSize, time.Second, func(m *Message) { mssg <- m })
+	p.Address("192.168.1.3:8001")
+	p.OnClose(func(m *Message) { mssg <- m })
+
+	for _, v := range append(packets, rst) {
+		p.Handler(v)
+	}
+
+	s.Require().Len(mssg, 3)
+	m := <-mssg
+	s.False(m.Closed())
+	s.Equal("datadatadatadatadata", string(m.Data()))
+	// FIN 在消息之后, 服务端的 RST 也用请求的 ConnectionID
+	for _, incoming := range []bool{true, false} {
+		closed := <-mssg
+		s.True(closed.Closed())
+		s.Empty(closed.Data())
+		s.Equal(incoming, closed.IsIncoming)
+		s.Equal(m.ConnectionID(), closed.ConnectionID())
+	}
+}
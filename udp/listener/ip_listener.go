@@ -1,3 +1,6 @@
+//go:build !nopcap
+// +build !nopcap
+
 package listener
 
 import (
@@ -17,14 +20,6 @@ import (
 
 const or = " or "
 
-// IPacket ip packet
-type IPacket struct {
-	srcIP     []byte
-	dstIP     []byte
-	payload   []byte
-	timestamp time.Time
-}
-
 // IPListener is ip listener struct
 type IPListener struct {
 	mu            sync.Mutex
@@ -0,0 +1,29 @@
+//go:build nopcap
+// +build nopcap
+
+package listener
+
+import (
+	"goreplay/logger"
+)
+
+// IPListener 使用 -tags nopcap 编译时没有 libpcap, 不能抓取 udp 流量
+type IPListener struct {
+	ipPacketsChan chan *IPacket
+}
+
+// NewIPListener new IPListener
+func NewIPListener(addr string, port uint16, trackResponse bool) *IPListener {
+	logger.Error("udp input needs libpcap, goreplay is built with -tags nopcap")
+	return &IPListener{ipPacketsChan: make(chan *IPacket)}
+}
+
+// IsReady 没有 libpcap 时永远不会就绪
+func (l *IPListener) IsReady() bool {
+	return false
+}
+
+// Receiver receive ip packet
+func (l *IPListener) Receiver() chan *IPacket {
+	return l.ipPacketsChan
+}
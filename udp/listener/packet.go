@@ -0,0 +1,11 @@
+package listener
+
+import "time"
+
+// IPacket ip packet
+type IPacket struct {
+	srcIP     []byte
+	dstIP     []byte
+	payload   []byte
+	timestamp time.Time
+}